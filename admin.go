@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wesrobin/cerebrium-test/pkg/cachefs"
+)
+
+const adminHelp = "commands: tree, stats, keys, top [n], invalidate <path>, refresh, warm <path> [jobs]"
+
+// adminTopN is how many entries top lists when not told.
+const adminTopN = 20
+
+// serveAdmin answers admin commands on a unix socket until ctx is done. Each line sent is a command,
+// answered with its output.
+func serveAdmin(ctx context.Context, socketPath string, fuseFS cachefs.FuseFS) error {
+	// A socket left behind by an earlier run would fail the listen.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		l.Close()
+		return err
+	}
+	log.Printf("ADMIN: Listening on %s", socketPath)
+
+	go func() {
+		<-ctx.Done()
+		l.Close() // Also removes the socket
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go handleAdminConn(conn, fuseFS)
+	}
+}
+
+func handleAdminConn(conn net.Conn, fuseFS cachefs.FuseFS) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := runAdminCommand(conn, fuseFS, line); err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		}
+	}
+}
+
+// runAdminCommand runs a single command, writing its output to w.
+func runAdminCommand(w io.Writer, fuseFS cachefs.FuseFS, line string) error {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch cmd {
+	case "tree":
+		fuseFS.PrintTree(w)
+	case "stats":
+		fmt.Fprintln(w, fuseFS.Stats())
+	case "keys":
+		return fuseFS.ListCache(w)
+	case "top":
+		n := adminTopN
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+				return errors.New("usage: top [n]")
+			}
+		}
+		cachefs.WriteHotFiles(w, fuseFS.TopN(n))
+	case "invalidate":
+		if arg == "" {
+			return errors.New("usage: invalidate <path>")
+		}
+		if err := fuseFS.Invalidate(arg); err != nil {
+			return err
+		}
+		log.Printf("ADMIN: Invalidated '%s'", arg)
+		fmt.Fprintln(w, "ok")
+	case "refresh":
+		if err := fuseFS.Refresh(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ok")
+	case "warm":
+		path, jobsArg, _ := strings.Cut(arg, " ")
+		jobs := 1
+		if jobsArg != "" {
+			var err error
+			if jobs, err = strconv.Atoi(strings.TrimSpace(jobsArg)); err != nil || jobs < 1 {
+				return errors.New("usage: warm <path> [jobs]")
+			}
+		}
+		if path == "" {
+			return errors.New("usage: warm <path> [jobs]")
+		}
+		log.Printf("ADMIN: Warming '%s' with %d jobs", path, jobs)
+		p, err := warmWithProgress(context.Background(), w, fuseFS, []string{path}, jobs)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, warmSummary(p))
+	default:
+		return fmt.Errorf("unknown command '%s', %s", cmd, adminHelp)
+	}
+	return nil
+}
@@ -9,7 +9,8 @@ APP_NAME="fuse-test"
 
 # The directory to copy files to
 DESTINATION_COPY_FOLDER="nfs"
-DIRECTORIES_TO_CREATE=("nfs" "ssd" "mnt/all-projects")
+MOUNTPOINT="mnt/all-projects"
+DIRECTORIES_TO_CREATE=("nfs" "ssd" "$MOUNTPOINT")
 
 # --- Script Functions ---
 
@@ -26,20 +27,43 @@ error_exit() {
 
 # --- Main Script ---
 
-# 1. Ask for the source location of files to copy
-read -p "Enter the full path to the source directory of files to copy. Leave empty for default ('testdata'): " SOURCE_FILES_LOCATION
+# --seed-demo wipes nfs and ssd and re-copies the source files into nfs. Without it, existing
+# directories are left alone, so pointing this at real data never destroys it.
+SEED_DEMO=false
+for arg in "$@"; do
+  case "$arg" in
+    --seed-demo) SEED_DEMO=true ;;
+    *) error_exit "Unknown argument '$arg'. Usage: $0 [--seed-demo]" ;;
+  esac
+done
+
+# is_mounted reports whether the path is a live mount, which must never be removed.
+is_mounted() {
+  local abs_path
+  abs_path=$(realpath -m "$1")
+  grep -qs " $abs_path " /proc/mounts
+}
 
-if [ -z "$SOURCE_FILES_LOCATION" ]; then
-  SOURCE_FILES_LOCATION="testdata"
+# 1. Ask for the source location of files to copy, if nfs is going to be (re)seeded
+SEED_NFS=$SEED_DEMO
+if [ ! -d "$DESTINATION_COPY_FOLDER" ]; then
+  SEED_NFS=true
 fi
 
-if [ ! -d "$SOURCE_FILES_LOCATION" ]; then
-  error_exit "Source directory '$SOURCE_FILES_LOCATION' does not exist."
+if [ "$SEED_NFS" = true ]; then
+  read -p "Enter the full path to the source directory of files to copy. Leave empty for default ('testdata'): " SOURCE_FILES_LOCATION
+
+  if [ -z "$SOURCE_FILES_LOCATION" ]; then
+    SOURCE_FILES_LOCATION="testdata"
+  fi
+
+  if [ ! -d "$SOURCE_FILES_LOCATION" ]; then
+    error_exit "Source directory '$SOURCE_FILES_LOCATION' does not exist."
+  fi
 fi
 
 log "Starting build process..."
 
-# 2. Update package list and install fuse3
 # 2. Check for fuse3 (fusermount3) and install if necessary
 log "Checking for fuse3 (fusermount3)..."
 if command -v fusermount3 &> /dev/null; then
@@ -67,40 +91,50 @@ if ! go build -o "$APP_NAME" .; then
 fi
 log "Go application built successfully: $APP_NAME"
 
-# 4. Create required directories in the working directory
-# 4. Check and remove existing directories, then recreate them
+# 4. Prepare the directories. They're only removed with --seed-demo, except the mountpoint, which
+# is recreated unless it's still mounted.
 log "Preparing directories..."
 for dir_name in "${DIRECTORIES_TO_CREATE[@]}"; do
-  if [ -d "$dir_name" ]; then
-    log "Directory '$dir_name' exists. Removing it..."
-    if ! rm -rf "$dir_name"; then
-      error_exit "Failed to remove directory '$dir_name'. Check permissions."
+  if [ "$dir_name" = "$MOUNTPOINT" ] || [ "$SEED_DEMO" = true ]; then
+    if is_mounted "$dir_name"; then
+      log "Directory '$dir_name' is still mounted, leaving it alone. Unmount it with 'fusermount3 -u $dir_name'."
+      continue
     fi
-    log "Directory '$dir_name' removed."
-  elif [ -f "$dir_name" ]; then
-    log "A file named '$dir_name' exists and is not a directory. Removing it..."
-    if ! rm -f "$dir_name"; then
-      error_exit "Failed to remove file '$dir_name'. Check permissions."
+    if [ -d "$dir_name" ] || [ -f "$dir_name" ]; then
+      log "'$dir_name' exists. Removing it..."
+      if ! rm -rf "$dir_name"; then
+        error_exit "Failed to remove '$dir_name'. Check permissions."
+      fi
+      log "'$dir_name' removed."
     fi
-    log "File '$dir_name' removed."
+  elif [ -e "$dir_name" ] && [ ! -d "$dir_name" ]; then
+    error_exit "'$dir_name' exists and is not a directory. Remove it, or run with --seed-demo."
   fi
 
-  log "Creating directory '$dir_name'..."
-  if ! mkdir -p "$dir_name"; then
-    error_exit "Failed to create directory '$dir_name'."
+  if [ ! -d "$dir_name" ]; then
+    log "Creating directory '$dir_name'..."
+    if ! mkdir -p "$dir_name"; then
+      error_exit "Failed to create directory '$dir_name'."
+    fi
+    log "Directory '$dir_name' created."
+  else
+    log "Directory '$dir_name' already exists, keeping it."
   fi
-  log "Directory '$dir_name' created."
 done
-log "All specified directories are ready."log "Directories created."
+log "All specified directories are ready."
 
 # 5. Copy files from user-specified source to the destination folder
-log "Copying files from '$SOURCE_FILES_LOCATION' to '$DESTINATION_COPY_FOLDER/'..."
-# Using rsync for better feedback and handling of directories.
-# The trailing slash on the source ensures the *contents* of the directory are copied.
-if ! rsync -av --progress "$SOURCE_FILES_LOCATION/" "$DESTINATION_COPY_FOLDER/"; then
-  error_exit "Failed to copy files from '$SOURCE_FILES_LOCATION'."
+if [ "$SEED_NFS" = true ]; then
+  log "Copying files from '$SOURCE_FILES_LOCATION' to '$DESTINATION_COPY_FOLDER/'..."
+  # Using rsync for better feedback and handling of directories.
+  # The trailing slash on the source ensures the *contents* of the directory are copied.
+  if ! rsync -av --progress "$SOURCE_FILES_LOCATION/" "$DESTINATION_COPY_FOLDER/"; then
+    error_exit "Failed to copy files from '$SOURCE_FILES_LOCATION'."
+  fi
+  log "Files copied successfully."
+else
+  log "Keeping the existing files in '$DESTINATION_COPY_FOLDER/'. Run with --seed-demo to replace them."
 fi
-log "Files copied successfully."
 
 log "Build script completed successfully!"
 echo ""
@@ -109,8 +143,10 @@ echo " SUMMARY:"
 echo "--------------------------------------------------"
 echo " > Application '$APP_NAME' built."
 echo " > fuse3 installation checked/performed."
-echo " > Directories created/recreated: ${DIRECTORIES_TO_CREATE[*]}"
-echo " > Files from '$SOURCE_FILES_LOCATION' copied to '$DESTINATION_COPY_FOLDER'."
+echo " > Directories ready: ${DIRECTORIES_TO_CREATE[*]}"
+if [ "$SEED_NFS" = true ]; then
+  echo " > Files from '$SOURCE_FILES_LOCATION' copied to '$DESTINATION_COPY_FOLDER'."
+fi
 echo "--------------------------------------------------"
 echo ""
 echo "Your application '$APP_NAME' is ready in the current directory. Run it with ./$APP_NAME"
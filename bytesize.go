@@ -0,0 +1,16 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/wesrobin/cerebrium-test/pkg/cachefs"
+)
+
+// byteSizeFlag defines a flag for a number of bytes, which may be given with a unit (see
+// cachefs.ByteSize).
+func byteSizeFlag(name string, value int64, usage string) *int64 {
+	p := new(int64)
+	*p = value
+	flag.Var((*cachefs.ByteSize)(p), name, usage)
+	return p
+}
@@ -2,6 +2,13 @@ module github.com/wesrobin/cerebrium-test
 
 go 1.24.2
 
-require bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+require (
+	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+	github.com/alicebob/miniredis/v2 v2.37.0
+	github.com/fsnotify/fsnotify v1.9.0
+)
 
-require golang.org/x/sys v0.33.0 // indirect
+require (
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"maps"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	_ "bazil.org/fuse/fs/fstestutil"
+
+	"github.com/wesrobin/cerebrium-test/pkg/cachefs"
 )
 
 const (
@@ -17,21 +26,96 @@ const (
 	nfsDir     = "./nfs" // Path to our simulated NFS directory
 	ssdDir     = "./ssd" // Path to our simulated SSD cache directory
 
-	nfsFileReadDelay = time.Second
-
-	perm_READWRITEEXECUTE = 0o700
-	perm_READEXECUTE      = 0o500
-	perm_READ             = 0o400
+	cacheKeyEnv  = "FUSE_TEST_CACHE_KEY"      // Alternative to --cache-key-file
+	redisPassEnv = "FUSE_TEST_REDIS_PASSWORD" // For --redis-addr, kept off the command line
 )
 
 var (
 	// *** Flag definitions ***
 
 	// ** Cache specific **
-	cache       = flag.String("cache", "default", "Define which cache to use (size, lru). If not specified, default cache is used.\n EXAMPLE: --cache=lru")
-	lruCapacity = flag.Int("lrucap", 2, "Define the capacity of the LRU cache. Only used when --cache=lru is set.")
-	lruDebug    = flag.Bool("lrudebug", false, "When specified, enable cache debugging (only available with LRU cache).")
-	sizeLimit   = flag.Int64("sizelim", 128, "Define the capacity of the Size Limited cache. Only used when --cache=size is set.")
+	cache        = flag.String("cache", "default", "Define which cache to use (default, size, lru, lfu, arc, clock, slru, redis, hybrid, dedup, ttl, mem, or any other registered cache). Several comma separated caches are tiered, fastest first: a file is read from the first that has it (and copied into the ones before), and written to all of them. A file only has to fit in one of them to be cached. Disk tiers in front of the last keep their files in a directory of their own, under the SSD directory.\n EXAMPLE: --cache=lru or --cache=mem,lru")
+	lruCapacity  = flag.Int("lrucap", 2, "Define the capacity of the LRU, LFU, ARC, Clock, SLRU or Redis cache. Only used when --cache=lru, --cache=lfu, --cache=arc, --cache=clock, --cache=slru, --cache=redis or --cache=hybrid is set.")
+	lruBytes     = byteSizeFlag("lrubytes", 0, "When set, limit the LRU, Clock, SLRU or Redis cache by the bytes its files take up instead of their number (or as well, if --lrucap is also set). Files bigger than this are not cached. Only used when --cache=lru, --cache=clock, --cache=slru or --cache=redis is set.\n EXAMPLE: --lrubytes=20GB")
+	admission    = flag.String("admission", "", "When set to tinylfu, only admit a new file into a full cache if it is read more often than the file it would evict, so one-off reads don't push out the working set (only used when --cache=lru, --cache=lfu, --cache=arc, --cache=clock, --cache=slru or --cache=hybrid is set). When set to second-access, only cache a file the second time it is read within --admission-window, so files read once are never cached.\n EXAMPLE: --admission=tinylfu")
+	admitWindow  = flag.Duration("admission-window", 10*time.Minute, "How long a file read once is remembered, for a second read to cache it. Only used when --admission=second-access is set.")
+	evictPolicy  = flag.String("evict", "lru", "Define which cached file to evict first: lru (least recently used), fifo (cached longest ago, however often it's read) or mru (most recently used, which suits repeated scans of more than fits). Only used when --cache=lru or --cache=hybrid is set.\n EXAMPLE: --evict=fifo")
+	slruProtect  = flag.Float64("slru-protected", 0.8, "Define the share (between 0 and 1) of the SLRU cache's --lrucap and --lrubytes kept for files read more than once. The rest is for files read once, and is evicted from first. Only used when --cache=slru is set.\n EXAMPLE: --slru-protected=0.5")
+	lruDebug     = flag.Bool("lrudebug", false, "When specified, enable cache debugging (only available with LRU cache).")
+	sizeLimit    = byteSizeFlag("sizelim", 128, "Define the capacity of the Size Limited cache in bytes. Only used when --cache=size, --cache=hybrid or --cache=mem is set.")
+	cacheTTL     = flag.Duration("ttl", 30*time.Second, "Define how long files stay in the TTL cache after they are cached. Only used when --cache=ttl is set.")
+	asyncPut     = flag.Bool("async-put", false, "When specified, write files to the cache in the background instead of during the read.")
+	asyncWorkers = flag.Int("async-workers", 4, "Number of background cache writers. Only used when --async-put is set.")
+	asyncQueue   = flag.Int("async-queue", 64, "Maximum number of cache writes waiting for a background writer. Only used when --async-put is set.")
+	asyncBlock   = flag.Bool("async-block", false, "When specified, reads wait for space in a full async queue instead of skipping the cache write. Only used when --async-put is set.")
+	chunkSize    = byteSizeFlag("chunk-size", 0, "When set, cache files in blocks of this many bytes, and only fetch the blocks a read covers. 0 caches whole files.\n EXAMPLE: --chunk-size=4MiB")
+	readAllLimit = byteSizeFlag("readall-threshold", 0, "When set, files of up to this many bytes are read whole once per open, rather than going to the cache for every read. Not used with --chunk-size.\n EXAMPLE: --readall-threshold=64KiB")
+	memTier      = byteSizeFlag("memcache", 0, "When set, keep up to this many bytes of the hottest files in memory, in front of the SSD cache.\n EXAMPLE: --memcache=256MB")
+	versionKeys  = flag.Bool("versioned-keys", false, "When specified, cache files under their path plus their NFS modification time and size, so a file changed on NFS misses the cache rather than being served stale. The copy of the old version is removed once the new one is cached (or, if cached before a restart, evicted as usual). Not used with --chunk-size.")
+	verifyCache  = flag.Bool("verify-cache", false, "When specified, checksum cached files and verify them on read. Corrupt files are re-fetched from NFS.")
+	cacheKeyFile = flag.String("cache-key-file", "", "When set, encrypt cached files with the AES key (16, 24 or 32 bytes, raw or hex encoded) in this file. The key can also be given in the FUSE_TEST_CACHE_KEY environment variable.\n EXAMPLE: --cache-key-file=/etc/fuse-test/cache.key")
+	cacheQuota   = flag.String("cache-quota", "", "When set, limit the bytes each project (top-level directory) may take up in the cache. Projects without a quota of their own use the default one, if given. A project over its quota has its own least recently used files evicted with --cache=lru or --cache=hybrid, and new files refused with --cache=size.\n EXAMPLE: --cache-quota=project-2=10GB,default=50GB")
+	partitions   = flag.Bool("partition-projects", false, "When specified, give every project (top-level directory) a cache of its own, so a project can only evict its own files. Each gets its --project-quota, or an even share of --sizelim after the quotas. Files directly under the root aren't cached. Only used when --cache=size, --cache=lru, --cache=clock, --cache=slru, --cache=hybrid, --cache=mem or --cache=redis is set (the last, with tiers).")
+	projectQuota = flag.String("project-quota", "", "When set, the bytes each project's partition may take up, with default for projects without their own. Only used when --partition-projects is set.\n EXAMPLE: --project-quota=project-2=10GB,default=50GB")
+	includeExt   = flag.String("cache-include-ext", "", "When set, only cache files with these comma separated extensions (case-insensitive, eg. py or .tar.gz). Files without an extension aren't cached. Files already cached are still read from the cache.\n EXAMPLE: --cache-include-ext=py,so,json")
+	excludeExt   = flag.String("cache-exclude-ext", "", "When set, never cache files with these comma separated extensions (case-insensitive). Takes precedence over --cache-include-ext, so a file matching both isn't cached.\n EXAMPLE: --cache-exclude-ext=ckpt")
+	cacheExclude = pathPatternsFlag("cache-exclude", "When set, never cache files whose path matches this glob (* doesn't match /), or any directory above it, or with a re: prefix, this RE2 regular expression (matched anywhere in the path unless anchored). Prefetching and warming skip them too. May be given more than once.\n EXAMPLE: --cache-exclude='*/checkpoints/*' --cache-exclude='re:\\.tmp$'")
+	maxFileSize  = byteSizeFlag("cache-max-file-size", 0, "When set, never cache files bigger than this, whatever the cache, so big one-off files are read from NFS rather than evicting the working set.\n EXAMPLE: --cache-max-file-size=100MB")
+	cachePins    = flag.String("cache-pin", "", "When set, never evict cached files matching these comma separated globs (* doesn't match /). They still count towards the cache's limits. Only used when --cache=lru, --cache=hybrid or --cache=size is set.\n EXAMPLE: --cache-pin='*/common-lib.py,project-1/bin/*'")
+	cacheSync    = flag.Bool("cache-sync", false, "When specified, fsync every file written to the cache (and its directory), so files survive a power loss. Writes are slower, by a disk flush or two per file.")
+	compress     = flag.Bool("compress", false, "When specified, gzip cached files on SSD. Files cached before compression was enabled are still read.")
+	gcOrphans    = flag.Bool("gc", false, "When specified, remove files from the SSD cache directory that the cache doesn't know about (eg. left by a previous run or another cache) after mounting. Only used with caches that index their files: size, lru, lfu, arc, clock, slru, redis, hybrid, dedup and ttl.")
+	gcInterval   = flag.Duration("gc-interval", 0, "When set, remove orphaned cache files again at this interval. Only used when --gc is set.\n EXAMPLE: --gc-interval=1h")
+	gcMinAge     = flag.Duration("gc-min-age", time.Hour, "Only remove orphaned cache files that haven't been modified for this long. Only used when --gc is set.")
+	gcDryRun     = flag.Bool("gc-dry-run", false, "When specified, only log the orphaned cache files that would be removed. Only used when --gc is set.")
+	shadowSpec   = flag.String("shadow", "", "When set, simulate a cache of this policy (lru, fifo or mru) and size alongside the real one, to see what hit rate it would get. Only an index is kept in memory, nothing is written for it. Its hits, misses and evictions are in the stats, and logged every --shadow-interval.\n EXAMPLE: --shadow=lru:500GB")
+	shadowEvery  = flag.Duration("shadow-interval", time.Minute, "How often to log the simulated cache's hit rate. Only used when --shadow is set.")
+	redisAddr    = flag.String("redis-addr", "", "The Redis server (host:port) to keep the cache index in, shared by every mount using the same SSD directory, so they share its limits and evict each other's files rather than each assuming it owns the directory. The password, if any, is read from the FUSE_TEST_REDIS_PASSWORD environment variable. Only used when --cache=redis is set.\n EXAMPLE: --redis-addr=localhost:6379")
+	redisDB      = flag.Int("redis-db", 0, "The Redis database to keep the cache index in. Only used when --cache=redis is set.")
+	redisPrefix  = flag.String("redis-prefix", "fuse-test", "Prefix of the Redis keys the cache index is kept in. Mounts sharing an SSD directory must use the same prefix, and mounts with different directories different ones. Only used when --cache=redis is set.")
+
+	// ** FUSE options **
+	nfsSources      = nfsSourcesFlag("nfs", "When set, serve these NFS directories merged into one tree instead of ./nfs, each as a directory at the root named after it. Nothing can be created or renamed at the root itself. Given once per directory.\n EXAMPLE: --nfs project-a=/mnt/a --nfs project-b=/mnt/b")
+	writable        = flag.Bool("writable", false, "When specified, mount the file system read-write. Changes (eg. new symlinks) are written through to NFS.")
+	allowOther      = flag.Bool("allow-other", false, "When specified, let users other than the one mounting use the mount, with their access checked against the files' permissions (as --map-uid and --map-gid show them). Users other than root need user_allow_other in /etc/fuse.conf to mount with it. Can't be used with --writable.")
+	writeBack       = flag.Bool("write-back", false, "When specified, cache files written through the mount and write them to NFS in the background, instead of to NFS on every write. Only used when --writable is set. Can't be used with --chunk-size.")
+	writeBackLimit  = byteSizeFlag("write-back-limit", 64<<20, "Maximum bytes of files not yet written back to NFS. Writes past it wait for files to be written. Only used when --write-back is set.")
+	writeBackEvery  = flag.Duration("write-back-interval", 5*time.Second, "How often files are written back to NFS. Everything left is written on unmount. Only used when --write-back is set.")
+	watchNFS        = flag.Bool("watch", false, "When specified, watch NFS for changes (inotify) and update the file tree as they happen.")
+	attrTTL         = flag.Duration("attr-ttl", time.Second, "How long the kernel may cache file attributes. Longer saves NFS stats on busy trees, but changes on NFS (eg. size) take longer to show up. --watch invalidates changed files regardless.")
+	attrCacheTTL    = flag.Duration("attr-cache-ttl", 0, "When set, remember NFS attributes (size, mode, times, owner) for this long, so stats don't go to NFS even after the kernel has forgotten them. Changes on NFS take up to this long to show up, unless --watch sees them.\n EXAMPLE: --attr-cache-ttl=1m")
+	dirListingTTL   = flag.Duration("dir-listing-ttl", 0, "When set, reuse directory listings for this long. A directory modified on NFS since it was last listed (or loaded) has its entries reloaded from NFS first, so files added or removed there show up without --watch or a refresh.\n EXAMPLE: --dir-listing-ttl=30s")
+	negativeTTL     = flag.Duration("negative-ttl", time.Second, "How long paths that don't exist on NFS are remembered as missing, saving repeated NFS lookups. 0 disables.")
+	nfsReadDelay    = flag.Duration("nfs-read-delay", 0, "When set, sleep this long before every file read from NFS, to simulate network latency.\n EXAMPLE: --nfs-read-delay=1s")
+	nfsRetries      = flag.Int("nfs-retries", 3, "How many times to retry a file read from NFS that fails with one of --nfs-retry-errnos, before failing it with EIO. 0 disables retries.")
+	nfsRetryDelay   = flag.Duration("nfs-retry-delay", 100*time.Millisecond, "How long to wait before the first retry of a failed NFS read, doubled after every retry.")
+	nfsRetryErrnos  = flag.String("nfs-retry-errnos", "ESTALE,EINTR,ETIMEDOUT,EAGAIN", "Comma separated errnos that NFS reads are retried on. Any of EAGAIN, EBUSY, ECONNREFUSED, ECONNRESET, EHOSTUNREACH, EINTR, EIO, ENETUNREACH, ESTALE and ETIMEDOUT.")
+	nfsConcurrency  = flag.Int("nfs-concurrency", 0, "When set, read at most this many files from NFS at once, including prefetching and warming. Reads past it queue for a turn. 0 doesn't limit them.\n EXAMPLE: --nfs-concurrency=16")
+	readAheadBytes  = byteSizeFlag("readahead-bytes", 0, "When set, read this many bytes ahead of sequential reads on an open file in the background, so the next read is served from memory.\n EXAMPLE: --readahead-bytes=1MiB")
+	readAheadLimit  = byteSizeFlag("readahead-limit", 64<<20, "Maximum bytes read ahead across all open files at once. Only used when --readahead-bytes is set.")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for reads in progress to finish on SIGINT/SIGTERM before unmounting anyway. New opens are refused while waiting.")
+	scrubInterval   = flag.Duration("scrub-interval", 0, "When set, check the files cached by this process against NFS at this interval, and invalidate any that changed or were removed.\n EXAMPLE: --scrub-interval=10m")
+	scrubRate       = flag.Int("scrub-rate", 50, "Maximum NFS stats a second while scrubbing. Only used when --scrub-interval is set.")
+	uidMap          = idMapFlag("map-uid", "When set, show files owned on NFS by the first uid as owned by the second, eg. for a service account that doesn't exist here. Access is checked against the new owner. May be given more than once.\n EXAMPLE: --map-uid=5001:1000")
+	gidMap          = idMapFlag("map-gid", "When set, show files owned on NFS by the first gid as owned by the second. May be given more than once.\n EXAMPLE: --map-gid=5001:1000")
+	refreshInterval = flag.Duration("refresh-interval", 0, "When set, reload the file tree from NFS at this interval. The tree can always be reloaded by sending SIGHUP.\n EXAMPLE: --refresh-interval=5m")
+
+	// ** Cache warming **
+	warmManifest = flag.String("warm-manifest", "", "Path to a file listing NFS relative paths (one per line) to load into the cache after mounting.")
+
+	// ** Prefetching **
+	prefetchDir         = flag.Bool("prefetch-dir", false, "When specified, a cache miss loads the rest of the file's directory into the cache in the background. Not used with --chunk-size.")
+	prefetchSiblings    = flag.Bool("prefetch-siblings", false, "Same as --prefetch-dir.")
+	prefetchConcurrency = flag.Int("prefetch-concurrency", 4, "Maximum number of concurrent NFS reads when prefetching. Only used when --prefetch-dir is set.")
+
+	// ** Stats **
+	statsInterval = flag.Duration("stats-interval", 0, "When set, log cache stats at this interval.\n EXAMPLE: --stats-interval=1m")
+	metricsEvery  = flag.Duration("metrics-checkpoint", 0, "When set, save the cache counters (hits, misses, evictions and bytes) to the SSD directory at this interval and on unmount, and load them at startup, so stats report lifetime_ counters across restarts alongside those since the process started.\n EXAMPLE: --metrics-checkpoint=1m")
+	adminSocket   = flag.String("admin-socket", "", "When set, listen on this unix socket for admin commands, one per line: tree, stats, keys, top [n], invalidate <path>, refresh.\n EXAMPLE: --admin-socket=/tmp/fuse-test.sock")
+	dumpFile      = flag.String("dump-file", "", "When set, SIGUSR1 writes a dump of the cache internals to this file instead of the log.\n EXAMPLE: --dump-file=/tmp/cache-dump.txt")
+
+	// ** Pre-flight check **
+	checkOnly = flag.Bool("check", false, "When specified, check that NFS is readable, the SSD cache is writable, the file tree loads and the cache can store a file, then exit without mounting. Exits non-zero if any check fails.")
 
 	// ** FUSE debugging **
 	debugServer = flag.Bool("sdebug", false, "When specified, log FUSE server messages.")
@@ -41,53 +125,453 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+// isFlagSet reports whether the flag was given on the command line, rather than left at its default.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func main() {
 	flag.Usage = usage
+
+	if len(os.Args) > 1 && os.Args[1] == "warm" {
+		if err := runWarm(os.Args[2:]); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		return
+	}
+
 	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+}
 
+// run sets up the cache and file system, and serves it until it's unmounted. Any error setting up
+// or serving is returned, for main to report.
+func run() error {
 	log.Printf("Mount point at %s", mountPoint)
-	log.Printf("NFS source (relative): %s", nfsDir)
+	if len(nfsSources) > 0 {
+		log.Printf("NFS sources (relative): %s", nfsSources)
+	} else {
+		log.Printf("NFS source (relative): %s", nfsDir)
+	}
 	log.Printf("SSD cache (relative): %s", ssdDir)
 
 	absSSDDir, err := filepath.Abs(ssdDir)
 	if err != nil {
-		log.Fatalf("FATAL: Invalid SSD relative path '%s'", ssdDir)
+		return fmt.Errorf("invalid SSD relative path '%s': %w", ssdDir, err)
 	} else if _, err := os.Stat(absSSDDir); err != nil {
-		log.Fatalf("FATAL: Could not find SSD path '%s'", absSSDDir)
+		return fmt.Errorf("could not find SSD path '%s': %w", absSSDDir, err)
+	}
+
+	retryErrnos, err := cachefs.ParseErrnos(*nfsRetryErrnos)
+	if err != nil {
+		return fmt.Errorf("invalid --nfs-retry-errnos: %w", err)
+	}
+
+	cfg := cachefs.Config{
+		Mountpoint:        mountPoint,
+		NFSDir:            nfsDir,
+		NFSSources:        nfsSources,
+		SSDDir:            ssdDir,
+		Writable:          *writable,
+		NegativeTTL:       *negativeTTL,
+		ChunkSize:         *chunkSize,
+		AttrTTL:           *attrTTL,
+		AttrCacheTTL:      *attrCacheTTL,
+		DirListingTTL:     *dirListingTTL,
+		NFSReadDelay:      *nfsReadDelay,
+		NFSRetries:        *nfsRetries,
+		NFSRetryDelay:     *nfsRetryDelay,
+		NFSRetryErrnos:    retryErrnos,
+		NFSConcurrency:    *nfsConcurrency,
+		MetricsCheckpoint: *metricsEvery,
+		ReadAllThreshold:  *readAllLimit,
+		ReadAheadBytes:    *readAheadBytes,
+		ReadAheadLimit:    *readAheadLimit,
+		VersionedKeys:     *versionKeys,
+		UIDMap:            uidMap,
+		GIDMap:            gidMap,
+		AllowOther:        *allowOther,
+	}
+	if *writable && *writeBack {
+		cfg.WriteBack = true
+		cfg.WriteBackLimit = *writeBackLimit
+		cfg.WriteBackInterval = *writeBackEvery
+	}
+	if *prefetchDir || *prefetchSiblings {
+		cfg.PrefetchConcurrency = *prefetchConcurrency
+	}
+
+	if *checkOnly {
+		// The check builds the cache on a scratch directory, so that it doesn't tidy up, evict from or
+		// write to the real one. With Redis, it's under its own prefix for the same reason.
+		*redisPrefix = fmt.Sprintf("%s:check-%d", *redisPrefix, os.Getpid())
+		if err := cachefs.Check(cfg, initCache); err != nil {
+			return fmt.Errorf("check failed: %w", err)
+		}
+		log.Printf("CHECK: All checks passed")
+		return nil
+	}
+
+	c, err := initCache(absSSDDir)
+	if err != nil {
+		return err
 	}
+	cfg.Cache = c
 
-	fuseFS := NewFS(mountPoint, nfsDir, ssdDir, initCache(absSSDDir))
+	fuseFS, err := cachefs.New(cfg)
+	if err != nil {
+		return err
+	}
+	fuseFS.PrintTree(os.Stdout)
 
 	if err := fuseFS.Mount(); err != nil {
-		log.Fatalf("failed to mount: '%v'", err)
+		return fmt.Errorf("failed to mount: %w", err)
 	}
 
 	log.Printf("Mounted file system at '%v'", mountPoint)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *watchNFS {
+		go func() {
+			if err := fuseFS.Watch(ctx); err != nil {
+				log.Printf("ERROR: Stopped watching NFS: '%v'", err)
+			}
+		}()
+	}
+
+	if *scrubInterval > 0 {
+		go func() {
+			if err := fuseFS.Scrub(ctx, *scrubInterval, *scrubRate); err != nil {
+				log.Printf("ERROR: Stopped scrubbing the cache: '%v'", err)
+			}
+		}()
+	}
+
+	if *gcOrphans {
+		go func() {
+			if err := fuseFS.GC(ctx, *gcInterval, *gcMinAge, *gcDryRun); err != nil {
+				log.Printf("ERROR: Stopped removing orphaned cache files: '%v'", err)
+			}
+		}()
+	}
+
+	if *warmManifest != "" {
+		go func() {
+			relPaths, err := cachefs.ReadManifest(*warmManifest)
+			if err != nil {
+				log.Printf("ERROR: Failed to read warm manifest '%s': '%v'", *warmManifest, err)
+				return
+			}
+			p, err := fuseFS.Warm(ctx, relPaths, 1, nil)
+			if err != nil {
+				log.Printf("WARNING: Cache warming stopped early: '%v'", err)
+			}
+			log.Printf("WARM: Loaded %d files (%d bytes) of %d into the cache", p.Cached, p.Bytes, p.Total)
+		}()
+	}
+
+	if *adminSocket != "" {
+		go func() {
+			if err := serveAdmin(ctx, *adminSocket, fuseFS); err != nil {
+				log.Printf("ERROR: Stopped serving admin socket: '%v'", err)
+			}
+		}()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
 	go func() {
 		<-sigChan
+		cancel()
 		log.Printf("Unmounted filesystem from %s", mountPoint)
-		if err := fuseFS.Unmount(); err != nil {
+		if err := fuseFS.Shutdown(*shutdownTimeout); err != nil {
 			log.Fatalf("failed to unmount: '%v'", err)
 		}
 	}()
 
+	if *statsInterval > 0 {
+		go func() {
+			for range time.Tick(*statsInterval) {
+				log.Printf("STATS: %v", fuseFS.Stats())
+			}
+		}()
+	}
+
+	dumpChan := make(chan os.Signal, 1)
+	signal.Notify(dumpChan, syscall.SIGUSR1)
+	go func() {
+		for range dumpChan {
+			if err := writeCacheDump(fuseFS, *dumpFile); err != nil {
+				log.Printf("ERROR: Failed to dump cache: '%v'", err)
+			}
+		}
+	}()
+
+	// SIGUSR1 already dumps the cache, so clearing it is on SIGUSR2.
+	clearChan := make(chan os.Signal, 1)
+	signal.Notify(clearChan, syscall.SIGUSR2)
+	go func() {
+		for range clearChan {
+			files, bytes, err := fuseFS.ClearCache()
+			if err != nil {
+				log.Printf("ERROR: Failed to clear cache: '%v'", err)
+				continue
+			}
+			log.Printf("CLEAR: Removed %d files (%d bytes) from the cache", files, bytes)
+		}
+	}()
+
+	refreshChan := make(chan os.Signal, 1)
+	signal.Notify(refreshChan, syscall.SIGHUP)
+	go func() {
+		var ticks <-chan time.Time
+		if *refreshInterval > 0 {
+			ticks = time.NewTicker(*refreshInterval).C
+		}
+		for {
+			select {
+			case <-refreshChan:
+			case <-ticks:
+			}
+			if err := fuseFS.Refresh(); err != nil {
+				log.Printf("ERROR: Failed to refresh file system: '%v'", err)
+			}
+		}
+	}()
+
 	if err := fuseFS.Serve(*debugServer); err != nil {
-		log.Fatalf("failed to serve: '%v'", err)
+		return fmt.Errorf("failed to serve: %w", err)
 	}
+	return nil
 }
 
-func initCache(ssdDir string) Cache {
-	var c Cache
-	switch *cache {
-	case "lru":
-		c = NewLRUCache(ssdDir, *lruCapacity, *lruDebug)
-	case "size":
-		c = NewSizeLimitedCache(ssdDir, *sizeLimit)
+// writeCacheDump dumps the cache's internals to the named file, or to the log if there's no file.
+func writeCacheDump(fuseFS cachefs.FuseFS, fileName string) error {
+	var buf bytes.Buffer
+	fuseFS.DumpCache(&buf)
+
+	if fileName == "" {
+		log.Printf("DUMP:\n%s", buf.String())
+		return nil
+	}
+	if err := os.WriteFile(fileName, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	log.Printf("DUMP: Wrote cache dump to %s", fileName)
+	return nil
+}
+
+// newPartitionedCache builds a cache with a partition of the named cache for every project, see
+// --partition-projects.
+func newPartitionedCache(name string, opts cachefs.CacheOpts) (cachefs.Cache, error) {
+	switch name {
+	case "size", "lru", "clock", "slru", "hybrid", "mem", "redis":
 	default:
-		c = NewDefaultCache(ssdDir)
+		return nil, fmt.Errorf("--partition-projects needs a cache limited by bytes (size, lru, clock, slru, hybrid, mem or redis), not %s", name)
+	}
+	if opts.Quotas != nil {
+		return nil, errors.New("--cache-quota can't be used with --partition-projects, use --project-quota")
 	}
-	return c
+
+	var quotas cachefs.Quotas
+	if *projectQuota != "" {
+		var err error
+		if quotas, err = cachefs.ParseQuotas(*projectQuota); err != nil {
+			return nil, fmt.Errorf("invalid --project-quota: %w", err)
+		}
+	}
+	var projects []string
+	if len(nfsSources) > 0 {
+		// Every source is a directory at the root.
+		projects = slices.Sorted(maps.Keys(nfsSources))
+	} else {
+		entries, err := os.ReadDir(nfsDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				projects = append(projects, entry.Name())
+			}
+		}
+	}
+
+	return cachefs.NewPartitionedCache(opts.SSDDir, projects, quotas, *sizeLimit, func(project, dir string, byteLimit int64) (cachefs.Cache, error) {
+		opts := opts
+		opts.SSDDir, opts.ByteLimit = dir, byteLimit
+		if (name == "lru" || name == "clock" || name == "slru" || name == "redis") && !isFlagSet("lrucap") {
+			opts.Capacity = 0 // Only limited by the partition's bytes
+		}
+		opts.Redis.Prefix += ":" + project
+		return cachefs.NewCache(name, opts)
+	})
+}
+
+// initCache builds the cache chosen by the flags, returning an error if they're invalid.
+func initCache(ssdDir string) (cachefs.Cache, error) {
+	cachefs.PrepareCacheDir(ssdDir)
+
+	var quotas cachefs.Quotas
+	if *cacheQuota != "" {
+		var err error
+		if quotas, err = cachefs.ParseQuotas(*cacheQuota); err != nil {
+			return nil, fmt.Errorf("invalid --cache-quota: %w", err)
+		}
+	}
+	pins, err := cachefs.ParsePins(*cachePins)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --cache-pin: %w", err)
+	}
+	if (quotas != nil || pins != nil) && (*cacheKeyFile != "" || os.Getenv(cacheKeyEnv) != "") {
+		log.Printf("WARNING: Cached file names are hashed when encrypting, so --cache-quota and --cache-pin can't tell files apart by path")
+	}
+
+	// Each name but the last is a faster tier in front of the ones after it, in its own directory if
+	// it's on disk. Quotas, pins and syncing are the slowest tier's, the one the others are copies of.
+	names := strings.Split(*cache, ",")
+	var c cachefs.Cache
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		opts := cachefs.CacheOpts{
+			SSDDir:    ssdDir,
+			Capacity:  *lruCapacity,
+			ByteLimit: *sizeLimit,
+			TTL:       *cacheTTL,
+			Evict:     *evictPolicy,
+			Protected: *slruProtect,
+			Redis: cachefs.RedisConfig{
+				Addr:     *redisAddr,
+				Password: os.Getenv(redisPassEnv),
+				DB:       *redisDB,
+				Prefix:   *redisPrefix,
+			},
+			Debug: *lruDebug,
+		}
+		if name == "lru" || name == "clock" || name == "slru" || name == "redis" {
+			// The LRU, Clock, SLRU and Redis caches only have a byte limit if --lrubytes is set, and only
+			// keep the default --lrucap if it isn't.
+			opts.ByteLimit = *lruBytes
+			if *lruBytes > 0 && !isFlagSet("lrucap") {
+				opts.Capacity = 0
+			}
+		}
+		if c == nil {
+			opts.Quotas, opts.Pins, opts.Sync = quotas, pins, *cacheSync
+		} else {
+			opts.SSDDir = cachefs.TierDir(ssdDir, i)
+			if err := os.MkdirAll(opts.SSDDir, 0o755); err != nil {
+				return nil, err
+			}
+			cachefs.PrepareCacheDir(opts.SSDDir)
+		}
+
+		newCache := cachefs.NewCache
+		if c == nil && *partitions {
+			newCache = newPartitionedCache
+		}
+		tier, err := newCache(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			c = tier
+		} else {
+			c = cachefs.NewTieredCache(tier, c)
+		}
+	}
+
+	switch *admission {
+	case "", "second-access":
+	case "tinylfu":
+		if c, err = cachefs.NewTinyLFUCache(c, *lruCapacity); err != nil {
+			return nil, errors.New("--admission=tinylfu needs --cache=lru, --cache=lfu, --cache=arc, --cache=clock, --cache=slru or --cache=hybrid")
+		}
+	default:
+		return nil, fmt.Errorf("unknown --admission '%s', must be tinylfu or second-access", *admission)
+	}
+
+	if *cacheKeyFile != "" {
+		key, err := cachefs.ReadKeyFile(*cacheKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read cache key file '%s': %w", *cacheKeyFile, err)
+		}
+		if c, err = cachefs.NewEncryptedCache(c, key); err != nil {
+			return nil, fmt.Errorf("invalid key in cache key file '%s': %w", *cacheKeyFile, err)
+		}
+	} else if env := os.Getenv(cacheKeyEnv); env != "" {
+		key, err := cachefs.ParseKey([]byte(env))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in %s: %w", cacheKeyEnv, err)
+		}
+		if c, err = cachefs.NewEncryptedCache(c, key); err != nil {
+			return nil, fmt.Errorf("invalid key in %s: %w", cacheKeyEnv, err)
+		}
+	}
+	if *compress {
+		c = cachefs.NewCompressedCache(c)
+	}
+	if *verifyCache {
+		c = cachefs.NewChecksumCache(c)
+	}
+	if *memTier > 0 {
+		c = cachefs.NewTieredCache(cachefs.NewMemCache(*memTier), c)
+	}
+	// The filters go around the other wrappers, so they see the paths being read rather than (eg.)
+	// encrypted names.
+	if *includeExt != "" || *excludeExt != "" {
+		c = cachefs.NewExtensionFilterCache(c, cachefs.ParseExtensions(*includeExt), cachefs.ParseExtensions(*excludeExt))
+	}
+	if len(*cacheExclude) > 0 {
+		c = cachefs.NewPathFilterCache(c, *cacheExclude)
+	}
+	if *maxFileSize > 0 {
+		// Sizes are those of the files as read, before (eg.) compression.
+		c = cachefs.NewMaxFileSizeCache(c, int64(*maxFileSize))
+	}
+	if *admission == "second-access" {
+		// Around the other wrappers, so it sees the paths being read rather than (eg.) encrypted names.
+		c = cachefs.NewDoorkeeperCache(c, *admitWindow)
+	}
+	if *asyncPut {
+		c = cachefs.NewAsyncCache(c, *asyncWorkers, *asyncQueue, *asyncBlock)
+	}
+	if *shadowSpec != "" {
+		// Around everything, so it sees every read and write the workload makes, as a real cache would.
+		if c, err = cachefs.NewShadowCache(c, *shadowSpec, *shadowEvery); err != nil {
+			return nil, fmt.Errorf("invalid --shadow: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// nfsSourcesFlag defines a flag for NFS sources, each given as name=dir (see cachefs.NFSSources).
+func nfsSourcesFlag(name, usage string) cachefs.NFSSources {
+	s := make(cachefs.NFSSources)
+	flag.Var(s, name, usage)
+	return s
+}
+
+// pathPatternsFlag defines a flag for path patterns, compiled as they're given (see
+// cachefs.PathPatterns).
+func pathPatternsFlag(name, usage string) *cachefs.PathPatterns {
+	p := new(cachefs.PathPatterns)
+	flag.Var(p, name, usage)
+	return p
+}
+
+// idMapFlag defines a flag for owner id mappings, each given as old:new (see cachefs.IDMap).
+func idMapFlag(name, usage string) cachefs.IDMap {
+	m := make(cachefs.IDMap)
+	flag.Var(m, name, usage)
+	return m
 }
@@ -0,0 +1,55 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Bits of the access(2) mask.
+const (
+	accessExecute = 1 << iota
+	accessWrite
+	accessRead
+)
+
+// Access answers access(2) from the file's permissions on NFS (as Attr reports them), for the
+// calling user, so callers that check before they write (eg. editors) get the same answer they'd get
+// by trying. Nothing can be written to a read-only mount, whatever the permissions. Only the
+// caller's primary group is known, so a file the caller can only use through a supplementary group
+// is reported as not accessible.
+func (n *fuseFSNode) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	if req.Mask&accessWrite != 0 && !n.FS.writable {
+		return syscall.EACCES
+	}
+
+	fi, err := n.stat()
+	if err != nil {
+		return err
+	}
+	perm := n.fileMode(fi).Perm()
+	uid, gid, _ := n.FS.owner(fi) // Files with an unknown owner are served as owned by root
+
+	var granted os.FileMode
+	switch {
+	case req.Uid == 0:
+		// Root can read and write anything, but only execute what someone can.
+		granted = accessRead | accessWrite
+		if n.isDir || perm&0o111 != 0 {
+			granted |= accessExecute
+		}
+	case req.Uid == uid:
+		granted = perm >> 6 & 0o7
+	case req.Gid == gid:
+		granted = perm >> 3 & 0o7
+	default:
+		granted = perm & 0o7
+	}
+
+	if req.Mask&^uint32(granted)&0o7 != 0 {
+		return syscall.EACCES
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestAccessChecksNFSPermissions(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.txt", []byte("a"))
+	writeTestFile(t, nfsDir, "run.sh", []byte("#!/bin/sh"))
+	for name, mode := range map[string]os.FileMode{"data.txt": 0o640, "run.sh": 0o750} {
+		path := filepath.Join(nfsDir, name)
+		if err := os.Chown(path, 1000, 1000); err != nil {
+			t.Skipf("can't give files another owner: %v", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writable := newTestFS(t, Config{NFSDir: nfsDir, Writable: true})
+	readOnly := newTestFS(t, Config{NFSDir: nfsDir})
+
+	for _, tc := range []struct {
+		name     string
+		rfs      *FS
+		relPath  string
+		uid, gid uint32
+		mask     uint32
+		want     error
+	}{
+		{"owner reads and writes", writable, "data.txt", 1000, 1000, accessRead | accessWrite, nil},
+		{"owner executes", writable, "data.txt", 1000, 1000, accessExecute, syscall.EACCES},
+		{"group reads", writable, "data.txt", 2000, 1000, accessRead, nil},
+		{"group writes", writable, "data.txt", 2000, 1000, accessWrite, syscall.EACCES},
+		{"other reads", writable, "data.txt", 2000, 2000, accessRead, syscall.EACCES},
+		{"root reads and writes", writable, "data.txt", 0, 0, accessRead | accessWrite, nil},
+		{"root executes a file nobody can", writable, "data.txt", 0, 0, accessExecute, syscall.EACCES},
+		{"root executes a file someone can", writable, "run.sh", 0, 0, accessExecute, nil},
+		{"owner writes to a read-only mount", readOnly, "data.txt", 1000, 1000, accessWrite, syscall.EACCES},
+		{"owner reads from a read-only mount", readOnly, "data.txt", 1000, 1000, accessRead, nil},
+	} {
+		req := &fuse.AccessRequest{Header: fuse.Header{Uid: tc.uid, Gid: tc.gid}, Mask: tc.mask}
+		if err := lookup(t, tc.rfs, tc.relPath).Access(context.Background(), req); err != tc.want {
+			t.Errorf("%s: Access = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
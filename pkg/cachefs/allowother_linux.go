@@ -0,0 +1,36 @@
+package cachefs
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+)
+
+// fuseConf is where fusermount reads the options users other than root may mount with.
+const fuseConf = "/etc/fuse.conf"
+
+// checkAllowOther returns an error if fusermount would refuse allow_other, ie. it isn't being
+// mounted by root and fuse.conf doesn't have user_allow_other.
+func checkAllowOther() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	f, err := os.Open(fuseConf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "user_allow_other" {
+				return nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return errors.New("allow_other needs user_allow_other in " + fuseConf + " when not mounting as root")
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package cachefs
+
+// checkAllowOther leaves it to the mount to refuse allow_other, as only Linux has fuse.conf.
+func checkAllowOther() error {
+	return nil
+}
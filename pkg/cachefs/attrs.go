@@ -0,0 +1,85 @@
+package cachefs
+
+import (
+	native_fs "io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// attrCache remembers the NFS attributes of paths for a while, so stats of files (eg. ls -l) don't
+// go out to NFS every time, even when the kernel has forgotten them. Entries are dropped whenever
+// the data for the path is invalidated. A ttl of 0 disables it.
+type attrCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]attrEntry
+
+	hits atomic.Int64
+}
+
+type attrEntry struct {
+	fi      native_fs.FileInfo
+	expires time.Time
+}
+
+func newAttrCache(ttl time.Duration) *attrCache {
+	return &attrCache{
+		ttl:     ttl,
+		entries: make(map[string]attrEntry),
+	}
+}
+
+// get returns the remembered attributes of the path, if they haven't expired.
+func (ac *attrCache) get(path string) (native_fs.FileInfo, bool) {
+	if ac.ttl <= 0 {
+		return nil, false
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	entry, ok := ac.entries[path]
+	if !ok {
+		return nil, false
+	} else if time.Now().After(entry.expires) {
+		delete(ac.entries, path)
+		return nil, false
+	}
+
+	ac.hits.Add(1)
+	return entry.fi, true
+}
+
+// put records the attributes of the path.
+func (ac *attrCache) put(path string, fi native_fs.FileInfo) {
+	if ac.ttl <= 0 {
+		return
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	now := time.Now()
+	if len(ac.entries) >= 4096 {
+		// Don't let expired entries pile up.
+		for p, entry := range ac.entries {
+			if now.After(entry.expires) {
+				delete(ac.entries, p)
+			}
+		}
+	}
+	ac.entries[path] = attrEntry{fi: fi, expires: now.Add(ac.ttl)}
+}
+
+// forget drops the attributes of a path that has changed.
+func (ac *attrCache) forget(path string) {
+	if ac.ttl <= 0 {
+		return
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	delete(ac.entries, path)
+}
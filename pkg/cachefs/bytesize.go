@@ -0,0 +1,56 @@
+package cachefs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the units a byte size can be given in. Decimal units are powers of 1000, binary
+// (eg. MiB) are powers of 1024.
+var byteUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1e3,
+	"KB":  1e3,
+	"KIB": 1 << 10,
+	"M":   1e6,
+	"MB":  1e6,
+	"MIB": 1 << 20,
+	"G":   1e9,
+	"GB":  1e9,
+	"GIB": 1 << 30,
+	"T":   1e12,
+	"TB":  1e12,
+	"TIB": 1 << 40,
+}
+
+// ByteSize is a number of bytes, given as a plain number or with a unit (eg. 256MB, 1.5GiB). It is
+// a flag.Value, so it can be used for flags.
+type ByteSize int64
+
+func (b *ByteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	numEnd := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if numEnd == -1 {
+		numEnd = len(s)
+	}
+
+	num, err := strconv.ParseFloat(s[:numEnd], 64)
+	if err != nil {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[numEnd:]))]
+	if !ok {
+		return fmt.Errorf("invalid byte size %q, unknown unit", s)
+	}
+
+	*b = ByteSize(num * unit)
+	return nil
+}
+
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
@@ -0,0 +1,1362 @@
+package cachefs
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNotFoundCache = errors.New("not found in cache")
+	ErrWontCache     = errors.New("cache refused the file")
+)
+
+type Cache interface {
+	// Get fetches a file at the given path from the cache.
+	// Returns ErrNotFoundCache if the file does not exist.
+	Get(path string) ([]byte, error)
+
+	// Has reports whether the file is in the cache, without reading it or counting as a use of it
+	// (eg. for LRU order). A file it reports may still be evicted before it is read.
+	Has(path string) bool
+
+	// Put a new file in the cache.
+	// Returns ErrWontCache if for whatever reason the cache refused the file.
+	// Returns nil error if file is successfully cached.
+	Put(path string, data []byte, mode os.FileMode) error
+
+	// Delete removes a file from the cache.
+	// Deleting a file that is not in the cache is not an error.
+	Delete(path string) error
+
+	// Clear removes every file from the cache.
+	Clear() error
+}
+
+// StreamingCache is implemented by caches that can read and write files without holding them in
+// memory whole, which matters for big files.
+type StreamingCache interface {
+	Cache
+
+	// GetReader opens a file in the cache for reading.
+	// Returns ErrNotFoundCache if the file does not exist.
+	GetReader(path string) (io.ReadSeekCloser, error)
+
+	// PutReader writes a new file to the cache from r, returning the number of bytes written.
+	// Returns ErrWontCache if for whatever reason the cache refused the file.
+	PutReader(path string, r io.Reader, mode os.FileMode) (int64, error)
+}
+
+// getReader opens a file in any cache for reading, loading it into memory if the cache doesn't
+// support streaming.
+func getReader(c Cache, path string) (io.ReadSeekCloser, error) {
+	if sc, ok := c.(StreamingCache); ok {
+		return sc.GetReader(path)
+	}
+
+	data, err := c.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// putReader writes a file from r to any cache, loading it into memory if the cache doesn't support
+// streaming.
+func putReader(c Cache, path string, r io.Reader, mode os.FileMode) (int64, error) {
+	if sc, ok := c.(StreamingCache); ok {
+		return sc.PutReader(path, r, mode)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), c.Put(path, data, mode)
+}
+
+// Entry is a cached file, along with what it was cached with.
+type Entry struct {
+	Data    []byte // nil from StatEntry
+	Mode    os.FileMode
+	ModTime time.Time // When the file was cached, not when it was last modified on NFS
+	Size    int64
+}
+
+// EntryCache is implemented by caches that know the mode files were put with and when, eg. for a
+// read to tell that a cached file is out of date, or to serve its attributes when NFS can't be.
+type EntryCache interface {
+	Cache
+
+	// GetEntry fetches a file at the given path from the cache, along with its metadata.
+	// Returns ErrNotFoundCache if the file does not exist.
+	GetEntry(path string) (Entry, error)
+
+	// StatEntry returns the metadata of a file in the cache, without reading it.
+	// Returns ErrNotFoundCache if the file does not exist.
+	StatEntry(path string) (Entry, error)
+}
+
+// getEntry fetches a file from any cache, along with whatever metadata the cache keeps. Caches that
+// don't keep any only give its size.
+func getEntry(c Cache, path string) (Entry, error) {
+	if ec, ok := c.(EntryCache); ok {
+		return ec.GetEntry(path)
+	}
+
+	data, err := c.Get(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Data: data, Size: int64(len(data))}, nil
+}
+
+// statEntry returns whatever metadata any cache keeps for a file, reading the file if that's the
+// only way to learn its size.
+func statEntry(c Cache, path string) (Entry, error) {
+	if ec, ok := c.(EntryCache); ok {
+		return ec.StatEntry(path)
+	}
+
+	entry, err := getEntry(c, path)
+	entry.Data = nil
+	return entry, err
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+// EvictNotifier is implemented by caches that evict files by themselves (eg. to stay within a
+// limit). The callback is called with the path and size of every evicted file once it is gone,
+// without any of the cache's locks held, so it may use the cache.
+type EvictNotifier interface {
+	OnEvict(fn func(path string, size int64))
+}
+
+// evictHooks holds the callbacks registered with OnEvict. Embed it to implement EvictNotifier.
+type evictHooks struct {
+	mu  sync.Mutex
+	fns []func(path string, size int64)
+}
+
+func (h *evictHooks) OnEvict(fn func(path string, size int64)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fns = append(h.fns, fn)
+}
+
+// notifyEvicted calls the registered callbacks. Must not be called with any cache locks held.
+func (h *evictHooks) notifyEvicted(path string, size int64) {
+	h.mu.Lock()
+	fns := h.fns
+	h.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(path, size)
+	}
+}
+
+// SyncWriter is implemented by caches that store files on disk, and can fsync every file they write
+// so it survives a power loss. SetSyncWrites must be called before the cache is used.
+type SyncWriter interface {
+	SetSyncWrites(enabled bool)
+}
+
+// ModeSetter is implemented by caches that store files with their permissions, and can change
+// them in place when the file is chmod'ed on NFS. SetMode returns ErrNotFoundCache if the file isn't
+// cached.
+type ModeSetter interface {
+	SetMode(path string, mode os.FileMode) error
+}
+
+// unwrapper is implemented by caches that wrap another cache, eg. to add checksums.
+type unwrapper interface {
+	Unwrap() Cache
+}
+
+// findCache returns the first layer of c (c itself, or a cache it wraps) that is a T, eg. to find
+// an optional interface through decorators.
+func findCache[T any](c Cache) (T, bool) {
+	for c != nil {
+		if t, ok := c.(T); ok {
+			return t, true
+		}
+		u, ok := c.(unwrapper)
+		if !ok {
+			break
+		}
+		c = u.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+func NewDefaultCache(ssdBasePath string) Cache {
+	return &defaultCache{
+		ssdBasePath: ssdBasePath,
+	}
+}
+
+// defaultCache writes files whole to a temporary file and renames it into place, so a read never
+// sees a partly written file. Operations on each file are still serialised, so concurrent Puts and
+// Deletes of a path take effect in the order they're made.
+type defaultCache struct {
+	ssdBasePath string
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+}
+
+func (d *defaultCache) SetSyncWrites(enabled bool) {
+	d.syncWrites = enabled
+}
+
+func (d *defaultCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(d.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		// An error other than "file not found" occurred when reading from SSD.
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+func (d *defaultCache) GetEntry(path string) (Entry, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	return readEntry(cacheFileName(d.ssdBasePath, flatPath), true)
+}
+
+func (d *defaultCache) StatEntry(path string) (Entry, error) {
+	return readEntry(cacheFileName(d.ssdBasePath, flattenDirPath(path)), false)
+}
+
+// Has stats the file, as this cache keeps no index of its own.
+func (d *defaultCache) Has(path string) bool {
+	_, err := os.Stat(cacheFileName(d.ssdBasePath, flattenDirPath(path)))
+	return err == nil
+}
+
+func (d *defaultCache) Put(path string, data []byte, mode os.FileMode) error {
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	fileName := cacheFileName(d.ssdBasePath, flatPath)
+	if err := writeFile(fileName, data, mode, d.syncWrites); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *defaultCache) GetReader(path string) (io.ReadSeekCloser, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	f, err := os.Open(cacheFileName(d.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *defaultCache) PutReader(path string, r io.Reader, mode os.FileMode) (int64, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	return writeFileFrom(cacheFileName(d.ssdBasePath, flatPath), r, mode, d.syncWrites)
+}
+
+func (d *defaultCache) Clear() error {
+	d.keyLocks.lockAll()
+	defer d.keyLocks.unlockAll()
+
+	return clearDir(d.ssdBasePath)
+}
+
+// Dump reports how many files are in the cache.
+func (d *defaultCache) Dump(w io.Writer) {
+	files, _, err := d.usage()
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "files: %d\n", files)
+}
+
+// Len, Bytes and Keys walk the cache directory, as this cache keeps no index of its own.
+func (d *defaultCache) Len() int {
+	files, _, _ := d.usage()
+	return files
+}
+
+func (d *defaultCache) Bytes() int64 {
+	_, bytes, _ := d.usage()
+	return bytes
+}
+
+// usage counts the cached files and the bytes they take up, leaving out anything that isn't a
+// cached file (eg. a faster tier's directory, see TierDir).
+func (d *defaultCache) usage() (files int, bytes int64, err error) {
+	err = walkCacheFiles(d.ssdBasePath, func(_ string, fi os.FileInfo) {
+		files++
+		bytes += fi.Size()
+	})
+	return files, bytes, err
+}
+
+func (d *defaultCache) Keys() []string {
+	var keys []string
+	walkCacheFiles(d.ssdBasePath, func(path string, _ os.FileInfo) {
+		keys = append(keys, path)
+	})
+	return keys
+}
+
+func (d *defaultCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	return chmodCacheFile(d.ssdBasePath, flatPath, mode)
+}
+
+func (d *defaultCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := d.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	fileName := cacheFileName(d.ssdBasePath, flatPath)
+	if err := removeCacheFile(d.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// NewSizeLimitedCache indexes the files already in ssdBasePath, so they count towards byteLimit
+// (and are served) from the start. If they take up more than byteLimit, the oldest are removed.
+func NewSizeLimitedCache(ssdBasePath string, byteLimit int64) Cache {
+	s := &sizeLimitedCache{
+		ssdBasePath: ssdBasePath,
+		byteLimit:   byteLimit,
+		sizes:       make(map[string]cachedSize),
+		usage:       newProjectUsage(),
+	}
+	if err := s.load(); err != nil {
+		log.Printf("WARNING: Failed to index existing files in %s: %v", ssdBasePath, err)
+	}
+	return s
+}
+
+// sizeLimitedCache budgets the space its files take up on disk (whole blocks), rather than their
+// length, as that's what runs out. Quotas are still by length, as that's what users see.
+type sizeLimitedCache struct {
+	ssdBasePath string
+	byteLimit   int64
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+
+	cacheMu      sync.Mutex // Guards the bookkeeping below. Never held during disk I/O
+	byteCount    int64      // On disk, counted against byteLimit
+	logicalBytes int64
+	sizes        map[string]cachedSize // Size of each cached file, so overwriting or deleting it is accounted for
+	usage        projectUsage          // Bytes per project, for quotas
+	pins         Pins
+}
+
+type cachedSize struct {
+	logical  int64 // Length of the file
+	physical int64 // Space it takes up on disk
+}
+
+// load indexes the files already in the cache directory, eg. from before a restart. If they take
+// up more than the limit (eg. it was lowered), the least recently modified are removed until they
+// fit, as this cache won't evict anything once it's running.
+func (s *sizeLimitedCache) load() error {
+	modTimes := make(map[string]time.Time)
+	err := walkCacheFiles(s.ssdBasePath, func(path string, fi os.FileInfo) {
+		flatPath := flattenDirPath(path)
+		size := cachedSize{logical: fi.Size(), physical: diskUsage(fi)}
+		s.sizes[flatPath] = size
+		s.byteCount += size.physical
+		s.logicalBytes += size.logical
+		s.usage.add(projectOf(path), size.logical)
+		modTimes[flatPath] = fi.ModTime()
+	})
+	if s.byteCount <= s.byteLimit {
+		return err
+	}
+
+	oldest := slices.Collect(maps.Keys(modTimes))
+	slices.SortFunc(oldest, func(a, b string) int {
+		return cmp.Or(modTimes[a].Compare(modTimes[b]), cmp.Compare(a, b))
+	})
+	before, removed := s.byteCount, 0
+	for _, flatPath := range oldest {
+		if s.byteCount <= s.byteLimit {
+			break
+		}
+		fileName := cacheFileName(s.ssdBasePath, flatPath)
+		if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+			log.Printf("ERROR: Failed to remove cached file %s over the limit: %v", fileName, err)
+			continue
+		}
+		size := s.sizes[flatPath]
+		delete(s.sizes, flatPath)
+		s.byteCount -= size.physical
+		s.logicalBytes -= size.logical
+		s.usage.add(projectOf(unflattenDirPath(flatPath)), -size.logical)
+		removed++
+	}
+	log.Printf("CACHE_LOADED: Cache directory %s took up %d bytes, over its %d byte limit. Removed the %d oldest files, leaving %d bytes",
+		s.ssdBasePath, before, s.byteLimit, removed, s.byteCount)
+	return err
+}
+
+// SetPins only makes refusing a pinned file an error worth logging, as this cache never evicts.
+func (s *sizeLimitedCache) SetPins(pins Pins) {
+	s.pins = pins
+}
+
+// refused reports a file the cache won't take. Pinned files are expected to always be cached, so
+// refusing one is logged as an error.
+func (s *sizeLimitedCache) refused(path string, size int64) error {
+	if s.pins.match(path) {
+		log.Printf("ERROR: Pinned file '%s' (%d bytes) doesn't fit in the cache (%d bytes)", path, size, s.byteLimit)
+	}
+	return ErrWontCache
+}
+
+// SetQuotas refuses files that would take their project over its quota.
+func (s *sizeLimitedCache) SetQuotas(quotas Quotas) {
+	s.usage.quotas = quotas
+}
+
+func (s *sizeLimitedCache) SetSyncWrites(enabled bool) {
+	s.syncWrites = enabled
+}
+
+func (s *sizeLimitedCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	s.cacheMu.Lock()
+	_, present := s.sizes[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return nil, ErrNotFoundCache
+	}
+
+	cachedData, err := os.ReadFile(cacheFileName(s.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		// An error other than "file not found" occurred when reading from SSD.
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+func (s *sizeLimitedCache) Has(path string) bool {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	_, present := s.sizes[flattenDirPath(path)]
+	return present
+}
+
+func (s *sizeLimitedCache) GetEntry(path string) (Entry, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	if !s.Has(path) {
+		return Entry{}, ErrNotFoundCache
+	}
+	return readEntry(cacheFileName(s.ssdBasePath, flatPath), true)
+}
+
+func (s *sizeLimitedCache) StatEntry(path string) (Entry, error) {
+	if !s.Has(path) {
+		return Entry{}, ErrNotFoundCache
+	}
+	return readEntry(cacheFileName(s.ssdBasePath, flattenDirPath(path)), false)
+}
+
+// Put will overwrite any existing data. Not great for huge files, but it (currently) isn't called
+// before first running a Get.
+func (s *sizeLimitedCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	// Reserve the space up front, so concurrent Puts of other files can't overshoot the limit. An
+	// existing file is replaced, so its space is reused. What the file really takes up on disk is
+	// only known once it's written, so this is an estimate until then.
+	dataLen := int64(len(data))
+	reserved := roundToBlock(dataLen)
+	project := projectOf(path)
+	s.cacheMu.Lock()
+	old := s.sizes[flatPath]
+	if s.byteCount-old.physical+reserved > s.byteLimit || !s.usage.fits(project, dataLen-old.logical) {
+		s.cacheMu.Unlock()
+		return s.refused(path, dataLen)
+	}
+	s.byteCount += reserved - old.physical
+	s.usage.add(project, dataLen-old.logical)
+	s.cacheMu.Unlock()
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	err := writeFile(fileName, data, mode, s.syncWrites)
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	// Give the reservation back, then account for the file as it really is.
+	s.byteCount -= reserved - old.physical
+	s.usage.add(project, old.logical-dataLen)
+	if err != nil {
+		// The old file (if any) is untouched.
+		return err
+	}
+	return s.store(path, flatPath, cachedSize{logical: dataLen, physical: fileDiskUsage(fileName, reserved)})
+}
+
+// store accounts for a file that has just been written, replacing whatever was there before. It is
+// refused (and removed) if it takes the cache over its limit, or its project over its quota.
+// Must be called with cacheMu held.
+func (s *sizeLimitedCache) store(path, flatPath string, size cachedSize) error {
+	project := projectOf(path)
+	old := s.sizes[flatPath]
+	s.byteCount -= old.physical
+	s.logicalBytes -= old.logical
+	s.usage.add(project, -old.logical)
+	delete(s.sizes, flatPath)
+
+	if s.byteCount+size.physical > s.byteLimit || !s.usage.fits(project, size.logical) {
+		// The old file has been replaced already, so it's gone too.
+		fileName := cacheFileName(s.ssdBasePath, flatPath)
+		if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+			log.Printf("ERROR: Failed to remove refused file %s: %v", fileName, err)
+		}
+		return s.refused(path, size.logical)
+	}
+
+	s.byteCount += size.physical
+	s.logicalBytes += size.logical
+	s.usage.add(project, size.logical)
+	s.sizes[flatPath] = size
+	return nil
+}
+
+func (s *sizeLimitedCache) GetReader(path string) (io.ReadSeekCloser, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	s.cacheMu.Lock()
+	_, present := s.sizes[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return nil, ErrNotFoundCache
+	}
+
+	f, err := os.Open(cacheFileName(s.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// PutReader can't know the size up front, so the file is written and then refused (and removed)
+// if it took the cache over its limit.
+func (s *sizeLimitedCache) PutReader(path string, r io.Reader, mode os.FileMode) (int64, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	// Don't bother reading more than could possibly fit. An existing file is replaced, so its space
+	// is reused.
+	project := projectOf(path)
+	s.cacheMu.Lock()
+	old := s.sizes[flatPath]
+	remaining := s.byteLimit - s.byteCount + old.physical
+	if quotaLeft, ok := s.usage.remaining(project); ok {
+		remaining = min(remaining, quotaLeft+old.logical)
+	}
+	s.cacheMu.Unlock()
+
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	written, err := writeFileFrom(fileName, io.LimitReader(r, max(remaining, 0)+1), mode, s.syncWrites)
+	if err != nil {
+		return written, err
+	}
+	size := cachedSize{logical: written, physical: fileDiskUsage(fileName, roundToBlock(written))}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return written, s.store(path, flatPath, size)
+}
+
+// Dump reports the bytes used against the limit, and the cached keys.
+func (s *sizeLimitedCache) Dump(w io.Writer) {
+	s.cacheMu.Lock()
+	byteCount, logicalBytes := s.byteCount, s.logicalBytes
+	keys := slices.Sorted(maps.Keys(s.sizes))
+	s.cacheMu.Unlock()
+
+	fmt.Fprintf(w, "bytes: %d/%d (%d logical)\n", byteCount, s.byteLimit, logicalBytes)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\n", unflattenDirPath(key))
+	}
+}
+
+func (s *sizeLimitedCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.sizes[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(s.ssdBasePath, flatPath, mode)
+}
+
+func (s *sizeLimitedCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.sizes[flatPath]
+	s.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(s.ssdBasePath, flatPath, before, dryRun)
+}
+
+func (s *sizeLimitedCache) Len() int {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return len(s.sizes)
+}
+
+// Bytes returns the space the files take up on disk, as counted against the limit.
+func (s *sizeLimitedCache) Bytes() int64 {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return s.byteCount
+}
+
+// Keys returns the cached paths, sorted. Nothing is ever evicted, so there's no eviction order.
+func (s *sizeLimitedCache) Keys() []string {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return sortedPaths(s.sizes)
+}
+
+func (s *sizeLimitedCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	size, present := s.sizes[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	s.cacheMu.Lock()
+	delete(s.sizes, flatPath)
+	s.byteCount -= size.physical
+	s.logicalBytes -= size.logical
+	s.usage.add(projectOf(path), -size.logical)
+	s.cacheMu.Unlock()
+
+	return nil
+}
+
+func (s *sizeLimitedCache) Clear() error {
+	s.keyLocks.lockAll()
+	defer s.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	s.cacheMu.Lock()
+	s.byteCount = 0
+	s.logicalBytes = 0
+	clear(s.sizes)
+	s.usage.reset()
+	s.cacheMu.Unlock()
+
+	return clearDir(s.ssdBasePath)
+}
+
+// Stats reports both the space taken up on disk, which is what the limit applies to, and the
+// length of the files.
+func (s *sizeLimitedCache) Stats() Stats {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	stats := Stats{
+		"size_entries":       int64(len(s.sizes)),
+		"size_bytes":         s.byteCount,
+		"size_bytes_logical": s.logicalBytes,
+	}
+	s.usage.addStats(stats)
+	return stats
+}
+
+func NewLRUCache(path string, capacity int, debug bool) (Cache, error) {
+	return NewHybridCache(path, capacity, 0, debug)
+}
+
+// NewByteLRUCache is an LRU cache limited by the bytes its files take up, however many there are.
+// Least recently used files are evicted until a new file fits, and files bigger than byteLimit are
+// refused.
+func NewByteLRUCache(path string, byteLimit int64, debug bool) (Cache, error) {
+	return NewHybridCache(path, 0, byteLimit, debug)
+}
+
+// NewHybridCache is an LRU cache limited by both the number of files and the bytes they take up.
+// Least recently used files are evicted until both limits hold. A capacity of 0 means no limit on
+// the number of files, a byteLimit of 0 means no byte limit (but not both, which is an error), and
+// files bigger than byteLimit are refused.
+func NewHybridCache(path string, capacity int, byteLimit int64, debug bool) (Cache, error) {
+	return newLRUCache(path, capacity, byteLimit, debug, lruPolicy{})
+}
+
+// newLRUCache is a hybrid cache that evicts files in the order policy keeps them in, rather than
+// least recently used first.
+func newLRUCache(path string, capacity int, byteLimit int64, debug bool, policy evictionPolicy) (Cache, error) {
+	if capacity == 0 && byteLimit == 0 {
+		return nil, errNoCapacity
+	}
+	lru := &lruCache{
+		ssdBasePath: path,
+		capacity:    capacity,
+		byteLimit:   byteLimit,
+		debug:       debug,
+		policy:      policy,
+
+		queue:   list.New(),
+		entries: make(map[string]*list.Element),
+		usage:   newProjectUsage(),
+	}
+	if err := lru.load(); err != nil {
+		log.Printf("WARNING: Failed to index existing files in %s: %v", path, err)
+	}
+	return lru, nil
+}
+
+type lruCache struct {
+	ssdBasePath string
+	capacity    int   // 0 for no limit
+	byteLimit   int64 // 0 for no limit
+	debug       bool
+	syncWrites  bool
+	policy      evictionPolicy // The order the queue is kept in, and evicted from
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	cacheMu   sync.Mutex               // Guards the bookkeeping below. Never held during disk I/O
+	queue     *list.List               // Of *lruEntry, least recently used at the front with the lru policy
+	entries   map[string]*list.Element // Key -> its place in the queue, for quick lookup and promotion
+	byteCount int64
+	usage     projectUsage // Bytes per project, for quotas
+	pins      Pins
+
+	evictedForCapacity, evictedForBytes, evictedForQuota atomic.Int64
+}
+
+type lruEntry struct {
+	key     string
+	size    int64
+	project string
+	pinned  bool // Never evicted
+}
+
+// SetQuotas evicts the project's own least recently used files when a Put takes it over its quota,
+// leaving other projects' files alone. Files bigger than their project's quota are refused.
+func (lru *lruCache) SetQuotas(quotas Quotas) {
+	lru.usage.quotas = quotas
+}
+
+// SetPins keeps files matching the pins from being evicted. They still count towards the limits,
+// so the other files are evicted to make room for them.
+func (lru *lruCache) SetPins(pins Pins) {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+	lru.pins = pins
+	lru.markPinned()
+}
+
+func (lru *lruCache) SetSyncWrites(enabled bool) {
+	lru.syncWrites = enabled
+}
+
+func (lru *lruCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	lru.cacheMu.Lock()
+	if !lru.touch(flatPath) {
+		lru.cacheMu.Unlock()
+		return nil, ErrNotFoundCache
+	}
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache updated, members: %v", lru.members())
+	}
+	lru.cacheMu.Unlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(lru.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		// An error other than "file not found" occurred when reading from SSD.
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// GetEntry is a read of the file, so it moves it up the LRU order like Get.
+func (lru *lruCache) GetEntry(path string) (Entry, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	lru.cacheMu.Lock()
+	present := lru.touch(flatPath)
+	lru.cacheMu.Unlock()
+	if !present {
+		return Entry{}, ErrNotFoundCache
+	}
+	return readEntry(cacheFileName(lru.ssdBasePath, flatPath), true)
+}
+
+// StatEntry, like Has, doesn't move the file up the LRU order.
+func (lru *lruCache) StatEntry(path string) (Entry, error) {
+	if !lru.Has(path) {
+		return Entry{}, ErrNotFoundCache
+	}
+	return readEntry(cacheFileName(lru.ssdBasePath, flattenDirPath(path)), false)
+}
+
+// Has doesn't move the file up the LRU order.
+func (lru *lruCache) Has(path string) bool {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+	_, present := lru.entries[flattenDirPath(path)]
+	return present
+}
+
+func (lru *lruCache) Put(path string, data []byte, mode os.FileMode) error {
+	_, err := lru.PutReader(path, bytes.NewReader(data), mode)
+	return err
+}
+
+func (lru *lruCache) GetReader(path string) (io.ReadSeekCloser, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	lru.cacheMu.Lock()
+	if !lru.touch(flatPath) {
+		lru.cacheMu.Unlock()
+		return nil, ErrNotFoundCache
+	}
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache updated, members: %v", lru.members())
+	}
+	lru.cacheMu.Unlock()
+
+	// If the file is evicted while open, the reader keeps working until it is closed.
+	f, err := os.Open(cacheFileName(lru.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (lru *lruCache) PutReader(path string, r io.Reader, mode os.FileMode) (int64, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	// Don't bother reading more than could possibly fit.
+	maxSize := lru.byteLimit
+	if quota, ok := lru.usage.quotas.limitFor(projectOf(path)); ok && (maxSize == 0 || quota < maxSize) {
+		maxSize = quota
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	fileName := cacheFileName(lru.ssdBasePath, flatPath)
+	written, err := writeFileFrom(fileName, r, mode, lru.syncWrites)
+	if err != nil {
+		keyLock.Unlock()
+		return written, err
+	}
+
+	if maxSize > 0 && written > maxSize {
+		defer keyLock.Unlock()
+		if lru.pins.match(path) {
+			log.Printf("ERROR: Pinned file '%s' (%d+ bytes) is bigger than the cache allows (%d bytes)", path, written, maxSize)
+		}
+		// The old file has been replaced already, so it's gone too.
+		if err := removeCacheFile(lru.ssdBasePath, fileName); err != nil {
+			log.Printf("ERROR: Failed to remove refused file %s: %v", fileName, err)
+		}
+		lru.cacheMu.Lock()
+		lru.remove(flatPath)
+		lru.cacheMu.Unlock()
+		return written, ErrWontCache
+	}
+
+	return written, lru.admit(flatPath, written, keyLock)
+}
+
+// index adds a file that is already in the cache directory (eg. written by a Redis cache just
+// before it lost Redis) as if it had just been put, evicting whatever no longer fits.
+func (lru *lruCache) index(path string, size int64) error {
+	flatPath := flattenDirPath(path)
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	return lru.admit(flatPath, size, keyLock)
+}
+
+// admit indexes the file just written for the key, and removes the files it evicts. Must be called
+// with the key's lock held, which it releases.
+func (lru *lruCache) admit(flatPath string, size int64, keyLock *sync.RWMutex) error {
+	lru.cacheMu.Lock()
+	// Promote or add the new path to the back of the lru
+	evicted := lru.promote(flatPath, size)
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache updated, members: %v", lru.members())
+	}
+	lru.cacheMu.Unlock()
+
+	// Let go of our own key before taking the evicted ones', so two Puts evicting each other's keys
+	// can't deadlock.
+	keyLock.Unlock()
+
+	refused := false
+	for _, entry := range evicted {
+		if entry.key == flatPath {
+			// Pinned files took up all the room, there's none for this one.
+			refused = lru.removeEvicted(entry.key)
+		} else if lru.removeEvicted(entry.key) {
+			lru.notifyEvicted(unflattenDirPath(entry.key), entry.size)
+		}
+	}
+	if refused {
+		return ErrWontCache
+	}
+	return nil
+}
+
+// Victim returns the file (that isn't pinned) which putting size bytes at path would evict first, eg.
+// the least recently used, or false if it would fit without evicting anything.
+func (lru *lruCache) Victim(path string, size int64) (string, bool) {
+	flatPath := flattenDirPath(path)
+
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+
+	count, byteCount := lru.queue.Len()+1, lru.byteCount+size
+	if el, ok := lru.entries[flatPath]; ok {
+		count--
+		byteCount -= el.Value.(*lruEntry).size
+	}
+	if (lru.capacity == 0 || count <= lru.capacity) && (lru.byteLimit == 0 || byteCount <= lru.byteLimit) {
+		return "", false
+	}
+
+	for el := range lru.policy.Victim(lru.queue) {
+		if entry := el.Value.(*lruEntry); !entry.pinned && entry.key != flatPath {
+			return unflattenDirPath(entry.key), true
+		}
+	}
+	return "", false
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime. It reports whether the key is still evicted.
+func (lru *lruCache) removeEvicted(flatPath string) bool {
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lru.cacheMu.Lock()
+	_, present := lru.entries[flatPath]
+	lru.cacheMu.Unlock()
+	if present {
+		return false
+	}
+
+	fileName := cacheFileName(lru.ssdBasePath, flatPath)
+	if err := removeCacheFile(lru.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the cache no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+// Dump reports the eviction order, eg. least recently used first, with the size and age of each
+// file.
+func (lru *lruCache) Dump(w io.Writer) {
+	lru.cacheMu.Lock()
+	var queue []string
+	pinned := make(map[string]bool)
+	for el := range lru.policy.Victim(lru.queue) {
+		entry := el.Value.(*lruEntry)
+		queue = append(queue, entry.key)
+		if entry.pinned {
+			pinned[entry.key] = true
+		}
+	}
+	byteCount := lru.byteCount
+	lru.cacheMu.Unlock()
+
+	if lru.capacity > 0 {
+		fmt.Fprintf(w, "entries: %d/%d (%s)\n", len(queue), lru.capacity, lru.policy.order())
+	} else {
+		fmt.Fprintf(w, "entries: %d (%s)\n", len(queue), lru.policy.order())
+	}
+	if lru.byteLimit > 0 {
+		fmt.Fprintf(w, "bytes: %d/%d\n", byteCount, lru.byteLimit)
+	}
+	if len(lru.pins) > 0 {
+		fmt.Fprintf(w, "pins: %s\n", strings.Join(lru.pins, ", "))
+	}
+	now := time.Now()
+	for _, flatPath := range queue {
+		fi, err := os.Stat(cacheFileName(lru.ssdBasePath, flatPath))
+		if err != nil {
+			fmt.Fprintf(w, "  %s error=%v\n", unflattenDirPath(flatPath), err)
+			continue
+		}
+		var flags string
+		if pinned[flatPath] {
+			flags = " pinned"
+		}
+		fmt.Fprintf(w, "  %s size=%d age=%s%s\n", unflattenDirPath(flatPath), fi.Size(), now.Sub(fi.ModTime()).Round(time.Second), flags)
+	}
+}
+
+func (lru *lruCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lru.cacheMu.Lock()
+	_, present := lru.entries[flatPath]
+	lru.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(lru.ssdBasePath, flatPath)
+	if err := removeCacheFile(lru.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	lru.cacheMu.Lock()
+	lru.remove(flatPath)
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache updated, members: %v", lru.members())
+	}
+	lru.cacheMu.Unlock()
+
+	return nil
+}
+
+// touch moves the key in the queue as its policy says a read should (eg. to the most recently used
+// position), reporting whether it is present.
+// Must be called with cacheMu held.
+func (lru *lruCache) touch(key string) bool {
+	el, ok := lru.entries[key]
+	if ok {
+		lru.policy.PromoteOnGet(lru.queue, el)
+	}
+	return ok
+}
+
+// promote updates the key in the queue
+// If the key is present in the queue, the policy moves it as it would for a read (eg. to the back,
+// the most recently used position).
+// If the key is not present in the queue, the policy adds it (eg. to the back).
+// Keys are then evicted in the policy's order (eg. least recently used first) until the queue is
+// within both its capacity and its byte limit, and returned. Pinned keys are skipped, so if they
+// take up all the room the key itself is evicted last.
+// Must be called with cacheMu held.
+func (lru *lruCache) promote(key string, size int64) []lruEntry {
+	project := projectOf(unflattenDirPath(key))
+	if el, ok := lru.entries[key]; ok {
+		entry := el.Value.(*lruEntry)
+		lru.byteCount += size - entry.size
+		lru.usage.add(project, size-entry.size)
+		entry.size = size
+		lru.policy.PromoteOnGet(lru.queue, el)
+	} else {
+		pinned := lru.pins.match(unflattenDirPath(key))
+		lru.entries[key] = lru.policy.InsertOrder(lru.queue, &lruEntry{key: key, size: size, project: project, pinned: pinned})
+		lru.byteCount += size
+		lru.usage.add(project, size)
+	}
+
+	var evicted []lruEntry
+	evict := func(evictee lruEntry) bool {
+		// Need to evict?
+		var reason string
+		if lru.capacity > 0 && lru.queue.Len() > lru.capacity {
+			lru.evictedForCapacity.Add(1)
+			reason = "capacity"
+		} else if lru.byteLimit > 0 && lru.byteCount > lru.byteLimit {
+			lru.evictedForBytes.Add(1)
+			reason = "byte limit"
+		} else {
+			return false
+		}
+
+		lru.remove(evictee.key)
+		evicted = append(evicted, evictee)
+		if lru.debug {
+			log.Printf("LRU_DEBUG: Evicted '%s' (over %s)", evictee.key, reason)
+		}
+		return true
+	}
+	for el := range lru.policy.Victim(lru.queue) {
+		if evictee := *el.Value.(*lruEntry); !evictee.pinned && evictee.key != key && !evict(evictee) {
+			break
+		}
+	}
+	if el, ok := lru.entries[key]; ok && !el.Value.(*lruEntry).pinned {
+		evict(*el.Value.(*lruEntry))
+	}
+
+	// Then the project's own files, until it is back within its quota.
+	for el := range lru.policy.Victim(lru.queue) {
+		if lru.usage.fits(project, 0) {
+			break
+		}
+		evictee := *el.Value.(*lruEntry)
+		if evictee.project != project || evictee.key == key || evictee.pinned {
+			continue
+		}
+
+		lru.evictedForQuota.Add(1)
+		lru.remove(evictee.key)
+		evicted = append(evicted, evictee)
+		if lru.debug {
+			log.Printf("LRU_DEBUG: Evicted '%s' (over quota for '%s')", evictee.key, project)
+		}
+	}
+	return evicted
+}
+
+// remove drops the key from the queue, if it is present.
+// Must be called with cacheMu held.
+func (lru *lruCache) remove(key string) {
+	if el, ok := lru.entries[key]; ok {
+		entry := lru.queue.Remove(el).(*lruEntry)
+		lru.byteCount -= entry.size
+		lru.usage.add(entry.project, -entry.size)
+		delete(lru.entries, key)
+	}
+}
+
+// members returns the keys in the queue, least recently used first.
+// Must be called with cacheMu held.
+func (lru *lruCache) members() []string {
+	keys := make([]string, 0, lru.queue.Len())
+	for el := lru.queue.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*lruEntry).key)
+	}
+	return keys
+}
+
+func (lru *lruCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lru.cacheMu.Lock()
+	_, present := lru.entries[flatPath]
+	lru.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(lru.ssdBasePath, flatPath, mode)
+}
+
+func (lru *lruCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := lru.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lru.cacheMu.Lock()
+	_, present := lru.entries[flatPath]
+	lru.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(lru.ssdBasePath, flatPath, before, dryRun)
+}
+
+func (lru *lruCache) Len() int {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+	return lru.queue.Len()
+}
+
+func (lru *lruCache) Bytes() int64 {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+	return lru.byteCount
+}
+
+// Keys returns the cached paths, least recently used (ie. next to be evicted) first.
+func (lru *lruCache) Keys() []string {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+
+	keys := lru.members()
+	for i, key := range keys {
+		keys[i] = unflattenDirPath(key)
+	}
+	return keys
+}
+
+func (lru *lruCache) Clear() error {
+	lru.keyLocks.lockAll()
+	defer lru.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	lru.cacheMu.Lock()
+	clear(lru.entries)
+	lru.queue.Init()
+	lru.byteCount = 0
+	lru.usage.reset()
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache updated, members: %v", lru.members())
+	}
+	lru.cacheMu.Unlock()
+
+	return clearDir(lru.ssdBasePath)
+}
+
+func (lru *lruCache) Stats() Stats {
+	lru.cacheMu.Lock()
+	defer lru.cacheMu.Unlock()
+	stats := Stats{
+		"lru_entries":          int64(lru.queue.Len()),
+		"lru_bytes":            lru.byteCount,
+		"lru_evicted_capacity": lru.evictedForCapacity.Load(),
+		"lru_evicted_bytes":    lru.evictedForBytes.Load(),
+		"lru_evicted_quota":    lru.evictedForQuota.Load(),
+	}
+	if len(lru.pins) > 0 {
+		var entries, bytes int64
+		for el := lru.queue.Front(); el != nil; el = el.Next() {
+			if entry := el.Value.(*lruEntry); entry.pinned {
+				entries++
+				bytes += entry.size
+			}
+		}
+		stats["lru_pinned_entries"] = entries
+		stats["lru_pinned_bytes"] = bytes
+	}
+	lru.usage.addStats(stats)
+	return stats
+}
@@ -0,0 +1,424 @@
+package cachefs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewARCCache caches up to capacity files with the Adaptive Replacement Cache policy. Files read
+// once live in T1, files read again are promoted to T2, and the split between the two adapts to the
+// workload: the keys of files evicted from each are remembered in ghost lists (B1 and B2, no data),
+// and a miss on a ghost grows the side it was evicted from. A scan then only churns T1, leaving the
+// files read repeatedly in T2, while a loop re-reading files soon after they leave T1 grows T1.
+func NewARCCache(ssdBasePath string, capacity int) (Cache, error) {
+	if capacity == 0 {
+		return nil, errNoCapacity
+	}
+	return &arcCache{
+		ssdBasePath: ssdBasePath,
+		capacity:    capacity,
+		t1:          list.New(),
+		t2:          list.New(),
+		b1:          list.New(),
+		b2:          list.New(),
+		entries:     make(map[string]*list.Element),
+	}, nil
+}
+
+type arcCache struct {
+	ssdBasePath string
+	capacity    int
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	// Guards the bookkeeping below. Never held during disk I/O. Every list holds *arcEntry, least
+	// recently used at the front.
+	cacheMu   sync.Mutex
+	t1, t2    *list.List               // Cached files, read once and read more than once
+	b1, b2    *list.List               // Ghosts of the files evicted from t1 and t2
+	entries   map[string]*list.Element // Key -> its place in whichever list it's in
+	p         int                      // Target size of t1
+	byteCount int64                    // Of the files in t1 and t2
+
+	evicted atomic.Int64
+}
+
+type arcEntry struct {
+	key  string
+	size int64
+	list *list.List
+}
+
+func (arc *arcCache) SetSyncWrites(enabled bool) {
+	arc.syncWrites = enabled
+}
+
+func (arc *arcCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	arc.cacheMu.Lock()
+	if !arc.hit(flatPath) {
+		arc.cacheMu.Unlock()
+		return nil, ErrNotFoundCache
+	}
+	arc.cacheMu.Unlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(arc.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// Has only reports cached files, not ghosts.
+func (arc *arcCache) Has(path string) bool {
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+	_, present := arc.cached(flattenDirPath(path))
+	return present
+}
+
+func (arc *arcCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(cacheFileName(arc.ssdBasePath, flatPath), data, mode, arc.syncWrites); err != nil {
+		keyLock.Unlock()
+		return err
+	}
+
+	arc.cacheMu.Lock()
+	evicted := arc.add(flatPath, int64(len(data)))
+	arc.cacheMu.Unlock()
+
+	// Let go of our own key before taking the evicted ones', so two Puts evicting each other's keys
+	// can't deadlock.
+	keyLock.Unlock()
+
+	for _, entry := range evicted {
+		if arc.removeEvicted(entry.key) {
+			arc.notifyEvicted(unflattenDirPath(entry.key), entry.size)
+		}
+	}
+	return nil
+}
+
+// cached returns the entry for the key, if its file is cached (ie. it isn't a ghost).
+// Must be called with cacheMu held.
+func (arc *arcCache) cached(key string) (*arcEntry, bool) {
+	el, ok := arc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*arcEntry)
+	if entry.list != arc.t1 && entry.list != arc.t2 {
+		return nil, false
+	}
+	return entry, true
+}
+
+// hit records a read of a cached key, promoting it to the most recently used end of t2. Reports
+// whether the key is cached.
+// Must be called with cacheMu held.
+func (arc *arcCache) hit(key string) bool {
+	if _, ok := arc.cached(key); !ok {
+		return false
+	}
+	arc.moveTo(key, arc.t2)
+	return true
+}
+
+// add caches the key, adapting the target size of t1 if it was a ghost. Files are evicted (into
+// the ghost lists) to make room, and returned.
+// Must be called with cacheMu held.
+func (arc *arcCache) add(key string, size int64) []arcEntry {
+	if entry, ok := arc.cached(key); ok {
+		arc.byteCount += size - entry.size
+		entry.size = size
+		arc.moveTo(key, arc.t2)
+		return nil
+	}
+
+	var evicted []arcEntry
+	var ghostOf *list.List
+	if el, ok := arc.entries[key]; ok {
+		ghostOf = el.Value.(*arcEntry).list
+	}
+
+	switch ghostOf {
+	case arc.b1:
+		// Evicted from t1 too soon, it should have more room.
+		arc.p = min(arc.capacity, arc.p+max(arc.b2.Len()/arc.b1.Len(), 1))
+		evicted = arc.makeRoom(false)
+		arc.moveTo(key, arc.t2)
+	case arc.b2:
+		// Evicted from t2 too soon, it should have more room.
+		arc.p = max(0, arc.p-max(arc.b1.Len()/arc.b2.Len(), 1))
+		evicted = arc.makeRoom(true)
+		arc.moveTo(key, arc.t2)
+	default:
+		evicted = arc.makeRoom(false)
+		// Keep the ghost lists to the capacity between them.
+		if arc.b1.Len() > arc.capacity-arc.p {
+			arc.drop(arc.b1.Front())
+		}
+		if arc.b2.Len() > arc.p {
+			arc.drop(arc.b2.Front())
+		}
+		arc.entries[key] = arc.t1.PushBack(&arcEntry{key: key, list: arc.t1})
+	}
+
+	entry := arc.entries[key].Value.(*arcEntry)
+	entry.size = size
+	arc.byteCount += size
+	return evicted
+}
+
+// makeRoom evicts a file into its ghost list if the cache is full: the least recently used of t1
+// if t1 is over its target size, otherwise the least recently used of t2. inB2 is whether the key
+// being added is a ghost in b2, which tips an exact tie towards t1.
+// Must be called with cacheMu held.
+func (arc *arcCache) makeRoom(inB2 bool) []arcEntry {
+	if arc.t1.Len()+arc.t2.Len() < arc.capacity {
+		return nil
+	}
+
+	from, to := arc.t2, arc.b2
+	if t1Len := arc.t1.Len(); t1Len > 0 && (t1Len > arc.p || (t1Len == arc.p && inB2) || arc.t2.Len() == 0) {
+		from, to = arc.t1, arc.b1
+	}
+
+	entry := from.Front().Value.(*arcEntry)
+	evicted := *entry
+	arc.moveTo(entry.key, to)
+	arc.byteCount -= entry.size
+	entry.size = 0
+	arc.evicted.Add(1)
+	return []arcEntry{evicted}
+}
+
+// moveTo moves the key to the most recently used end of the list.
+// Must be called with cacheMu held.
+func (arc *arcCache) moveTo(key string, to *list.List) {
+	el := arc.entries[key]
+	entry := el.Value.(*arcEntry)
+	if entry.list == to {
+		to.MoveToBack(el)
+		return
+	}
+	entry.list.Remove(el)
+	entry.list = to
+	arc.entries[key] = to.PushBack(entry)
+}
+
+// drop forgets the key in the element entirely, cached or not.
+// Must be called with cacheMu held.
+func (arc *arcCache) drop(el *list.Element) {
+	if el == nil {
+		return
+	}
+	entry := el.Value.(*arcEntry)
+	entry.list.Remove(el)
+	delete(arc.entries, entry.key)
+	arc.byteCount -= entry.size
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime. It reports whether the key is still evicted.
+func (arc *arcCache) removeEvicted(flatPath string) bool {
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	arc.cacheMu.Lock()
+	_, present := arc.cached(flatPath)
+	arc.cacheMu.Unlock()
+	if present {
+		return false
+	}
+
+	fileName := cacheFileName(arc.ssdBasePath, flatPath)
+	if err := removeCacheFile(arc.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the cache no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+// Delete removes the file, and forgets its ghost too, as it's been invalidated rather than evicted.
+func (arc *arcCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	arc.cacheMu.Lock()
+	_, present := arc.cached(flatPath)
+	if !present {
+		arc.drop(arc.entries[flatPath])
+	}
+	arc.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(arc.ssdBasePath, flatPath)
+	if err := removeCacheFile(arc.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	arc.cacheMu.Lock()
+	arc.drop(arc.entries[flatPath])
+	arc.cacheMu.Unlock()
+
+	return nil
+}
+
+func (arc *arcCache) Clear() error {
+	arc.keyLocks.lockAll()
+	defer arc.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	arc.cacheMu.Lock()
+	for _, l := range []*list.List{arc.t1, arc.t2, arc.b1, arc.b2} {
+		l.Init()
+	}
+	clear(arc.entries)
+	arc.p = 0
+	arc.byteCount = 0
+	arc.cacheMu.Unlock()
+
+	return clearDir(arc.ssdBasePath)
+}
+
+// Victim returns the file that putting a new file would evict, or false if there's room for it.
+func (arc *arcCache) Victim(path string, size int64) (string, bool) {
+	flatPath := flattenDirPath(path)
+
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+
+	if _, ok := arc.cached(flatPath); ok || arc.t1.Len()+arc.t2.Len() < arc.capacity {
+		return "", false
+	}
+	from := arc.t2
+	if t1Len := arc.t1.Len(); t1Len > 0 && (t1Len > arc.p || arc.t2.Len() == 0) {
+		from = arc.t1
+	}
+	return unflattenDirPath(from.Front().Value.(*arcEntry).key), true
+}
+
+func (arc *arcCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	arc.cacheMu.Lock()
+	_, present := arc.cached(flatPath)
+	arc.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(arc.ssdBasePath, flatPath, mode)
+}
+
+func (arc *arcCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := arc.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	arc.cacheMu.Lock()
+	_, present := arc.cached(flatPath)
+	arc.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(arc.ssdBasePath, flatPath, before, dryRun)
+}
+
+// arcKeys returns the keys in the list, least recently used first.
+// Must be called with cacheMu held.
+func arcKeys(l *list.List) []string {
+	keys := make([]string, 0, l.Len())
+	for el := l.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*arcEntry).key)
+	}
+	return keys
+}
+
+func (arc *arcCache) Len() int {
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+	return arc.t1.Len() + arc.t2.Len()
+}
+
+func (arc *arcCache) Bytes() int64 {
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+	return arc.byteCount
+}
+
+// Keys returns the cached paths, those read once (t1) before those read more than once (t2), least
+// recently used first within each.
+func (arc *arcCache) Keys() []string {
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+
+	keys := append(arcKeys(arc.t1), arcKeys(arc.t2)...)
+	for i, key := range keys {
+		keys[i] = unflattenDirPath(key)
+	}
+	return keys
+}
+
+// Dump reports the four lists, least recently used first, and the target size of t1.
+func (arc *arcCache) Dump(w io.Writer) {
+	arc.cacheMu.Lock()
+	lists := [][]string{arcKeys(arc.t1), arcKeys(arc.t2), arcKeys(arc.b1), arcKeys(arc.b2)}
+	p := arc.p
+	arc.cacheMu.Unlock()
+
+	fmt.Fprintf(w, "entries: %d/%d, t1 target: %d (least recently used first)\n", len(lists[0])+len(lists[1]), arc.capacity, p)
+	for i, name := range []string{"t1", "t2", "b1 (ghosts)", "b2 (ghosts)"} {
+		fmt.Fprintf(w, "%s:\n", name)
+		for _, key := range lists[i] {
+			fmt.Fprintf(w, "  %s\n", unflattenDirPath(key))
+		}
+	}
+}
+
+func (arc *arcCache) Stats() Stats {
+	arc.cacheMu.Lock()
+	defer arc.cacheMu.Unlock()
+	return Stats{
+		"arc_t1_entries": int64(arc.t1.Len()),
+		"arc_t2_entries": int64(arc.t2.Len()),
+		"arc_b1_entries": int64(arc.b1.Len()),
+		"arc_b2_entries": int64(arc.b2.Len()),
+		"arc_t1_target":  int64(arc.p),
+		"arc_bytes":      arc.byteCount,
+		"arc_evicted":    arc.evicted.Load(),
+	}
+}
@@ -0,0 +1,80 @@
+package cachefs
+
+import (
+	"fmt"
+	"testing"
+)
+
+// loopTrace reads n files in order, round and round, rounds times.
+func loopTrace(n, rounds int) []string {
+	var trace []string
+	for range rounds {
+		for i := range n {
+			trace = append(trace, fmt.Sprintf("loop/%d", i))
+		}
+	}
+	return trace
+}
+
+func TestARCScanKeepsFrequentFiles(t *testing.T) {
+	workingSet := []string{"lib/a.py", "lib/b.py"}
+	var scan []string
+	for i := range 20 {
+		scan = append(scan, fmt.Sprintf("scan/%d", i))
+	}
+
+	for name, newCache := range map[string]func(dir string) Cache{
+		"lru": func(dir string) Cache { return must(NewLRUCache(dir, 4, false)) },
+		"arc": func(dir string) Cache { return must(NewARCCache(dir, 4)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+			replay(t, cache, append(workingSet, workingSet...))
+			replay(t, cache, scan)
+
+			hits := replay(t, cache, workingSet)
+			if kept := hits == len(workingSet); kept != (name == "arc") {
+				t.Errorf("%d of %d frequently read files survived the scan", hits, len(workingSet))
+			}
+		})
+	}
+}
+
+func TestARCAdaptsToLoop(t *testing.T) {
+	// A loop one file bigger than the cache never hits with LRU: each file is evicted just before
+	// it's read again.
+	if hits := replay(t, must(NewLRUCache(t.TempDir(), 4, false)), loopTrace(5, 10)); hits != 0 {
+		t.Fatalf("LRU hit %d times on a loop, want 0", hits)
+	}
+	cache := must(NewARCCache(t.TempDir(), 4)).(*arcCache)
+	if hits := replay(t, cache, loopTrace(5, 10)); hits == 0 {
+		t.Error("ARC never hit on the loop")
+	}
+	if cached := cache.Len(); cached > 4 {
+		t.Errorf("%d files cached, capacity is 4", cached)
+	}
+}
+
+func TestARCTargetSize(t *testing.T) {
+	cache := must(NewARCCache(t.TempDir(), 4)).(*arcCache)
+	target := func() int {
+		cache.cacheMu.Lock()
+		defer cache.cacheMu.Unlock()
+		return cache.p
+	}
+
+	// The first round of a loop leaves loop/0 in b1, and reading it again grows t1's target.
+	replay(t, cache, loopTrace(5, 1))
+	replay(t, cache, []string{"loop/0"})
+	if got := target(); got != 1 {
+		t.Fatalf("t1's target = %d after a b1 ghost came back, want 1", got)
+	}
+
+	// Reading the rest of t1 again moves it all to t2, so the next new file evicts loop/0 from t2
+	// into b2. Reading it again shrinks t1's target.
+	replay(t, cache, []string{"loop/2", "loop/3", "loop/4", "new"})
+	replay(t, cache, []string{"loop/0"})
+	if got := target(); got != 0 {
+		t.Errorf("t1's target = %d after a b2 ghost came back, want 0", got)
+	}
+}
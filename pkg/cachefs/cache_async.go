@@ -0,0 +1,195 @@
+package cachefs
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// NewAsyncCache wraps a cache so that Puts happen in the background on a pool of workers, rather
+// than holding up the read that fetched the file. At most queueSize writes wait at any time, and
+// when the queue is full Put either blocks until there is space or drops the write (returning
+// ErrWontCache), depending on blockWhenFull. Repeated Puts of a path that is still queued only
+// write the latest data.
+// Close must be called to write anything still queued.
+func NewAsyncCache(inner Cache, workers, queueSize int, blockWhenFull bool) Cache {
+	a := &asyncCache{
+		Cache:         inner,
+		blockWhenFull: blockWhenFull,
+		queue:         make(chan string, queueSize),
+		pending:       make(map[string]asyncWrite),
+	}
+
+	a.workers.Add(workers)
+	for range workers {
+		go a.work()
+	}
+
+	return a
+}
+
+type asyncWrite struct {
+	data []byte
+	mode os.FileMode
+}
+
+type asyncCache struct {
+	Cache
+	blockWhenFull bool
+
+	closeMu sync.RWMutex // Held for writing when closing the queue, so no Put sends on a closed queue
+	closed  bool
+	queue   chan string // Paths waiting to be written, data is kept in pending
+
+	pendingMu sync.Mutex
+	pending   map[string]asyncWrite
+
+	clearMu sync.RWMutex // Held for reading by a worker while it writes, and for writing by Clear
+
+	workers sync.WaitGroup
+
+	queued, deduped, dropped, failed atomic.Int64
+}
+
+func (a *asyncCache) Unwrap() Cache {
+	return a.Cache
+}
+
+// Get returns data that is still waiting to be written, otherwise it reads from the wrapped cache.
+func (a *asyncCache) Get(path string) ([]byte, error) {
+	a.pendingMu.Lock()
+	put, ok := a.pending[path]
+	a.pendingMu.Unlock()
+	if ok {
+		return put.data, nil
+	}
+
+	return a.Cache.Get(path)
+}
+
+// Has reports writes that are still waiting as cached.
+func (a *asyncCache) Has(path string) bool {
+	a.pendingMu.Lock()
+	_, ok := a.pending[path]
+	a.pendingMu.Unlock()
+	return ok || a.Cache.Has(path)
+}
+
+// Put queues the data to be written to the wrapped cache. A nil error means the write was queued,
+// not that it has happened.
+func (a *asyncCache) Put(path string, data []byte, mode os.FileMode) error {
+	a.closeMu.RLock()
+	defer a.closeMu.RUnlock()
+	if a.closed {
+		return ErrWontCache
+	}
+
+	a.pendingMu.Lock()
+	_, alreadyQueued := a.pending[path]
+	a.pending[path] = asyncWrite{data: data, mode: mode}
+	a.pendingMu.Unlock()
+
+	if alreadyQueued {
+		// The queued write will pick up the new data.
+		a.deduped.Add(1)
+		return nil
+	}
+
+	if a.blockWhenFull {
+		a.queue <- path
+	} else {
+		select {
+		case a.queue <- path:
+		default:
+			a.pendingMu.Lock()
+			delete(a.pending, path)
+			a.pendingMu.Unlock()
+			a.dropped.Add(1)
+			return ErrWontCache
+		}
+	}
+
+	a.queued.Add(1)
+	return nil
+}
+
+func (a *asyncCache) Delete(path string) error {
+	a.pendingMu.Lock()
+	delete(a.pending, path)
+	a.pendingMu.Unlock()
+
+	return a.Cache.Delete(path)
+}
+
+// Clear drops every write still waiting in the queue, waits for writes already being made by a
+// worker, and clears the wrapped cache.
+func (a *asyncCache) Clear() error {
+	a.clearMu.Lock()
+	defer a.clearMu.Unlock()
+
+	a.pendingMu.Lock()
+	clear(a.pending)
+	a.pendingMu.Unlock()
+
+	return a.Cache.Clear()
+}
+
+// Close stops accepting Puts and waits for everything already queued to be written.
+func (a *asyncCache) Close() error {
+	a.closeMu.Lock()
+	if a.closed {
+		a.closeMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.closeMu.Unlock()
+
+	a.workers.Wait()
+
+	if closer, ok := findCache[io.Closer](a.Cache); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (a *asyncCache) Stats() Stats {
+	stats := statsOf(a.Cache)
+	stats["async_queued"] = a.queued.Load()
+	stats["async_deduped"] = a.deduped.Load()
+	stats["async_dropped"] = a.dropped.Load()
+	stats["async_failed"] = a.failed.Load()
+	return stats
+}
+
+func (a *asyncCache) work() {
+	defer a.workers.Done()
+
+	for path := range a.queue {
+		a.write(path)
+	}
+}
+
+func (a *asyncCache) write(path string) {
+	a.clearMu.RLock()
+	defer a.clearMu.RUnlock()
+
+	a.pendingMu.Lock()
+	put, ok := a.pending[path]
+	delete(a.pending, path)
+	a.pendingMu.Unlock()
+	if !ok {
+		return // Deleted (or cleared) while queued
+	}
+
+	if err := a.Cache.Put(path, put.data, put.mode); err == ErrWontCache {
+		log.Printf("WARNING: Cache refuse to write file: '%v'", err)
+	} else if err != nil {
+		a.failed.Add(1)
+		log.Printf("ERROR: Failed to write to cache %s: %v", path, err)
+	} else {
+		log.Printf("CACHE_LOADED: Wrote '%s' to cache in the background", path)
+	}
+}
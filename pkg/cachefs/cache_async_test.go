@@ -0,0 +1,111 @@
+package cachefs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gatedCache holds every Put until the gate is opened.
+type gatedCache struct {
+	Cache
+	gate chan struct{}
+}
+
+func (g *gatedCache) Put(path string, data []byte, mode os.FileMode) error {
+	<-g.gate
+	return g.Cache.Put(path, data, mode)
+}
+
+func TestAsyncCacheReadDoesNotWaitForPut(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	inner := &gatedCache{Cache: NewDefaultCache(ssdDir), gate: make(chan struct{})}
+	cache := NewAsyncCache(inner, 1, 8, false)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache})
+
+	if got, err := lookup(t, rfs, "a.txt").data(context.Background()); err != nil || string(got) != "a" {
+		t.Fatalf("read = %q, %v", got, err)
+	}
+	cacheFile := filepath.Join(ssdDir, "a.txt")
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Fatalf("cache file exists before the write was let through: %v", err)
+	}
+
+	close(inner.gate)
+	if err := cache.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(cacheFile); err != nil || string(got) != "a" {
+		t.Errorf("cache file = %q, %v after the queue drained", got, err)
+	}
+	if got := statsOf(cache)["async_queued"]; got != 1 {
+		t.Errorf("async_queued = %d, want 1", got)
+	}
+}
+
+func TestAsyncCacheDropsWhenFull(t *testing.T) {
+	inner := &gatedCache{Cache: NewDefaultCache(t.TempDir()), gate: make(chan struct{})}
+	cache := NewAsyncCache(inner, 1, 1, false)
+	defer func() {
+		close(inner.gate)
+		cache.(io.Closer).Close()
+	}()
+
+	// The worker takes the first and waits at the gate, the second fills the queue.
+	if err := cache.Put("a", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for _, path := range []string{"b", "c", "d"} {
+		if err = cache.Put(path, []byte(path), 0o644); err == ErrWontCache {
+			break
+		}
+	}
+	if err != ErrWontCache {
+		t.Fatalf("Put into a full queue = %v, want %v", err, ErrWontCache)
+	}
+	if got := statsOf(cache)["async_dropped"]; got != 1 {
+		t.Errorf("async_dropped = %d, want 1", got)
+	}
+}
+
+func TestAsyncCacheClearWaitsForWritesInProgress(t *testing.T) {
+	inner := &gatedCache{Cache: NewDefaultCache(t.TempDir()), gate: make(chan struct{})}
+	cache := NewAsyncCache(inner, 1, 8, false)
+	defer cache.(io.Closer).Close()
+	if err := cache.Put("a", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the worker to take the write, which then waits at the gate.
+	a := cache.(*asyncCache)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		a.pendingMu.Lock()
+		taken := len(a.pending) == 0
+		a.pendingMu.Unlock()
+		if taken {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the worker never took the write")
+		}
+	}
+
+	cleared := make(chan error)
+	go func() { cleared <- cache.Clear() }()
+	select {
+	case err := <-cleared:
+		t.Fatalf("Clear = %v before the write in progress finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(inner.gate)
+	if err := <-cleared; err != nil {
+		t.Fatal(err)
+	}
+	// The write landed before the Clear, rather than surviving it.
+	if got, err := inner.Get("a"); err != ErrNotFoundCache {
+		t.Errorf("Get after Clear = %q, %v, want %v", got, err, ErrNotFoundCache)
+	}
+}
@@ -0,0 +1,60 @@
+package cachefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// NewChecksumCache wraps a cache, storing a SHA-256 checksum as a header on every entry and
+// verifying it on Get. Corrupt entries are deleted and reported as not found, so the caller falls
+// back to NFS and re-caches the file.
+func NewChecksumCache(inner Cache) Cache {
+	return &checksumCache{Cache: inner}
+}
+
+type checksumCache struct {
+	Cache
+
+	verified, corrupt atomic.Int64
+}
+
+func (c *checksumCache) Unwrap() Cache {
+	return c.Cache
+}
+
+func (c *checksumCache) Get(path string) ([]byte, error) {
+	cachedData, err := c.Cache.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cachedData) >= sha256.Size {
+		sum, data := cachedData[:sha256.Size], cachedData[sha256.Size:]
+		if expected := sha256.Sum256(data); bytes.Equal(sum, expected[:]) {
+			c.verified.Add(1)
+			return data, nil
+		}
+	}
+
+	c.corrupt.Add(1)
+	log.Printf("CACHE_CORRUPT: Checksum mismatch for '%s', removing it from the cache", path)
+	if err := c.Cache.Delete(path); err != nil {
+		log.Printf("ERROR: Failed to remove corrupt cache entry %s: %v", path, err)
+	}
+	return nil, ErrNotFoundCache
+}
+
+func (c *checksumCache) Put(path string, data []byte, mode os.FileMode) error {
+	sum := sha256.Sum256(data)
+	return c.Cache.Put(path, append(sum[:], data...), mode)
+}
+
+func (c *checksumCache) Stats() Stats {
+	stats := statsOf(c.Cache)
+	stats["checksum_verified"] = c.verified.Load()
+	stats["checksum_corrupt"] = c.corrupt.Load()
+	return stats
+}
@@ -0,0 +1,48 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumCacheRefetchesCorruptFile(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	want := []byte("the real contents")
+	writeTestFile(t, nfsDir, "dir/a.txt", want)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: NewChecksumCache(NewDefaultCache(ssdDir))})
+	n := lookup(t, rfs, "dir/a.txt")
+
+	if _, err := n.data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the contents on SSD, after the checksum.
+	cacheFile := filepath.Join(ssdDir, "dir/a.txt")
+	cached, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached[len(cached)-1] ^= 0xff
+	if err := os.WriteFile(cacheFile, cached, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := n.data(context.Background()); err != nil || string(got) != string(want) {
+		t.Fatalf("read of the corrupt file = %q, %v, want %q from NFS", got, err, want)
+	}
+	stats := rfs.Stats()
+	if stats["checksum_corrupt"] != 1 {
+		t.Errorf("checksum_corrupt = %d, want 1", stats["checksum_corrupt"])
+	}
+
+	// It was cached again, intact.
+	if got, err := n.data(context.Background()); err != nil || string(got) != string(want) {
+		t.Fatalf("read after re-fetching = %q, %v, want %q", got, err, want)
+	}
+	if stats := rfs.Stats(); stats["checksum_verified"] != 1 || stats["cache_hits"] != 1 {
+		t.Errorf("checksum_verified = %d, cache_hits = %d, want the re-cached file hit and verified",
+			stats["checksum_verified"], stats["cache_hits"])
+	}
+}
@@ -0,0 +1,389 @@
+package cachefs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewClockCache approximates an LRU cache without reordering anything on Get: a hit only sets the
+// file's reference bit, without taking the cache's lock. To make room, a hand sweeps the files in
+// the order they were added, clearing set bits (a second chance) and evicting the first file whose
+// bit was already clear. It is limited by the number of files, the bytes they take up, or both. A
+// limit of 0 means none (but not both, which is an error), and files bigger than byteLimit are
+// refused.
+func NewClockCache(ssdBasePath string, capacity int, byteLimit int64) (Cache, error) {
+	if capacity == 0 && byteLimit == 0 {
+		return nil, errNoCapacity
+	}
+	return &clockCache{
+		ssdBasePath: ssdBasePath,
+		capacity:    capacity,
+		byteLimit:   byteLimit,
+		ring:        list.New(),
+	}, nil
+}
+
+type clockCache struct {
+	ssdBasePath string
+	capacity    int   // 0 for no limit
+	byteLimit   int64 // 0 for no limit
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	// Key -> *clockEntry. Read by Get without cacheMu, only changed with it held.
+	entries sync.Map
+
+	cacheMu   sync.Mutex    // Guards the bookkeeping below. Never held during disk I/O
+	ring      *list.List    // Of *clockEntry, in the order the hand sweeps them (wrapping around)
+	hand      *list.Element // Next to be considered for eviction, nil for the front
+	byteCount int64
+
+	evicted, secondChances atomic.Int64
+}
+
+type clockEntry struct {
+	key        string
+	size       int64
+	referenced atomic.Bool // Read since the hand last passed
+	el         *list.Element
+}
+
+func (c *clockCache) SetSyncWrites(enabled bool) {
+	c.syncWrites = enabled
+}
+
+func (c *clockCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	entry, ok := c.entries.Load(flatPath)
+	if !ok {
+		return nil, ErrNotFoundCache
+	}
+	entry.(*clockEntry).referenced.Store(true)
+
+	cachedData, err := os.ReadFile(cacheFileName(c.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// Has doesn't set the file's reference bit.
+func (c *clockCache) Has(path string) bool {
+	_, present := c.entries.Load(flattenDirPath(path))
+	return present
+}
+
+func (c *clockCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	fileName := cacheFileName(c.ssdBasePath, flatPath)
+	if c.byteLimit > 0 && int64(len(data)) > c.byteLimit {
+		defer keyLock.Unlock()
+		// Whatever was cached before is out of date, so it can't stay either.
+		c.cacheMu.Lock()
+		c.remove(flatPath)
+		c.cacheMu.Unlock()
+		if err := removeCacheFile(c.ssdBasePath, fileName); err != nil {
+			log.Printf("ERROR: Failed to remove refused file %s: %v", fileName, err)
+		}
+		return ErrWontCache
+	}
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(fileName, data, mode, c.syncWrites); err != nil {
+		keyLock.Unlock()
+		return err
+	}
+
+	c.cacheMu.Lock()
+	evicted := c.add(flatPath, int64(len(data)))
+	c.cacheMu.Unlock()
+
+	// Let go of our own key before taking the evicted ones', so two Puts evicting each other's keys
+	// can't deadlock.
+	keyLock.Unlock()
+
+	for _, entry := range evicted {
+		if c.removeEvicted(entry.key) {
+			c.notifyEvicted(unflattenDirPath(entry.key), entry.size)
+		}
+	}
+	return nil
+}
+
+// full reports whether the cache is over either of its limits.
+// Must be called with cacheMu held.
+func (c *clockCache) full() bool {
+	return (c.capacity > 0 && c.ring.Len() > c.capacity) || (c.byteLimit > 0 && c.byteCount > c.byteLimit)
+}
+
+// add adds the key just behind the hand, so it's the last the hand reaches, or updates its size if
+// it's already cached. The hand then sweeps until the cache is within its limits, and the evicted
+// entries are returned. The key itself is never evicted, or a new file would be the first to go
+// whenever the other files had been read.
+// Must be called with cacheMu held.
+func (c *clockCache) add(key string, size int64) []*clockEntry {
+	if value, ok := c.entries.Load(key); ok {
+		entry := value.(*clockEntry)
+		c.byteCount += size - entry.size
+		entry.size = size
+		entry.referenced.Store(true)
+	} else {
+		entry := &clockEntry{key: key, size: size}
+		if c.hand != nil {
+			entry.el = c.ring.InsertBefore(entry, c.hand)
+		} else {
+			entry.el = c.ring.PushBack(entry)
+		}
+		c.entries.Store(key, entry)
+		c.byteCount += size
+	}
+
+	// Every bit is cleared in the first sweep, so this stops by the end of the second.
+	var evicted []*clockEntry
+	for c.full() && c.ring.Len() > 1 {
+		el := c.hand
+		if el == nil {
+			el = c.ring.Front()
+		}
+		c.hand = el.Next()
+
+		entry := el.Value.(*clockEntry)
+		if entry.key == key {
+			continue
+		}
+		if entry.referenced.Swap(false) {
+			c.secondChances.Add(1)
+			continue
+		}
+		c.remove(entry.key)
+		c.evicted.Add(1)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// remove drops the key, if it is present, moving the hand past it.
+// Must be called with cacheMu held.
+func (c *clockCache) remove(key string) {
+	value, ok := c.entries.LoadAndDelete(key)
+	if !ok {
+		return
+	}
+	entry := value.(*clockEntry)
+	if c.hand == entry.el {
+		c.hand = entry.el.Next()
+	}
+	c.ring.Remove(entry.el)
+	c.byteCount -= entry.size
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime. It reports whether the key is still evicted.
+func (c *clockCache) removeEvicted(flatPath string) bool {
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if _, present := c.entries.Load(flatPath); present {
+		return false
+	}
+
+	fileName := cacheFileName(c.ssdBasePath, flatPath)
+	if err := removeCacheFile(c.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the cache no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+func (c *clockCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if _, present := c.entries.Load(flatPath); !present {
+		return nil
+	}
+
+	fileName := cacheFileName(c.ssdBasePath, flatPath)
+	if err := removeCacheFile(c.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	c.cacheMu.Lock()
+	c.remove(flatPath)
+	c.cacheMu.Unlock()
+
+	return nil
+}
+
+func (c *clockCache) Clear() error {
+	c.keyLocks.lockAll()
+	defer c.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	c.cacheMu.Lock()
+	c.entries.Clear()
+	c.ring.Init()
+	c.hand = nil
+	c.byteCount = 0
+	c.cacheMu.Unlock()
+
+	return clearDir(c.ssdBasePath)
+}
+
+// Victim returns the file the hand would evict first to put size bytes at path, or false if they
+// would fit without evicting anything. Reference bits are left as they are.
+func (c *clockCache) Victim(path string, size int64) (string, bool) {
+	flatPath := flattenDirPath(path)
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	count, byteCount := c.ring.Len()+1, c.byteCount+size
+	if value, ok := c.entries.Load(flatPath); ok {
+		count--
+		byteCount -= value.(*clockEntry).size
+	}
+	if (c.capacity == 0 || count <= c.capacity) && (c.byteLimit == 0 || byteCount <= c.byteLimit) {
+		return "", false
+	}
+
+	// The first file without its bit set, or if they all have it, the hand's once it comes back round.
+	var first string
+	for _, key := range c.sweepOrder() {
+		if key == flatPath {
+			continue
+		}
+		if first == "" {
+			first = key
+		}
+		if value, ok := c.entries.Load(key); ok && !value.(*clockEntry).referenced.Load() {
+			return unflattenDirPath(key), true
+		}
+	}
+	if first == "" {
+		return "", false
+	}
+	return unflattenDirPath(first), true
+}
+
+func (c *clockCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if _, present := c.entries.Load(flatPath); !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(c.ssdBasePath, flatPath, mode)
+}
+
+func (c *clockCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := c.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if _, present := c.entries.Load(flatPath); present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(c.ssdBasePath, flatPath, before, dryRun)
+}
+
+// sweepOrder returns the keys in the order the hand will reach them.
+// Must be called with cacheMu held.
+func (c *clockCache) sweepOrder() []string {
+	keys := make([]string, 0, c.ring.Len())
+	start := c.hand
+	if start == nil {
+		start = c.ring.Front()
+	}
+	for el := start; el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*clockEntry).key)
+	}
+	for el := c.ring.Front(); el != start; el = el.Next() {
+		keys = append(keys, el.Value.(*clockEntry).key)
+	}
+	return keys
+}
+
+func (c *clockCache) Len() int {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	return c.ring.Len()
+}
+
+func (c *clockCache) Bytes() int64 {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	return c.byteCount
+}
+
+// Keys returns the cached paths in the order the hand will reach them.
+func (c *clockCache) Keys() []string {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	keys := c.sweepOrder()
+	for i, key := range keys {
+		keys[i] = unflattenDirPath(key)
+	}
+	return keys
+}
+
+// Dump reports the files in the order the hand will reach them, with the size and reference bit of
+// each.
+func (c *clockCache) Dump(w io.Writer) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if c.capacity > 0 {
+		fmt.Fprintf(w, "entries: %d/%d (from the hand)\n", c.ring.Len(), c.capacity)
+	} else {
+		fmt.Fprintf(w, "entries: %d (from the hand)\n", c.ring.Len())
+	}
+	if c.byteLimit > 0 {
+		fmt.Fprintf(w, "bytes: %d/%d\n", c.byteCount, c.byteLimit)
+	}
+	for _, key := range c.sweepOrder() {
+		value, _ := c.entries.Load(key)
+		entry := value.(*clockEntry)
+		fmt.Fprintf(w, "  %s size=%d referenced=%t\n", unflattenDirPath(key), entry.size, entry.referenced.Load())
+	}
+}
+
+func (c *clockCache) Stats() Stats {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	return Stats{
+		"clock_entries":        int64(c.ring.Len()),
+		"clock_bytes":          c.byteCount,
+		"clock_evicted":        c.evicted.Load(),
+		"clock_second_chances": c.secondChances.Load(),
+	}
+}
@@ -0,0 +1,46 @@
+package cachefs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestClockCacheGivesReadFilesASecondChance(t *testing.T) {
+	cache := must(NewClockCache(t.TempDir(), 3, 0))
+	for _, path := range []string{"a", "b", "c"} {
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hand passes over a, clearing its bit, and evicts b.
+	if err := cache.Put("d", []byte("d"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys := cache.(Inspector).Keys()
+	slices.Sort(keys)
+	if want := []string{"a", "c", "d"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys = %q, want %q", keys, want)
+	}
+	if stats := statsOf(cache); stats["clock_evicted"] != 1 || stats["clock_second_chances"] != 1 {
+		t.Errorf("evicted %d with %d second chances, want 1 and 1", stats["clock_evicted"], stats["clock_second_chances"])
+	}
+}
+
+func TestClockCacheByteLimit(t *testing.T) {
+	cache := must(NewClockCache(t.TempDir(), 0, 10))
+	for _, path := range []string{"a", "b", "c"} {
+		if err := cache.Put(path, make([]byte, 4), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := cache.(Inspector).Bytes(); got > 10 {
+		t.Errorf("holds %d bytes, limit is 10", got)
+	}
+	if err := cache.Put("big", make([]byte, 11), 0o644); err != ErrWontCache {
+		t.Errorf("Put over the byte limit = %v, want %v", err, ErrWontCache)
+	}
+}
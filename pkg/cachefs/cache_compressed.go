@@ -0,0 +1,66 @@
+package cachefs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+)
+
+// compressedMagic marks a cache entry as gzip-compressed. Entries without it were written before
+// compression was enabled, and are returned as-is.
+var compressedMagic = []byte("FCGZ\x00\x01")
+
+// NewCompressedCache wraps a cache, gzip-compressing every entry before it is written to the inner
+// cache and decompressing it on Get. The inner cache only ever sees the compressed bytes, so size
+// limits apply to the space the entry takes on SSD.
+func NewCompressedCache(inner Cache) Cache {
+	return &compressedCache{Cache: inner}
+}
+
+type compressedCache struct {
+	Cache
+}
+
+func (c *compressedCache) Unwrap() Cache {
+	return c.Cache
+}
+
+func (c *compressedCache) Get(path string) ([]byte, error) {
+	cachedData, err := c.Cache.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(cachedData, compressedMagic) {
+		return cachedData, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(cachedData[len(compressedMagic):]))
+	if err == nil {
+		var data []byte
+		if data, err = io.ReadAll(zr); err == nil {
+			return data, nil
+		}
+	}
+
+	log.Printf("CACHE_CORRUPT: Failed to decompress '%s', removing it from the cache: %v", path, err)
+	if err := c.Cache.Delete(path); err != nil {
+		log.Printf("ERROR: Failed to remove corrupt cache entry %s: %v", path, err)
+	}
+	return nil, ErrNotFoundCache
+}
+
+func (c *compressedCache) Put(path string, data []byte, mode os.FileMode) error {
+	var buf bytes.Buffer
+	buf.Write(compressedMagic)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return c.Cache.Put(path, buf.Bytes(), mode)
+}
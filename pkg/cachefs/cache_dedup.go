@@ -0,0 +1,289 @@
+package cachefs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupIndexName is the file the dedup cache saves which blob each path has to on Close, under its
+// directory, so the blobs can still be served (and removed) after a restart.
+const dedupIndexName = ".fuse-test-dedup-index"
+
+// NewDedupCache returns a content-addressed cache. File contents are stored once on SSD, named by
+// their SHA-256 hash and mode, so identical files at different paths (eg. a shared lib copied into
+// several projects) only take up space once.
+func NewDedupCache(ssdBasePath string) Cache {
+	d := &dedupCache{
+		ssdBasePath: ssdBasePath,
+		blobs:       make(map[string]string),
+		refs:        make(map[string]int),
+	}
+	if err := d.load(); err != nil {
+		log.Printf("WARNING: Failed to index existing files in %s: %v", ssdBasePath, err)
+	}
+	return d
+}
+
+type dedupCache struct {
+	ssdBasePath string
+	syncWrites  bool
+
+	cacheMu sync.RWMutex
+	blobs   map[string]string // path -> name of the blob with its contents, see blobName
+	refs    map[string]int    // blob name -> number of paths referencing it
+}
+
+// blobName names the blob storing data with the given mode. Files with the same contents but
+// different modes are stored apart, as a blob has a single mode.
+func blobName(data []byte, mode os.FileMode) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%s-%o", hex.EncodeToString(sum[:]), mode.Perm())
+}
+
+// isBlobName reports whether name is that of a blob, see blobName.
+func isBlobName(name string) bool {
+	hash, _, _ := strings.Cut(name, "-")
+	_, err := hex.DecodeString(hash)
+	return len(hash) == 2*sha256.Size && err == nil
+}
+
+// load reads the index saved by the last Close. Paths whose blob has gone are dropped, and blobs no
+// path references (eg. stored after the last save, before a crash) are removed, as nothing could
+// ever read them.
+func (d *dedupCache) load() error {
+	saved, err := readDedupIndex(filepath.Join(d.ssdBasePath, dedupIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: Failed to read the saved dedup index, files already cached are removed: %v", err)
+	}
+
+	entries, err := os.ReadDir(d.ssdBasePath)
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isBlobName(entry.Name()) {
+			onDisk[entry.Name()] = true
+		}
+	}
+
+	dropped := 0
+	for path, blob := range saved {
+		if !onDisk[blob] {
+			dropped++
+			continue
+		}
+		d.blobs[path] = blob
+		d.refs[blob]++
+	}
+
+	removed := 0
+	for blob := range onDisk {
+		if d.refs[blob] > 0 {
+			continue
+		}
+		if err := os.Remove(d.blobPath(blob)); err != nil {
+			log.Printf("ERROR: Failed to remove unreferenced blob %s: %v", blob, err)
+			continue
+		}
+		removed++
+	}
+
+	if len(onDisk) > 0 || dropped > 0 {
+		log.Printf("CACHE_LOADED: Indexed %d files in %d blobs already in %s. %d files in the saved index had no blob, and %d unreferenced blobs were removed",
+			len(d.blobs), len(d.refs), d.ssdBasePath, dropped, removed)
+	}
+	return nil
+}
+
+// readDedupIndex reads the index saved by Close, path -> blob name.
+func readDedupIndex(name string) (map[string]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		quoted, blob, ok := strings.Cut(scanner.Text(), " ")
+		path, err := strconv.Unquote(quoted)
+		if err != nil || !ok || !isBlobName(blob) {
+			return nil, fmt.Errorf("%s:%d: invalid entry %q", name, line, scanner.Text())
+		}
+		index[path] = blob
+	}
+	return index, scanner.Err()
+}
+
+// Close saves which blob each path has, so the next cache in the same directory can serve them.
+func (d *dedupCache) Close() error {
+	d.cacheMu.RLock()
+	paths := slices.Sorted(maps.Keys(d.blobs))
+	// One quoted path and its blob per line. Quoting keeps any spaces or newlines in file names from
+	// splitting an entry.
+	var buf bytes.Buffer
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "%s %s\n", strconv.Quote(path), d.blobs[path])
+	}
+	d.cacheMu.RUnlock()
+
+	if err := writeFile(filepath.Join(d.ssdBasePath, dedupIndexName), buf.Bytes(), 0o644, d.syncWrites); err != nil {
+		return fmt.Errorf("failed to save the dedup index: %w", err)
+	}
+	return nil
+}
+
+func (d *dedupCache) SetSyncWrites(enabled bool) {
+	d.syncWrites = enabled
+}
+
+func (d *dedupCache) Get(path string) ([]byte, error) {
+	d.cacheMu.RLock()
+	defer d.cacheMu.RUnlock()
+
+	blob, ok := d.blobs[path]
+	if !ok {
+		return nil, ErrNotFoundCache
+	}
+
+	cachedData, err := os.ReadFile(d.blobPath(blob))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+func (d *dedupCache) Has(path string) bool {
+	d.cacheMu.RLock()
+	defer d.cacheMu.RUnlock()
+	_, present := d.blobs[path]
+	return present
+}
+
+func (d *dedupCache) Put(path string, data []byte, mode os.FileMode) error {
+	blob := blobName(data, mode)
+
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	oldBlob, hadOld := d.blobs[path]
+	if hadOld && oldBlob == blob {
+		return nil // Same contents and mode, nothing to do
+	}
+
+	if d.refs[blob] == 0 {
+		// First reference to this content, write the blob.
+		if err := writeFile(d.blobPath(blob), data, mode, d.syncWrites); err != nil {
+			return err
+		}
+	}
+	d.blobs[path] = blob
+	d.refs[blob]++
+
+	if hadOld {
+		return d.release(oldBlob)
+	}
+	return nil
+}
+
+func (d *dedupCache) Delete(path string) error {
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	blob, ok := d.blobs[path]
+	if !ok {
+		return nil
+	}
+	delete(d.blobs, path)
+
+	return d.release(blob)
+}
+
+func (d *dedupCache) Clear() error {
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	// Forget the blobs before removing them, so a failure part way leaves nothing indexed. The saved
+	// index goes too, or it would be read back after a restart.
+	clear(d.blobs)
+	clear(d.refs)
+
+	if err := os.Remove(filepath.Join(d.ssdBasePath, dedupIndexName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return clearDir(d.ssdBasePath)
+}
+
+// release drops a reference to the blob, removing it from SSD once nothing references it.
+// Must be called with cacheMu held.
+func (d *dedupCache) release(blob string) error {
+	d.refs[blob]--
+	if d.refs[blob] > 0 {
+		return nil
+	}
+
+	delete(d.refs, blob)
+	if err := os.Remove(d.blobPath(blob)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeOrphan removes anything that isn't a referenced blob, eg. files cached by another cache.
+func (d *dedupCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	if d.refs[flatPath] > 0 {
+		return 0, false, nil
+	}
+	return removeOrphanFile(d.ssdBasePath, flatPath, before, dryRun)
+}
+
+func (d *dedupCache) Len() int {
+	d.cacheMu.RLock()
+	defer d.cacheMu.RUnlock()
+	return len(d.blobs)
+}
+
+// Bytes returns the size of the stored blobs, so files with the same contents are only counted
+// once.
+func (d *dedupCache) Bytes() int64 {
+	d.cacheMu.RLock()
+	defer d.cacheMu.RUnlock()
+
+	var bytes int64
+	for blob := range d.refs {
+		if fi, err := os.Stat(d.blobPath(blob)); err == nil {
+			bytes += fi.Size()
+		}
+	}
+	return bytes
+}
+
+// Keys returns the cached paths, sorted. Nothing is ever evicted, so there's no eviction order.
+func (d *dedupCache) Keys() []string {
+	d.cacheMu.RLock()
+	defer d.cacheMu.RUnlock()
+	return slices.Sorted(maps.Keys(d.blobs))
+}
+
+func (d *dedupCache) blobPath(blob string) string {
+	return filepath.Join(d.ssdBasePath, blob)
+}
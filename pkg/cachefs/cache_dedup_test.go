@@ -0,0 +1,126 @@
+package cachefs
+
+import (
+	"os"
+	"testing"
+)
+
+// blobs returns the names of the blobs in dir.
+func blobs(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if isBlobName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestDedupCacheStoresIdenticalFilesOnce(t *testing.T) {
+	dir := t.TempDir()
+	c := NewDedupCache(dir)
+	data := []byte("shared lib")
+
+	for _, path := range []string{"a/lib.so", "b/lib.so"} {
+		if err := c.Put(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := blobs(t, dir); len(got) != 1 {
+		t.Fatalf("got blobs %v, want one", got)
+	}
+
+	// Evicting one path leaves the blob for the other.
+	if err := c.Delete("a/lib.so"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get("b/lib.so"); err != nil || string(got) != string(data) {
+		t.Fatalf("Get(b/lib.so) = %q, %v, want %q", got, err, data)
+	}
+	if _, err := c.Get("a/lib.so"); err != ErrNotFoundCache {
+		t.Fatalf("Get(a/lib.so) after Delete: got %v, want %v", err, ErrNotFoundCache)
+	}
+
+	// The last reference takes the blob with it.
+	if err := c.Delete("b/lib.so"); err != nil {
+		t.Fatal(err)
+	}
+	if got := blobs(t, dir); len(got) != 0 {
+		t.Fatalf("got blobs %v after deleting every path, want none", got)
+	}
+}
+
+func TestDedupCacheKeepsModes(t *testing.T) {
+	dir := t.TempDir()
+	c := NewDedupCache(dir)
+	data := []byte("#!/bin/sh\n")
+
+	if err := c.Put("script", data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("copy", data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{"script": 0o755, "copy": 0o644} {
+		fi, err := os.Stat(c.(*dedupCache).blobPath(c.(*dedupCache).blobs[path]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s has mode %v, want %v", path, fi.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestDedupCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := NewDedupCache(dir)
+	for path, data := range map[string]string{"a": "same", "b": "same", "c": "other"} {
+		if err := c.Put(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.(*dedupCache).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewDedupCache(dir)
+	for path, want := range map[string]string{"a": "same", "b": "same", "c": "other"} {
+		if got, err := c.Get(path); err != nil || string(got) != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	// The refcounts were rebuilt too, so the shared blob stays until both paths are gone.
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get("b"); err != nil || string(got) != "same" {
+		t.Errorf("Get(b) = %q, %v, want %q", got, err, "same")
+	}
+	if err := c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := blobs(t, dir); len(got) != 1 {
+		t.Errorf("got blobs %v, want only c's", got)
+	}
+}
+
+func TestDedupCacheRemovesUnreferencedBlobs(t *testing.T) {
+	dir := t.TempDir()
+	c := NewDedupCache(dir)
+	if err := c.Put("a", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a Close (eg. after a crash), nothing says which path the blob is for.
+	NewDedupCache(dir)
+	if got := blobs(t, dir); len(got) != 0 {
+		t.Errorf("got blobs %v, want none", got)
+	}
+}
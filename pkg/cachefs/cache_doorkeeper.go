@@ -0,0 +1,149 @@
+package cachefs
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// doorkeeperMaxPaths bounds how many files read once the doorkeeper remembers. Past it, the oldest
+// are forgotten early, and have to be read twice more to be cached.
+const doorkeeperMaxPaths = 1 << 16
+
+// NewDoorkeeperCache only admits a file into the wrapped cache the second time it's put within
+// window, so files that are read once (eg. logs, build artifacts) don't evict the ones that are
+// read over and over. The first Put remembers the path and returns ErrWontCache. Files already in
+// the wrapped cache are always admitted, so they can be updated.
+func NewDoorkeeperCache(inner Cache, window time.Duration) Cache {
+	return &doorkeeperCache{
+		Cache:  inner,
+		window: window,
+		order:  list.New(),
+		seen:   make(map[string]*list.Element),
+	}
+}
+
+// admitter is implemented by caches with an admission policy, for a caller that knows a file is
+// wanted in the cache (eg. the check's round trip) to have it admitted on its next Put.
+type admitter interface {
+	expect(path string)
+}
+
+type doorkeeperCache struct {
+	Cache
+	window time.Duration
+
+	mu    sync.Mutex
+	order *list.List               // Of *seenPath, oldest first. All have the same window, so it's also the order they expire in
+	seen  map[string]*list.Element // Path -> its place in order
+
+	admitted, rejected, refused atomic.Int64
+}
+
+type seenPath struct {
+	path string
+	at   time.Time
+}
+
+func (d *doorkeeperCache) Unwrap() Cache {
+	return d.Cache
+}
+
+func (d *doorkeeperCache) Put(path string, data []byte, mode os.FileMode) error {
+	if !d.Cache.Has(path) && !d.secondAccess(path) {
+		d.rejected.Add(1)
+		return ErrWontCache
+	}
+
+	err := d.Cache.Put(path, data, mode)
+	if err == ErrWontCache {
+		// The wrapped cache refused it, eg. because it's full.
+		d.refused.Add(1)
+	} else if err == nil {
+		d.admitted.Add(1)
+	}
+	return err
+}
+
+// secondAccess reports whether the path was seen within the window, forgetting it if so. If not,
+// it's remembered for next time.
+func (d *doorkeeperCache) secondAccess(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expireLocked(time.Now())
+	if el, ok := d.seen[path]; ok {
+		d.order.Remove(el)
+		delete(d.seen, path)
+		return true
+	}
+	d.expectLocked(path)
+	return false
+}
+
+func (d *doorkeeperCache) expect(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.seen[path]; ok {
+		d.order.Remove(el)
+		delete(d.seen, path)
+	}
+	d.expectLocked(path)
+}
+
+// expectLocked remembers the path as seen now. Must be called with mu held, and the path not
+// already remembered.
+func (d *doorkeeperCache) expectLocked(path string) {
+	for d.order.Len() >= doorkeeperMaxPaths {
+		oldest := d.order.Front()
+		delete(d.seen, oldest.Value.(*seenPath).path)
+		d.order.Remove(oldest)
+	}
+	d.seen[path] = d.order.PushBack(&seenPath{path: path, at: time.Now()})
+}
+
+// expireLocked forgets the paths seen longer than the window ago. Must be called with mu held.
+func (d *doorkeeperCache) expireLocked(now time.Time) {
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		seen := el.Value.(*seenPath)
+		if now.Sub(seen.at) <= d.window {
+			return
+		}
+		delete(d.seen, seen.path)
+		d.order.Remove(el)
+	}
+}
+
+func (d *doorkeeperCache) Clear() error {
+	d.mu.Lock()
+	d.order.Init()
+	clear(d.seen)
+	d.mu.Unlock()
+	return d.Cache.Clear()
+}
+
+// Stats tells the files the doorkeeper turned away (read once so far) from those the wrapped cache
+// refused (eg. for being full).
+func (d *doorkeeperCache) Stats() Stats {
+	d.mu.Lock()
+	d.expireLocked(time.Now())
+	tracked := d.order.Len()
+	d.mu.Unlock()
+
+	stats := statsOf(d.Cache)
+	stats["doorkeeper_admitted"] = d.admitted.Load()
+	stats["doorkeeper_rejected"] = d.rejected.Load()
+	stats["doorkeeper_refused_by_cache"] = d.refused.Load()
+	stats["doorkeeper_tracked_paths"] = int64(tracked)
+	return stats
+}
+
+// expectPut has the cache's admission policy, if it has one, admit the file on its next Put.
+func expectPut(c Cache, path string) {
+	if a, ok := findCache[admitter](c); ok {
+		a.expect(path)
+	}
+}
@@ -0,0 +1,67 @@
+package cachefs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDoorkeeperCachesFilesReadTwice(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "train.py", []byte("hot"))
+	writeTestFile(t, nfsDir, "run.log", []byte("once"))
+	cache := NewDoorkeeperCache(NewDefaultCache(ssdDir), time.Minute)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache})
+
+	for _, relPath := range []string{"train.py", "train.py", "run.log"} {
+		if _, err := lookup(t, rfs, relPath).data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cache.Has("train.py") {
+		t.Error("file read twice wasn't cached")
+	}
+	if cache.Has("run.log") {
+		t.Error("file read once was cached")
+	}
+
+	stats := statsOf(cache)
+	for key, want := range map[string]int64{
+		"doorkeeper_admitted":         1,
+		"doorkeeper_rejected":         2,
+		"doorkeeper_refused_by_cache": 0,
+		"doorkeeper_tracked_paths":    1,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %d, want %d", key, stats[key], want)
+		}
+	}
+}
+
+func TestDoorkeeperTellsRejectionsFromRefusals(t *testing.T) {
+	cache := NewDoorkeeperCache(NewMemCache(4), time.Minute)
+	for range 2 {
+		if err := cache.Put("big", make([]byte, 10), 0o644); err != ErrWontCache {
+			t.Fatalf("Put = %v, want %v", err, ErrWontCache)
+		}
+	}
+	stats := statsOf(cache)
+	if stats["doorkeeper_rejected"] != 1 || stats["doorkeeper_refused_by_cache"] != 1 {
+		t.Errorf("rejected %d and refused by the cache %d, want 1 and 1",
+			stats["doorkeeper_rejected"], stats["doorkeeper_refused_by_cache"])
+	}
+}
+
+func TestDoorkeeperForgetsAfterWindow(t *testing.T) {
+	cache := NewDoorkeeperCache(NewMemCache(1<<10), 10*time.Millisecond)
+	if err := cache.Put("a", []byte("a"), 0o644); err != ErrWontCache {
+		t.Fatalf("first Put = %v, want %v", err, ErrWontCache)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := cache.Put("a", []byte("a"), 0o644); err != ErrWontCache {
+		t.Errorf("Put after the window = %v, want %v", err, ErrWontCache)
+	}
+	if err := cache.Put("a", []byte("a"), 0o644); err != nil {
+		t.Errorf("Put within the window = %v", err)
+	}
+}
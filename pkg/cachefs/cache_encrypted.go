@@ -0,0 +1,213 @@
+package cachefs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NewEncryptedCache wraps a cache, encrypting every entry with AES-GCM before it is written to the
+// inner cache. Each entry is stored as a random nonce followed by the ciphertext, under an HMAC of
+// its path so the names of cached files aren't readable either. Entries that fail to decrypt (eg.
+// tampered with, or written with another key) are deleted and reported as not found, so the caller
+// falls back to NFS. The key must be 16, 24 or 32 bytes long.
+func NewEncryptedCache(inner Cache, key []byte) (Cache, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise AES-GCM: %w", err)
+	}
+
+	// Names are keyed separately from the data, with a key derived from the one we were given.
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cache file names"))
+
+	c := &encryptedCache{Cache: inner, aead: aead, nameKey: mac.Sum(nil), paths: make(map[string]string)}
+	if notifier, ok := findCache[EvictNotifier](inner); ok {
+		notifier.OnEvict(c.evicted)
+	}
+	return c, nil
+}
+
+var errModeUnsupported = errors.New("inner cache can't change file modes")
+
+type encryptedCache struct {
+	Cache
+	aead    cipher.AEAD
+	nameKey []byte
+	evictHooks
+
+	// The names can't be turned back into paths, so the paths of the entries put or read through
+	// this cache are remembered, for listing them and reporting their eviction. Entries cached before
+	// it was created and not read since aren't known.
+	pathsMu sync.Mutex
+	paths   map[string]string // Name in the inner cache -> path
+}
+
+// name returns the name the path is stored under in the inner cache.
+func (c *encryptedCache) name(path string) string {
+	mac := hmac.New(sha256.New, c.nameKey)
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *encryptedCache) Unwrap() Cache {
+	return c.Cache
+}
+
+func (c *encryptedCache) remember(name, path string) {
+	c.pathsMu.Lock()
+	defer c.pathsMu.Unlock()
+	c.paths[name] = path
+}
+
+// forget drops the name's path, returning it if it was known.
+func (c *encryptedCache) forget(name string) (string, bool) {
+	c.pathsMu.Lock()
+	defer c.pathsMu.Unlock()
+	path, ok := c.paths[name]
+	delete(c.paths, name)
+	return path, ok
+}
+
+// evicted passes an eviction from the inner cache on under the entry's path, if it's known. Entries
+// that aren't were never read through this cache, so nothing above it knows about them either.
+func (c *encryptedCache) evicted(name string, size int64) {
+	if path, ok := c.forget(name); ok {
+		c.notifyEvicted(path, size)
+	}
+}
+
+func (c *encryptedCache) Get(path string) ([]byte, error) {
+	name := c.name(path)
+	cachedData, err := c.Cache.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if nonceSize := c.aead.NonceSize(); len(cachedData) >= nonceSize {
+		nonce, ciphertext := cachedData[:nonceSize], cachedData[nonceSize:]
+		// The path is authenticated too, so an entry can't be passed off as another file's.
+		if data, err := c.aead.Open(nil, nonce, ciphertext, []byte(path)); err == nil {
+			c.remember(name, path)
+			return data, nil
+		}
+	}
+
+	log.Printf("CACHE_CORRUPT: Failed to decrypt '%s', removing it from the cache", path)
+	c.forget(name)
+	if err := c.Cache.Delete(name); err != nil {
+		log.Printf("ERROR: Failed to remove corrupt cache entry %s: %v", path, err)
+	}
+	return nil, ErrNotFoundCache
+}
+
+func (c *encryptedCache) Has(path string) bool {
+	return c.Cache.Has(c.name(path))
+}
+
+func (c *encryptedCache) Put(path string, data []byte, mode os.FileMode) error {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	name := c.name(path)
+	// Before the Put, so an eviction it causes of the entry itself is reported under its path.
+	c.remember(name, path)
+	err := c.Cache.Put(name, c.aead.Seal(nonce, nonce, data, []byte(path)), mode)
+	if err != nil && !c.Cache.Has(name) {
+		c.forget(name)
+	}
+	return err
+}
+
+// SetMode changes the mode of the entry in the inner cache, which is stored under another name.
+func (c *encryptedCache) SetMode(path string, mode os.FileMode) error {
+	setter, ok := findCache[ModeSetter](c.Cache)
+	if !ok {
+		return errModeUnsupported
+	}
+	return setter.SetMode(c.name(path), mode)
+}
+
+func (c *encryptedCache) Delete(path string) error {
+	name := c.name(path)
+	c.forget(name)
+	return c.Cache.Delete(name)
+}
+
+func (c *encryptedCache) Clear() error {
+	c.pathsMu.Lock()
+	clear(c.paths)
+	c.pathsMu.Unlock()
+	return c.Cache.Clear()
+}
+
+// Len and Bytes count every entry in the inner cache, including those whose paths aren't known.
+func (c *encryptedCache) Len() int {
+	if inspector, ok := findCache[Inspector](c.Cache); ok {
+		return inspector.Len()
+	}
+	return 0
+}
+
+func (c *encryptedCache) Bytes() int64 {
+	if inspector, ok := findCache[Inspector](c.Cache); ok {
+		return inspector.Bytes()
+	}
+	return 0
+}
+
+// Keys returns the paths of the entries, in the inner cache's order, leaving out those whose paths
+// aren't known.
+func (c *encryptedCache) Keys() []string {
+	inspector, ok := findCache[Inspector](c.Cache)
+	if !ok {
+		return nil
+	}
+	names := inspector.Keys()
+
+	c.pathsMu.Lock()
+	defer c.pathsMu.Unlock()
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if path, ok := c.paths[name]; ok {
+			keys = append(keys, path)
+		}
+	}
+	return keys
+}
+
+// ReadKeyFile reads an AES key from a file, either as raw bytes or hex encoded.
+func ReadKeyFile(name string) ([]byte, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(contents)
+}
+
+// ParseKey decodes a hex encoded key, or returns the key as-is if it isn't hex. Keys that aren't 16,
+// 24 or 32 bytes long are an error.
+func ParseKey(key []byte) ([]byte, error) {
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(key))); err == nil {
+		key = decoded
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, aes.KeySizeError(len(key))
+}
@@ -0,0 +1,159 @@
+package cachefs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestEncryptedCacheListsPaths(t *testing.T) {
+	dir := t.TempDir()
+	inner := must(NewHybridCache(dir, 2, 0, false))
+	c := must(NewEncryptedCache(inner, testKey))
+
+	var evicted []string
+	c.(EvictNotifier).OnEvict(func(path string, size int64) { evicted = append(evicted, path) })
+
+	for _, path := range []string{"a", "dir/b", "c"} {
+		if err := c.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inspector, ok := findCache[Inspector](c)
+	if !ok {
+		t.Fatal("encrypted cache isn't an Inspector")
+	}
+	if got, want := inspector.Keys(), []string{"dir/b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	if want := []string{"a"}; !slices.Equal(evicted, want) {
+		t.Errorf("evictions reported for %v, want %v", evicted, want)
+	}
+
+	// After a restart, entries are only known once they've been read.
+	if err := inner.(*lruCache).Close(); err != nil {
+		t.Fatal(err)
+	}
+	c = must(NewEncryptedCache(must(NewHybridCache(dir, 2, 0, false)), testKey))
+	inspector, _ = findCache[Inspector](c)
+	if got := inspector.Keys(); len(got) != 0 {
+		t.Errorf("Keys() after a restart = %v, want none", got)
+	}
+	if _, err := c.Get("c"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := inspector.Keys(), []string{"c"}; !slices.Equal(got, want) {
+		t.Errorf("Keys() after reading c = %v, want %v", got, want)
+	}
+	if got := inspector.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+}
+
+func TestListCacheEncrypted(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeTestFile(t, nfsDir, name, []byte(name))
+	}
+	cache := must(NewEncryptedCache(must(NewHybridCache(ssdDir, 2, 0, false)), testKey))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache})
+
+	for _, name := range []string{"a", "a", "b", "b", "c"} {
+		if _, err := lookup(t, rfs, name).data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := rfs.ListCache(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "entries: 2 bytes: "; !strings.HasPrefix(got, want) {
+		t.Errorf("listing %q doesn't start with %q", got, want)
+	}
+	if got := buf.String(); !strings.Contains(got, "\n  b\n  c\n") {
+		t.Errorf("listing %q doesn't list b and c", got)
+	}
+
+	// a was hit, then evicted under its path, so it isn't reported as hot any more.
+	for _, f := range rfs.TopN(10) {
+		if f.Key == "a" {
+			t.Errorf("evicted a is still in the hottest entries: %+v", rfs.TopN(10))
+		}
+	}
+}
+
+func TestEncryptedCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	c := must(NewEncryptedCache(NewDefaultCache(dir), testKey))
+
+	big := bytes.Repeat([]byte("secret model weights "), 5<<20/21)
+	for path, data := range map[string][]byte{"empty": {}, "big.bin": big} {
+		if err := c.Put(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.Get(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Get %s = %d bytes, %v, want %d bytes", path, len(got), err, len(data))
+		}
+	}
+
+	// Neither the path nor the data are readable on disk.
+	files := 0
+	err := walkCacheFiles(dir, func(name string, _ os.FileInfo) {
+		files++
+		if strings.Contains(name, "big") {
+			t.Errorf("cache file %s names the file", name)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); bytes.Contains(data, []byte("secret")) {
+			t.Errorf("cache file %s holds the plaintext", name)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if files != 2 {
+		t.Errorf("%d cache files, want 2", files)
+	}
+}
+
+func TestEncryptedCacheWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := must(NewEncryptedCache(NewDefaultCache(dir), testKey)).Put("a.txt", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := must(NewEncryptedCache(NewDefaultCache(dir), bytes.Repeat([]byte{8}, 32)))
+	if got, err := c.Get("a.txt"); err != ErrNotFoundCache {
+		t.Errorf("Get with the wrong key = %q, %v, want %v", got, err, ErrNotFoundCache)
+	}
+}
+
+func TestEncryptedCacheTamperedEntry(t *testing.T) {
+	inner := NewMemCache(1 << 20)
+	c := must(NewEncryptedCache(inner, testKey))
+	if err := c.Put("a.txt", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := c.(*encryptedCache).name("a.txt")
+	stored, err := inner.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)-1] ^= 1
+	if err := inner.Put(name, stored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := c.Get("a.txt"); err != ErrNotFoundCache {
+		t.Errorf("Get of a tampered entry = %q, %v, want %v", got, err, ErrNotFoundCache)
+	}
+	if inner.Has(name) {
+		t.Error("tampered entry is still cached")
+	}
+}
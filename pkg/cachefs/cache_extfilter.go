@@ -0,0 +1,97 @@
+package cachefs
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Extensions are file name suffixes (eg. ".py", or ".tar.gz"), matched case-insensitively.
+type Extensions []string
+
+// ParseExtensions parses comma separated extensions, with or without their leading dot.
+func ParseExtensions(s string) Extensions {
+	var exts Extensions
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			continue
+		}
+		exts = append(exts, "."+ext)
+	}
+	return exts
+}
+
+// match reports whether the file's name ends in one of the extensions. A name that is only the
+// extension (eg. ".py") is a file without one.
+func (e Extensions) match(relPath string) bool {
+	name := strings.ToLower(path.Base(relPath))
+	for _, ext := range e {
+		if len(name) > len(ext) && strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewExtensionFilterCache only caches files whose extension is included, and isn't excluded: files
+// matching both lists aren't cached. An empty include list includes every file, so files without
+// an extension are only cached if it's empty. Put returns ErrWontCache for files filtered out, and
+// everything else (eg. Get of a file cached before the filter) goes to the wrapped cache as usual.
+func NewExtensionFilterCache(inner Cache, include, exclude Extensions) Cache {
+	return &extFilterCache{
+		Cache:   inner,
+		include: include,
+		exclude: exclude,
+	}
+}
+
+type extFilterCache struct {
+	Cache
+	include, exclude Extensions
+
+	filtered atomic.Int64
+}
+
+func (f *extFilterCache) Unwrap() Cache {
+	return f.Cache
+}
+
+func (f *extFilterCache) Put(path string, data []byte, mode os.FileMode) error {
+	if !f.allowed(path) {
+		f.filtered.Add(1)
+		return ErrWontCache
+	}
+	return f.Cache.Put(path, data, mode)
+}
+
+// allowed reports whether the file a cache key is for may be cached.
+func (f *extFilterCache) allowed(key string) bool {
+	relPath := keyPath(key)
+	if f.exclude.match(relPath) {
+		return false
+	}
+	return len(f.include) == 0 || f.include.match(relPath)
+}
+
+func (f *extFilterCache) Stats() Stats {
+	stats := statsOf(f.Cache)
+	stats["ext_filtered"] = f.filtered.Load()
+	return stats
+}
+
+// keyPath returns the path of the file a cache key is for, without the suffix of a block or version
+// key.
+func keyPath(key string) string {
+	if relPath, ok := splitVersionedKey(key); ok {
+		return relPath
+	}
+	if i := strings.LastIndex(key, chunkSep); i >= 0 {
+		if _, err := strconv.ParseInt(key[i+len(chunkSep):], 10, 64); err == nil {
+			return key[:i]
+		}
+	}
+	return key
+}
@@ -0,0 +1,92 @@
+package cachefs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseExtensions(t *testing.T) {
+	got := ParseExtensions(" .Py , ,json,TAR.GZ")
+	if want := (Extensions{".py", ".json", ".tar.gz"}); !slices.Equal(got, want) {
+		t.Errorf("ParseExtensions = %q, want %q", got, want)
+	}
+}
+
+func TestExtensionFilterCache(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		include, exclude string
+		cached           map[string]bool
+	}{
+		{
+			name:    "include and exclude",
+			include: "py,json,tar.gz",
+			exclude: "test.py",
+			cached: map[string]bool{
+				"lib/model.py":      true,
+				"lib/MODEL.PY":      true,
+				"config.Json":       true,
+				"data.tar.gz":       true,
+				"lib/model.test.py": false, // Excluding wins
+				"weights.ckpt":      false,
+				"Makefile":          false, // No extension, so not included
+				"lib/.py":           false, // Only the extension
+			},
+		},
+		{
+			name:    "exclude only",
+			exclude: ".CKPT",
+			cached: map[string]bool{
+				"lib/model.py":              true,
+				"Makefile":                  true,
+				"weights.ckpt":              false,
+				"Weights.Ckpt":              false,
+				chunkKey("weights.ckpt", 3): false,
+				versionedKey("weights.ckpt", time.Now(), 1): false,
+			},
+		},
+		{
+			name: "neither",
+			cached: map[string]bool{
+				"Makefile":     true,
+				"weights.ckpt": true,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := NewMemCache(1 << 20)
+			cache := NewExtensionFilterCache(inner, ParseExtensions(tc.include), ParseExtensions(tc.exclude))
+
+			var filtered int64
+			for path, want := range tc.cached {
+				err := cache.Put(path, []byte("x"), 0o644)
+				if want && err != nil {
+					t.Errorf("Put %s = %v", path, err)
+				} else if !want && err != ErrWontCache {
+					t.Errorf("Put %s = %v, want %v", path, err, ErrWontCache)
+				}
+				if !want {
+					filtered++
+				}
+				if inner.Has(path) != want {
+					t.Errorf("%s cached = %v, want %v", path, inner.Has(path), want)
+				}
+			}
+			if got := statsOf(cache)["ext_filtered"]; got != filtered {
+				t.Errorf("ext_filtered = %d, want %d", got, filtered)
+			}
+		})
+	}
+}
+
+func TestExtensionFilterCacheGetsFilesCachedBefore(t *testing.T) {
+	inner := NewMemCache(1 << 20)
+	if err := inner.Put("weights.ckpt", []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewExtensionFilterCache(inner, nil, ParseExtensions("ckpt"))
+	if got, err := cache.Get("weights.ckpt"); err != nil || string(got) != "x" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+}
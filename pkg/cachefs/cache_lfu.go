@@ -0,0 +1,395 @@
+package cachefs
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewLFUCache caches up to capacity files, evicting the least frequently used (the least recently
+// used of those, on a tie) to make room. A handful of hot files then survive a burst of one-off
+// reads, which would push them out of an LRU. All counts are halved every 10*capacity accesses, so
+// files that were popular once but aren't any more can still be evicted.
+func NewLFUCache(ssdBasePath string, capacity int) (Cache, error) {
+	if capacity == 0 {
+		return nil, errNoCapacity
+	}
+	return &lfuCache{
+		ssdBasePath: ssdBasePath,
+		capacity:    capacity,
+		decayAfter:  10 * capacity,
+		entries:     make(map[string]*lfuEntry),
+	}, nil
+}
+
+type lfuCache struct {
+	ssdBasePath string
+	capacity    int
+	decayAfter  int // Halve the counts after this many accesses
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	cacheMu   sync.Mutex // Guards the bookkeeping below. Never held during disk I/O
+	entries   map[string]*lfuEntry
+	order     lfuHeap // Next to be evicted at the root
+	clock     uint64  // Ticks on every access, to tell which of two files was used last
+	accesses  int     // Since the counts were last halved
+	byteCount int64
+
+	evicted, decays atomic.Int64
+}
+
+type lfuEntry struct {
+	key      string
+	size     int64
+	count    int
+	lastUsed uint64
+	index    int // In the heap
+}
+
+// lfuHeap orders entries by how often, then how recently, they were used, least first.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].lastUsed < h[j].lastUsed
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	entry := x.(*lfuEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func (lfu *lfuCache) SetSyncWrites(enabled bool) {
+	lfu.syncWrites = enabled
+}
+
+func (lfu *lfuCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	lfu.cacheMu.Lock()
+	entry, ok := lfu.entries[flatPath]
+	if !ok {
+		lfu.cacheMu.Unlock()
+		return nil, ErrNotFoundCache
+	}
+	lfu.use(entry)
+	lfu.cacheMu.Unlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(lfu.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// Has doesn't count as a use of the file.
+func (lfu *lfuCache) Has(path string) bool {
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+	_, present := lfu.entries[flattenDirPath(path)]
+	return present
+}
+
+func (lfu *lfuCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(cacheFileName(lfu.ssdBasePath, flatPath), data, mode, lfu.syncWrites); err != nil {
+		keyLock.Unlock()
+		return err
+	}
+
+	lfu.cacheMu.Lock()
+	evicted := lfu.add(flatPath, int64(len(data)))
+	lfu.cacheMu.Unlock()
+
+	// Let go of our own key before taking the evicted ones', so two Puts evicting each other's keys
+	// can't deadlock.
+	keyLock.Unlock()
+
+	for _, entry := range evicted {
+		if lfu.removeEvicted(entry.key) {
+			lfu.notifyEvicted(unflattenDirPath(entry.key), entry.size)
+		}
+	}
+	return nil
+}
+
+// use counts an access to the entry.
+// Must be called with cacheMu held.
+func (lfu *lfuCache) use(entry *lfuEntry) {
+	lfu.clock++
+	entry.count++
+	entry.lastUsed = lfu.clock
+	heap.Fix(&lfu.order, entry.index)
+
+	lfu.accesses++
+	if lfu.accesses >= lfu.decayAfter {
+		lfu.decay()
+	}
+}
+
+// decay halves every count, so old popularity fades.
+// Must be called with cacheMu held.
+func (lfu *lfuCache) decay() {
+	for _, entry := range lfu.order {
+		entry.count /= 2
+	}
+	heap.Init(&lfu.order)
+	lfu.accesses = 0
+	lfu.decays.Add(1)
+}
+
+// add counts a Put of the key as an access, adding it if it's new. The least frequently used keys
+// are then evicted until the cache is within its capacity, and returned. The key itself is never
+// evicted, or a new file would always be the first to go.
+// Must be called with cacheMu held.
+func (lfu *lfuCache) add(key string, size int64) []lfuEntry {
+	if entry, ok := lfu.entries[key]; ok {
+		lfu.byteCount += size - entry.size
+		entry.size = size
+		lfu.use(entry)
+		return nil
+	}
+
+	entry := &lfuEntry{key: key, size: size}
+	lfu.entries[key] = entry
+	heap.Push(&lfu.order, entry)
+	lfu.byteCount += size
+	lfu.use(entry)
+
+	var evicted []lfuEntry
+	for len(lfu.entries) > lfu.capacity {
+		evictee := heap.Pop(&lfu.order).(*lfuEntry)
+		if evictee == entry {
+			// Take the next one instead, and put the new key back.
+			next := heap.Pop(&lfu.order).(*lfuEntry)
+			heap.Push(&lfu.order, entry)
+			evictee = next
+		}
+		delete(lfu.entries, evictee.key)
+		lfu.byteCount -= evictee.size
+		lfu.evicted.Add(1)
+		evicted = append(evicted, *evictee)
+	}
+	return evicted
+}
+
+// remove drops the key, if it is present.
+// Must be called with cacheMu held.
+func (lfu *lfuCache) remove(key string) {
+	if entry, ok := lfu.entries[key]; ok {
+		heap.Remove(&lfu.order, entry.index)
+		delete(lfu.entries, key)
+		lfu.byteCount -= entry.size
+	}
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime. It reports whether the key is still evicted.
+func (lfu *lfuCache) removeEvicted(flatPath string) bool {
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lfu.cacheMu.Lock()
+	_, present := lfu.entries[flatPath]
+	lfu.cacheMu.Unlock()
+	if present {
+		return false
+	}
+
+	fileName := cacheFileName(lfu.ssdBasePath, flatPath)
+	if err := removeCacheFile(lfu.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the cache no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+func (lfu *lfuCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lfu.cacheMu.Lock()
+	_, present := lfu.entries[flatPath]
+	lfu.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(lfu.ssdBasePath, flatPath)
+	if err := removeCacheFile(lfu.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	lfu.cacheMu.Lock()
+	lfu.remove(flatPath)
+	lfu.cacheMu.Unlock()
+
+	return nil
+}
+
+func (lfu *lfuCache) Clear() error {
+	lfu.keyLocks.lockAll()
+	defer lfu.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	lfu.cacheMu.Lock()
+	clear(lfu.entries)
+	lfu.order = nil
+	lfu.byteCount = 0
+	lfu.accesses = 0
+	lfu.cacheMu.Unlock()
+
+	return clearDir(lfu.ssdBasePath)
+}
+
+// Victim returns the least frequently used file, which putting a new file would evict, or false if
+// there's room for it.
+func (lfu *lfuCache) Victim(path string, size int64) (string, bool) {
+	flatPath := flattenDirPath(path)
+
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+
+	if _, ok := lfu.entries[flatPath]; ok || len(lfu.entries) < lfu.capacity || len(lfu.order) == 0 {
+		return "", false
+	}
+	return unflattenDirPath(lfu.order[0].key), true
+}
+
+func (lfu *lfuCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lfu.cacheMu.Lock()
+	_, present := lfu.entries[flatPath]
+	lfu.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(lfu.ssdBasePath, flatPath, mode)
+}
+
+func (lfu *lfuCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := lfu.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	lfu.cacheMu.Lock()
+	_, present := lfu.entries[flatPath]
+	lfu.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(lfu.ssdBasePath, flatPath, before, dryRun)
+}
+
+// members returns the entries in eviction order, least frequently used first.
+// Must be called with cacheMu held.
+func (lfu *lfuCache) members() []lfuEntry {
+	members := make([]lfuEntry, len(lfu.order))
+	for i, entry := range lfu.order {
+		members[i] = *entry
+	}
+	slices.SortFunc(members, func(a, b lfuEntry) int {
+		return cmp.Or(cmp.Compare(a.count, b.count), cmp.Compare(a.lastUsed, b.lastUsed))
+	})
+	return members
+}
+
+func (lfu *lfuCache) Len() int {
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+	return len(lfu.entries)
+}
+
+func (lfu *lfuCache) Bytes() int64 {
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+	return lfu.byteCount
+}
+
+// Keys returns the cached paths, least frequently used (ie. next to be evicted) first.
+func (lfu *lfuCache) Keys() []string {
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+
+	members := lfu.members()
+	keys := make([]string, len(members))
+	for i, entry := range members {
+		keys[i] = unflattenDirPath(entry.key)
+	}
+	return keys
+}
+
+// Dump reports the eviction order, least frequently used first, with the size and count of each
+// file.
+func (lfu *lfuCache) Dump(w io.Writer) {
+	lfu.cacheMu.Lock()
+	members := lfu.members()
+	lfu.cacheMu.Unlock()
+
+	fmt.Fprintf(w, "entries: %d/%d (least frequently used first)\n", len(members), lfu.capacity)
+	for _, entry := range members {
+		fmt.Fprintf(w, "  %s size=%d count=%d\n", unflattenDirPath(entry.key), entry.size, entry.count)
+	}
+}
+
+func (lfu *lfuCache) Stats() Stats {
+	lfu.cacheMu.Lock()
+	defer lfu.cacheMu.Unlock()
+	return Stats{
+		"lfu_entries": int64(len(lfu.entries)),
+		"lfu_bytes":   lfu.byteCount,
+		"lfu_evicted": lfu.evicted.Load(),
+		"lfu_decays":  lfu.decays.Load(),
+	}
+}
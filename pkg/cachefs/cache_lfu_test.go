@@ -0,0 +1,33 @@
+package cachefs
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestLFUCacheKeepsFrequentFiles(t *testing.T) {
+	cache := must(NewLFUCache(t.TempDir(), 3))
+	if err := cache.Put("hot", []byte("hot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		if _, err := cache.Get("hot"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 10 {
+		path := fmt.Sprintf("once-%d", i)
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Least frequently used first, and least recently used of those on a tie.
+	if got, want := cache.(Inspector).Keys(), []string{"once-8", "once-9", "hot"}; !slices.Equal(got, want) {
+		t.Errorf("Keys = %q, want %q", got, want)
+	}
+	if got := statsOf(cache)["lfu_evicted"]; got != 8 {
+		t.Errorf("lfu_evicted = %d, want 8", got)
+	}
+}
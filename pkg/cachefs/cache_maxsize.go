@@ -0,0 +1,74 @@
+package cachefs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// errTooBig stops a file being streamed into the cache once it's past the maximum size.
+var errTooBig = errors.New("file is bigger than the cache's maximum file size")
+
+// NewMaxFileSizeCache never caches files bigger than maxSize bytes: Put returns ErrWontCache for
+// them, so they're read from NFS every time rather than evicting the files that fit. A file being
+// streamed in is abandoned as soon as it's past the limit. Everything else goes to the wrapped cache
+// as usual.
+func NewMaxFileSizeCache(inner Cache, maxSize int64) Cache {
+	return &maxFileSizeCache{
+		Cache:   inner,
+		maxSize: maxSize,
+	}
+}
+
+type maxFileSizeCache struct {
+	Cache
+	maxSize int64
+
+	refused atomic.Int64
+}
+
+func (m *maxFileSizeCache) Unwrap() Cache {
+	return m.Cache
+}
+
+func (m *maxFileSizeCache) Put(path string, data []byte, mode os.FileMode) error {
+	if int64(len(data)) > m.maxSize {
+		m.refused.Add(1)
+		return ErrWontCache
+	}
+	return m.Cache.Put(path, data, mode)
+}
+
+func (m *maxFileSizeCache) GetReader(path string) (io.ReadSeekCloser, error) {
+	return getReader(m.Cache, path)
+}
+
+func (m *maxFileSizeCache) PutReader(path string, r io.Reader, mode os.FileMode) (int64, error) {
+	written, err := putReader(m.Cache, path, &maxSizeReader{r: r, left: m.maxSize}, mode)
+	if errors.Is(err, errTooBig) {
+		m.refused.Add(1)
+		return written, ErrWontCache
+	}
+	return written, err
+}
+
+// maxSizeReader reads from r, failing with errTooBig once more than left bytes have been read.
+type maxSizeReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.left -= int64(n); l.left < 0 {
+		return n, errTooBig
+	}
+	return n, err
+}
+
+func (m *maxFileSizeCache) Stats() Stats {
+	stats := statsOf(m.Cache)
+	stats["max_file_size_refused"] = m.refused.Load()
+	return stats
+}
@@ -0,0 +1,70 @@
+package cachefs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+)
+
+func TestMaxFileSizeCache(t *testing.T) {
+	for name, newInner := range map[string]func(dir string) Cache{
+		"default": func(dir string) Cache { return NewDefaultCache(dir) },
+		"mem":     func(string) Cache { return NewMemCache(1 << 20) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache := NewMaxFileSizeCache(newInner(dir), 10)
+
+			if err := cache.Put("fits", make([]byte, 10), 0o644); err != nil {
+				t.Errorf("Put at the limit = %v", err)
+			}
+			if err := cache.Put("too-big", make([]byte, 11), 0o644); err != ErrWontCache {
+				t.Errorf("Put over the limit = %v, want %v", err, ErrWontCache)
+			}
+			if _, err := putReader(cache, "fits-streamed", bytes.NewReader(make([]byte, 10)), 0o644); err != nil {
+				t.Errorf("PutReader at the limit = %v", err)
+			}
+			if _, err := putReader(cache, "too-big-streamed", bytes.NewReader(make([]byte, 1<<20)), 0o644); err != ErrWontCache {
+				t.Errorf("PutReader over the limit = %v, want %v", err, ErrWontCache)
+			}
+
+			for path, want := range map[string]bool{"fits": true, "too-big": false, "fits-streamed": true, "too-big-streamed": false} {
+				if cache.Has(path) != want {
+					t.Errorf("%s cached = %v, want %v", path, !want, want)
+				}
+			}
+			if got := statsOf(cache)["max_file_size_refused"]; got != 2 {
+				t.Errorf("max_file_size_refused = %d, want 2", got)
+			}
+			// A refused stream leaves nothing behind on SSD.
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if name := e.Name(); name != "fits" && name != "fits-streamed" {
+					t.Errorf("%s left in the cache directory", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBigFilesAreReadFromNFS(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	big := bytes.Repeat([]byte("b"), 100)
+	writeTestFile(t, nfsDir, "big.bin", big)
+	writeTestFile(t, nfsDir, "small.txt", []byte("small"))
+	cache := NewMaxFileSizeCache(NewDefaultCache(ssdDir), 10)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache})
+
+	for relPath, want := range map[string][]byte{"big.bin": big, "small.txt": []byte("small")} {
+		if got, err := lookup(t, rfs, relPath).data(context.Background()); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: data = %q, %v, want %q", relPath, got, err, want)
+		}
+	}
+	if cache.Has("big.bin") || !cache.Has("small.txt") {
+		t.Errorf("big.bin cached = %v, small.txt cached = %v, want only small.txt", cache.Has("big.bin"), cache.Has("small.txt"))
+	}
+}
@@ -0,0 +1,99 @@
+package cachefs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// NewMemCache caches files in memory only, never touching disk, evicting the least recently used
+// when their total size would go over byteLimit. For tests, machines without a scratch SSD, and as a
+// baseline for benchmarking the SSD caches.
+func NewMemCache(byteLimit int64) Cache {
+	return &memCache{mem: newMemLRU(byteLimit)}
+}
+
+type memCache struct {
+	mem *memLRU
+	evictHooks
+
+	evicted atomic.Int64
+}
+
+func (m *memCache) Get(path string) ([]byte, error) {
+	data, ok := m.mem.get(path)
+	if !ok {
+		return nil, ErrNotFoundCache
+	}
+	return data, nil
+}
+
+func (m *memCache) Has(path string) bool {
+	return m.mem.has(path)
+}
+
+// Put keeps a copy of data, as callers may reuse their buffer.
+func (m *memCache) Put(path string, data []byte, mode os.FileMode) error {
+	evicted, ok := m.mem.put(path, bytes.Clone(data))
+	if !ok {
+		return ErrWontCache
+	}
+
+	m.evicted.Add(int64(len(evicted)))
+	for _, e := range evicted {
+		m.notifyEvicted(e.path, int64(len(e.data)))
+	}
+	return nil
+}
+
+func (m *memCache) Delete(path string) error {
+	m.mem.remove(path)
+	return nil
+}
+
+func (m *memCache) Clear() error {
+	m.mem.clear()
+	return nil
+}
+
+func (m *memCache) Stats() Stats {
+	entries, size := m.mem.usage()
+	return Stats{
+		"mem_entries": int64(entries),
+		"mem_bytes":   size,
+		"mem_evicted": m.evicted.Load(),
+	}
+}
+
+func (m *memCache) Len() int {
+	entries, _ := m.mem.usage()
+	return entries
+}
+
+func (m *memCache) Bytes() int64 {
+	_, size := m.mem.usage()
+	return size
+}
+
+// Keys returns the cached paths, least recently used (ie. next to be evicted) first.
+func (m *memCache) Keys() []string {
+	members := m.mem.members()
+	keys := make([]string, len(members))
+	for i, e := range members {
+		keys[i] = e.path
+	}
+	return keys
+}
+
+// Dump reports the cached files, least recently used first.
+func (m *memCache) Dump(w io.Writer) {
+	members := m.mem.members()
+	_, size := m.mem.usage()
+
+	fmt.Fprintf(w, "bytes: %d/%d (least recently used first)\n", size, m.mem.limit)
+	for _, e := range members {
+		fmt.Fprintf(w, "  %s size=%d\n", e.path, len(e.data))
+	}
+}
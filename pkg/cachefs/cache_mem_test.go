@@ -0,0 +1,91 @@
+package cachefs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+)
+
+// TestMemCacheConcurrentRandomOps has 16 goroutines do random Gets, Puts and Deletes, then checks
+// the cache's usage adds up. Run it with -race.
+func TestMemCacheConcurrentRandomOps(t *testing.T) {
+	const limit = 4 << 10
+	cache := NewMemCache(limit).(*memCache)
+
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(g), 0))
+			for range 2000 {
+				path := fmt.Sprintf("file-%d", rng.IntN(64))
+				switch op := rng.IntN(10); {
+				case op < 5:
+					// Every file's data starts with its path, so a mixed up entry shows.
+					data := append([]byte(path), bytes.Repeat([]byte{'.'}, rng.IntN(512))...)
+					if err := cache.Put(path, data, 0o644); err != nil {
+						t.Errorf("Put %s: %v", path, err)
+						return
+					}
+				case op < 9:
+					if got, err := cache.Get(path); err == nil && !bytes.HasPrefix(got, []byte(path)) {
+						t.Errorf("Get %s = %q", path, got)
+						return
+					}
+				default:
+					cache.Delete(path)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	keys := cache.Keys()
+	for _, path := range keys {
+		data, err := cache.Get(path)
+		if err != nil {
+			t.Fatalf("Get %s, listed in Keys: %v", path, err)
+		}
+		total += int64(len(data))
+	}
+	if cache.Len() != len(keys) || cache.Bytes() != total {
+		t.Errorf("Len, Bytes = %d, %d, the entries add up to %d, %d", cache.Len(), cache.Bytes(), len(keys), total)
+	}
+	if total > limit {
+		t.Errorf("holds %d bytes, limit is %d", total, limit)
+	}
+}
+
+func TestMemCache(t *testing.T) {
+	cache := NewMemCache(10)
+
+	data := []byte("abc")
+	if err := cache.Put("a", data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'x' // The caller's buffer isn't kept
+	if got, err := cache.Get("a"); err != nil || string(got) != "abc" {
+		t.Errorf("Get = %q, %v, want %q", got, err, "abc")
+	}
+
+	if err := cache.Put("big", make([]byte, 11), 0o644); err != ErrWontCache {
+		t.Errorf("Put of a file over the limit = %v, want %v", err, ErrWontCache)
+	}
+	if !cache.Has("a") {
+		t.Error("refusing a Put evicted a")
+	}
+
+	if err := cache.Put("b", make([]byte, 8), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Has("a") {
+		t.Error("a wasn't evicted to make room")
+	}
+	if stats := statsOf(cache); stats["mem_entries"] != 1 || stats["mem_bytes"] != 8 || stats["mem_evicted"] != 1 {
+		t.Errorf("stats = %v", stats)
+	}
+}
@@ -0,0 +1,319 @@
+package cachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartitionFactory builds the cache for one project's partition, keeping its files in dir and
+// taking up at most byteLimit bytes.
+type PartitionFactory func(project, dir string, byteLimit int64) (Cache, error)
+
+// NewPartitionedCache gives every project (top-level directory) a cache of its own, so a project
+// can only ever evict its own files, however much another one reads. Each partition keeps its files
+// in its project's directory under ssdDir, where an unpartitioned cache would, and is given its
+// project's quota, or the "default" one. Without either, it gets an even share of what byteLimit
+// leaves over after the quotas of the given projects that have one. A project that isn't given
+// gets the same share, so the partitions can then add up to more than byteLimit.
+//
+// Partitions are built up front for the given projects (eg. those on NFS at startup), and when a
+// file is first put for any other project. Files directly under the root belong to no project, and
+// are refused.
+func NewPartitionedCache(ssdDir string, projects []string, quotas Quotas, byteLimit int64, newPartition PartitionFactory) (Cache, error) {
+	p := &partitionedCache{
+		ssdDir:       ssdDir,
+		quotas:       quotas,
+		newPartition: newPartition,
+		partitions:   make(map[string]*partition),
+	}
+
+	var shared []string
+	remaining := byteLimit
+	for _, project := range projects {
+		if limit, ok := quotas.limitFor(project); ok {
+			remaining -= limit
+		} else {
+			shared = append(shared, project)
+		}
+	}
+	if _, ok := quotas[defaultQuota]; !ok {
+		p.share = remaining / int64(max(len(shared), 1))
+		if p.share <= 0 {
+			return nil, fmt.Errorf("no bytes left to share between projects without a quota (%d after quotas, for %d projects)", remaining, len(shared))
+		}
+	}
+
+	for _, project := range projects {
+		if _, err := p.partition(project, true); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+type partitionedCache struct {
+	ssdDir       string
+	quotas       Quotas
+	share        int64 // For projects without a quota
+	newPartition PartitionFactory
+	evictHooks
+
+	mu         sync.RWMutex
+	partitions map[string]*partition
+}
+
+type partition struct {
+	Cache
+	limit int64
+}
+
+// split returns the project a path belongs to, and the path within it, or false for a file directly
+// under the root.
+func (p *partitionedCache) split(path string) (project, rest string, ok bool) {
+	return strings.Cut(filepath.ToSlash(path), "/")
+}
+
+// partition returns the project's partition, building it if create is set. It returns nil (and no
+// error) if the partition doesn't exist and create isn't set.
+func (p *partitionedCache) partition(project string, create bool) (*partition, error) {
+	p.mu.RLock()
+	part := p.partitions[project]
+	p.mu.RUnlock()
+	if part != nil || !create {
+		return part, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if part := p.partitions[project]; part != nil {
+		return part, nil
+	}
+
+	limit, ok := p.quotas.limitFor(project)
+	if !ok {
+		limit = p.share
+	}
+	dir := filepath.Join(p.ssdDir, project)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c, err := p.newPartition(project, dir, limit)
+	if err != nil {
+		return nil, fmt.Errorf("partition for %s: %w", project, err)
+	}
+	if notifier, ok := findCache[EvictNotifier](c); ok {
+		notifier.OnEvict(func(path string, size int64) {
+			p.notifyEvicted(project+"/"+path, size)
+		})
+	}
+
+	part = &partition{Cache: c, limit: limit}
+	p.partitions[project] = part
+	log.Printf("CACHE_PARTITION: Project %s has a partition of %d bytes", project, limit)
+	return part, nil
+}
+
+// sortedPartitions returns the partitions built so far, by project.
+func (p *partitionedCache) sortedPartitions() ([]string, []*partition) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	projects := slices.Sorted(maps.Keys(p.partitions))
+	parts := make([]*partition, len(projects))
+	for i, project := range projects {
+		parts[i] = p.partitions[project]
+	}
+	return projects, parts
+}
+
+func (p *partitionedCache) Get(path string) ([]byte, error) {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return nil, ErrNotFoundCache
+	}
+	part, _ := p.partition(project, false)
+	if part == nil {
+		return nil, ErrNotFoundCache
+	}
+	return part.Get(rest)
+}
+
+func (p *partitionedCache) Has(path string) bool {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return false
+	}
+	part, _ := p.partition(project, false)
+	return part != nil && part.Has(rest)
+}
+
+func (p *partitionedCache) Put(path string, data []byte, mode os.FileMode) error {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return ErrWontCache
+	}
+	part, err := p.partition(project, true)
+	if err != nil {
+		return err
+	}
+	return part.Put(rest, data, mode)
+}
+
+func (p *partitionedCache) Delete(path string) error {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return nil
+	}
+	part, _ := p.partition(project, false)
+	if part == nil {
+		return nil
+	}
+	return part.Delete(rest)
+}
+
+func (p *partitionedCache) Clear() error {
+	_, parts := p.sortedPartitions()
+	var errs []error
+	for _, part := range parts {
+		errs = append(errs, part.Clear())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *partitionedCache) SetMode(path string, mode os.FileMode) error {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return ErrNotFoundCache
+	}
+	part, _ := p.partition(project, false)
+	if part == nil {
+		return ErrNotFoundCache
+	}
+	setter, ok := findCache[ModeSetter](part.Cache)
+	if !ok {
+		return errModeUnsupported
+	}
+	return setter.SetMode(rest, mode)
+}
+
+// Victim only looks at the path's own partition, as that's the only one a Put can evict from.
+func (p *partitionedCache) Victim(path string, size int64) (string, bool) {
+	project, rest, ok := p.split(path)
+	if !ok {
+		return "", false
+	}
+	part, _ := p.partition(project, false)
+	if part == nil {
+		return "", false
+	}
+	finder, ok := findCache[victimFinder](part.Cache)
+	if !ok {
+		return "", false
+	}
+	victim, ok := finder.Victim(rest, size)
+	if !ok {
+		return "", false
+	}
+	return project + "/" + victim, true
+}
+
+func (p *partitionedCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	project, rest, ok := p.split(unflattenDirPath(flatPath))
+	if !ok || isMetaFile(rest) {
+		return 0, false, nil // A partition's own metadata (eg. the saved LRU order), not an orphan
+	}
+	part, _ := p.partition(project, false)
+	if part == nil {
+		// No partition knows about the file, so it is an orphan.
+		return removeOrphanFile(p.ssdDir, flatPath, before, dryRun)
+	}
+	remover, ok := findCache[orphanRemover](part.Cache)
+	if !ok {
+		return 0, false, nil
+	}
+	return remover.removeOrphan(flattenDirPath(rest), before, dryRun)
+}
+
+// Close closes every partition that needs it, eg. to save the LRU order.
+func (p *partitionedCache) Close() error {
+	_, parts := p.sortedPartitions()
+	var errs []error
+	for _, part := range parts {
+		if closer, ok := findCache[io.Closer](part.Cache); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *partitionedCache) Len() int {
+	n := 0
+	_, parts := p.sortedPartitions()
+	for _, part := range parts {
+		if inspector, ok := findCache[Inspector](part.Cache); ok {
+			n += inspector.Len()
+		}
+	}
+	return n
+}
+
+func (p *partitionedCache) Bytes() int64 {
+	var n int64
+	_, parts := p.sortedPartitions()
+	for _, part := range parts {
+		if inspector, ok := findCache[Inspector](part.Cache); ok {
+			n += inspector.Bytes()
+		}
+	}
+	return n
+}
+
+// Keys returns the cached paths of each project in turn, in the order its partition lists them.
+func (p *partitionedCache) Keys() []string {
+	var keys []string
+	projects, parts := p.sortedPartitions()
+	for i, part := range parts {
+		if inspector, ok := findCache[Inspector](part.Cache); ok {
+			for _, key := range inspector.Keys() {
+				keys = append(keys, projects[i]+"/"+key)
+			}
+		}
+	}
+	return keys
+}
+
+// Dump describes every partition in turn.
+func (p *partitionedCache) Dump(w io.Writer) {
+	projects, parts := p.sortedPartitions()
+	for i, part := range parts {
+		fmt.Fprintf(w, "partition %s (limit %d bytes):\n", projects[i], part.limit)
+		dumpCache(w, part.Cache)
+	}
+}
+
+// Stats adds up the partitions' stats (eg. lru_bytes is the total across them), and adds each
+// partition's limit and usage.
+func (p *partitionedCache) Stats() Stats {
+	stats := Stats{}
+	projects, parts := p.sortedPartitions()
+	for i, part := range parts {
+		for k, v := range statsOf(part.Cache) {
+			stats[k] += v
+		}
+		stats["partition_limit_"+projects[i]] = part.limit
+		if inspector, ok := findCache[Inspector](part.Cache); ok {
+			stats["partition_bytes_"+projects[i]] = inspector.Bytes()
+		}
+	}
+	stats["partitions"] = int64(len(parts))
+	return stats
+}
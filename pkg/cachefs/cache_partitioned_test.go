@@ -0,0 +1,90 @@
+package cachefs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func byteLRUPartition(_, dir string, byteLimit int64) (Cache, error) {
+	return NewByteLRUCache(dir, byteLimit, false)
+}
+
+func TestPartitionChurnStaysInProject(t *testing.T) {
+	// project-1 and project-2 share the 600 bytes evenly.
+	cache := must(NewPartitionedCache(t.TempDir(), []string{"project-1", "project-2"}, nil, 600, byteLRUPartition))
+
+	for i := range 3 {
+		if err := cache.Put(fmt.Sprintf("project-1/lib-%d.py", i), make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// project-2 goes through many times its share, evicting its own files.
+	for i := range 20 {
+		if err := cache.Put(fmt.Sprintf("project-2/shard-%d", i), make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 3 {
+		if path := fmt.Sprintf("project-1/lib-%d.py", i); !cache.Has(path) {
+			t.Errorf("%s was evicted", path)
+		}
+	}
+	for i := range 20 {
+		path := fmt.Sprintf("project-2/shard-%d", i)
+		if want := i >= 17; cache.Has(path) != want {
+			t.Errorf("%s cached = %v, want %v", path, !want, want)
+		}
+	}
+
+	// Files directly under the root belong to no project.
+	if err := cache.Put("top-level", []byte("x"), 0o644); err != ErrWontCache {
+		t.Errorf("Put of a file under the root = %v, want %v", err, ErrWontCache)
+	}
+}
+
+func TestPartitionLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		quotas  Quotas
+		limit   int64
+		want    map[string]int
+		wantErr bool
+	}{
+		// project-1 has 300 of the 900 bytes, the rest is split between project-2, project-3 and
+		// project-4, which isn't given up front.
+		{name: "share", quotas: Quotas{"project-1": 300}, limit: 900, want: map[string]int{"project-1": 3, "project-2": 3, "project-3": 3, "project-4": 3}},
+		{name: "default", quotas: Quotas{"default": 200}, limit: 900, want: map[string]int{"project-1": 2, "project-2": 2, "project-3": 2, "project-4": 2}},
+		{name: "nothing left", quotas: Quotas{"project-1": 900}, limit: 900, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			projects := []string{"project-1", "project-2", "project-3"}
+			cache, err := NewPartitionedCache(t.TempDir(), projects, tc.quotas, tc.limit, byteLRUPartition)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("NewPartitionedCache succeeded with no bytes left to share")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for project, want := range tc.want {
+				for i := range 5 {
+					if err := cache.Put(fmt.Sprintf("%s/%d", project, i), make([]byte, 100), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				cached := 0
+				for i := range 5 {
+					if cache.Has(fmt.Sprintf("%s/%d", project, i)) {
+						cached++
+					}
+				}
+				if cached != want {
+					t.Errorf("%s kept %d files, want %d", project, cached, want)
+				}
+			}
+		})
+	}
+}
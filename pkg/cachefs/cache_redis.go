@@ -0,0 +1,409 @@
+package cachefs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redisRetryInterval is how long a Redis cache stays local-only after Redis can't be reached, before
+// trying it again.
+const redisRetryInterval = 10 * time.Second
+
+// NewRedisCache is an LRU cache whose index (which files are cached, their sizes and how recently
+// they were read) is kept in Redis, while the files stay in ssdBasePath. Several processes sharing
+// the directory (and cfg.Prefix) then share the limits and evict each other's least recently used
+// files, rather than each believing it owns the directory. capacity and byteLimit are as for
+// NewHybridCache.
+//
+// If Redis can't be reached, the cache carries on with a local index of its own (files cached by
+// the other processes aren't known, and may be evicted), and tries Redis again every
+// redisRetryInterval.
+func NewRedisCache(ssdBasePath string, capacity int, byteLimit int64, cfg RedisConfig) (Cache, error) {
+	if capacity == 0 && byteLimit == 0 {
+		return nil, errNoCapacity
+	}
+	r := &redisCache{
+		ssdBasePath: ssdBasePath,
+		capacity:    capacity,
+		byteLimit:   byteLimit,
+		redis:       newRedisClient(cfg),
+	}
+	if _, err := r.redis.do("PING"); err != nil {
+		r.degrade(err)
+	}
+	return r, nil
+}
+
+type redisCache struct {
+	ssdBasePath string
+	capacity    int   // 0 for no limit
+	byteLimit   int64 // 0 for no limit
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file within this process
+	evictHooks
+
+	redis *redisClient
+
+	localMu    sync.Mutex
+	local      Cache     // Used while Redis can't be reached, nil otherwise
+	retryAfter time.Time // When to try Redis again
+
+	evicted, redisErrors, degradations atomic.Int64
+}
+
+// The index in Redis: a sorted set of the cached keys scored by when they were last used (ticks of
+// a shared clock), a hash of their sizes, and the total of those sizes. The scripts run atomically,
+// so processes can't interleave partial updates.
+const (
+	// KEYS: recency, sizes, bytes, clock. ARGV: key, size, capacity, byteLimit.
+	// Returns the evicted keys and their sizes, flattened.
+	redisAdmitScript = `
+local old = tonumber(redis.call('HGET', KEYS[2], ARGV[1])) or 0
+local size = tonumber(ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], size)
+redis.call('ZADD', KEYS[1], redis.call('INCR', KEYS[4]), ARGV[1])
+local bytes = redis.call('INCRBY', KEYS[3], size - old)
+local capacity, limit = tonumber(ARGV[3]), tonumber(ARGV[4])
+local evicted = {}
+while (capacity > 0 and redis.call('ZCARD', KEYS[1]) > capacity) or (limit > 0 and bytes > limit) do
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 1)
+	local victim = oldest[1]
+	if victim == ARGV[1] then victim = oldest[2] end
+	if not victim then break end
+	local victimSize = tonumber(redis.call('HGET', KEYS[2], victim)) or 0
+	redis.call('ZREM', KEYS[1], victim)
+	redis.call('HDEL', KEYS[2], victim)
+	bytes = redis.call('INCRBY', KEYS[3], -victimSize)
+	table.insert(evicted, victim)
+	table.insert(evicted, victimSize)
+end
+return evicted`
+
+	// KEYS: recency, clock. ARGV: key. Returns 1 if the key is cached, after marking it used.
+	redisTouchScript = `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('ZADD', KEYS[1], redis.call('INCR', KEYS[2]), ARGV[1])
+	return 1
+end
+return 0`
+
+	// KEYS: recency, sizes, bytes. ARGV: key. Returns 1 if the key was cached.
+	redisRemoveScript = `
+local size = redis.call('HGET', KEYS[2], ARGV[1])
+if not size then return 0 end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('INCRBY', KEYS[3], -tonumber(size))
+return 1`
+)
+
+// fallback returns the local cache to use instead of Redis, or nil if Redis should be tried.
+func (r *redisCache) fallback() Cache {
+	r.localMu.Lock()
+	defer r.localMu.Unlock()
+
+	if r.local != nil && time.Now().After(r.retryAfter) {
+		if _, err := r.redis.do("PING"); err == nil {
+			log.Printf("REDIS: %s is reachable again, using the shared index", r.redis.cfg.Addr)
+			r.local = nil
+		} else {
+			r.retryAfter = time.Now().Add(redisRetryInterval)
+		}
+	}
+	return r.local
+}
+
+// degrade switches to a local index after Redis couldn't be reached, and returns it.
+func (r *redisCache) degrade(err error) Cache {
+	r.redisErrors.Add(1)
+
+	r.localMu.Lock()
+	defer r.localMu.Unlock()
+
+	r.retryAfter = time.Now().Add(redisRetryInterval)
+	if r.local == nil {
+		log.Printf("WARNING: Redis at %s can't be reached, using a local index until it can: %v", r.redis.cfg.Addr, err)
+		local, _ := NewHybridCache(r.ssdBasePath, r.capacity, r.byteLimit, false) // Can't fail, NewRedisCache checked the limits
+		local.(SyncWriter).SetSyncWrites(r.syncWrites)
+		local.(EvictNotifier).OnEvict(r.notifyEvicted)
+		r.local = local
+		r.degradations.Add(1)
+	}
+	return r.local
+}
+
+// eval runs one of the index scripts.
+func (r *redisCache) eval(script string, keys []string, args ...any) (any, error) {
+	cmd := append([]any{"EVAL", script, len(keys)}, toAny(keys)...)
+	reply, err := r.redis.do(append(cmd, args...)...)
+	if err != nil && !isRedisUnreachable(err) {
+		r.redisErrors.Add(1)
+		log.Printf("ERROR: Redis index script failed: %v", err)
+	}
+	return reply, err
+}
+
+func toAny[T any](s []T) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+// present reports whether the key is in the shared index.
+func (r *redisCache) present(flatPath string) (bool, error) {
+	reply, err := r.redis.do("ZSCORE", r.redis.key("recency"), flatPath)
+	return reply != nil, err
+}
+
+func (r *redisCache) SetSyncWrites(enabled bool) {
+	r.syncWrites = enabled
+}
+
+func (r *redisCache) Get(path string) ([]byte, error) {
+	if local := r.fallback(); local != nil {
+		return local.Get(path)
+	}
+	flatPath := flattenDirPath(path)
+
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	reply, err := r.eval(redisTouchScript, []string{r.redis.key("recency"), r.redis.key("clock")}, flatPath)
+	if isRedisUnreachable(err) {
+		return r.degrade(err).Get(path)
+	} else if err != nil {
+		return nil, err
+	} else if redisInt(reply) == 0 {
+		return nil, ErrNotFoundCache
+	}
+
+	// Another process may have evicted the file since.
+	cachedData, err := os.ReadFile(cacheFileName(r.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+	return cachedData, nil
+}
+
+// Has checks the shared index, so it reports files put by other processes too.
+func (r *redisCache) Has(path string) bool {
+	if local := r.fallback(); local != nil {
+		return local.Has(path)
+	}
+	present, err := r.present(flattenDirPath(path))
+	if isRedisUnreachable(err) {
+		return r.degrade(err).Has(path)
+	}
+	return err == nil && present
+}
+
+func (r *redisCache) Put(path string, data []byte, mode os.FileMode) error {
+	if local := r.fallback(); local != nil {
+		return local.Put(path, data, mode)
+	}
+	if r.byteLimit > 0 && int64(len(data)) > r.byteLimit {
+		// Whatever was cached before is out of date, so it can't stay either.
+		if err := r.Delete(path); err != nil {
+			log.Printf("ERROR: Failed to remove refused file '%s': %v", path, err)
+		}
+		return ErrWontCache
+	}
+	flatPath := flattenDirPath(path)
+
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(cacheFileName(r.ssdBasePath, flatPath), data, mode, r.syncWrites); err != nil {
+		keyLock.Unlock()
+		return err
+	}
+
+	keys := []string{r.redis.key("recency"), r.redis.key("sizes"), r.redis.key("bytes"), r.redis.key("clock")}
+	reply, err := r.eval(redisAdmitScript, keys, flatPath, len(data), r.capacity, r.byteLimit)
+	keyLock.Unlock()
+	if isRedisUnreachable(err) {
+		// The file is written, but only the local index can know about it.
+		return r.degrade(err).(*lruCache).index(path, int64(len(data)))
+	} else if err != nil {
+		return err
+	}
+
+	evicted, _ := reply.([]any)
+	for i := 0; i+1 < len(evicted); i += 2 {
+		key, _ := evicted[i].(string)
+		if r.removeEvicted(key) {
+			r.evicted.Add(1)
+			r.notifyEvicted(unflattenDirPath(key), redisInt(evicted[i+1]))
+		}
+	}
+	return nil
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime (by any process). It reports whether the key is still evicted.
+func (r *redisCache) removeEvicted(flatPath string) bool {
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if present, err := r.present(flatPath); present || err != nil {
+		return false
+	}
+
+	fileName := cacheFileName(r.ssdBasePath, flatPath)
+	if err := removeCacheFile(r.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the index no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+func (r *redisCache) Delete(path string) error {
+	if local := r.fallback(); local != nil {
+		return local.Delete(path)
+	}
+	flatPath := flattenDirPath(path)
+
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	// Unindex it first, so no other process serves the file while it's being removed.
+	_, err := r.eval(redisRemoveScript, []string{r.redis.key("recency"), r.redis.key("sizes"), r.redis.key("bytes")}, flatPath)
+	if isRedisUnreachable(err) {
+		return r.degrade(err).Delete(path)
+	} else if err != nil {
+		return err
+	}
+	return removeCacheFile(r.ssdBasePath, cacheFileName(r.ssdBasePath, flatPath))
+}
+
+// Clear empties the shared index and the directory, for every process sharing them.
+func (r *redisCache) Clear() error {
+	if local := r.fallback(); local != nil {
+		return local.Clear()
+	}
+
+	r.keyLocks.lockAll()
+	defer r.keyLocks.unlockAll()
+
+	if _, err := r.redis.do("DEL", r.redis.key("recency"), r.redis.key("sizes"), r.redis.key("bytes")); err != nil {
+		return err
+	}
+	return clearDir(r.ssdBasePath)
+}
+
+func (r *redisCache) SetMode(path string, mode os.FileMode) error {
+	if local := r.fallback(); local != nil {
+		return local.(ModeSetter).SetMode(path, mode)
+	}
+	flatPath := flattenDirPath(path)
+
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if present, err := r.present(flatPath); err != nil {
+		return err
+	} else if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(r.ssdBasePath, flatPath, mode)
+}
+
+// removeOrphan only removes files the shared index doesn't know about, so never those other
+// processes cached. Nothing is removed while Redis can't be reached, as the local index doesn't
+// know about them.
+func (r *redisCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	if r.fallback() != nil {
+		return 0, false, fmt.Errorf("redis at %s can't be reached", r.redis.cfg.Addr)
+	}
+
+	keyLock := r.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	if present, err := r.present(flatPath); err != nil || present {
+		return 0, false, err
+	}
+	return removeOrphanFile(r.ssdBasePath, flatPath, before, dryRun)
+}
+
+func (r *redisCache) Len() int {
+	if local := r.fallback(); local != nil {
+		return local.(Inspector).Len()
+	}
+	reply, _ := r.redis.do("ZCARD", r.redis.key("recency"))
+	return int(redisInt(reply))
+}
+
+func (r *redisCache) Bytes() int64 {
+	if local := r.fallback(); local != nil {
+		return local.(Inspector).Bytes()
+	}
+	reply, _ := r.redis.do("GET", r.redis.key("bytes"))
+	return redisInt(reply)
+}
+
+// Keys returns the paths in the shared index, least recently used first.
+func (r *redisCache) Keys() []string {
+	if local := r.fallback(); local != nil {
+		return local.(Inspector).Keys()
+	}
+	reply, _ := r.redis.do("ZRANGE", r.redis.key("recency"), 0, -1)
+	members, _ := reply.([]any)
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		if key, ok := member.(string); ok {
+			keys = append(keys, unflattenDirPath(key))
+		}
+	}
+	return keys
+}
+
+// Dump reports the shared eviction order, least recently used first, or the local one's while
+// Redis can't be reached.
+func (r *redisCache) Dump(w io.Writer) {
+	if local := r.fallback(); local != nil {
+		fmt.Fprintf(w, "redis at %s can't be reached, local index:\n", r.redis.cfg.Addr)
+		local.(Dumper).Dump(w)
+		return
+	}
+	keys := r.Keys()
+	fmt.Fprintf(w, "entries: %d, bytes: %d (shared through redis at %s, least recently used first)\n", len(keys), r.Bytes(), r.redis.cfg.Addr)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\n", key)
+	}
+}
+
+func (r *redisCache) Stats() Stats {
+	stats := Stats{}
+	local := r.fallback()
+	if local != nil {
+		stats = statsOf(local)
+	} else {
+		stats["redis_entries"] = int64(r.Len())
+		stats["redis_bytes"] = r.Bytes()
+	}
+	stats["redis_evicted"] = r.evicted.Load()
+	stats["redis_errors"] = r.redisErrors.Load()
+	stats["redis_degradations"] = r.degradations.Load()
+	if local != nil {
+		stats["redis_degraded"] = 1
+	} else {
+		stats["redis_degraded"] = 0
+	}
+	return stats
+}
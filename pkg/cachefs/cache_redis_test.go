@@ -0,0 +1,94 @@
+package cachefs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisCache(t *testing.T, m *miniredis.Miniredis, dir string, capacity int) *redisCache {
+	t.Helper()
+	return must(NewRedisCache(dir, capacity, 0, RedisConfig{Addr: m.Addr(), Prefix: "test"})).(*redisCache)
+}
+
+func TestRedisCacheSharesIndex(t *testing.T) {
+	m := miniredis.RunT(t)
+	dir := t.TempDir()
+	first, second := newTestRedisCache(t, m, dir, 2), newTestRedisCache(t, m, dir, 2)
+
+	for _, path := range []string{"a", "b"} {
+		if err := first.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := second.Get("a"); err != nil || string(got) != "a" {
+		t.Fatalf("second.Get(a) = %q, %v, want the file the first put", got, err)
+	}
+
+	// a was just read, so b is the least recently used of the shared index, and makes room for c.
+	if err := second.Put("c", []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if first.Has("b") {
+		t.Error("b is still cached, want it evicted by the second cache's Put")
+	}
+	if _, err := first.Get("b"); err != ErrNotFoundCache {
+		t.Errorf("first.Get(b) after eviction: got %v, want %v", err, ErrNotFoundCache)
+	}
+	for _, path := range []string{"a", "c"} {
+		if got, err := first.Get(path); err != nil || string(got) != path {
+			t.Errorf("first.Get(%s) = %q, %v", path, got, err)
+		}
+	}
+
+	if err := first.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if second.Has("a") {
+		t.Error("a is still cached after the first cache deleted it")
+	}
+	if n, _ := m.ZMembers("test:recency"); len(n) != 1 {
+		t.Errorf("index has %v, want only c", n)
+	}
+}
+
+func TestRedisCacheFallsBackToLocalIndex(t *testing.T) {
+	m := miniredis.RunT(t)
+	dir := t.TempDir()
+	c := newTestRedisCache(t, m, dir, 10)
+	if err := c.Put("a", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+	if err := c.Put("b", []byte("b"), 0o644); err != nil {
+		t.Fatalf("Put with Redis down: %v", err)
+	}
+	if got := statsOf(c)["redis_degradations"]; got != 1 {
+		t.Errorf("got %d degradations, want 1", got)
+	}
+	for _, path := range []string{"a", "b"} {
+		if got, err := c.Get(path); err != nil || string(got) != path {
+			t.Errorf("Get(%s) with Redis down = %q, %v", path, got, err)
+		}
+	}
+	if local := c.local.(*lruCache); local.Len() != 2 {
+		t.Errorf("local index has %d files, want 2", local.Len())
+	}
+}
+
+func TestRedisClientRejectsUnsupportedArguments(t *testing.T) {
+	m := miniredis.RunT(t)
+	c := newRedisClient(RedisConfig{Addr: m.Addr()})
+
+	if _, err := c.do("SET", "k", 1.5); !errors.Is(err, errRedisArgument) {
+		t.Fatalf("got %v, want %v", err, errRedisArgument)
+	} else if isRedisUnreachable(err) {
+		t.Errorf("%v is taken for Redis being unreachable", err)
+	}
+	// Nothing was sent, so the connection is still in step.
+	if reply, err := c.do("PING"); err != nil || reply != "PONG" {
+		t.Errorf("PING after the rejected command = %v, %v", reply, err)
+	}
+}
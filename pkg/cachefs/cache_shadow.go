@@ -0,0 +1,236 @@
+package cachefs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewShadowCache wraps a cache to simulate another alongside it, eg. to answer what hit rate a
+// bigger cache would get. The simulated cache is given as policy:size (eg. lru:500GB, for any of
+// EvictionPolicies), and only keeps an index in memory: every file the workload reads or caches is
+// recorded in it, as if the simulated cache were the real one, but nothing is written for it. Its
+// hits, misses and evictions are in Stats, and logged every logEvery if it's set. The wrapped cache
+// is used as it would be without the shadow.
+func NewShadowCache(inner Cache, spec string, logEvery time.Duration) (Cache, error) {
+	policyName, size, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid shadow cache %q, must be policy:size", spec)
+	}
+	policy, err := evictionPolicyNamed(policyName)
+	if err != nil {
+		return nil, err
+	}
+	var byteLimit ByteSize
+	if err := byteLimit.Set(size); err != nil {
+		return nil, err
+	} else if byteLimit <= 0 {
+		return nil, errNoByteLimit
+	}
+
+	s := &shadowCache{
+		Cache:     inner,
+		spec:      spec,
+		policy:    policy,
+		byteLimit: int64(byteLimit),
+		queue:     list.New(),
+		entries:   make(map[string]*list.Element),
+		stop:      make(chan struct{}),
+	}
+	if logEvery > 0 {
+		go s.logEvery(logEvery)
+	}
+	return s, nil
+}
+
+type shadowCache struct {
+	Cache
+	spec      string
+	policy    evictionPolicy
+	byteLimit int64
+
+	mu        sync.Mutex
+	queue     *list.List               // Of *lruEntry, in the policy's order
+	entries   map[string]*list.Element // Path -> its place in queue
+	byteCount int64
+
+	hits, misses, evicted int64 // Guarded by mu
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func (s *shadowCache) Unwrap() Cache {
+	return s.Cache
+}
+
+func (s *shadowCache) Get(path string) ([]byte, error) {
+	data, err := s.Cache.Get(path)
+	s.read(path, int64(len(data)), err == nil)
+	return data, err
+}
+
+func (s *shadowCache) GetEntry(path string) (Entry, error) {
+	entry, err := getEntry(s.Cache, path)
+	s.read(path, entry.Size, err == nil)
+	return entry, err
+}
+
+// StatEntry isn't a read, so isn't recorded.
+func (s *shadowCache) StatEntry(path string) (Entry, error) {
+	return statEntry(s.Cache, path)
+}
+
+func (s *shadowCache) GetReader(path string) (io.ReadSeekCloser, error) {
+	r, err := getReader(s.Cache, path)
+	if err != nil {
+		s.read(path, 0, false)
+		return nil, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	s.read(path, size, true)
+	return r, nil
+}
+
+// Put records the file as cached in the simulated cache whether or not the wrapped cache took it,
+// as the simulated cache would have.
+func (s *shadowCache) Put(path string, data []byte, mode os.FileMode) error {
+	err := s.Cache.Put(path, data, mode)
+	s.mu.Lock()
+	s.add(path, int64(len(data)))
+	s.mu.Unlock()
+	return err
+}
+
+func (s *shadowCache) PutReader(path string, r io.Reader, mode os.FileMode) (int64, error) {
+	written, err := putReader(s.Cache, path, r, mode)
+	if err == nil || err == ErrWontCache {
+		s.mu.Lock()
+		s.add(path, written)
+		s.mu.Unlock()
+	}
+	return written, err
+}
+
+// read records a read of the file, which is a hit if the simulated cache has it. A file the wrapped
+// cache had but the simulated one didn't would have been fetched and cached, so it's added.
+func (s *shadowCache) read(path string, size int64, cached bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[path]; ok {
+		s.hits++
+		s.policy.PromoteOnGet(s.queue, el)
+		return
+	}
+	s.misses++
+	if cached {
+		s.add(path, size)
+	}
+}
+
+// add caches the file in the simulated cache, or updates its size, then evicts files (other than it)
+// until the cache is within its limit. Files bigger than the limit aren't cached.
+// Must be called with mu held.
+func (s *shadowCache) add(path string, size int64) {
+	if el, ok := s.entries[path]; ok {
+		entry := el.Value.(*lruEntry)
+		s.byteCount += size - entry.size
+		entry.size = size
+		s.policy.PromoteOnGet(s.queue, el)
+	} else if size <= s.byteLimit {
+		s.entries[path] = s.policy.InsertOrder(s.queue, &lruEntry{key: path, size: size})
+		s.byteCount += size
+	} else {
+		return
+	}
+
+	for el := range s.policy.Victim(s.queue) {
+		if s.byteCount <= s.byteLimit {
+			return
+		}
+		entry := el.Value.(*lruEntry)
+		if entry.key == path {
+			continue
+		}
+		s.queue.Remove(el)
+		delete(s.entries, entry.key)
+		s.byteCount -= entry.size
+		s.evicted++
+	}
+}
+
+// Delete forgets the file in the simulated cache too, as it's been invalidated.
+func (s *shadowCache) Delete(path string) error {
+	s.mu.Lock()
+	if el, ok := s.entries[path]; ok {
+		s.queue.Remove(el)
+		delete(s.entries, path)
+		s.byteCount -= el.Value.(*lruEntry).size
+	}
+	s.mu.Unlock()
+	return s.Cache.Delete(path)
+}
+
+func (s *shadowCache) Clear() error {
+	s.mu.Lock()
+	s.queue.Init()
+	clear(s.entries)
+	s.byteCount = 0
+	s.mu.Unlock()
+	return s.Cache.Clear()
+}
+
+// Close stops logging the simulated cache's stats.
+func (s *shadowCache) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	if closer, ok := findCache[io.Closer](s.Cache); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *shadowCache) logEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+		hits, misses, evicted, entries, bytes := s.hits, s.misses, s.evicted, len(s.entries), s.byteCount
+		s.mu.Unlock()
+
+		var ratio float64
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses) * 100
+		}
+		log.Printf("SHADOW: %s would have hit %.1f%% of reads (%d hits, %d misses), evicting %d files, holding %d files (%d bytes)", s.spec, ratio, hits, misses, evicted, entries, bytes)
+	}
+}
+
+func (s *shadowCache) Stats() Stats {
+	stats := statsOf(s.Cache)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats["shadow_hits"] = s.hits
+	stats["shadow_misses"] = s.misses
+	stats["shadow_evicted"] = s.evicted
+	stats["shadow_entries"] = int64(len(s.entries))
+	stats["shadow_bytes"] = s.byteCount
+	return stats
+}
@@ -0,0 +1,60 @@
+package cachefs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShadowCacheCounters(t *testing.T) {
+	inner := NewMemCache(1 << 20)
+	cache, err := NewShadowCache(inner, "lru:30B", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.(*shadowCache).Close() })
+
+	// The shadow holds three 10 byte files. b is read again after it was evicted from the shadow,
+	// but not from the real cache.
+	var realHits int
+	for _, path := range []string{"a", "b", "c", "a", "d", "a", "b"} {
+		if _, err := cache.Get(path); err == nil {
+			realHits++
+			continue
+		}
+		if err := cache.Put(path, make([]byte, 10), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if realHits != 3 {
+		t.Errorf("%d real hits, want 3", realHits)
+	}
+
+	stats := statsOf(cache)
+	for key, want := range map[string]int64{
+		"shadow_hits":    2,
+		"shadow_misses":  5,
+		"shadow_evicted": 2,
+		"shadow_entries": 3,
+		"shadow_bytes":   30,
+		"mem_entries":    4,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %d, want %d", key, stats[key], want)
+		}
+	}
+	if err := cache.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := statsOf(cache); stats["shadow_entries"] != 2 || stats["shadow_bytes"] != 20 {
+		t.Errorf("after Delete, shadow has %d files of %d bytes, want 2 of 20",
+			stats["shadow_entries"], stats["shadow_bytes"])
+	}
+}
+
+func TestShadowCacheInvalidSpecs(t *testing.T) {
+	for _, spec := range []string{"lru", "random:1GB", "lru:lots", "lru:0"} {
+		if _, err := NewShadowCache(NewMemCache(1), spec, time.Minute); err == nil {
+			t.Errorf("NewShadowCache(%q) succeeded", spec)
+		}
+	}
+}
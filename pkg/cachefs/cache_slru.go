@@ -0,0 +1,450 @@
+package cachefs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewSLRUCache caches files with a Segmented LRU policy. New files go into a probation segment, and
+// a second read promotes them to a protected segment, which gets protectedFraction of the cache's
+// limits. Files are evicted from probation first, least recently used first, and when protected
+// outgrows its share its least recently used files are demoted back to probation, to be promoted
+// again if they're read there. A burst of files read once then only churns probation, leaving the
+// files read repeatedly in protected. It is limited by the number of files, the bytes they take
+// up, or both. A limit of 0 means none (but not both, which is an error), and files bigger than
+// byteLimit are refused. protectedFraction must be between 0 and 1.
+func NewSLRUCache(ssdBasePath string, capacity int, byteLimit int64, protectedFraction float64) (Cache, error) {
+	if capacity == 0 && byteLimit == 0 {
+		return nil, errNoCapacity
+	} else if protectedFraction <= 0 || protectedFraction >= 1 {
+		return nil, fmt.Errorf("protected share of the slru cache must be between 0 and 1, not %g", protectedFraction)
+	}
+	return &slruCache{
+		ssdBasePath:    ssdBasePath,
+		capacity:       capacity,
+		byteLimit:      byteLimit,
+		protectedCap:   int(float64(capacity) * protectedFraction),
+		protectedLimit: int64(float64(byteLimit) * protectedFraction),
+		probation:      list.New(),
+		protected:      list.New(),
+		entries:        make(map[string]*list.Element),
+	}, nil
+}
+
+type slruCache struct {
+	ssdBasePath    string
+	capacity       int   // 0 for no limit
+	byteLimit      int64 // 0 for no limit
+	protectedCap   int   // Files protected may hold before demoting, 0 for no limit (or none, with capacity)
+	protectedLimit int64 // Bytes protected may hold before demoting, likewise
+	syncWrites     bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	// Guards the bookkeeping below. Never held during disk I/O. Both lists hold *slruEntry, least
+	// recently used at the front.
+	cacheMu            sync.Mutex
+	probation          *list.List
+	protected          *list.List
+	entries            map[string]*list.Element // Key -> its place in whichever segment it's in
+	byteCount          int64                    // Of the files in both segments
+	protectedByteCount int64
+
+	evicted, promoted, demoted atomic.Int64
+}
+
+type slruEntry struct {
+	key     string
+	size    int64
+	segment *list.List
+}
+
+func (s *slruCache) SetSyncWrites(enabled bool) {
+	s.syncWrites = enabled
+}
+
+func (s *slruCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+
+	s.cacheMu.Lock()
+	if !s.hit(flatPath) {
+		s.cacheMu.Unlock()
+		return nil, ErrNotFoundCache
+	}
+	s.cacheMu.Unlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(s.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// Has doesn't count as a read, so doesn't promote the file.
+func (s *slruCache) Has(path string) bool {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	_, present := s.entries[flattenDirPath(path)]
+	return present
+}
+
+func (s *slruCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	if s.byteLimit > 0 && int64(len(data)) > s.byteLimit {
+		defer keyLock.Unlock()
+		// Whatever was cached before is out of date, so it can't stay either.
+		s.cacheMu.Lock()
+		s.remove(flatPath)
+		s.cacheMu.Unlock()
+		if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+			log.Printf("ERROR: Failed to remove refused file %s: %v", fileName, err)
+		}
+		return ErrWontCache
+	}
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(fileName, data, mode, s.syncWrites); err != nil {
+		keyLock.Unlock()
+		return err
+	}
+
+	s.cacheMu.Lock()
+	evicted := s.add(flatPath, int64(len(data)))
+	s.cacheMu.Unlock()
+
+	// Let go of our own key before taking the evicted ones', so two Puts evicting each other's keys
+	// can't deadlock.
+	keyLock.Unlock()
+
+	for _, entry := range evicted {
+		if s.removeEvicted(entry.key) {
+			s.notifyEvicted(unflattenDirPath(entry.key), entry.size)
+		}
+	}
+	return nil
+}
+
+// hit records a read of the key: a file on probation is promoted to protected, and a protected file
+// moves to its most recently used end. Reports whether the key is cached.
+// Must be called with cacheMu held.
+func (s *slruCache) hit(key string) bool {
+	el, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	entry := el.Value.(*slruEntry)
+	if entry.segment == s.protected {
+		s.protected.MoveToBack(el)
+		return true
+	}
+
+	s.moveTo(el, s.protected)
+	s.promoted.Add(1)
+	// Demote the least recently used protected files until it fits its share again, other than the
+	// file just promoted.
+	for s.protectedFull() && s.protected.Len() > 1 {
+		s.moveTo(s.protected.Front(), s.probation)
+		s.demoted.Add(1)
+	}
+	return true
+}
+
+// add caches the key on probation, or counts putting a cached key again as a read of it, then
+// evicts files until the cache is within its limits. The evicted entries are returned. The key
+// itself is never evicted, or a new file would be the first to go whenever probation was empty.
+// Must be called with cacheMu held.
+func (s *slruCache) add(key string, size int64) []slruEntry {
+	if el, ok := s.entries[key]; ok {
+		entry := el.Value.(*slruEntry)
+		s.resize(entry, size)
+		s.hit(key)
+	} else {
+		entry := &slruEntry{key: key, segment: s.probation}
+		s.entries[key] = s.probation.PushBack(entry)
+		s.resize(entry, size)
+	}
+
+	var evicted []slruEntry
+	for s.full() && len(s.entries) > 1 {
+		el := s.probation.Front()
+		if el != nil && el.Value.(*slruEntry).key == key {
+			el = el.Next()
+		}
+		if el == nil {
+			el = s.protected.Front()
+			if el.Value.(*slruEntry).key == key {
+				el = el.Next()
+			}
+		}
+		entry := *el.Value.(*slruEntry)
+		s.remove(entry.key)
+		s.evicted.Add(1)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// full reports whether the cache is over either of its limits.
+// Must be called with cacheMu held.
+func (s *slruCache) full() bool {
+	return (s.capacity > 0 && len(s.entries) > s.capacity) || (s.byteLimit > 0 && s.byteCount > s.byteLimit)
+}
+
+// protectedFull reports whether protected is over either of its shares of the limits.
+// Must be called with cacheMu held.
+func (s *slruCache) protectedFull() bool {
+	return (s.capacity > 0 && s.protected.Len() > s.protectedCap) || (s.byteLimit > 0 && s.protectedByteCount > s.protectedLimit)
+}
+
+// resize changes the entry's size, keeping the byte counts up to date.
+// Must be called with cacheMu held.
+func (s *slruCache) resize(entry *slruEntry, size int64) {
+	s.byteCount += size - entry.size
+	if entry.segment == s.protected {
+		s.protectedByteCount += size - entry.size
+	}
+	entry.size = size
+}
+
+// moveTo moves the entry in the element to the most recently used end of the segment.
+// Must be called with cacheMu held.
+func (s *slruCache) moveTo(el *list.Element, to *list.List) {
+	entry := el.Value.(*slruEntry)
+	if entry.segment == s.protected {
+		s.protectedByteCount -= entry.size
+	}
+	entry.segment.Remove(el)
+	entry.segment = to
+	s.entries[entry.key] = to.PushBack(entry)
+	if to == s.protected {
+		s.protectedByteCount += entry.size
+	}
+}
+
+// remove drops the key, if it is present.
+// Must be called with cacheMu held.
+func (s *slruCache) remove(key string) {
+	el, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*slruEntry)
+	s.resize(entry, 0)
+	entry.segment.Remove(el)
+	delete(s.entries, key)
+}
+
+// removeEvicted deletes the file of an evicted key from SSD, unless it has been put back in the
+// meantime. It reports whether the key is still evicted.
+func (s *slruCache) removeEvicted(flatPath string) bool {
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.entries[flatPath]
+	s.cacheMu.Unlock()
+	if present {
+		return false
+	}
+
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+		// The file is orphaned, but the cache no longer considers it present so it won't be served.
+		log.Printf("ERROR: Failed to remove evicted file %s: %v", fileName, err)
+	}
+	return true
+}
+
+func (s *slruCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.entries[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(s.ssdBasePath, flatPath)
+	if err := removeCacheFile(s.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	s.cacheMu.Lock()
+	s.remove(flatPath)
+	s.cacheMu.Unlock()
+
+	return nil
+}
+
+func (s *slruCache) Clear() error {
+	s.keyLocks.lockAll()
+	defer s.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	s.cacheMu.Lock()
+	s.probation.Init()
+	s.protected.Init()
+	clear(s.entries)
+	s.byteCount = 0
+	s.protectedByteCount = 0
+	s.cacheMu.Unlock()
+
+	return clearDir(s.ssdBasePath)
+}
+
+// Victim returns the file that putting size bytes at path would evict first, or false if they
+// would fit without evicting anything.
+func (s *slruCache) Victim(path string, size int64) (string, bool) {
+	flatPath := flattenDirPath(path)
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	count, byteCount := len(s.entries)+1, s.byteCount+size
+	if el, ok := s.entries[flatPath]; ok {
+		count--
+		byteCount -= el.Value.(*slruEntry).size
+	}
+	if (s.capacity == 0 || count <= s.capacity) && (s.byteLimit == 0 || byteCount <= s.byteLimit) {
+		return "", false
+	}
+
+	for _, segment := range []*list.List{s.probation, s.protected} {
+		for el := segment.Front(); el != nil; el = el.Next() {
+			if key := el.Value.(*slruEntry).key; key != flatPath {
+				return unflattenDirPath(key), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *slruCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.entries[flatPath]
+	s.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(s.ssdBasePath, flatPath, mode)
+}
+
+func (s *slruCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := s.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	s.cacheMu.Lock()
+	_, present := s.entries[flatPath]
+	s.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(s.ssdBasePath, flatPath, before, dryRun)
+}
+
+// slruKeys returns the keys in the segment, least recently used first.
+// Must be called with cacheMu held.
+func slruKeys(segment *list.List) []string {
+	keys := make([]string, 0, segment.Len())
+	for el := segment.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*slruEntry).key)
+	}
+	return keys
+}
+
+func (s *slruCache) Len() int {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return len(s.entries)
+}
+
+func (s *slruCache) Bytes() int64 {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return s.byteCount
+}
+
+// Keys returns the cached paths in the order they'd be evicted: probation before protected, least
+// recently used first within each.
+func (s *slruCache) Keys() []string {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	keys := append(slruKeys(s.probation), slruKeys(s.protected)...)
+	for i, key := range keys {
+		keys[i] = unflattenDirPath(key)
+	}
+	return keys
+}
+
+// Dump reports both segments, least recently used first, with the size of each file.
+func (s *slruCache) Dump(w io.Writer) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.capacity > 0 {
+		fmt.Fprintf(w, "entries: %d/%d, protected: %d/%d (least recently used first)\n", len(s.entries), s.capacity, s.protected.Len(), s.protectedCap)
+	} else {
+		fmt.Fprintf(w, "entries: %d, protected: %d (least recently used first)\n", len(s.entries), s.protected.Len())
+	}
+	if s.byteLimit > 0 {
+		fmt.Fprintf(w, "bytes: %d/%d, protected: %d/%d\n", s.byteCount, s.byteLimit, s.protectedByteCount, s.protectedLimit)
+	}
+	for _, segment := range []struct {
+		name string
+		list *list.List
+	}{{"probation", s.probation}, {"protected", s.protected}} {
+		fmt.Fprintf(w, "%s:\n", segment.name)
+		for el := segment.list.Front(); el != nil; el = el.Next() {
+			entry := el.Value.(*slruEntry)
+			fmt.Fprintf(w, "  %s size=%d\n", unflattenDirPath(entry.key), entry.size)
+		}
+	}
+}
+
+func (s *slruCache) Stats() Stats {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return Stats{
+		"slru_probation_entries": int64(s.probation.Len()),
+		"slru_protected_entries": int64(s.protected.Len()),
+		"slru_bytes":             s.byteCount,
+		"slru_protected_bytes":   s.protectedByteCount,
+		"slru_promoted":          s.promoted.Load(),
+		"slru_demoted":           s.demoted.Load(),
+		"slru_evicted":           s.evicted.Load(),
+	}
+}
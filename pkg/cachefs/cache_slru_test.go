@@ -0,0 +1,59 @@
+package cachefs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSLRUResistsBursts(t *testing.T) {
+	workingSet := []string{"lib/a.py", "lib/b.py", "lib/c.py", "lib/d.py"}
+	var trace []string
+	for range 2 {
+		trace = append(trace, workingSet...)
+	}
+	// Each burst of files read once is bigger than the whole cache.
+	for burst := range 3 {
+		for i := range 20 {
+			trace = append(trace, fmt.Sprintf("burst-%d/%d.bin", burst, i))
+		}
+		trace = append(trace, workingSet...)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cache    func(dir string) Cache
+		wantHits int
+	}{
+		// Only the second read of the working set hits, every burst flushes it.
+		{"lru", func(dir string) Cache { return must(NewLRUCache(dir, 10, false)) }, 4},
+		// The working set is protected, so it hits after every burst too.
+		{"slru", func(dir string) Cache { return must(NewSLRUCache(dir, 10, 0, 0.5)) }, 16},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if hits := replay(t, tc.cache(t.TempDir()), trace); hits != tc.wantHits {
+				t.Errorf("%d hits, want %d", hits, tc.wantHits)
+			}
+		})
+	}
+}
+
+func TestSLRUDemotesFromProtected(t *testing.T) {
+	cache := must(NewSLRUCache(t.TempDir(), 4, 0, 0.5))
+	// Reading each of three files twice promotes them all, but protected only holds two.
+	replay(t, cache, []string{"a", "a", "b", "b", "c", "c"})
+	for _, path := range []string{"a", "b", "c"} {
+		if !cache.Has(path) {
+			t.Errorf("%s was evicted rather than demoted", path)
+		}
+	}
+	// a was demoted to probation, so it goes first to make room for new files.
+	replay(t, cache, []string{"d", "e"})
+	if cache.Has("a") {
+		t.Error("demoted file wasn't evicted first")
+	}
+	for _, path := range []string{"b", "c", "e"} {
+		if !cache.Has(path) {
+			t.Errorf("%s was evicted", path)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package cachefs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// diskCaches builds each of the caches that keep their files under dir.
+var diskCaches = map[string]func(dir string) Cache{
+	"default": NewDefaultCache,
+	"size":    func(dir string) Cache { return NewSizeLimitedCache(dir, 1<<30) },
+	"lru":     func(dir string) Cache { return must(NewLRUCache(dir, 1000, false)) },
+	"hybrid":  func(dir string) Cache { return must(NewHybridCache(dir, 1000, 1<<30, false)) },
+}
+
+func TestCachesConcurrentAccess(t *testing.T) {
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+
+			var wg sync.WaitGroup
+			for g := range 16 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					own := fmt.Sprintf("own-%d", g)
+					for i := range 50 {
+						data := bytes.Repeat([]byte{byte(g)}, 100+i)
+						if err := cache.Put(own, data, 0o644); err != nil {
+							t.Errorf("Put %s: %v", own, err)
+							return
+						}
+						if got, err := cache.Get(own); err != nil || !bytes.Equal(got, data) {
+							t.Errorf("Get %s = %d bytes, %v, want %d bytes", own, len(got), err, len(data))
+							return
+						}
+						// Everyone writes the shared file too, it must never be read torn.
+						cache.Put("shared", bytes.Repeat([]byte{byte(g)}, 1000), 0o644)
+						if got, err := cache.Get("shared"); err == nil && (len(got) != 1000 || !bytes.Equal(got, bytes.Repeat(got[:1], 1000))) {
+							t.Errorf("Get shared returned a mix of writes")
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestCachesClear(t *testing.T) {
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache := newCache(dir)
+			paths := []string{"a.txt", "dir/b.txt"}
+			for _, path := range paths {
+				if err := cache.Put(path, []byte(path), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := cache.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range paths {
+				if got, err := cache.Get(path); err != ErrNotFoundCache {
+					t.Errorf("Get %s after Clear = %q, %v, want %v", path, got, err, ErrNotFoundCache)
+				}
+			}
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Errorf("cache directory after Clear = %v, %v, want it empty", entries, err)
+			}
+
+			// The cache is still usable.
+			if err := cache.Put("a.txt", []byte("again"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := cache.Get("a.txt"); err != nil || string(got) != "again" {
+				t.Errorf("Get after Clear and Put = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestCachesReturnEntries(t *testing.T) {
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+			before := time.Now().Add(-time.Second) // File times may be coarser than the clock
+			if err := cache.Put("dir/a.sh", []byte("echo"), 0o750); err != nil {
+				t.Fatal(err)
+			}
+
+			entry, err := getEntry(cache, "dir/a.sh")
+			if err != nil || string(entry.Data) != "echo" || entry.Mode != 0o750 || entry.Size != 4 || entry.ModTime.Before(before) {
+				t.Errorf("getEntry = %+v, %v, want the data, mode 0750, size 4 and the time it was put", entry, err)
+			}
+			entry, err = statEntry(cache, "dir/a.sh")
+			if err != nil || entry.Data != nil || entry.Mode != 0o750 || entry.Size != 4 {
+				t.Errorf("statEntry = %+v, %v, want mode 0750 and size 4 without the data", entry, err)
+			}
+			if _, err := statEntry(cache, "missing"); err != ErrNotFoundCache {
+				t.Errorf("statEntry of a missing file = %v, want %v", err, ErrNotFoundCache)
+			}
+		})
+	}
+
+	// Caches that don't keep the metadata only give the size.
+	cache := NewMemCache(1 << 10)
+	if err := cache.Put("a", []byte("abc"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := statEntry(cache, "a"); err != nil || entry.Data != nil || entry.Mode != 0 || !entry.ModTime.IsZero() || entry.Size != 3 {
+		t.Errorf("statEntry from the mem cache = %+v, %v, want only the size", entry, err)
+	}
+}
+
+func TestTTLCacheExpiresFiles(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewTTLCache(dir, 50*time.Millisecond)
+	if err := cache.Put("a.txt", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cache.Get("a.txt"); err != nil || string(got) != "a" {
+		t.Fatalf("Get before the ttl = %q, %v", got, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if cache.Has("a.txt") {
+		t.Error("Has after the ttl = true, want false")
+	}
+	if got, err := cache.Get("a.txt"); err != ErrNotFoundCache {
+		t.Errorf("Get after the ttl = %q, %v, want %v", got, err, ErrNotFoundCache)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("cache directory after expiry = %v, %v, want it empty", entries, err)
+	}
+}
+
+// BenchmarkCacheGetParallel has 16 goroutines each read its own file while one keeps writing a
+// large file, which used to hold up every read.
+func BenchmarkCacheGetParallel(b *testing.B) {
+	for name, newCache := range diskCaches {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache(b.TempDir())
+			data := bytes.Repeat([]byte("x"), 64<<10)
+			for g := range 16 {
+				if err := cache.Put(fmt.Sprintf("file-%d", g), data, 0o644); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			stop := make(chan struct{})
+			var writer sync.WaitGroup
+			writer.Add(1)
+			go func() {
+				defer writer.Done()
+				big := bytes.Repeat([]byte("y"), 16<<20)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						cache.Put("big", big, 0o644)
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := range 16 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					path := fmt.Sprintf("file-%d", g)
+					for range b.N {
+						if _, err := cache.Get(path); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			close(stop)
+			writer.Wait()
+		})
+	}
+}
+
+// BenchmarkHotGet compares the cost of hits on a small set of files read by many goroutines at
+// once. The LRU cache takes its lock to reorder the queue on every Get; the clock cache only sets
+// a bit.
+func BenchmarkHotGet(b *testing.B) {
+	for name, newCache := range map[string]func(dir string) Cache{
+		"lru":   func(dir string) Cache { return must(NewLRUCache(dir, 1000, false)) },
+		"clock": func(dir string) Cache { return must(NewClockCache(dir, 1000, 0)) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache(b.TempDir())
+			for i := range 8 {
+				if err := cache.Put(fmt.Sprintf("file-%d", i), []byte("x"), 0o644); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := cache.Get(fmt.Sprintf("file-%d", i%8)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSizeLimitedCacheOverwriteAccounting(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewSizeLimitedCache(dir, 4*diskBlockSize).(*sizeLimitedCache)
+	onDisk := func(paths ...string) int64 {
+		var total int64
+		for _, path := range paths {
+			total += fileDiskUsage(cacheFileName(dir, flattenDirPath(path)), -1)
+		}
+		return total
+	}
+	put := func(path string, size int64) error {
+		return cache.Put(path, bytes.Repeat([]byte("x"), int(size)), 0o644)
+	}
+
+	for _, size := range []int64{diskBlockSize + 1, 3 * diskBlockSize, 10} {
+		if err := put("a", size); err != nil {
+			t.Fatalf("Put of %d bytes: %v", size, err)
+		}
+		if cache.byteCount != onDisk("a") || cache.logicalBytes != size {
+			t.Errorf("after overwriting with %d bytes: byteCount = %d, logicalBytes = %d, want %d, %d",
+				size, cache.byteCount, cache.logicalBytes, onDisk("a"), size)
+		}
+	}
+
+	// Only the last copy of a counts, so another three blocks still fit.
+	if err := put("b", 3*diskBlockSize); err != nil {
+		t.Fatalf("Put that fits the corrected total: %v", err)
+	}
+	if err := put("c", diskBlockSize); err != ErrWontCache {
+		t.Errorf("Put over the limit = %v, want %v", err, ErrWontCache)
+	}
+	if cache.byteCount != onDisk("a", "b") {
+		t.Errorf("byteCount = %d, want %d", cache.byteCount, onDisk("a", "b"))
+	}
+}
+
+func TestByteLRUCacheEvictsOnCorrectedTotal(t *testing.T) {
+	cache := must(NewByteLRUCache(t.TempDir(), 10, false))
+	for _, put := range []struct {
+		path string
+		size int
+	}{{"a", 8}, {"a", 2}, {"b", 8}} {
+		if err := cache.Put(put.path, bytes.Repeat([]byte("x"), put.size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a's first copy no longer counts, so both fit.
+	for _, path := range []string{"a", "b"} {
+		if !cache.Has(path) {
+			t.Errorf("%s was evicted", path)
+		}
+	}
+}
+
+// TestLRUCacheStress has 32 goroutines get and put a shared set of files on a cache small enough
+// to keep evicting. Run it with -race.
+func TestLRUCacheStress(t *testing.T) {
+	cache := must(NewHybridCache(t.TempDir(), 16, 0, false))
+
+	var wg sync.WaitGroup
+	for g := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				path := fmt.Sprintf("file-%d", (g*7+i)%48)
+				if i%3 == 0 {
+					if err := cache.Put(path, []byte(path), 0o644); err != nil {
+						t.Errorf("Put %s: %v", path, err)
+						return
+					}
+				} else if got, err := cache.Get(path); err == nil && string(got) != path {
+					t.Errorf("Get %s = %q", path, got)
+					return
+				} else if err != nil && err != ErrNotFoundCache {
+					t.Errorf("Get %s: %v", path, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	lru := cache.(*lruCache)
+	if got := len(lru.entries); got > 16 {
+		t.Errorf("%d entries, capacity is 16", got)
+	}
+	if lru.queue.Len() != len(lru.entries) {
+		t.Errorf("queue has %d entries, index has %d", lru.queue.Len(), len(lru.entries))
+	}
+	if want := int64(lru.queue.Len()) * int64(len("file-00")); lru.byteCount > want {
+		t.Errorf("byteCount = %d, more than the %d the queue holds", lru.byteCount, want)
+	}
+}
+
+func TestHybridCacheOnePutEvictsSeveral(t *testing.T) {
+	dir := t.TempDir()
+	cache := must(NewHybridCache(dir, 10, 100, false))
+	for _, path := range []string{"a", "b", "c", "d"} {
+		if err := cache.Put(path, bytes.Repeat([]byte("x"), 20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 80 bytes cached, so 70 more only fit once a, b and c are gone.
+	if err := cache.Put("big", bytes.Repeat([]byte("x"), 70), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"a": false, "b": false, "c": false, "d": true, "big": true} {
+		if got := cache.Has(path); got != want {
+			t.Errorf("%s cached = %v, want %v", path, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, path)); os.IsNotExist(err) == want {
+			t.Errorf("%s on SSD = %v, want %v", path, err == nil, want)
+		}
+	}
+	if stats := statsOf(cache); stats["lru_evicted_bytes"] != 3 || stats["lru_evicted_capacity"] != 0 {
+		t.Errorf("evicted %d for bytes and %d for capacity, want 3 and 0",
+			stats["lru_evicted_bytes"], stats["lru_evicted_capacity"])
+	}
+}
+
+func TestHybridCacheEvictsForCapacity(t *testing.T) {
+	cache := must(NewHybridCache(t.TempDir(), 2, 1<<20, false))
+	for _, path := range []string{"a", "b", "c", "d"} {
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := statsOf(cache); stats["lru_evicted_capacity"] != 2 || stats["lru_evicted_bytes"] != 0 {
+		t.Errorf("evicted %d for capacity and %d for bytes, want 2 and 0",
+			stats["lru_evicted_capacity"], stats["lru_evicted_bytes"])
+	}
+}
+
+func TestEvictCallbacks(t *testing.T) {
+	for name, newCache := range map[string]func(dir string) Cache{
+		"lru":   func(dir string) Cache { return must(NewLRUCache(dir, 2, false)) },
+		"arc":   func(dir string) Cache { return must(NewARCCache(dir, 2)) },
+		"clock": func(dir string) Cache { return must(NewClockCache(dir, 2, 0)) },
+		"lfu":   func(dir string) Cache { return must(NewLFUCache(dir, 2)) },
+		"slru":  func(dir string) Cache { return must(NewSLRUCache(dir, 2, 0, 0.5)) },
+		"mem":   func(string) Cache { return NewMemCache(2) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+			evicted := make(map[string]int)
+			var mu sync.Mutex
+			cache.(EvictNotifier).OnEvict(func(path string, size int64) {
+				// Calling back into the cache deadlocks if the hook runs with a lock held.
+				cache.Has(path)
+				cache.Get(path)
+
+				mu.Lock()
+				defer mu.Unlock()
+				evicted[path]++
+				if size != 1 {
+					t.Errorf("%s evicted with size %d, want 1", path, size)
+				}
+			})
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for _, path := range []string{"a", "b", "c", "d", "e"} {
+					if err := cache.Put(path, []byte("x"), 0o644); err != nil {
+						t.Errorf("Put %s: %v", path, err)
+					}
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Put deadlocked calling the evict hook")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(evicted) != 3 {
+				t.Errorf("evicted %v, want 3 files", evicted)
+			}
+			for path, n := range evicted {
+				if n != 1 {
+					t.Errorf("hook called %d times for %s", n, path)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCachePutSync measures what fsyncing every file written costs (see SyncWriter).
+func BenchmarkCachePutSync(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 64<<10)
+	for name, newCache := range diskCaches {
+		for _, durable := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/sync=%v", name, durable), func(b *testing.B) {
+				cache := newCache(b.TempDir())
+				cache.(SyncWriter).SetSyncWrites(durable)
+				b.SetBytes(int64(len(data)))
+				for i := range b.N {
+					if err := cache.Put(fmt.Sprintf("file-%d", i%100), data, 0o644); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSizeLimitedCacheRespectsBudgetOfExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	for i := range 5 {
+		name := fmt.Sprintf("project-1/file-%d", i)
+		writeTestFile(t, dir, name, bytes.Repeat([]byte("x"), 100))
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	perFile := fileDiskUsage(filepath.Join(dir, "project-1/file-0"), diskBlockSize)
+
+	cache := NewSizeLimitedCache(dir, 3*perFile)
+
+	// The two oldest files are removed to get under the limit, the rest are served.
+	for i := range 5 {
+		path := fmt.Sprintf("project-1/file-%d", i)
+		if got, want := cache.Has(path), i >= 2; got != want {
+			t.Errorf("%s cached = %v, want %v", path, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, path)); (err == nil) != (i >= 2) {
+			t.Errorf("%s on disk: %v", path, err)
+		}
+	}
+	stats := statsOf(cache)
+	if stats["size_bytes"] != 3*perFile || stats["size_bytes_logical"] != 300 || stats["size_entries"] != 3 {
+		t.Errorf("stats = %v, want %d bytes on disk, 300 logical, 3 entries", stats, 3*perFile)
+	}
+	if err := cache.Put("project-1/new", []byte("x"), 0o644); err != ErrWontCache {
+		t.Errorf("Put into a full cache = %v, want %v", err, ErrWontCache)
+	}
+}
+
+func TestByteLRUCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := must(NewByteLRUCache(dir, 100, false))
+	for _, path := range []string{"a", "b", "c", "d", "e"} {
+		if err := cache.Put(path, make([]byte, 20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Making room for 60 bytes evicts the three least recently used: b, c and d.
+	if err := cache.Put("big", make([]byte, 60), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"a": true, "b": false, "c": false, "d": false, "e": true, "big": true} {
+		if got := cache.Has(path); got != want {
+			t.Errorf("%s cached = %v, want %v", path, got, want)
+		}
+	}
+	if got := cache.(Inspector).Bytes(); got != 100 {
+		t.Errorf("Bytes = %d, want 100", got)
+	}
+
+	// A file bigger than the whole budget is refused without evicting anything.
+	if err := cache.Put("huge", make([]byte, 101), 0o644); err != ErrWontCache {
+		t.Errorf("Put over the budget = %v, want %v", err, ErrWontCache)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "huge")); !os.IsNotExist(err) {
+		t.Errorf("refused file left on SSD: %v", err)
+	}
+	if got := cache.(Inspector).Len(); got != 3 {
+		t.Errorf("%d files cached after refusing one, want 3", got)
+	}
+}
+
+func TestConstructorsReturnErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, newCache := range map[string]func() (Cache, error){
+		"lru":            func() (Cache, error) { return NewLRUCache(dir, 0, false) },
+		"byte lru":       func() (Cache, error) { return NewByteLRUCache(dir, 0, false) },
+		"hybrid":         func() (Cache, error) { return NewHybridCache(dir, 0, 0, false) },
+		"arc":            func() (Cache, error) { return NewARCCache(dir, 0) },
+		"clock":          func() (Cache, error) { return NewClockCache(dir, 0, 0) },
+		"lfu":            func() (Cache, error) { return NewLFUCache(dir, 0) },
+		"slru":           func() (Cache, error) { return NewSLRUCache(dir, 0, 0, 0.5) },
+		"slru protected": func() (Cache, error) { return NewSLRUCache(dir, 10, 0, 1) },
+		"redis":          func() (Cache, error) { return NewRedisCache(dir, 0, 0, RedisConfig{Addr: "localhost:0"}) },
+		"encrypted":      func() (Cache, error) { return NewEncryptedCache(NewMemCache(1<<10), []byte("short")) },
+	} {
+		if c, err := newCache(); err == nil || c != nil {
+			t.Errorf("%s: got %v, %v, want an error", name, c, err)
+		}
+	}
+}
+
+func TestDefaultCacheSameKeyStress(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewDefaultCache(dir)
+	const size = 1 << 20
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(g)}, size)
+			for range 20 {
+				if err := cache.Put("model.bin", data, 0o644); err != nil {
+					t.Errorf("Put: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				got, err := cache.Get("model.bin")
+				if err == ErrNotFoundCache {
+					continue
+				} else if err != nil {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				if len(got) != size || !bytes.Equal(got, bytes.Repeat(got[:1], size)) {
+					t.Errorf("Get returned %d bytes, not one whole write", len(got))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Only the file itself is left behind, no temporary files.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the cache directory, want 1", len(entries))
+	}
+}
@@ -0,0 +1,300 @@
+package cachefs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// promotedMode is the mode a file gets in the fast tier when it's promoted from the slow one, as the
+// slow tier's Get doesn't say what it was put with. The FS sets the real mode where it matters (see
+// ModeSetter).
+const promotedMode = 0o644
+
+// NewTieredCache chains two caches, eg. one in memory in front of one on SSD. Get tries fast, then
+// slow, promoting a file found only in slow into fast. Put writes to both. Each tier decides for
+// itself whether to keep a file, and where they disagree:
+//
+//   - A file either tier refuses (ErrWontCache) is removed from that tier, so it can't serve an older
+//     version. Put only returns ErrWontCache if both refuse it.
+//   - Any other error putting to either tier is returned, after removing the file from that tier,
+//     even if the other tier kept it.
+//   - Failing to promote a file into fast, whether it was refused or not, doesn't fail the Get: the
+//     data from slow is returned, and the failure is counted in the stats.
+//   - An error other than ErrNotFoundCache getting from fast is logged and treated as a miss.
+//
+// Optional interfaces (eg. Inspector, EvictNotifier) are those of the slow tier, which is what
+// Unwrap returns.
+func NewTieredCache(fast, slow Cache) Cache {
+	return &tieredCache{Cache: slow, fast: fast}
+}
+
+// TierDir returns the directory a cache in front of the one in ssdDir keeps its files in, when
+// both are on disk. tier numbers them from the front (0 for the fastest). It's under ssdDir, so the
+// slow tier's own scans and Clear leave it alone (see metaPrefix).
+func TierDir(ssdDir string, tier int) string {
+	return filepath.Join(ssdDir, fmt.Sprintf("%stier%d", metaPrefix, tier))
+}
+
+type tieredCache struct {
+	Cache // The slow tier
+	fast  Cache
+
+	// Held for writing by Clear, so a Get can't promote a file from slow into fast while Clear is
+	// removing it from both.
+	clearMu sync.RWMutex
+
+	fastHits, slowHits, misses       atomic.Int64
+	promotions, promotionsRefused    atomic.Int64
+	promotionErrors, fastRefusedPuts atomic.Int64
+	slowRefusedPuts, fastGetErrors   atomic.Int64
+}
+
+func (t *tieredCache) Unwrap() Cache {
+	return t.Cache
+}
+
+func (t *tieredCache) Get(path string) ([]byte, error) {
+	t.clearMu.RLock()
+	defer t.clearMu.RUnlock()
+
+	data, err := t.fast.Get(path)
+	if err == nil {
+		t.fastHits.Add(1)
+		return data, nil
+	} else if !errors.Is(err, ErrNotFoundCache) {
+		t.fastGetErrors.Add(1)
+		log.Printf("WARNING: Fast cache tier failed to get %s, trying the slow tier: %v", path, err)
+	}
+
+	data, err = t.Cache.Get(path)
+	if err != nil {
+		t.misses.Add(1)
+		return nil, err
+	}
+	t.slowHits.Add(1)
+
+	switch err := t.fast.Put(path, data, promotedMode); {
+	case err == nil:
+		t.promotions.Add(1)
+	case errors.Is(err, ErrWontCache):
+		t.promotionsRefused.Add(1)
+	default:
+		t.promotionErrors.Add(1)
+		log.Printf("WARNING: Failed to promote %s into the fast cache tier: %v", path, err)
+	}
+	return data, nil
+}
+
+// Has doesn't promote the file into the fast tier.
+func (t *tieredCache) Has(path string) bool {
+	t.clearMu.RLock()
+	defer t.clearMu.RUnlock()
+	return t.fast.Has(path) || t.Cache.Has(path)
+}
+
+func (t *tieredCache) Put(path string, data []byte, mode os.FileMode) error {
+	t.clearMu.RLock()
+	defer t.clearMu.RUnlock()
+
+	slowErr := t.putTier(t.Cache, path, data, mode, &t.slowRefusedPuts)
+	fastErr := t.putTier(t.fast, path, data, mode, &t.fastRefusedPuts)
+
+	if errors.Is(slowErr, ErrWontCache) && errors.Is(fastErr, ErrWontCache) {
+		return ErrWontCache
+	}
+	if errors.Is(slowErr, ErrWontCache) {
+		slowErr = nil
+	}
+	if errors.Is(fastErr, ErrWontCache) {
+		fastErr = nil
+	}
+	return errors.Join(slowErr, fastErr)
+}
+
+// putTier puts the file to one tier. If that fails, the tier's copy is removed, as it's out of date.
+func (t *tieredCache) putTier(c Cache, path string, data []byte, mode os.FileMode, refused *atomic.Int64) error {
+	err := c.Put(path, data, mode)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrWontCache) {
+		refused.Add(1)
+	}
+	if delErr := c.Delete(path); delErr != nil {
+		log.Printf("ERROR: Failed to remove out of date %s from a cache tier: %v", path, delErr)
+	}
+	return err
+}
+
+func (t *tieredCache) Delete(path string) error {
+	return errors.Join(t.fast.Delete(path), t.Cache.Delete(path))
+}
+
+func (t *tieredCache) Clear() error {
+	t.clearMu.Lock()
+	defer t.clearMu.Unlock()
+
+	return errors.Join(t.fast.Clear(), t.Cache.Clear())
+}
+
+// SetMode changes the mode of the file in whichever tiers can, and have it.
+func (t *tieredCache) SetMode(path string, mode os.FileMode) error {
+	var errs []error
+	supported, found := false, false
+	for _, c := range []Cache{t.fast, t.Cache} {
+		setter, ok := findCache[ModeSetter](c)
+		if !ok {
+			continue
+		}
+		supported = true
+		if err := setter.SetMode(path, mode); err == nil {
+			found = true
+		} else if !errors.Is(err, ErrNotFoundCache) {
+			errs = append(errs, err)
+		}
+	}
+	if !supported {
+		return errModeUnsupported
+	} else if len(errs) > 0 {
+		return errors.Join(errs...)
+	} else if !found {
+		return ErrNotFoundCache
+	}
+	return nil
+}
+
+// Stats reports the slow tier's stats as they are, and the fast tier's prefixed with "fast_", so
+// they don't clash if both tiers are the same kind of cache.
+func (t *tieredCache) Stats() Stats {
+	stats := statsOf(t.Cache)
+	for k, v := range statsOf(t.fast) {
+		stats["fast_"+k] = v
+	}
+	stats["tiered_fast_hits"] = t.fastHits.Load()
+	stats["tiered_slow_hits"] = t.slowHits.Load()
+	stats["tiered_misses"] = t.misses.Load()
+	stats["tiered_promotions"] = t.promotions.Load()
+	stats["tiered_promotions_refused"] = t.promotionsRefused.Load()
+	stats["tiered_promotion_errors"] = t.promotionErrors.Load()
+	stats["tiered_fast_refused_puts"] = t.fastRefusedPuts.Load()
+	stats["tiered_slow_refused_puts"] = t.slowRefusedPuts.Load()
+	stats["tiered_fast_get_errors"] = t.fastGetErrors.Load()
+	return stats
+}
+
+// memLRU holds file contents in memory up to a byte limit, evicting the least recently used.
+type memLRU struct {
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // Of *memEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+type memEntry struct {
+	path string
+	data []byte
+}
+
+func newMemLRU(limit int64) *memLRU {
+	return &memLRU{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *memLRU) get(path string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[path]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memEntry).data, true
+}
+
+// has reports whether the file is held, without moving it up the LRU order.
+func (m *memLRU) has(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[path]
+	return ok
+}
+
+// put adds the file, evicting the least recently used files to make room, and returns the evicted
+// files. A file bigger than the limit is not added, and false is returned.
+func (m *memLRU) put(path string, data []byte) ([]memEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(path)
+	if int64(len(data)) > m.limit {
+		return nil, false // Would never fit
+	}
+
+	m.entries[path] = m.order.PushFront(&memEntry{path: path, data: data})
+	m.size += int64(len(data))
+
+	var evicted []memEntry
+	for m.size > m.limit {
+		oldest := m.order.Back().Value.(*memEntry)
+		evicted = append(evicted, *oldest)
+		m.removeLocked(oldest.path)
+	}
+	return evicted, true
+}
+
+// remove drops the file, returning whether it was there.
+func (m *memLRU) remove(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeLocked(path)
+}
+
+// members returns the paths and sizes of the files, least recently used first.
+func (m *memLRU) members() []memEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]memEntry, 0, len(m.entries))
+	for el := m.order.Back(); el != nil; el = el.Prev() {
+		members = append(members, *el.Value.(*memEntry))
+	}
+	return members
+}
+
+// usage returns the number of files and their total size.
+func (m *memLRU) usage() (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries), m.size
+}
+
+func (m *memLRU) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.size = 0
+	m.order.Init()
+	clear(m.entries)
+}
+
+func (m *memLRU) removeLocked(path string) bool {
+	el, ok := m.entries[path]
+	if !ok {
+		return false
+	}
+	m.order.Remove(el)
+	delete(m.entries, path)
+	m.size -= int64(len(el.Value.(*memEntry).data))
+	return true
+}
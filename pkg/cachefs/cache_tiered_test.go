@@ -0,0 +1,86 @@
+package cachefs
+
+import "testing"
+
+func TestTieredCachePromotesOnSecondAccess(t *testing.T) {
+	fast, slow := NewMemCache(10), NewDefaultCache(t.TempDir())
+	c := NewTieredCache(fast, slow)
+	for _, path := range []string{"a", "b", "c"} {
+		if err := c.Put(path, []byte("12345"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Memory only holds two, but evicting a from it leaves the SSD copy.
+	if fast.Has("a") || !slow.Has("a") {
+		t.Fatalf("a in memory = %v, on SSD = %v, want false, true", fast.Has("a"), slow.Has("a"))
+	}
+
+	// Has doesn't promote, so the first Get still hits the slow tier.
+	if !c.Has("a") {
+		t.Fatal("Has(a) = false, want true")
+	}
+	for range 2 {
+		if got, err := c.Get("a"); err != nil || string(got) != "12345" {
+			t.Fatalf("Get = %q, %v", got, err)
+		}
+	}
+	if _, err := c.Get("missing"); err != ErrNotFoundCache {
+		t.Fatalf("Get of a missing file = %v", err)
+	}
+
+	stats := statsOf(c)
+	for key, want := range map[string]int64{
+		"tiered_slow_hits":  1,
+		"tiered_promotions": 1,
+		"tiered_fast_hits":  1,
+		"tiered_misses":     1,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %d, want %d", key, stats[key], want)
+		}
+	}
+	if !fast.Has("a") {
+		t.Error("a wasn't promoted into memory")
+	}
+}
+
+func TestTieredCacheRefusals(t *testing.T) {
+	// Memory refuses files over 4 bytes, the SSD files over 8.
+	fast, slow := NewMemCache(4), must(NewByteLRUCache(t.TempDir(), 8, false))
+	c := NewTieredCache(fast, slow)
+
+	for _, tc := range []struct {
+		path       string
+		size       int
+		wantErr    error
+		fast, slow bool
+	}{
+		{path: "small", size: 2, fast: true, slow: true},
+		{path: "medium", size: 6, slow: true},
+		{path: "large", size: 10, wantErr: ErrWontCache},
+	} {
+		if err := c.Put(tc.path, make([]byte, tc.size), 0o644); err != tc.wantErr {
+			t.Errorf("Put %s = %v, want %v", tc.path, err, tc.wantErr)
+		}
+		if fast.Has(tc.path) != tc.fast || slow.Has(tc.path) != tc.slow {
+			t.Errorf("%s in memory = %v, on SSD = %v, want %v, %v",
+				tc.path, fast.Has(tc.path), slow.Has(tc.path), tc.fast, tc.slow)
+		}
+	}
+
+	// Memory refusing to take the file from the SSD doesn't fail the Get.
+	if got, err := c.Get("medium"); err != nil || len(got) != 6 {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	stats := statsOf(c)
+	for key, want := range map[string]int64{
+		"tiered_promotions_refused": 1,
+		"tiered_promotions":         0,
+		"tiered_fast_refused_puts":  2,
+		"tiered_slow_refused_puts":  1,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %d, want %d", key, stats[key], want)
+		}
+	}
+}
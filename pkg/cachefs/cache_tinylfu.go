@@ -0,0 +1,161 @@
+package cachefs
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// victimFinder is implemented by caches that can tell which file they would evict to make room for
+// another, eg. for an admission policy to weigh the two against each other.
+type victimFinder interface {
+	// Victim returns the path that putting size bytes at path would evict first, or false if
+	// nothing needs evicting.
+	Victim(path string, size int64) (string, bool)
+}
+
+// NewTinyLFUCache puts a TinyLFU admission policy in front of an evicting cache (eg. lru). Accesses
+// are counted in a small frequency sketch, and when the cache is full a new file is only admitted
+// if it has been asked for more often than the file it would evict. One-off reads (eg. a scan of a
+// big directory) then don't push out the files that are read over and over.
+// capacity is roughly how many files the cache holds, and sizes the sketch. Returns ErrNoEviction if
+// inner doesn't evict.
+func NewTinyLFUCache(inner Cache, capacity int) (Cache, error) {
+	victims, ok := findCache[victimFinder](inner)
+	if !ok {
+		return nil, ErrNoEviction
+	}
+	return &tinyLFUCache{
+		Cache:   inner,
+		victims: victims,
+		sketch:  newFrequencySketch(capacity),
+	}, nil
+}
+
+// ErrNoEviction is returned by NewTinyLFUCache for a cache that never evicts, so there is nothing
+// to admit files in place of.
+var ErrNoEviction = errors.New("TinyLFU admission needs a cache that evicts, eg. lru")
+
+type tinyLFUCache struct {
+	Cache
+	victims victimFinder
+	sketch  *frequencySketch
+
+	admitted, rejected atomic.Int64
+}
+
+func (t *tinyLFUCache) Unwrap() Cache {
+	return t.Cache
+}
+
+// Get counts every access, hit or miss, towards the file's frequency.
+func (t *tinyLFUCache) Get(path string) ([]byte, error) {
+	t.sketch.increment(path)
+	return t.Cache.Get(path)
+}
+
+func (t *tinyLFUCache) Put(path string, data []byte, mode os.FileMode) error {
+	if victim, full := t.victims.Victim(path, int64(len(data))); full {
+		if t.sketch.estimate(path) <= t.sketch.estimate(victim) {
+			t.rejected.Add(1)
+			return ErrWontCache
+		}
+	}
+	t.admitted.Add(1)
+	return t.Cache.Put(path, data, mode)
+}
+
+func (t *tinyLFUCache) Clear() error {
+	t.sketch.reset()
+	return t.Cache.Clear()
+}
+
+func (t *tinyLFUCache) Stats() Stats {
+	stats := statsOf(t.Cache)
+	stats["tinylfu_admitted"] = t.admitted.Load()
+	stats["tinylfu_rejected"] = t.rejected.Load()
+	return stats
+}
+
+// frequencySketch is a count-min sketch of how often keys have been accessed recently. Counters
+// saturate at 15, and are all halved every so often so old popularity fades.
+type frequencySketch struct {
+	mu         sync.Mutex
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	resetAfter int // Halve the counters after this many increments
+}
+
+func newFrequencySketch(capacity int) *frequencySketch {
+	width := 1 << bits.Len(uint(max(capacity, 8)*8-1)) // Power of two, at least 8 counters a file
+	s := &frequencySketch{
+		mask:       uint64(width - 1),
+		resetAfter: 10 * max(capacity, 8),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the counter for key in each row, using double hashing.
+func (s *frequencySketch) indexes(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum, (sum>>32)|1
+
+	var idx [4]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *frequencySketch) increment(key string) {
+	idx := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, row := range s.rows {
+		if row[idx[i]] < 15 {
+			row[idx[i]]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAfter {
+		s.additions = 0
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+	}
+}
+
+// estimate returns how often key has been accessed recently. It may overestimate, never under.
+func (s *frequencySketch) estimate(key string) uint8 {
+	idx := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	least := uint8(15)
+	for i, row := range s.rows {
+		least = min(least, row[idx[i]])
+	}
+	return least
+}
+
+func (s *frequencySketch) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.additions = 0
+	for _, row := range s.rows {
+		clear(row)
+	}
+}
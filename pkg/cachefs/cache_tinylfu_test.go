@@ -0,0 +1,99 @@
+package cachefs
+
+import (
+	"fmt"
+	"testing"
+)
+
+// replay reads each path in trace as the FS would: Get, and Put on a miss. It returns the hits.
+func replay(t *testing.T, cache Cache, trace []string) int {
+	t.Helper()
+	hits := 0
+	for _, path := range trace {
+		if _, err := cache.Get(path); err == nil {
+			hits++
+			continue
+		}
+		if err := cache.Put(path, []byte(path), 0o644); err != nil && err != ErrWontCache {
+			t.Fatalf("Put %s: %v", path, err)
+		}
+	}
+	return hits
+}
+
+func TestTinyLFUScanKeepsWorkingSet(t *testing.T) {
+	workingSet := []string{"lib/a.py", "lib/b.py", "lib/c.py", "lib/d.py"}
+	var warm, scan []string
+	for range 5 {
+		warm = append(warm, workingSet...)
+	}
+	for i := range 100 {
+		scan = append(scan, fmt.Sprintf("scan/%d.bin", i))
+	}
+
+	for _, tc := range []struct {
+		name     string
+		tinyLFU  bool
+		wantKept bool
+	}{
+		{"lru", false, false},
+		{"tinylfu", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cache Cache = must(NewLRUCache(t.TempDir(), 5, false))
+			if tc.tinyLFU {
+				var err error
+				if cache, err = NewTinyLFUCache(cache, 5); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			replay(t, cache, warm)
+			replay(t, cache, scan)
+			if hits := replay(t, cache, workingSet); (hits == len(workingSet)) != tc.wantKept {
+				t.Errorf("%d of %d working set files still cached after the scan", hits, len(workingSet))
+			}
+		})
+	}
+}
+
+func TestTinyLFURejectsUnlessMoreFrequent(t *testing.T) {
+	cache, err := NewTinyLFUCache(must(NewLRUCache(t.TempDir(), 1, false)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay(t, cache, []string{"hot", "hot", "hot"})
+
+	if err := cache.Put("cold", nil, 0o644); err != ErrWontCache {
+		t.Errorf("Put of a file read less than the victim = %v, want %v", err, ErrWontCache)
+	}
+	replay(t, cache, []string{"cold", "cold", "cold", "cold"})
+	if !cache.Has("cold") || cache.Has("hot") {
+		t.Error("a file read more than the victim wasn't admitted in its place")
+	}
+	if stats := statsOf(cache); stats["tinylfu_rejected"] < 1 || stats["tinylfu_admitted"] < 2 {
+		t.Errorf("admitted %d, rejected %d", stats["tinylfu_admitted"], stats["tinylfu_rejected"])
+	}
+}
+
+func TestFrequencySketchHalves(t *testing.T) {
+	s := newFrequencySketch(8)
+	for range 10 {
+		s.increment("a")
+	}
+	if got := s.estimate("a"); got != 10 {
+		t.Fatalf("estimate = %d, want 10", got)
+	}
+	for i := range s.resetAfter - 10 {
+		s.increment(fmt.Sprint(i))
+	}
+	if got := s.estimate("a"); got > 5 {
+		t.Errorf("estimate after halving = %d, want at most 5", got)
+	}
+}
+
+func TestTinyLFUNeedsEviction(t *testing.T) {
+	if _, err := NewTinyLFUCache(NewDefaultCache(t.TempDir()), 10); err != ErrNoEviction {
+		t.Errorf("NewTinyLFUCache over a cache that never evicts = %v, want %v", err, ErrNoEviction)
+	}
+}
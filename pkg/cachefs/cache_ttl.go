@@ -0,0 +1,239 @@
+package cachefs
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// NewTTLCache caches files for ttl after they were put, however often they're read. Expired files
+// are reported as not found (and removed), so they're fetched from NFS again and stale data heals
+// itself.
+func NewTTLCache(ssdBasePath string, ttl time.Duration) Cache {
+	return &ttlCache{
+		ssdBasePath: ssdBasePath,
+		ttl:         ttl,
+		insertedAt:  make(map[string]time.Time),
+	}
+}
+
+type ttlCache struct {
+	ssdBasePath string
+	ttl         time.Duration
+	syncWrites  bool
+
+	keyLocks keyLocks // Serialises disk I/O per file, so different files are read/written in parallel
+	evictHooks
+
+	cacheMu    sync.Mutex // Guards the bookkeeping below. Never held during disk I/O
+	insertedAt map[string]time.Time
+}
+
+func (t *ttlCache) SetSyncWrites(enabled bool) {
+	t.syncWrites = enabled
+}
+
+func (t *ttlCache) Get(path string) ([]byte, error) {
+	flatPath := flattenDirPath(path)
+
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.RLock()
+	t.cacheMu.Lock()
+	insertedAt, present := t.insertedAt[flatPath]
+	t.cacheMu.Unlock()
+	if !present {
+		keyLock.RUnlock()
+		return nil, ErrNotFoundCache
+	}
+
+	if time.Since(insertedAt) > t.ttl {
+		keyLock.RUnlock()
+		size, expired, err := t.expire(flatPath, insertedAt)
+		if err != nil {
+			return nil, err
+		} else if expired {
+			t.notifyEvicted(path, size)
+		}
+		return nil, ErrNotFoundCache
+	}
+	defer keyLock.RUnlock()
+
+	cachedData, err := os.ReadFile(cacheFileName(t.ssdBasePath, flatPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFoundCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cachedData, nil
+}
+
+// Has reports an expired file as not cached, but leaves removing it to the next Get.
+func (t *ttlCache) Has(path string) bool {
+	t.cacheMu.Lock()
+	defer t.cacheMu.Unlock()
+	insertedAt, present := t.insertedAt[flattenDirPath(path)]
+	return present && time.Since(insertedAt) <= t.ttl
+}
+
+func (t *ttlCache) Put(path string, data []byte, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	// Write the file to SSD with the same permissions it has in FUSE/NFS.
+	if err := writeFile(cacheFileName(t.ssdBasePath, flatPath), data, mode, t.syncWrites); err != nil {
+		return err
+	}
+
+	t.cacheMu.Lock()
+	t.insertedAt[flatPath] = time.Now()
+	t.cacheMu.Unlock()
+
+	return nil
+}
+
+func (t *ttlCache) Delete(path string) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	t.cacheMu.Lock()
+	_, present := t.insertedAt[flatPath]
+	t.cacheMu.Unlock()
+	if !present {
+		return nil
+	}
+
+	fileName := cacheFileName(t.ssdBasePath, flatPath)
+	if err := removeCacheFile(t.ssdBasePath, fileName); err != nil {
+		return err
+	}
+
+	t.cacheMu.Lock()
+	delete(t.insertedAt, flatPath)
+	t.cacheMu.Unlock()
+
+	return nil
+}
+
+func (t *ttlCache) Clear() error {
+	t.keyLocks.lockAll()
+	defer t.keyLocks.unlockAll()
+
+	// Forget the files before removing them. If removing fails part way, what's left is unindexed
+	// (and overwritten by the next Put), rather than indexed but half gone.
+	t.cacheMu.Lock()
+	clear(t.insertedAt)
+	t.cacheMu.Unlock()
+
+	return clearDir(t.ssdBasePath)
+}
+
+// expire removes an expired file, unless it was put again since it was found to have expired. It
+// returns the size of the removed file, and whether it was removed.
+func (t *ttlCache) expire(flatPath string, insertedAt time.Time) (int64, bool, error) {
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	t.cacheMu.Lock()
+	current, present := t.insertedAt[flatPath]
+	t.cacheMu.Unlock()
+	if !present || !current.Equal(insertedAt) {
+		return 0, false, nil
+	}
+
+	fileName := cacheFileName(t.ssdBasePath, flatPath)
+	var size int64
+	if fi, err := os.Stat(fileName); err == nil {
+		size = fi.Size()
+	}
+	if err := removeCacheFile(t.ssdBasePath, fileName); err != nil {
+		return 0, false, err
+	}
+
+	t.cacheMu.Lock()
+	delete(t.insertedAt, flatPath)
+	t.cacheMu.Unlock()
+
+	return size, true, nil
+}
+
+func (t *ttlCache) SetMode(path string, mode os.FileMode) error {
+	flatPath := flattenDirPath(path)
+
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	t.cacheMu.Lock()
+	_, present := t.insertedAt[flatPath]
+	t.cacheMu.Unlock()
+	if !present {
+		return ErrNotFoundCache
+	}
+	return chmodCacheFile(t.ssdBasePath, flatPath, mode)
+}
+
+func (t *ttlCache) removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	keyLock := t.keyLocks.forKey(flatPath)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	t.cacheMu.Lock()
+	_, present := t.insertedAt[flatPath]
+	t.cacheMu.Unlock()
+	if present {
+		return 0, false, nil
+	}
+	return removeOrphanFile(t.ssdBasePath, flatPath, before, dryRun)
+}
+
+func (t *ttlCache) Len() int {
+	t.cacheMu.Lock()
+	defer t.cacheMu.Unlock()
+	return len(t.insertedAt)
+}
+
+// Bytes walks the cache directory, as this cache doesn't keep track of file sizes.
+func (t *ttlCache) Bytes() int64 {
+	_, bytes, _ := dirUsage(t.ssdBasePath)
+	return bytes
+}
+
+// Keys returns the cached paths, oldest (ie. next to expire) first.
+func (t *ttlCache) Keys() []string {
+	t.cacheMu.Lock()
+	defer t.cacheMu.Unlock()
+
+	keys := slices.SortedFunc(maps.Keys(t.insertedAt), func(a, b string) int {
+		return t.insertedAt[a].Compare(t.insertedAt[b])
+	})
+	for i, key := range keys {
+		keys[i] = unflattenDirPath(key)
+	}
+	return keys
+}
+
+// Dump reports the cached keys, with how long until each expires.
+func (t *ttlCache) Dump(w io.Writer) {
+	t.cacheMu.Lock()
+	insertedAt := maps.Clone(t.insertedAt)
+	t.cacheMu.Unlock()
+
+	fmt.Fprintf(w, "entries: %d (ttl %s)\n", len(insertedAt), t.ttl)
+	now := time.Now()
+	for _, flatPath := range slices.Sorted(maps.Keys(insertedAt)) {
+		expiresIn := t.ttl - now.Sub(insertedAt[flatPath])
+		fmt.Fprintf(w, "  %s expires_in=%s\n", unflattenDirPath(flatPath), max(expiresIn, 0).Round(time.Second))
+	}
+}
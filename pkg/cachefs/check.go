@@ -0,0 +1,108 @@
+package cachefs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+)
+
+// checkKey is the cache key written and removed by the cache round trip. It's a hidden name at the
+// root, so it's unlikely to be a real file on NFS.
+const checkKey = ".fuse-test-check"
+
+// Check validates the set up without mounting, for CI and pre-flight health checks where FUSE
+// isn't available: NFS must be readable, the SSD cache directory writable, the file tree must load
+// (and is printed), and a file must survive a Put/Get/Delete round trip through the cache.
+//
+// Check changes nothing in the SSD directory, or in an index shared with other mounts: cfg.Cache is
+// ignored, and the round trip goes through a cache newCache builds on a scratch directory, which is
+// cleared and removed afterwards.
+func Check(cfg Config, newCache func(dir string) (Cache, error)) error {
+	nfsDirs := []string{cfg.NFSDir}
+	if len(cfg.NFSSources) > 0 {
+		nfsDirs = slices.Sorted(maps.Values(cfg.NFSSources))
+	}
+	for _, dir := range nfsDirs {
+		if _, err := os.ReadDir(dir); err != nil {
+			return fmt.Errorf("NFS directory isn't readable: %w", err)
+		}
+		log.Printf("CHECK: NFS directory %s is readable", dir)
+	}
+
+	f, err := os.CreateTemp(cfg.SSDDir, ".check.*"+tempSuffix)
+	if err != nil {
+		return fmt.Errorf("SSD directory isn't writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	log.Printf("CHECK: SSD directory %s is writable", cfg.SSDDir)
+
+	scratchDir, err := os.MkdirTemp("", "fuse-test-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratchDir)
+
+	c, err := newCache(scratchDir)
+	if err != nil {
+		return err
+	}
+
+	// Nothing the file system saves (eg. metrics) goes in the real SSD directory either.
+	cfg.SSDDir, cfg.Cache = scratchDir, c
+	rfs, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	rfs.PrintTree(os.Stdout)
+	log.Printf("CHECK: File tree loaded")
+
+	if err := checkCache(c); err != nil {
+		return fmt.Errorf("cache round trip failed: %w", err)
+	}
+
+	// Nothing the check left behind (eg. index keys in Redis) should outlive it.
+	if err := c.Clear(); err != nil {
+		return err
+	}
+	// Some caches have writes in flight that need to finish (eg. async), or connections to close.
+	if closer, ok := findCache[io.Closer](c); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// checkCache puts a file in the cache, reads it back and deletes it.
+func checkCache(c Cache) error {
+	data := []byte("fuse-test check\n")
+
+	expectPut(c, checkKey)
+	err := c.Put(checkKey, data, 0o644)
+	if err == ErrWontCache {
+		// Not a fault in itself, eg. a full size limited cache refuses new files.
+		log.Printf("WARNING: The cache refused the check file, so it can't be read back")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	got, err := c.Get(checkKey)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	} else if !bytes.Equal(got, data) {
+		return fmt.Errorf("get: read back %q, want %q", got, data)
+	}
+
+	if err := c.Delete(checkKey); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if _, err := c.Get(checkKey); err != ErrNotFoundCache {
+		return fmt.Errorf("get after delete: got %v, want %v", err, ErrNotFoundCache)
+	}
+	log.Printf("CHECK: Cache round trip succeeded")
+	return nil
+}
@@ -0,0 +1,59 @@
+package cachefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLeavesSSDDirUntouched(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+
+	// A cached file, a file left half written and one in the old flat layout: building the cache on
+	// this directory would remove the second and move the third, and --lrucap=1 would evict the first
+	// for the check file.
+	files := map[string]string{
+		"a.txt":            "a",
+		".a.txt.123.tmp":   "half",
+		"dir$b.txt":        "flat",
+		metricsName:        "hits=1\n",
+		"dir/c.txt":        "c",
+		".fuse-test-other": "meta",
+	}
+	for name, data := range files {
+		writeTestFile(t, ssdDir, name, []byte(data))
+	}
+
+	cfg := Config{Mountpoint: "/mnt/fuse-test", NFSDir: nfsDir, SSDDir: ssdDir, Cache: NewDefaultCache(ssdDir)}
+	var scratch string
+	newCache := func(dir string) (Cache, error) {
+		scratch = dir
+		return NewLRUCache(dir, 1, false)
+	}
+	if err := Check(cfg, newCache); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(ssdDir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var found int
+	filepath.WalkDir(ssdDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			found++
+		}
+		return nil
+	})
+	if found != len(files) {
+		t.Errorf("found %d files in the SSD directory, want %d", found, len(files))
+	}
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Errorf("scratch directory %s wasn't removed: %v", scratch, err)
+	}
+}
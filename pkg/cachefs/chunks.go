@@ -0,0 +1,163 @@
+package cachefs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// chunkSep separates a file's path from a block's index in a block's cache key.
+const chunkSep = "#chunk"
+
+// chunkKey is the cache key for a single block of a file.
+func chunkKey(relPath string, idx int64) string {
+	return fmt.Sprintf("%s%s%d", relPath, chunkSep, idx)
+}
+
+// chunkIndex tracks how many blocks of each file may be cached, so they can all be evicted
+// together.
+type chunkIndex struct {
+	mu     sync.Mutex
+	counts map[string]int64 // path -> 1 + the highest block index cached
+}
+
+func (ci *chunkIndex) add(relPath string, idx int64) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.counts == nil {
+		ci.counts = make(map[string]int64)
+	}
+	ci.counts[relPath] = max(ci.counts[relPath], idx+1)
+}
+
+// take forgets the file, returning how many of its blocks may be cached.
+func (ci *chunkIndex) take(relPath string) int64 {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	count := ci.counts[relPath]
+	delete(ci.counts, relPath)
+	return count
+}
+
+// reset forgets every file.
+func (ci *chunkIndex) reset() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	clear(ci.counts)
+}
+
+// readChunked reads up to size bytes from offset. The file is cached in fixed size blocks, and
+// only the blocks covering the read are fetched from NFS.
+func (n *fuseFSNode) readChunked(ctx context.Context, offset int64, size int) ([]byte, error) {
+	fi, err := n.stat()
+	if err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, syscall.EISDIR
+	}
+
+	end := min(offset+int64(size), fi.Size())
+	if offset >= end {
+		return nil, nil // At or past EOF
+	}
+
+	chunkSize := n.FS.chunkSize
+	data := make([]byte, 0, end-offset)
+	for idx := offset / chunkSize; idx*chunkSize < end; idx++ {
+		chunk, err := n.chunk(ctx, idx)
+		if err != nil {
+			return nil, err
+		}
+
+		chunkStart := idx * chunkSize
+		from := max(offset, chunkStart) - chunkStart
+		to := min(end, chunkStart+int64(len(chunk))) - chunkStart
+		if from >= to {
+			break // The file shrank, this is as much as there is
+		}
+		data = append(data, chunk[from:to]...)
+	}
+
+	return data, nil
+}
+
+// chunk returns block idx of the file, from the cache if possible, otherwise from NFS. The final
+// block of a file may be short.
+func (n *fuseFSNode) chunk(ctx context.Context, idx int64) ([]byte, error) {
+	key := chunkKey(n.relPath(), idx)
+
+	// 1. Try reading from SSD cache
+	cachedData, err := n.FS.ssdCache.Get(key)
+	if err == nil {
+		n.FS.counters.hit(int64(len(cachedData)))
+		n.FS.hot.hit(key, int64(len(cachedData)))
+		log.Printf("CACHE_HIT: Read %d bytes from SSD for '%s'", len(cachedData), key)
+		return cachedData, nil
+	}
+	if err != ErrNotFoundCache {
+		log.Printf("WARNING: Error reading from SSD cache for %s (will try NFS): %v", key, err)
+	}
+
+	// 2. Read just this block from NFS. Concurrent readers of the block share the read, rather than
+	// each reading it and putting it in the cache.
+	data, err := n.FS.chunkFetches.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		// A flight for the block may have finished between our cache miss and starting this one.
+		if cachedData, err := n.FS.ssdCache.Get(key); err == nil {
+			return cachedData, nil
+		}
+		return n.fetchChunk(ctx, key, idx)
+	})
+	if err != nil && ctx.Err() != nil {
+		return nil, syscall.EINTR
+	} else if err == nil {
+		n.FS.counters.miss(int64(len(data)))
+	}
+	return data, err
+}
+
+// fetchChunk reads block idx of the file from NFS, and writes it to the cache under key.
+func (n *fuseFSNode) fetchChunk(ctx context.Context, key string, idx int64) ([]byte, error) {
+	done, err := n.FS.startNFSRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nfsData := make([]byte, n.FS.chunkSize)
+	var read int
+	err = n.FS.retryNFS(ctx, key, func() error {
+		f, err := n.FS.openNFS(n.nfsPathAbs())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		read, err = f.ReadAt(nfsData, idx*n.FS.chunkSize)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	done()
+	if err == syscall.EINTR {
+		return nil, err
+	} else if err != nil {
+		log.Printf("ERROR: Failed to read from NFS path %s: %v", n.nfsPathAbs(), err)
+		return nil, syscall.EIO
+	}
+	nfsData = nfsData[:read]
+	log.Printf("NFS_READ: Read %d bytes for '%s'", len(nfsData), key)
+
+	// Write the block to the cache
+	if err := n.FS.ssdCache.Put(key, nfsData, n.Mode); err == ErrWontCache {
+		log.Printf("WARNING: Cache refuse to write file: '%v'", err)
+	} else if err != nil {
+		log.Printf("ERROR: Failed to write to cache %s: %v. Proceeding without caching.", key, err)
+	} else {
+		n.FS.chunks.add(n.relPath(), idx)
+		log.Printf("CACHE_LOADED: Copied '%s' from NFS to cache", key)
+	}
+
+	return nfsData, nil
+}
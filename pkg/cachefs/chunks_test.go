@@ -0,0 +1,108 @@
+package cachefs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChunkedReads(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789")) // Blocks "0123", "4567" and a partial "89"
+	cache := NewDefaultCache(t.TempDir())
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache, ChunkSize: 4})
+	n := lookup(t, rfs, "data.bin")
+
+	for _, tc := range []struct {
+		name         string
+		offset       int64
+		size         int
+		want         string
+		cachedBlocks []int64
+	}{
+		{"within a block", 1, 2, "12", []int64{0}},
+		{"spanning a boundary", 3, 2, "34", []int64{0, 1}},
+		{"spanning every block", 2, 7, "2345678", []int64{0, 1, 2}},
+		{"into the partial last block", 6, 4, "6789", []int64{0, 1, 2}},
+		{"past EOF", 8, 100, "89", []int64{0, 1, 2}},
+		{"at EOF", 10, 4, "", []int64{0, 1, 2}},
+	} {
+		got, err := n.readChunked(context.Background(), tc.offset, tc.size)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s: read = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+		for _, idx := range tc.cachedBlocks {
+			if !cache.Has(chunkKey("data.bin", idx)) {
+				t.Errorf("%s: block %d isn't cached", tc.name, idx)
+			}
+		}
+	}
+
+	if got, err := cache.Get(chunkKey("data.bin", 2)); err != nil || string(got) != "89" {
+		t.Errorf("partial last block = %q, %v", got, err)
+	}
+	if cache.Has("data.bin") {
+		t.Error("the whole file was cached")
+	}
+}
+
+func TestChunkedReadFetchesOnlyCoveringBlocks(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789"))
+	cache := NewDefaultCache(t.TempDir())
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache, ChunkSize: 4})
+
+	if _, err := lookup(t, rfs, "data.bin").readChunked(context.Background(), 5, 2); err != nil {
+		t.Fatal(err)
+	}
+	for idx, want := range []bool{false, true, false} {
+		if got := cache.Has(chunkKey("data.bin", int64(idx))); got != want {
+			t.Errorf("block %d cached = %v, want %v", idx, got, want)
+		}
+	}
+}
+
+func TestEvictRemovesEveryBlock(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789"))
+	cache := NewDefaultCache(t.TempDir())
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache, ChunkSize: 4})
+
+	if _, err := lookup(t, rfs, "data.bin").readChunked(context.Background(), 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	rfs.evict("data.bin")
+	for idx := range int64(3) {
+		if cache.Has(chunkKey("data.bin", idx)) {
+			t.Errorf("block %d still cached after evicting the file", idx)
+		}
+	}
+}
+
+func TestConcurrentBlockMissesShareOneNFSRead(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, ChunkSize: 4, NFSReadDelay: 100 * time.Millisecond})
+	opens := countNFSOpens(rfs)
+	n := lookup(t, rfs, "data.bin")
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := n.readChunked(context.Background(), 4, 4); err != nil || string(got) != "4567" {
+				t.Errorf("reader %d got %q, %v", i, got, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := opens.Load(); got != 1 {
+		t.Errorf("read NFS %d times, want 1", got)
+	}
+	if rfs.Stats()["fetches_shared"] == 0 {
+		t.Error("no fetches were shared")
+	}
+}
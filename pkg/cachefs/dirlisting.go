@@ -0,0 +1,101 @@
+package cachefs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// dirListing is a directory's entries as last listed, kept on its node so listing it again doesn't
+// rebuild them. It's dropped whenever the node's children change, and isn't used once it has
+// expired or the directory's NFS modification time has changed since.
+type dirListing struct {
+	dirents []fuse.Dirent
+	modTime time.Time // Of the directory on NFS, when it was listed
+	expires time.Time
+}
+
+// listing returns the directory's cached listing, if it's still fresh for a directory last modified
+// on NFS at modTime. changed reports whether the directory has been modified on NFS since the
+// listing was made, or if there isn't one, since its children were loaded: ie. entries have been
+// added or removed.
+func (n *fuseFSNode) listing(modTime time.Time) (dirents []fuse.Dirent, changed bool) {
+	n.childrenMu.RLock()
+	defer n.childrenMu.RUnlock()
+
+	if n.cachedListing == nil {
+		return nil, !n.loadedModTime.IsZero() && !n.loadedModTime.Equal(modTime)
+	} else if !n.cachedListing.modTime.Equal(modTime) {
+		return nil, true
+	} else if time.Now().After(n.cachedListing.expires) {
+		return nil, false
+	}
+	return slices.Clone(n.cachedListing.dirents), false
+}
+
+// list builds the directory's entries from its children, remembering them for ttl (if set) as the
+// listing of the directory as of modTime.
+func (n *fuseFSNode) list(modTime time.Time, ttl time.Duration) []fuse.Dirent {
+	lock := n.childrenMu.RLocker()
+	if ttl > 0 {
+		lock = &n.childrenMu // Built and stored at once, so a child added meanwhile drops it
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	ents := make([]fuse.Dirent, len(n.Children))
+	for i, node := range n.Children {
+		typ := fuse.DT_File
+		if node.Mode.IsDir() {
+			typ = fuse.DT_Dir
+		} else if node.isSymlink() {
+			typ = fuse.DT_Link
+		}
+		ents[i] = fuse.Dirent{Inode: node.Inode, Type: typ, Name: node.name()}
+	}
+	if ttl > 0 {
+		n.cachedListing = &dirListing{dirents: slices.Clone(ents), modTime: modTime, expires: time.Now().Add(ttl)}
+	}
+	return ents
+}
+
+// reloadDir re-reads the directory's entries from NFS and reconciles its children with them, as
+// Refresh does for the whole tree, but without walking the directories already in it. New
+// directories are loaded with everything under them.
+func (rfs *FS) reloadDir(dir *fuseFSNode) error {
+	rfs.treeMu.Lock()
+	defer rfs.treeMu.Unlock()
+
+	// Before reading the entries, so a change made meanwhile is caught by the next listing.
+	fi, err := os.Stat(dir.nfsPathAbs())
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir.nfsPathAbs())
+	if err != nil {
+		return err
+	}
+
+	fresh := NewFuseFSNode(rfs, dir.name(), dir.parentPath(), dir.nfsPathAbs(), dir.Inode, dir.Mode, true)
+	fresh.loadedModTime = fi.ModTime()
+	for _, d := range entries {
+		child := newNodeFromEntry(rfs, fresh, d)
+		if existing := dir.child(d.Name()); child.isDir && (existing == nil || !existing.isDir) {
+			if err := loadSubtree(rfs, child); err != nil {
+				return fmt.Errorf("loading new directory '%s': %w", child.relPath(), err)
+			}
+		}
+		fresh.addChild(child)
+		// It may have been looked up while missing.
+		rfs.negCache.forget(child.relPath())
+	}
+
+	added, removed, _ := rfs.mergeChildren(dir, fresh)
+	rfs.dirReloads.Add(1)
+	log.Printf("REFRESH: Reloaded '%s' from NFS, %d nodes added, %d nodes removed", dir.relPath(), added, removed)
+	return nil
+}
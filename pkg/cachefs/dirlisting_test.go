@@ -0,0 +1,87 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// names lists the directory at relPath through the mount, returning the entries' names sorted.
+func names(t *testing.T, rfs *FS, relPath string) []string {
+	t.Helper()
+	ents, err := lookup(t, rfs, relPath).ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// addNFSFile adds a file to an NFS directory, and moves the directory's mtime on so the change is
+// seen however coarse the filesystem's timestamps are.
+func addNFSFile(t *testing.T, nfsDir, relPath string, bump time.Duration) {
+	t.Helper()
+	writeTestFile(t, nfsDir, relPath, []byte(relPath))
+	dir := filepath.Join(nfsDir, filepath.Dir(relPath))
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dir, time.Now(), fi.ModTime().Add(bump)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirListingReloadsFileAddedSinceLoad(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, DirListingTTL: time.Hour})
+
+	// Added after the tree was loaded, before the directory was ever listed.
+	addNFSFile(t, nfsDir, "dir/b", time.Second)
+	if got, want := names(t, rfs, "dir"), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("first listing gave %v, want %v", got, want)
+	}
+	if got := rfs.Stats()["dir_reloads"]; got != 1 {
+		t.Errorf("got %d reloads, want 1", got)
+	}
+}
+
+func TestDirListingInvalidatedByNFSChange(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, DirListingTTL: time.Hour})
+
+	if got, want := names(t, rfs, "dir"), []string{"a"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := names(t, rfs, "dir"), []string{"a"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := rfs.Stats()["dir_listing_hits"]; got != 1 {
+		t.Errorf("got %d listing hits, want the second listing served from the first", got)
+	}
+
+	addNFSFile(t, nfsDir, "dir/b", time.Second)
+	if got, want := names(t, rfs, "dir"), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("listing after a file was added on NFS gave %v, want %v", got, want)
+	}
+
+	if err := os.Remove(filepath.Join(nfsDir, "dir/a")); err != nil {
+		t.Fatal(err)
+	}
+	addNFSFile(t, nfsDir, "dir/c", 2*time.Second)
+	if got, want := names(t, rfs, "dir"), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("listing after NFS changed again gave %v, want %v", got, want)
+	}
+	if got := rfs.Stats()["dir_reloads"]; got != 2 {
+		t.Errorf("got %d reloads, want 2", got)
+	}
+}
@@ -0,0 +1,28 @@
+package cachefs
+
+import (
+	"fmt"
+	"io"
+)
+
+// Dumper is implemented by caches that can describe their internals (eg. eviction order), for
+// debugging.
+type Dumper interface {
+	Dump(w io.Writer)
+}
+
+// dumpCache writes a human-readable description of every layer of the cache, outermost first.
+func dumpCache(w io.Writer, c Cache) {
+	for c != nil {
+		fmt.Fprintf(w, "== %T ==\n", c)
+		if d, ok := c.(Dumper); ok {
+			d.Dump(w)
+		}
+
+		u, ok := c.(unwrapper)
+		if !ok {
+			return
+		}
+		c = u.Unwrap()
+	}
+}
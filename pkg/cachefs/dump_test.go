@@ -0,0 +1,61 @@
+package cachefs
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var diskBytes = regexp.MustCompile(`bytes: \d+/(\d+) \(`)
+
+func TestDumpCache(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		newCache func(dir string) Cache
+		want     string
+	}{
+		{"default", NewDefaultCache, `== *cachefs.defaultCache ==
+files: 2
+`},
+		{"size", func(dir string) Cache { return NewSizeLimitedCache(dir, 1<<20) }, `== *cachefs.sizeLimitedCache ==
+bytes: BLOCKS/1048576 (5 logical)
+  a.txt
+  dir/b.txt
+`},
+		{"lru", func(dir string) Cache { return must(NewHybridCache(dir, 10, 1<<20, false)) }, `== *cachefs.lruCache ==
+entries: 2/10 (least recently used first)
+bytes: 5/1048576
+  dir/b.txt size=2 age=0s
+  a.txt size=3 age=0s
+`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := tc.newCache(t.TempDir())
+			for path, data := range map[string]string{"a.txt": "aaa", "dir/b.txt": "bb"} {
+				if err := cache.Put(path, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Used last, so evicted last.
+			if _, err := cache.Get("a.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			var b strings.Builder
+			dumpCache(&b, cache)
+			// The size cache counts whole blocks, which depends on the file system.
+			got := diskBytes.ReplaceAllString(b.String(), "bytes: BLOCKS/$1 (")
+			if got != tc.want {
+				t.Errorf("dump =\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDumpCacheWalksWrappers(t *testing.T) {
+	var b strings.Builder
+	dumpCache(&b, NewChecksumCache(NewDefaultCache(t.TempDir())))
+	if want := "== *cachefs.checksumCache ==\n== *cachefs.defaultCache ==\nfiles: 0\n"; b.String() != want {
+		t.Errorf("dump =\n%s\nwant\n%s", b.String(), want)
+	}
+}
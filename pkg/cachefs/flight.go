@@ -0,0 +1,89 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var errFlightPanicked = errors.New("flight panicked")
+
+// flightGroup collapses concurrent calls for the same key into one: the first caller starts the
+// work, and everyone arriving while it is in flight waits for it and shares its result, error
+// included.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+
+	shared atomic.Int64 // Calls that were answered by someone else's flight
+}
+
+type flightCall[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+
+	waiters int                // Callers still waiting for the result. Guarded by the group's mu
+	cancel  context.CancelFunc // Cancels the flight's context
+}
+
+// do runs fn for key, or waits for the flight already running it. fn gets a context of its own,
+// which is only cancelled once every caller waiting on it has had their ctx cancelled, so one
+// caller going away doesn't fail the others. Callers whose ctx is cancelled return its error.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	call, ok := g.calls[key]
+	if ok {
+		g.shared.Add(1)
+	} else {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go g.run(flightCtx, key, call, fn)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody wants the result any more. Later callers start a flight of their own, rather
+			// than joining one that's being cancelled.
+			call.cancel()
+			g.forget(key, call)
+		}
+		g.mu.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (g *flightGroup[T]) run(ctx context.Context, key string, call *flightCall[T], fn func(ctx context.Context) (T, error)) {
+	// Deferred, so waiters are released (with errFlightPanicked) even if fn panics.
+	call.err = errFlightPanicked
+	defer func() {
+		g.mu.Lock()
+		g.forget(key, call)
+		g.mu.Unlock()
+		call.cancel()
+		close(call.done)
+	}()
+
+	call.val, call.err = fn(ctx)
+}
+
+// forget drops the call for key, unless it has already been replaced by a newer one.
+// Must be called with mu held.
+func (g *flightGroup[T]) forget(key string, call *flightCall[T]) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
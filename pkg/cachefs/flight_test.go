@@ -0,0 +1,164 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readConcurrently reads the file at relPath from n goroutines at once, returning what each got.
+func readConcurrently(t *testing.T, rfs *FS, relPath string, n int) ([][]byte, []error) {
+	t.Helper()
+	node := lookup(t, rfs, relPath)
+	data, errs := make([][]byte, n), make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data[i], errs[i] = node.data(context.Background())
+		}()
+	}
+	wg.Wait()
+	return data, errs
+}
+
+func TestConcurrentMissesShareOneNFSRead(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "project-1/main.py", []byte("print()"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSReadDelay: 100 * time.Millisecond})
+	opens := countNFSOpens(rfs)
+
+	data, errs := readConcurrently(t, rfs, "project-1/main.py", 10)
+	for i := range data {
+		if errs[i] != nil || string(data[i]) != "print()" {
+			t.Errorf("reader %d got %q, %v", i, data[i], errs[i])
+		}
+	}
+	if got := opens.Load(); got != 1 {
+		t.Errorf("read NFS %d times, want 1", got)
+	}
+
+	// A reader arriving afterwards is served by the cache.
+	if _, err := lookup(t, rfs, "project-1/main.py").data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := opens.Load(); got != 1 {
+		t.Errorf("read NFS %d times after a late read, want 1", got)
+	}
+}
+
+func TestFlightErrorReachesEveryWaiter(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "main.py", []byte("print()"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSReadDelay: 100 * time.Millisecond})
+	var mu sync.Mutex
+	opens := 0
+	rfs.openNFS = func(name string) (*os.File, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opens++
+		return nil, errors.New("NFS went away")
+	}
+
+	_, errs := readConcurrently(t, rfs, "main.py", 10)
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("reader %d got no error", i)
+		}
+	}
+	if opens != 1 {
+		t.Errorf("tried NFS %d times, want 1", opens)
+	}
+}
+
+// countingCache counts the Puts that reach the cache it wraps.
+type countingCache struct {
+	Cache
+	puts atomic.Int64
+}
+
+func (c *countingCache) Put(path string, data []byte, mode os.FileMode) error {
+	c.puts.Add(1)
+	return c.Cache.Put(path, data, mode)
+}
+
+func TestConcurrentReadsPutOnce(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("shared"))
+	cache := &countingCache{Cache: NewMemCache(1 << 20)}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache, NFSReadDelay: 100 * time.Millisecond})
+	opens := countNFSOpens(rfs)
+
+	data, errs := readConcurrently(t, rfs, "data.bin", 20)
+	for i := range data {
+		if errs[i] != nil || string(data[i]) != "shared" {
+			t.Errorf("reader %d got %q, %v", i, data[i], errs[i])
+		}
+	}
+	if got := opens.Load(); got != 1 {
+		t.Errorf("read NFS %d times, want 1", got)
+	}
+	if got := cache.puts.Load(); got != 1 {
+		t.Errorf("put the file %d times, want 1", got)
+	}
+	if got := rfs.Stats()["fetches_shared"]; got != 19 {
+		t.Errorf("fetches_shared = %d, want 19", got)
+	}
+}
+
+func TestCancelledReadReturnsEINTR(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "main.py", []byte("print()"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSReadDelay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := lookup(t, rfs, "main.py").data(ctx); err != syscall.EINTR {
+		t.Errorf("data = %v, want EINTR", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancelled read took %v, want it to give up with the request", elapsed)
+	}
+	if rfs.ssdCache.Has("main.py") {
+		t.Error("a cancelled read was cached")
+	}
+}
+
+func TestCancelledReaderDoesNotFailSharedFetch(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "main.py", []byte("print()"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSReadDelay: 200 * time.Millisecond})
+	node := lookup(t, rfs, "main.py")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := node.data(ctx)
+		cancelled <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	go func() {
+		defer close(done)
+		data, err = node.data(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-cancelled; err != syscall.EINTR {
+		t.Errorf("cancelled reader got %v, want EINTR", err)
+	}
+	<-done
+	if err != nil || string(data) != "print()" {
+		t.Errorf("other reader got %q, %v", data, err)
+	}
+}
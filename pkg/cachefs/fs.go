@@ -0,0 +1,942 @@
+package cachefs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	native_fs "io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+const (
+	unmountAttempts = 5
+	unmountBackoff  = 250 * time.Millisecond // Doubled after every attempt, ~4s in all
+
+	perm_READWRITEEXECUTE = 0o700
+	perm_READEXECUTE      = 0o500
+	perm_READ             = 0o400
+)
+
+type FuseFS interface {
+	Mount() error
+	Serve(debug bool) error
+	Unmount() error
+	Shutdown(timeout time.Duration) error
+	Mountpoint() string
+	Refresh() error
+	Invalidate(relPath string) error
+	PrintTree(w io.Writer)
+	Watch(ctx context.Context) error
+	Scrub(ctx context.Context, interval time.Duration, rate int) error
+	GC(ctx context.Context, interval, minAge time.Duration, dryRun bool) error
+	Warm(ctx context.Context, relPaths []string, jobs int, progress func(WarmProgress)) (WarmProgress, error)
+	DumpCache(w io.Writer)
+	ListCache(w io.Writer) error
+	ClearCache() (files int, bytes int64, err error)
+	TopN(n int) []HotFile
+	StatsReporter
+
+	fs.FS
+	fs.FSInodeGenerator
+	fs.FSStatfser
+}
+
+// Config configures a file system. Mountpoint, NFSDir and SSDDir are required, the rest is
+// optional behaviour, off when left as the zero value.
+type Config struct {
+	// Mountpoint is where the file system is mounted.
+	Mountpoint string
+	// NFSDir is the directory being served, the source of truth for every file.
+	NFSDir string
+	// NFSSources, when set, are served merged into one tree instead of NFSDir, each as a directory
+	// in the root named after it.
+	NFSSources NFSSources
+	// SSDDir is the cache directory. It must be the directory Cache stores its files in, if it
+	// stores them on disk.
+	SSDDir string
+	// Cache caches the files read from NFSDir. A default cache in SSDDir is used if it's nil.
+	Cache Cache
+
+	// Writable mounts the file system read-write, allowing changes (eg. symlinks) to be made
+	// through the mount. These are passed straight through to NFS.
+	Writable bool
+	// ChunkSize, when set, caches files in blocks of this many bytes rather than whole. Reads then
+	// only fetch the blocks they cover.
+	ChunkSize int64
+	// PrefetchConcurrency, when set, loads the rest of a directory into the cache in the background
+	// when one of its files misses, using at most this many concurrent NFS reads. Not used when
+	// chunking.
+	PrefetchConcurrency int
+	// AttrTTL is how long the kernel may cache node attributes before asking again.
+	AttrTTL time.Duration
+	// AttrCacheTTL is how long NFS attributes are remembered, saving a stat of NFS when the kernel
+	// asks for them again. Cached attributes are dropped when the file's data is invalidated.
+	AttrCacheTTL time.Duration
+	// DirListingTTL, when set, is how long a directory's listing is reused, unless the directory is
+	// modified on NFS before then. A directory modified on NFS since it was last listed has its
+	// entries reloaded from NFS before it's listed again.
+	DirListingTTL time.Duration
+	// NegativeTTL is how long paths that don't exist on NFS are remembered as missing. 0 disables.
+	NegativeTTL time.Duration
+	// ReadAllThreshold, when set, reads files of up to this many bytes whole when they are opened,
+	// rather than going to the cache for every read. Not used when chunking.
+	ReadAllThreshold int64
+	// NFSReadDelay is slept before every file read from NFS, to simulate network latency.
+	NFSReadDelay time.Duration
+	// MetricsCheckpoint, when set, saves the cache counters (hits, misses, evictions and bytes) under
+	// SSDDir at this interval and on Close, and loads them when the file system is created, so
+	// stats report lifetime counters alongside those since the process started.
+	MetricsCheckpoint time.Duration
+	// NFSRetries is how many times a file read from NFS that fails with one of NFSRetryErrnos is
+	// retried, waiting NFSRetryDelay before the first retry and doubling it after each.
+	NFSRetries     int
+	NFSRetryDelay  time.Duration
+	NFSRetryErrnos Errnos
+	// NFSConcurrency, when set, is the most file reads from NFS at once (including prefetching).
+	// Reads past it wait for a turn.
+	NFSConcurrency int
+	// ReadAheadBytes, when set, reads this many bytes ahead of sequential reads on an open file, in
+	// the background, so the next read is served from memory.
+	ReadAheadBytes int64
+	// ReadAheadLimit caps the bytes read ahead across all open files at once. Only used when
+	// ReadAheadBytes is set.
+	ReadAheadLimit int64
+	// VersionedKeys caches whole files under their path plus their NFS modification time and size,
+	// so a file changed on NFS misses rather than being served stale. Not used when chunking.
+	VersionedKeys bool
+	// WriteBack, on a writable mount, caches files written through it and writes them to NFS in the
+	// background, rather than writing through to NFS on every write. Files not yet written back are
+	// held in memory, up to WriteBackLimit bytes, after which writers wait for them to be written.
+	// They're written at least every WriteBackInterval, and all of them on Unmount. Can't be used
+	// with chunking. With versioned keys, the new contents aren't cached until they're next read, as
+	// their key depends on their version on NFS once written back.
+	WriteBack         bool
+	WriteBackLimit    int64
+	WriteBackInterval time.Duration
+	// UIDMap and GIDMap change the owners files have on NFS to the ones they're shown with (and
+	// access is checked against) on the mount. Owners without a mapping are shown as they are.
+	UIDMap, GIDMap IDMap
+	// AllowOther lets users other than the one mounting use the mount, with the kernel checking
+	// their access against the files' permissions. Users other than root need user_allow_other in
+	// /etc/fuse.conf to mount with it. Can't be used with a writable mount.
+	AllowOther bool
+}
+
+// New loads the file tree from cfg.NFSDir (or cfg.NFSSources), and returns the file system ready to
+// be mounted. It returns an error if any directory can't be found or the tree fails to load.
+func New(cfg Config) (*FS, error) {
+	var absNFSDir string
+	var sources NFSSources
+	if len(cfg.NFSSources) == 0 {
+		var err error
+		if absNFSDir, err = absNFSPath(cfg.NFSDir); err != nil {
+			return nil, err
+		}
+	} else {
+		sources = make(NFSSources, len(cfg.NFSSources))
+		for name, dir := range cfg.NFSSources {
+			absDir, err := absNFSPath(dir)
+			if err != nil {
+				return nil, fmt.Errorf("NFS source %s: %w", name, err)
+			}
+			for other, otherDir := range sources {
+				if _, nested := relPathUnder(otherDir, absDir); nested {
+					return nil, fmt.Errorf("NFS sources %s and %s overlap", name, other)
+				} else if _, nested := relPathUnder(absDir, otherDir); nested {
+					return nil, fmt.Errorf("NFS sources %s and %s overlap", name, other)
+				}
+			}
+			sources[name] = absDir
+		}
+	}
+	absSSDDir, err := filepath.Abs(cfg.SSDDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSD relative path '%s': %w", cfg.SSDDir, err)
+	} else if _, err := os.Stat(absSSDDir); err != nil {
+		return nil, fmt.Errorf("could not find SSD path '%s': %w", absSSDDir, err)
+	}
+
+	if cfg.WriteBack {
+		if !cfg.Writable {
+			return nil, errors.New("write-back needs a writable mount")
+		} else if cfg.ChunkSize > 0 {
+			return nil, errors.New("write-back can't be used with chunking")
+		} else if cfg.WriteBackLimit <= 0 || cfg.WriteBackInterval <= 0 {
+			return nil, errors.New("write-back needs a dirty byte limit and flush interval")
+		}
+	}
+
+	if cfg.AllowOther && cfg.Writable {
+		// Whoever writes, the change reaches NFS as the user that mounted.
+		return nil, errors.New("allow_other can't be used with a writable mount")
+	}
+
+	cache := cfg.Cache
+	if cache == nil {
+		cache = NewDefaultCache(absSSDDir)
+	}
+
+	rfs := &FS{
+		mountpoint:       cfg.Mountpoint,
+		nfsBaseAbs:       absNFSDir,
+		nfsSources:       sources,
+		mergedAt:         time.Now(),
+		ssdBaseAbs:       absSSDDir,
+		ssdCache:         cache,
+		writable:         cfg.Writable,
+		allowOther:       cfg.AllowOther,
+		negCache:         newNegativeCache(cfg.NegativeTTL),
+		attrCache:        newAttrCache(cfg.AttrCacheTTL),
+		chunkSize:        cfg.ChunkSize,
+		attrTTL:          cfg.AttrTTL,
+		dirListingTTL:    cfg.DirListingTTL,
+		nfsReadDelay:     cfg.NFSReadDelay,
+		openNFS:          os.Open,
+		nfsRetries:       cfg.NFSRetries,
+		nfsRetryDelay:    cfg.NFSRetryDelay,
+		nfsRetryErrnos:   cfg.NFSRetryErrnos,
+		readAllThreshold: cfg.ReadAllThreshold,
+		versionedKeys:    cfg.VersionedKeys && cfg.ChunkSize == 0,
+		uidMap:           cfg.UIDMap,
+		gidMap:           cfg.GIDMap,
+	}
+
+	if cfg.NFSConcurrency > 0 {
+		rfs.nfsLimit = newNFSLimiter(cfg.NFSConcurrency)
+	}
+
+	if cfg.ReadAheadBytes > 0 {
+		rfs.readAhead = newReadAhead(cfg.ReadAheadBytes, cfg.ReadAheadLimit)
+	}
+
+	if cfg.PrefetchConcurrency > 0 && cfg.ChunkSize == 0 {
+		rfs.prefetch = newPrefetcher(cfg.PrefetchConcurrency)
+	}
+
+	if notifier, ok := findCache[EvictNotifier](cache); ok {
+		notifier.OnEvict(rfs.onEvict)
+	}
+
+	rfs.lastInode.Store(1)
+	if fi, err := os.Stat(absNFSDir); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			rfs.nfsDev = uint64(st.Dev)
+		}
+	}
+
+	rootNode, err := loadFSTree(rfs)
+	if err != nil {
+		return nil, fmt.Errorf("building FS: %w", err)
+	}
+
+	rfs.rootNode = rootNode
+
+	if cfg.MetricsCheckpoint > 0 {
+		rfs.metrics = newMetricsCheckpoint(absSSDDir, &rfs.counters, cfg.MetricsCheckpoint)
+	}
+
+	if cfg.WriteBack {
+		rfs.writeBack = newWriteBack(rfs.nfsPath, cfg.WriteBackLimit, cfg.WriteBackInterval, func(relPath string) {
+			rfs.attrCache.forget(relPath) // Its size and mtime on NFS have changed
+		})
+	}
+
+	return rfs, nil
+}
+
+// FS is a FUSE file system serving the files in an NFS directory, caching them as they're read.
+type FS struct {
+	mountpoint string
+	lastInode  atomic.Uint64
+	nfsDev     uint64 // Device of nfsBaseAbs, whose files keep their NFS inode numbers (see nfsInode)
+	conn       *fuse.Conn
+	server     *fs.Server
+	nfsBaseAbs string
+	nfsSources NFSSources // Name -> absolute directory when merging several, nil when serving nfsBaseAbs
+	mergedAt   time.Time  // When a merged tree was created, the modification time of its root
+	ssdBaseAbs string
+
+	rootNode  *fuseFSNode // TODO(wes): Should this rather be a map[path]node?
+	treeMu    sync.Mutex  // Serialises changes to the tree structure from refreshes and watch events
+	ssdCache  Cache
+	negCache  *negativeCache
+	attrCache *attrCache
+	writable  bool
+	attrTTL   time.Duration
+
+	dirListingTTL  time.Duration // How long directory listings are reused, 0 to rebuild them every time
+	dirListingHits atomic.Int64
+	dirReloads     atomic.Int64 // Directories reloaded from NFS when listed, as they'd changed
+
+	allowOther bool // Users other than the one mounting may use the mount
+
+	uidMap, gidMap IDMap // NFS owner -> the owner shown on the mount
+
+	nfsReadDelay     time.Duration // Simulated NFS latency, 0 for none
+	nfsLimit         *nfsLimiter   // nil when NFS reads aren't limited
+	readAllThreshold int64         // Files up to this size are read whole on open, 0 to disable
+	readAhead        *readAhead    // nil when not reading ahead
+
+	nfsRetries     int           // Retries of NFS reads failing with one of nfsRetryErrnos
+	nfsRetryDelay  time.Duration // Before the first retry, doubled after each
+	nfsRetryErrnos Errnos
+	nfsRetried     atomic.Int64
+
+	openNFS func(name string) (*os.File, error) // Opens files to read from NFS. os.Open, but for tests
+
+	chunkSize int64      // 0 when caching whole files
+	chunks    chunkIndex // Blocks cached per file, when chunking
+
+	versionedKeys bool // Whole files are cached under versionedKey, rather than their path
+
+	writeBack *writeBack // nil when writing through to NFS
+
+	prefetch *prefetcher // nil when not prefetching
+	fetches  flightGroup[fetchResult]
+
+	chunkFetches flightGroup[[]byte] // Of blocks, when chunking
+
+	counters cacheCounters
+	hot      hotFiles
+	metrics  *metricsCheckpoint // nil when the counters aren't saved
+	latency  fsLatencies
+
+	requests requestTracker // Reads in progress, drained on shutdown
+	versions cachedVersions // NFS versions of cached files, for the scrubber
+}
+
+func (rfs *FS) Mount() error {
+	opts := []fuse.MountOption{
+		fuse.FSName("fusefs"),
+		fuse.Subtype("fusefs"),
+	}
+	if !rfs.writable {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	if rfs.allowOther {
+		if err := checkAllowOther(); err != nil {
+			return err
+		}
+		// Without default_permissions the kernel lets every user open every file, leaving it to us,
+		// and only Access checks permissions.
+		opts = append(opts, fuse.AllowOther(), fuse.DefaultPermissions())
+	}
+
+	c, err := fuse.Mount(rfs.mountpoint, opts...)
+	if err != nil {
+		if rfs.allowOther {
+			return fmt.Errorf("mounting with allow_other failed (users other than root need user_allow_other in /etc/fuse.conf): %w", err)
+		}
+		return err
+	}
+	rfs.conn = c
+
+	return nil
+}
+
+func (rfs *FS) Serve(debug bool) error {
+	fsConf := new(fs.Config)
+	if debug {
+		fsConf.Debug = func(msg any) {
+			log.Printf("S_DEBUG: '%v'", msg)
+		}
+	}
+	rfs.server = fs.New(rfs.conn, fsConf)
+	return rfs.server.Serve(rfs)
+}
+
+func (rfs *FS) Unmount() error {
+	if rfs.prefetch != nil {
+		rfs.prefetch.stop()
+	}
+
+	if err := unmountWithRetry(rfs.mountpoint); err != nil {
+		return err
+	}
+	if err := rfs.conn.Close(); err != nil {
+		return err
+	}
+	return rfs.Close()
+}
+
+// Close writes back everything not yet written to NFS, and closes the cache. It's called by
+// Unmount, and is for file systems that were never mounted, eg. to warm the cache.
+func (rfs *FS) Close() error {
+	// Nothing more can be written, so everything not yet written back to NFS is written now.
+	var errs []error
+	if rfs.writeBack != nil {
+		if err := rfs.writeBack.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write back to NFS: %w", err))
+		}
+	}
+
+	// Some caches have writes in flight that need to finish (eg. async), or state to save (eg. lru).
+	if closer, ok := findCache[io.Closer](rfs.ssdCache); ok {
+		errs = append(errs, closer.Close())
+	}
+	if rfs.metrics != nil {
+		errs = append(errs, rfs.metrics.close())
+	}
+	return errors.Join(errs...)
+}
+
+// ClearCache removes everything from the cache, eg. after the files on NFS have been replaced. It
+// returns how many files and bytes were freed from SSD.
+func (rfs *FS) ClearCache() (files int, bytes int64, err error) {
+	filesBefore, bytesBefore, err := dirUsage(rfs.ssdBaseAbs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := rfs.ssdCache.Clear(); err != nil {
+		return 0, 0, err
+	}
+	rfs.chunks.reset()
+	rfs.hot.reset()
+	rfs.versions.reset()
+
+	filesAfter, bytesAfter, err := dirUsage(rfs.ssdBaseAbs)
+	if err != nil {
+		return 0, 0, err
+	}
+	return filesBefore - filesAfter, bytesBefore - bytesAfter, nil
+}
+
+// DumpCache writes a human-readable description of the cache's internals to w.
+func (rfs *FS) DumpCache(w io.Writer) {
+	dumpCache(w, rfs.ssdCache)
+
+	fmt.Fprintf(w, "== hottest %d ==\n", dumpHottest)
+	WriteHotFiles(w, rfs.TopN(dumpHottest))
+}
+
+// TopN returns the n cache entries read from the cache most often since they were cached, most
+// first.
+func (rfs *FS) TopN(n int) []HotFile {
+	return rfs.hot.top(n)
+}
+
+func (rfs *FS) Stats() Stats {
+	stats := statsOf(rfs.ssdCache)
+	stats["negative_hits"] = rfs.negCache.hits.Load()
+	stats["attr_hits"] = rfs.attrCache.hits.Load()
+	stats["dir_listing_hits"] = rfs.dirListingHits.Load()
+	stats["dir_reloads"] = rfs.dirReloads.Load()
+	maps.Copy(stats, rfs.counters.snapshot())
+	stats["nfs_retries"] = rfs.nfsRetried.Load()
+	if rfs.metrics != nil {
+		rfs.metrics.addStats(stats)
+	}
+	stats["fetches_shared"] = rfs.fetches.shared.Load() + rfs.chunkFetches.shared.Load()
+	rfs.latency.addStats(stats)
+	if rfs.prefetch != nil {
+		stats["prefetch_issued"] = rfs.prefetch.issued.Load()
+		stats["prefetch_hits"] = rfs.prefetch.hits.Load()
+	}
+	if rfs.writeBack != nil {
+		rfs.writeBack.addStats(stats)
+	}
+	if rfs.nfsLimit != nil {
+		rfs.nfsLimit.addStats(stats)
+	}
+	if rfs.readAhead != nil {
+		stats["readahead_hits"] = rfs.readAhead.hits.Load()
+		stats["readahead_denied"] = rfs.readAhead.denied.Load()
+		stats["readahead_bytes"] = rfs.readAhead.inUse()
+	}
+	return stats
+}
+
+func (rfs *FS) Mountpoint() string {
+	return rfs.mountpoint
+}
+
+func (rfs *FS) Root() (fs.Node, error) {
+	return rfs.rootNode, nil
+}
+
+// Statfs reports the capacity of the NFS file system backing the mount. A merged tree reports its
+// first source's, as its sources may well share a file system.
+func (rfs *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	var st syscall.Statfs_t
+	root := rfs.nfsRoots()[0]
+	if err := syscall.Statfs(root, &st); err != nil {
+		log.Printf("ERROR: Failed to statfs NFS path %s: %v", root, err)
+		return syscall.EIO
+	}
+
+	resp.Blocks = st.Blocks
+	resp.Bfree = st.Bfree
+	resp.Bavail = st.Bavail
+	resp.Files = st.Files
+	resp.Ffree = st.Ffree
+	resp.Bsize = uint32(st.Bsize)
+	resp.Frsize = uint32(st.Bsize)
+	resp.Namelen = 255
+	return nil
+}
+
+// Refresh re-walks NFS and reconciles the node tree with it. Nodes for paths that still exist are
+// kept as they are (so inodes and cached data survive), new paths get new nodes and nodes for
+// removed paths are dropped along with their cached data.
+func (rfs *FS) Refresh() error {
+	rfs.treeMu.Lock()
+	defer rfs.treeMu.Unlock()
+
+	freshRoot, err := loadFSTree(rfs)
+	if err != nil {
+		return fmt.Errorf("refreshing FS: %w", err)
+	}
+
+	added, removed := rfs.mergeTree(rfs.rootNode, freshRoot)
+	// Paths that were missing may have just been added. Their nodes would still report ENOENT until
+	// the entries expired.
+	rfs.negCache.reset()
+	log.Printf("REFRESH: Reloaded tree from NFS, %d nodes added, %d nodes removed", added, removed)
+
+	return nil
+}
+
+// unmountWithRetry unmounts, retrying with backoff while the mount is busy (eg. a shell is still
+// cd'ed into it). If it is still busy after the last attempt, it is lazily unmounted instead, so
+// the process doesn't leave a broken mount behind.
+func unmountWithRetry(mountpoint string) error {
+	backoff := unmountBackoff
+	var err error
+	for attempt := 1; attempt <= unmountAttempts; attempt++ {
+		if err = fuse.Unmount(mountpoint); err == nil {
+			return nil
+		}
+		log.Printf("WARNING: Unmount attempt %d/%d of '%s' failed: %v", attempt, unmountAttempts, mountpoint, err)
+		if !isBusy(err) {
+			return err
+		}
+		if attempt < unmountAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Printf("WARNING: '%s' is still busy, unmounting lazily", mountpoint)
+	if lazyErr := lazyUnmount(mountpoint); lazyErr != nil {
+		log.Printf("ERROR: %v", lazyErr)
+		return err
+	}
+	return nil
+}
+
+// isBusy reports whether an unmount failed because the mount is in use. fusermount only reports it
+// in its output, so the message is checked too.
+func isBusy(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || strings.Contains(strings.ToLower(err.Error()), "busy")
+}
+
+// Invalidate drops everything cached for the file (or directory) at relPath, as though it had
+// changed on NFS.
+func (rfs *FS) Invalidate(relPath string) error {
+	rfs.treeMu.Lock()
+	defer rfs.treeMu.Unlock()
+
+	relPath = strings.TrimPrefix(filepath.Clean("/"+relPath), "/")
+	node := rfs.nodeAt(relPath)
+	if node == nil {
+		return fmt.Errorf("'%s': %w", relPath, os.ErrNotExist)
+	}
+
+	rfs.forgetNode(node)
+	if rfs.server != nil && !node.isDir {
+		if err := rfs.server.InvalidateNodeData(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("WARNING: Failed to invalidate kernel data for '%s': %v", relPath, err)
+		}
+	}
+	return nil
+}
+
+// PrintTree writes the file tree, as it is now, to w.
+func (rfs *FS) PrintTree(w io.Writer) {
+	printTree(w, rfs.rootNode, "")
+}
+
+// mergeTree reconciles the children of existing with those of fresh, recursively. Children are
+// matched by name and type, anything unmatched in existing is removed and unmatched in fresh is
+// added. Returns the number of nodes added and removed.
+func (rfs *FS) mergeTree(existing, fresh *fuseFSNode) (added, removed int) {
+	added, removed, subDirs := rfs.mergeChildren(existing, fresh)
+	for _, p := range subDirs {
+		a, r := rfs.mergeTree(p.existing, p.fresh)
+		added += a
+		removed += r
+	}
+	return added, removed
+}
+
+// dirPair is a directory in the tree, and the same directory freshly loaded from NFS.
+type dirPair struct{ existing, fresh *fuseFSNode }
+
+// mergeChildren reconciles the children of existing with those of fresh, as mergeTree does, but
+// only one level deep. It returns the directories matched, whose children are yet to be merged.
+func (rfs *FS) mergeChildren(existing, fresh *fuseFSNode) (added, removed int, subDirs []dirPair) {
+	existing.childrenMu.Lock()
+	oldChildren := make(map[string]*fuseFSNode, len(existing.Children))
+	for _, child := range existing.Children {
+		oldChildren[child.name()] = child
+	}
+
+	merged := make([]*fuseFSNode, 0, len(fresh.Children))
+	for _, freshChild := range fresh.Children {
+		oldChild, ok := oldChildren[freshChild.name()]
+		if ok && oldChild.Mode.Type() == freshChild.Mode.Type() {
+			merged = append(merged, oldChild)
+			delete(oldChildren, freshChild.name())
+			if oldChild.isDir {
+				subDirs = append(subDirs, dirPair{oldChild, freshChild})
+			}
+			continue
+		}
+		merged = append(merged, freshChild)
+		added++
+	}
+	existing.Children = merged
+	existing.cachedListing = nil
+	existing.loadedModTime = fresh.loadedModTime
+	existing.childrenMu.Unlock()
+
+	for _, oldChild := range oldChildren {
+		rfs.dropNode(existing, oldChild)
+		removed++
+	}
+
+	return added, removed, subDirs
+}
+
+// dropNode cleans up after a node that has been removed from parent: anything cached for it (or
+// below it) is deleted, and the kernel is told to forget the entry.
+func (rfs *FS) dropNode(parent, node *fuseFSNode) {
+	rfs.forgetNode(node)
+
+	if rfs.server != nil {
+		if err := rfs.server.InvalidateEntry(parent, node.name()); err != nil && err != fuse.ErrNotCached {
+			log.Printf("WARNING: Failed to invalidate kernel entry for '%s': %v", node.relPath(), err)
+		}
+	}
+}
+
+// forgetNode deletes anything cached for the node, or below it, without telling the kernel. For
+// changes the kernel already knows about, eg. renames through the mount.
+func (rfs *FS) forgetNode(node *fuseFSNode) {
+	if node.isDir {
+		for _, child := range node.children() {
+			rfs.forgetNode(child)
+		}
+	} else {
+		rfs.evict(node.relPath())
+	}
+	rfs.attrCache.forget(node.relPath())
+}
+
+// onEvict is called by the cache when it evicts a file by itself, eg. to stay within its limits.
+func (rfs *FS) onEvict(key string, size int64) {
+	log.Printf("EVICT: '%s' (%d bytes) was evicted from the cache", key, size)
+	rfs.counters.evictions.Add(1)
+	rfs.hot.forget(key)
+
+	relPath := key
+	if path, ok := splitVersionedKey(key); ok && rfs.versionedKeys {
+		relPath = path
+	}
+	rfs.versions.forgetKey(relPath, key)
+	if rfs.prefetch != nil {
+		rfs.prefetch.forget(relPath)
+	}
+}
+
+// evict removes everything cached for the file at relPath, including its attributes.
+func (rfs *FS) evict(relPath string) {
+	key := relPath
+	if v, ok := rfs.versions.get(relPath); ok {
+		key = v.key
+	}
+
+	rfs.attrCache.forget(relPath)
+	rfs.versions.forget(relPath)
+	rfs.hot.forget(key)
+	if err := rfs.ssdCache.Delete(key); err != nil {
+		log.Printf("WARNING: Failed to remove '%s' from cache: %v", key, err)
+	}
+
+	for idx := range rfs.chunks.take(relPath) {
+		rfs.hot.forget(chunkKey(relPath, idx))
+		if err := rfs.ssdCache.Delete(chunkKey(relPath, idx)); err != nil {
+			log.Printf("WARNING: Failed to remove '%s' from cache: %v", chunkKey(relPath, idx), err)
+		}
+	}
+}
+
+// recordVersion remembers the NFS version of a file just cached under key. With versioned keys, the
+// copy of the version before it is deleted straight away, rather than waiting to be evicted.
+func (rfs *FS) recordVersion(relPath, key string, fi native_fs.FileInfo, mode os.FileMode) {
+	prev, ok := rfs.versions.record(relPath, key, fi.Size(), fi.ModTime(), mode)
+	if !ok || prev.key == key {
+		return
+	}
+	rfs.hot.forget(prev.key)
+	if err := rfs.ssdCache.Delete(prev.key); err != nil {
+		log.Printf("WARNING: Failed to remove the old version of '%s' from cache: %v", relPath, err)
+		return
+	}
+	log.Printf("CACHE_VERSION: '%s' changed on NFS, removed the copy cached as '%s'", relPath, prev.key)
+}
+
+// simulateNFSLatency sleeps for the configured NFS read delay, if any. It returns syscall.EINTR
+// early if ctx is cancelled, eg. because the process that made the request has gone.
+func (rfs *FS) simulateNFSLatency(ctx context.Context) error {
+	if rfs.nfsReadDelay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(rfs.nfsReadDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// syntheticInodes is the range generated inodes are in: the top bit is set, which inodes derived from
+// NFS never have (see nfsInode), so the two can't collide.
+const syntheticInodes = 1 << 63
+
+// GenerateInode keeps a global fs counter and just increments it for simplicity. Nodes use their NFS
+// inode where possible, this is the fallback for when there isn't one (eg. the root of merged
+// sources). Called concurrently by the FUSE server, so the counter is atomic.
+func (rfs *FS) GenerateInode(_ uint64, _ string) uint64 {
+	return syntheticInodes | rfs.lastInode.Add(1)
+}
+
+func loadFSTree(fs *FS) (*fuseFSNode, error) {
+	if fs.merged() {
+		return loadMergedTree(fs)
+	}
+
+	rootNFSNode := NewFuseFSNode(
+		fs,
+		"",
+		"", // Relative to base NFS/SSD
+		fs.nfsBaseAbs,
+		fs.inodeFor(fs.nfsBaseAbs, 0, ""),
+		os.ModeDir|perm_READ,
+		true,
+	)
+
+	if err := loadSubtree(fs, rootNFSNode); err != nil {
+		return nil, err
+	}
+
+	return rootNFSNode, nil
+}
+
+// loadMergedTree loads a tree merged from several sources: a root that isn't on NFS, with a
+// directory for each source.
+func loadMergedTree(fs *FS) (*fuseFSNode, error) {
+	rootNode := NewFuseFSNode(fs, "", "", "", fs.GenerateInode(0, ""), os.ModeDir|perm_READ, true)
+
+	for _, name := range slices.Sorted(maps.Keys(fs.nfsSources)) {
+		dir := fs.nfsSources[name]
+		sourceNode := NewFuseFSNode(fs, name, "", dir, fs.inodeFor(dir, rootNode.Inode, name), os.ModeDir|perm_READEXECUTE, true)
+		if err := loadSubtree(fs, sourceNode); err != nil {
+			return nil, fmt.Errorf("NFS source %s: %w", name, err)
+		}
+		rootNode.addChild(sourceNode)
+	}
+
+	return rootNode, nil
+}
+
+// loadSubtree walks NFS from the directory backing dirNode, adding a node for everything under it.
+func loadSubtree(fs *FS, dirNode *fuseFSNode) error {
+	dirAbsNFSPath := dirNode.nfsPathAbs()
+	// Before walking it, so a change made meanwhile is caught by the next listing.
+	if fi, err := os.Stat(dirAbsNFSPath); err == nil {
+		dirNode.loadedModTime = fi.ModTime()
+	}
+
+	// nodesByRelPath maps a directory's relative path to its node object
+	// This helps in finding the parent node for the current entry.
+	nodesByRelPath := make(map[string]*fuseFSNode)
+	nodesByRelPath[dirNode.relPath()] = dirNode
+
+	walkErr := filepath.WalkDir(dirAbsNFSPath, func(currentAbsNFSPath string, d native_fs.DirEntry, err error) error {
+		if err != nil {
+			// This error is from filepath.WalkDir itself, e.g., permission denied to list a directory.
+			fmt.Printf("Error accessing path %q: %v. Skipping subtree.\n", currentAbsNFSPath, err)
+			if d != nil && d.IsDir() {
+				return native_fs.SkipDir // Skip processing this directory further
+			}
+			return err // Propagate error to stop WalkDir if it's critical or for a file
+		}
+
+		// Skip the directory itself in the callback, as we've already created its node.
+		if currentAbsNFSPath == dirAbsNFSPath {
+			return nil
+		}
+
+		parentAbsNFSPath := filepath.Dir(currentAbsNFSPath)
+		parentRelPath, _ := relPathUnder(dirAbsNFSPath, parentAbsNFSPath)
+		parentRelPath = filepath.Join(dirNode.relPath(), parentRelPath)
+
+		// Determine parent node
+		parent, ok := nodesByRelPath[parentRelPath]
+		if !ok {
+			// This should ideally not happen if WalkDir processes parents before children.
+			return fmt.Errorf("parent node not found for path: %s (parent: %s)", currentAbsNFSPath, parentRelPath)
+		}
+
+		currentNode := newNodeFromEntry(fs, parent, d)
+		if d.IsDir() {
+			// Add to nodesByPath so its children can find it.
+			nodesByRelPath[currentNode.relPath()] = currentNode
+		}
+
+		// Add current node to its parent's children list
+		parent.addChild(currentNode)
+
+		return nil
+	})
+
+	if walkErr != nil {
+		return fmt.Errorf("error walking from %s: %w", dirAbsNFSPath, walkErr)
+	}
+
+	return nil
+}
+
+// newNodeFromEntry creates the node for an NFS directory entry in parent. The node is not added to
+// parent's children.
+func newNodeFromEntry(fs *FS, parent *fuseFSNode, d native_fs.DirEntry) *fuseFSNode {
+	mode := os.ModeDir | perm_READEXECUTE
+	if d.Type()&os.ModeSymlink != 0 {
+		// Symlinks are not followed, the link itself is the node. Link permissions are ignored.
+		mode = os.ModeSymlink | os.ModePerm
+	} else if !d.IsDir() {
+		mode = perm_READEXECUTE
+	}
+
+	var inode uint64
+	fi, err := d.Info()
+	if err == nil {
+		inode, _ = fs.nfsInode(fi)
+	}
+	if inode == 0 {
+		inode = fs.GenerateInode(parent.Inode, d.Name())
+	}
+
+	node := NewFuseFSNode(
+		fs,
+		d.Name(),
+		parent.relPath(),
+		parent.childNFSPath(d.Name()),
+		inode,
+		mode,
+		d.IsDir(),
+	)
+	if d.IsDir() && err == nil {
+		// Its entries are read right after, so they're as of this.
+		node.loadedModTime = fi.ModTime()
+	}
+	return node
+}
+
+// absNFSPath returns the absolute path of an NFS directory, checking that it exists.
+func absNFSPath(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid NFS relative path '%s': %w", dir, err)
+	} else if _, err := os.Stat(absDir); err != nil {
+		return "", fmt.Errorf("could not find NFS path '%s': %w", absDir, err)
+	}
+	return absDir, nil
+}
+
+// inodeFor returns the NFS inode of the file at absPath, so inodes are stable across remounts and
+// refreshes, and hardlinks share one. Falls back to a generated inode if it can't be found.
+func (rfs *FS) inodeFor(absPath string, parentInode uint64, name string) uint64 {
+	if fi, err := os.Lstat(absPath); err == nil {
+		if ino, ok := rfs.nfsInode(fi); ok {
+			return ino
+		}
+	}
+	return rfs.GenerateInode(parentInode, name)
+}
+
+// nfsInode derives the inode of a node from its NFS file info, if the platform provides one. It's
+// the NFS inode number itself for files on the same filesystem as the NFS directory. Inode numbers
+// are only unique within a filesystem though, so for files on any other (eg. a second merged
+// source, or a share mounted inside the NFS directory) it's a hash of the device and inode number.
+// Either way it's outside syntheticInodes.
+func (rfs *FS) nfsInode(fi native_fs.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	dev, ino := uint64(st.Dev), uint64(st.Ino)
+	if !rfs.merged() && dev == rfs.nfsDev && ino < syntheticInodes {
+		return ino, true
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], dev)
+	binary.LittleEndian.PutUint64(buf[8:], ino)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64() &^ syntheticInodes, true
+}
+
+// owner returns the owner the file is shown with on the mount: its owner on NFS, mapped by the
+// configured UIDMap and GIDMap.
+func (rfs *FS) owner(fi native_fs.FileInfo) (uid, gid uint32, ok bool) {
+	uid, gid, ok = nfsOwner(fi)
+	if !ok {
+		return 0, 0, false
+	}
+	return rfs.uidMap.mapID(uid), rfs.gidMap.mapID(gid), true
+}
+
+// nfsOwner extracts the owning user and group from NFS file info, if the platform provides them.
+func nfsOwner(fi native_fs.FileInfo) (uid, gid uint32, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid, true
+	}
+	return 0, 0, false
+}
+
+// nodeAt finds the node at the given relative path, or nil if there isn't one.
+func (rfs *FS) nodeAt(relPath string) *fuseFSNode {
+	node := rfs.rootNode
+	if relPath == "" || relPath == "." {
+		return node
+	}
+
+	for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+		if node = node.child(name); node == nil {
+			return nil
+		}
+	}
+	return node
+}
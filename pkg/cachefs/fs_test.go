@@ -0,0 +1,212 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// statInode returns the inode number of the file at path.
+func statInode(t *testing.T, path string) uint64 {
+	t.Helper()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint64(fi.Sys().(*syscall.Stat_t).Ino)
+}
+
+func TestInodesAreNFSInodes(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	first := lookup(t, rfs, "dir/a.txt").Inode
+	if second := lookup(t, rfs, "dir/a.txt").Inode; second != first {
+		t.Errorf("second lookup gave inode %d, first %d", second, first)
+	}
+	if want := statInode(t, filepath.Join(nfsDir, "dir/a.txt")); first != want {
+		t.Errorf("got inode %d, want the NFS inode %d", first, want)
+	}
+
+	var attr fuse.Attr
+	if err := lookup(t, rfs, "dir/a.txt").Attr(context.Background(), &attr); err != nil {
+		t.Fatal(err)
+	} else if attr.Inode != first {
+		t.Errorf("Attr reported inode %d, want %d", attr.Inode, first)
+	}
+	ents, err := lookup(t, rfs, "dir").ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 || ents[0].Inode != first {
+		t.Errorf("ReadDirAll gave %+v, want a.txt with inode %d", ents, first)
+	}
+}
+
+func TestAttrReportsNFSSizesAndBlocks(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a.txt", make([]byte, 5000))
+	writeTestFile(t, nfsDir, "dir/b.txt", []byte("b"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true, WriteBack: true, WriteBackLimit: 1 << 20, WriteBackInterval: time.Hour})
+
+	for _, relPath := range []string{"dir", "dir/a.txt"} {
+		fi, err := os.Stat(filepath.Join(nfsDir, relPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attr fuse.Attr
+		if err := lookup(t, rfs, relPath).Attr(context.Background(), &attr); err != nil {
+			t.Fatal(err)
+		}
+		blocks := uint64(fi.Sys().(*syscall.Stat_t).Blocks)
+		if attr.Size != uint64(fi.Size()) || attr.Blocks != blocks {
+			t.Errorf("%s: Attr has size %d in %d blocks, want NFS's %d in %d", relPath, attr.Size, attr.Blocks, fi.Size(), blocks)
+		}
+	}
+
+	// Data not yet written back takes up the blocks it will on NFS.
+	n := lookup(t, rfs, "dir/b.txt")
+	if err := n.Write(context.Background(), &fuse.WriteRequest{Data: make([]byte, 5000)}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.Attr
+	if err := n.Attr(context.Background(), &attr); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(roundToBlock(5000) / 512); attr.Size != 5000 || attr.Blocks != want {
+		t.Errorf("dirty file: Attr has size %d in %d blocks, want 5000 in %d", attr.Size, attr.Blocks, want)
+	}
+}
+
+func TestInodesAreStableAcrossRefresh(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+	before := lookup(t, rfs, "dir/a.txt").Inode
+
+	writeTestFile(t, nfsDir, "dir/b.txt", []byte("b"))
+	if err := rfs.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if after := lookup(t, rfs, "dir/a.txt").Inode; after != before {
+		t.Errorf("got inode %d after Refresh, %d before", after, before)
+	}
+
+	// And across remounts.
+	if again := lookup(t, newTestFS(t, Config{NFSDir: nfsDir}), "dir/a.txt").Inode; again != before {
+		t.Errorf("got inode %d after remounting, %d before", again, before)
+	}
+}
+
+func TestGeneratedInodesAreDisjointFromNFSInodes(t *testing.T) {
+	rfs := newTestFS(t, Config{})
+	for range 3 {
+		if ino := rfs.GenerateInode(0, ""); ino < syntheticInodes {
+			t.Errorf("generated inode %d is outside the synthetic range", ino)
+		}
+	}
+}
+
+func TestGeneratedInodesAreUniqueUnderConcurrency(t *testing.T) {
+	rfs := newTestFS(t, Config{})
+
+	const goroutines, each = 8, 1000
+	inodes := make(chan uint64, goroutines*each)
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				inodes <- rfs.GenerateInode(0, "")
+			}
+		}()
+	}
+	wg.Wait()
+	close(inodes)
+
+	seen := make(map[uint64]bool)
+	for ino := range inodes {
+		if seen[ino] {
+			t.Fatalf("inode %d handed out twice", ino)
+		}
+		seen[ino] = true
+	}
+}
+
+// statInfo is file info whose Sys is the given stat.
+type statInfo struct {
+	os.FileInfo
+	st *syscall.Stat_t
+}
+
+func (fi statInfo) Sys() any { return fi.st }
+
+func TestMergedSourcesHaveDistinctInodes(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeTestFile(t, a, "x/f", []byte("a"))
+	writeTestFile(t, b, "x/f", []byte("b"))
+	rfs := newTestFS(t, Config{NFSSources: NFSSources{"a": a, "b": b}})
+
+	if root := rfs.rootNode.Inode; root < syntheticInodes {
+		t.Errorf("synthetic root has inode %d, outside the synthetic range", root)
+	}
+	seen := make(map[uint64]string)
+	for _, path := range []string{"", "a", "a/x", "a/x/f", "b", "b/x", "b/x/f"} {
+		ino := lookup(t, rfs, path).Inode
+		if other, ok := seen[ino]; ok {
+			t.Errorf("%q and %q share inode %d", path, other, ino)
+		}
+		seen[ino] = path
+	}
+
+	// Sources on different filesystems can have files with the same inode number.
+	fi, err := os.Lstat(filepath.Join(a, "x/f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := rfs.nfsInode(statInfo{fi, &syscall.Stat_t{Dev: 1, Ino: 12}})
+	second, _ := rfs.nfsInode(statInfo{fi, &syscall.Stat_t{Dev: 2, Ino: 12}})
+	if first == second {
+		t.Errorf("inode 12 on two devices gave the same inode %d", first)
+	}
+	if first >= syntheticInodes || second >= syntheticInodes {
+		t.Errorf("got inodes %d and %d, inside the synthetic range", first, second)
+	}
+}
+
+func TestNewReturnsErrors(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	writeTestFile(t, dir, "nfs/sub/a.txt", nil)
+	nfs := filepath.Join(dir, "nfs")
+
+	for _, tc := range []struct {
+		name        string
+		cfg         Config
+		wantMissing bool // The error is for a directory that doesn't exist
+	}{
+		{"missing NFS dir", Config{NFSDir: missing, SSDDir: dir}, true},
+		{"missing SSD dir", Config{NFSDir: nfs, SSDDir: missing}, true},
+		{"missing NFS source", Config{NFSSources: NFSSources{"a": nfs, "b": missing}, SSDDir: dir}, true},
+		{"overlapping NFS sources", Config{NFSSources: NFSSources{"a": nfs, "b": filepath.Join(nfs, "sub")}, SSDDir: dir}, false},
+		{"write-back on a read-only mount", Config{NFSDir: nfs, SSDDir: dir, WriteBack: true}, false},
+		{"allow_other on a writable mount", Config{NFSDir: nfs, SSDDir: dir, Writable: true, AllowOther: true}, false},
+	} {
+		rfs, err := New(tc.cfg)
+		if err == nil {
+			rfs.Close()
+			t.Errorf("%s: New succeeded", tc.name)
+		} else if errors.Is(err, fs.ErrNotExist) != tc.wantMissing {
+			t.Errorf("%s: New = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cachefs
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Writes go straight through to NFS, or with write-back, are written back in the background, so
+// nothing is buffered per handle: Flush has nothing to do, and Fsync only has to write back what
+// hasn't been and make NFS sync it. On a read-only mount, or for a file nothing has been changed in
+// through the mount (eg. fsynced through a read-only handle), both are no-ops, so callers that fsync
+// unconditionally (eg. editors) don't fail, or lose what's cached.
+
+// Fsync syncs the file (or directory) on NFS, and drops what is cached for it, so the next read is
+// of what NFS has made durable.
+func (n *fuseFSNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if !n.FS.writable || n.isSymlink() || n.synthetic() {
+		return nil
+	}
+	if !n.unsynced.Swap(false) {
+		return nil
+	}
+	// Tried again by the next fsync if this one fails.
+	synced := false
+	defer func() {
+		if !synced {
+			n.unsynced.Store(true)
+		}
+	}()
+
+	if n.FS.writeBack != nil {
+		if err := n.FS.writeBack.flush(n.relPath()); err != nil {
+			return syscall.EIO
+		}
+	}
+
+	f, err := os.Open(n.nfsPathAbs())
+	if os.IsNotExist(err) {
+		return syscall.ENOENT
+	} else if err != nil {
+		log.Printf("ERROR: Failed to open NFS path %s for fsync: %v", n.nfsPathAbs(), err)
+		return syscall.EIO
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		log.Printf("ERROR: Failed to fsync NFS path %s: %v", n.nfsPathAbs(), err)
+		return syscall.EIO
+	}
+
+	synced = true
+	if !n.isDir {
+		n.FS.evict(n.relPath())
+	}
+	return nil
+}
+
+func (n *fuseFSNode) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+func (h *readAllHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+func (h *readAheadHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestFsyncWithoutWritesIsNoOp(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true})
+	ctx := context.Background()
+
+	n := lookup(t, rfs, "a.txt")
+	if _, err := n.data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !rfs.ssdCache.Has("a.txt") {
+		t.Fatal("a.txt wasn't cached when read")
+	}
+
+	// Were NFS touched, the file being gone would fail the fsync.
+	if err := os.Remove(filepath.Join(nfsDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatalf("Fsync of a file nothing was written to: %v", err)
+	}
+	if !rfs.ssdCache.Has("a.txt") {
+		t.Error("Fsync of a file nothing was written to evicted it")
+	}
+}
+
+func TestFsyncAfterChangeSyncsOnce(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	if err := setxattr(filepath.Join(nfsDir, "a.txt"), "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("no xattr support here: %v", err)
+	}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true})
+	ctx := context.Background()
+
+	n := lookup(t, rfs, "a.txt")
+	if _, err := n.data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.test", Xattr: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if rfs.ssdCache.Has("a.txt") {
+		t.Error("Fsync after a change left the cached copy")
+	}
+
+	// Synced, so the next fsync has nothing to do.
+	if err := os.Remove(filepath.Join(nfsDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Errorf("second Fsync: %v", err)
+	}
+}
+
+func TestFsyncWritesBack(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("old"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true, WriteBack: true, WriteBackLimit: 1 << 20, WriteBackInterval: time.Hour})
+	ctx := context.Background()
+
+	n := lookup(t, rfs, "a.txt")
+	if err := n.Write(ctx, &fuse.WriteRequest{Data: []byte("new")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(nfsDir, "a.txt")); err != nil || string(got) != "new" {
+		t.Fatalf("NFS has %q, %v after Fsync, want %q", got, err, "new")
+	}
+
+	// Synced, so the next fsync has nothing to do.
+	if err := os.Remove(filepath.Join(nfsDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Errorf("second Fsync: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+var errNoGC = errors.New("cache doesn't keep an index of its files, so can't tell which are orphaned")
+
+// orphanRemover is implemented by caches that keep an index of the files they store on disk.
+// Anything else in their directory is an orphan, eg. left behind by a previous run, by another
+// cache, or by a Delete that failed part way.
+type orphanRemover interface {
+	// removeOrphan removes the file with the given flattened path from the cache directory, if the
+	// cache doesn't know about it and it was last modified before the given time. With dryRun it's
+	// only reported. Returns the file's size and whether it was (or would be) removed. It is
+	// serialised with Puts of the same file, so a file being cached is never removed.
+	removeOrphan(flatPath string, before time.Time, dryRun bool) (int64, bool, error)
+}
+
+// gcResult is the summary of a garbage collection pass.
+type gcResult struct {
+	scanned, removed, errors int
+	bytes                    int64
+}
+
+// GC removes orphaned files from the cache directory: files the cache doesn't know about. It runs a
+// pass straight away, then every interval (if set) until ctx is done. Only files that haven't been
+// modified for minAge are removed, so files being written are left alone. With dryRun the files are
+// only logged.
+func (rfs *FS) GC(ctx context.Context, interval, minAge time.Duration, dryRun bool) error {
+	remover, ok := findCache[orphanRemover](rfs.ssdCache)
+	if !ok {
+		return errNoGC
+	}
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		res := rfs.gcPass(ctx, remover, minAge, dryRun)
+		if ctx.Err() != nil {
+			return nil // Stopped part way through the pass
+		}
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		log.Printf("GC: Scanned %d files, %s %d orphans (%d bytes), %d errors", res.scanned, verb, res.removed, res.bytes, res.errors)
+
+		if ticks == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticks:
+		}
+	}
+}
+
+// gcPass removes the orphans in the cache directory once, stopping early if ctx is done.
+func (rfs *FS) gcPass(ctx context.Context, remover orphanRemover, minAge time.Duration, dryRun bool) gcResult {
+	before := time.Now().Add(-minAge)
+
+	// Listed up front, rather than removing while walking. Files cached since are indexed by the
+	// time they're looked at, or too new to be removed.
+	var paths []string
+	if err := walkCacheFiles(rfs.ssdBaseAbs, func(path string, _ os.FileInfo) {
+		paths = append(paths, path)
+	}); err != nil {
+		log.Printf("WARNING: Failed to list all of %s for garbage collection: %v", rfs.ssdBaseAbs, err)
+	}
+
+	res := gcResult{scanned: len(paths)}
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return res
+		}
+
+		size, removed, err := remover.removeOrphan(flattenDirPath(path), before, dryRun)
+		if err != nil {
+			log.Printf("WARNING: Failed to remove orphaned cache file '%s': %v", path, err)
+			res.errors++
+			continue
+		} else if !removed {
+			continue
+		}
+
+		res.removed++
+		res.bytes += size
+		if dryRun {
+			log.Printf("GC: Would remove orphaned cache file '%s' (%d bytes)", path, size)
+		} else {
+			log.Printf("GC: Removed orphaned cache file '%s' (%d bytes)", path, size)
+		}
+	}
+	return res
+}
+
+// removeOrphanFile removes the cached file with the given flattened path from base, if it was last
+// modified before the given time. The caller must have checked the file isn't indexed, and stop it
+// from being cached until this returns.
+func removeOrphanFile(base, flatPath string, before time.Time, dryRun bool) (int64, bool, error) {
+	fileName := cacheFileName(base, flatPath)
+	fi, err := os.Lstat(fileName)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if !fi.ModTime().Before(before) {
+		return 0, false, nil
+	}
+
+	if dryRun {
+		return fi.Size(), true, nil
+	}
+	if err := removeCacheFile(base, fileName); err != nil {
+		return 0, false, err
+	}
+	return fi.Size(), true, nil
+}
@@ -0,0 +1,99 @@
+package cachefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addOrphans writes files the cache in ssdDir doesn't know about, last modified an hour ago.
+func addOrphans(t *testing.T, ssdDir string, paths ...string) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	for _, path := range paths {
+		writeTestFile(t, ssdDir, path, []byte("orphan"))
+		if err := os.Chtimes(filepath.Join(ssdDir, path), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGCRemovesOnlyOrphans(t *testing.T) {
+	ssdDir := t.TempDir()
+	cache := must(NewLRUCache(ssdDir, 100, false))
+	rfs := newTestFS(t, Config{SSDDir: ssdDir, Cache: cache})
+
+	// Indexed, even though it's as old as the orphans.
+	if err := cache.Put("project-1/kept.py", []byte("kept"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addOrphans(t, ssdDir, "project-1/kept.py")
+	addOrphans(t, ssdDir, "project-1/orphan.py", "old/dir/orphan.bin")
+
+	remover, _ := findCache[orphanRemover](cache)
+	if res := rfs.gcPass(context.Background(), remover, time.Minute, true); res.removed != 2 {
+		t.Errorf("dry run = %+v, want 2 removed", res)
+	}
+	if _, err := os.Stat(filepath.Join(ssdDir, "project-1/orphan.py")); err != nil {
+		t.Errorf("dry run removed a file: %v", err)
+	}
+
+	if err := rfs.GC(context.Background(), 0, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"project-1/kept.py": true, "project-1/orphan.py": false, "old": false} {
+		if _, err := os.Stat(filepath.Join(ssdDir, path)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+}
+
+func TestGCRacingPuts(t *testing.T) {
+	ssdDir := t.TempDir()
+	cache := must(NewLRUCache(ssdDir, 1000, false))
+	rfs := newTestFS(t, Config{SSDDir: ssdDir, Cache: cache})
+	for i := range 50 {
+		addOrphans(t, ssdDir, fmt.Sprintf("dir-%d/orphan", i))
+	}
+	remover, _ := findCache[orphanRemover](cache)
+
+	// Puts land in the directories GC is emptying, and some replace the orphans themselves.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 50 {
+			path := fmt.Sprintf("dir-%d/new", i)
+			if i%2 == 0 {
+				path = fmt.Sprintf("dir-%d/orphan", i)
+			}
+			if err := cache.Put(path, []byte(path), 0o644); err != nil {
+				t.Errorf("Put %s: %v", path, err)
+			}
+		}
+	}()
+	// No minimum age, so only the index keeps files being put safe.
+	rfs.gcPass(context.Background(), remover, 0, false)
+	wg.Wait()
+
+	for i := range 50 {
+		path := fmt.Sprintf("dir-%d/new", i)
+		if i%2 == 0 {
+			path = fmt.Sprintf("dir-%d/orphan", i)
+		}
+		if got, err := cache.Get(path); err != nil || string(got) != path {
+			t.Errorf("Get %s = %q, %v after GC", path, got, err)
+		}
+	}
+}
+
+func TestGCNeedsAnIndex(t *testing.T) {
+	rfs := newTestFS(t, Config{})
+	if err := rfs.GC(context.Background(), 0, 0, false); err != errNoGC {
+		t.Errorf("GC of the default cache = %v, want %v", err, errNoGC)
+	}
+}
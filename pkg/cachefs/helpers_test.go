@@ -0,0 +1,80 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// writeTestFile writes data to relPath under dir, creating its parent directories.
+func writeTestFile(t testing.TB, dir, relPath string, data []byte) {
+	t.Helper()
+	path := filepath.Join(dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestFS builds a file system on cfg without mounting it, with NFS and SSD directories in
+// temporary directories unless cfg has them. It's closed when the test ends.
+func newTestFS(t testing.TB, cfg Config) *FS {
+	t.Helper()
+	if cfg.Mountpoint == "" {
+		cfg.Mountpoint = "/mnt/fuse-test"
+	}
+	if cfg.NFSDir == "" && len(cfg.NFSSources) == 0 {
+		cfg.NFSDir = t.TempDir()
+	}
+	if cfg.SSDDir == "" {
+		cfg.SSDDir = t.TempDir()
+	}
+	rfs, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	return rfs
+}
+
+// lookup looks relPath up one name at a time from the root, as the kernel would.
+func lookup(t testing.TB, rfs *FS, relPath string) *fuseFSNode {
+	t.Helper()
+	n := rfs.rootNode
+	if relPath == "" {
+		return n
+	}
+	for _, name := range strings.Split(relPath, "/") {
+		child, err := n.Lookup(context.Background(), name)
+		if err != nil {
+			t.Fatalf("lookup %s: %s: %v", relPath, name, err)
+		}
+		n = child.(*fuseFSNode)
+	}
+	return n
+}
+
+// countNFSOpens counts the files rfs opens to read from NFS from now on.
+func countNFSOpens(rfs *FS) *atomic.Int64 {
+	var opens atomic.Int64
+	open := rfs.openNFS
+	rfs.openNFS = func(name string) (*os.File, error) {
+		opens.Add(1)
+		return open(name)
+	}
+	return &opens
+}
+
+// must returns the cache built, for tests building caches with valid settings. It panics if
+// building it failed.
+func must(c Cache, err error) Cache {
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package cachefs
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dumpHottest is how many of the hottest entries a cache dump lists.
+const dumpHottest = 20
+
+// HotFile is a cache entry and how often it has been read from the cache.
+type HotFile struct {
+	Key        string // The cache key, ie. the file's path, or that of one of its blocks or versions
+	Hits       int64
+	Size       int64 // Bytes read on the last hit
+	LastAccess time.Time
+}
+
+// hotFiles counts the hits of every cache entry read since it was cached. Reads of an entry already
+// counted only load it from a sync.Map and update it atomically, so they never wait on each other.
+type hotFiles struct {
+	entries sync.Map // Key -> *hotEntry
+}
+
+type hotEntry struct {
+	hits       atomic.Int64
+	size       atomic.Int64
+	lastAccess atomic.Int64 // Unix nanoseconds
+}
+
+func (h *hotFiles) hit(key string, size int64) {
+	v, ok := h.entries.Load(key)
+	if !ok {
+		v, _ = h.entries.LoadOrStore(key, new(hotEntry))
+	}
+	entry := v.(*hotEntry)
+	entry.hits.Add(1)
+	entry.size.Store(size)
+	entry.lastAccess.Store(time.Now().UnixNano())
+}
+
+// forget drops the entry's counters, once it has left the cache.
+func (h *hotFiles) forget(key string) {
+	h.entries.Delete(key)
+}
+
+func (h *hotFiles) reset() {
+	h.entries.Clear()
+}
+
+// top returns the n entries with the most hits, most first. Ties go to the most recently read.
+func (h *hotFiles) top(n int) []HotFile {
+	var files []HotFile
+	h.entries.Range(func(k, v any) bool {
+		entry := v.(*hotEntry)
+		files = append(files, HotFile{
+			Key:        k.(string),
+			Hits:       entry.hits.Load(),
+			Size:       entry.size.Load(),
+			LastAccess: time.Unix(0, entry.lastAccess.Load()),
+		})
+		return true
+	})
+	slices.SortFunc(files, func(a, b HotFile) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), b.LastAccess.Compare(a.LastAccess), cmp.Compare(a.Key, b.Key))
+	})
+	return files[:min(n, len(files))]
+}
+
+// WriteHotFiles writes the entries, one per line, as a cache dump lists them.
+func WriteHotFiles(w io.Writer, files []HotFile) {
+	for _, f := range files {
+		fmt.Fprintf(w, "  %s hits=%d size=%d last_access=%s\n", f.Key, f.Hits, f.Size, f.LastAccess.Format(time.RFC3339))
+	}
+}
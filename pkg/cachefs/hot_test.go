@@ -0,0 +1,66 @@
+package cachefs
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestTopNOrdersBySkewedHits(t *testing.T) {
+	nfsDir := t.TempDir()
+	reads := map[string]int{"a.py": 6, "b.py": 4, "c.py": 2, "d.py": 1}
+	for relPath := range reads {
+		writeTestFile(t, nfsDir, relPath, []byte(relPath))
+	}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+	for relPath, n := range reads {
+		node := lookup(t, rfs, relPath)
+		for range n {
+			if _, err := node.data(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	keys := func(files []HotFile) []string {
+		var keys []string
+		for _, f := range files {
+			keys = append(keys, f.Key)
+		}
+		return keys
+	}
+	// The first read of each file was a miss, so d.py has no hits.
+	top := rfs.TopN(10)
+	if want := []string{"a.py", "b.py", "c.py"}; !slices.Equal(keys(top), want) {
+		t.Fatalf("TopN = %q, want %q", keys(top), want)
+	}
+	for i, wantHits := range []int64{5, 3, 1} {
+		if top[i].Hits != wantHits || top[i].Size != 4 || top[i].LastAccess.IsZero() {
+			t.Errorf("%s: hits = %d, size = %d, last access %v, want %d hits of 4 bytes",
+				top[i].Key, top[i].Hits, top[i].Size, top[i].LastAccess, wantHits)
+		}
+	}
+	if got := keys(rfs.TopN(2)); !slices.Equal(got, []string{"a.py", "b.py"}) {
+		t.Errorf("TopN(2) = %q", got)
+	}
+
+	// A file that leaves the cache starts counting again.
+	rfs.evict("a.py")
+	if got := keys(rfs.TopN(10)); !slices.Equal(got, []string{"b.py", "c.py"}) {
+		t.Errorf("TopN after evicting a.py = %q", got)
+	}
+}
+
+func TestTopNBreaksTiesByLastAccess(t *testing.T) {
+	var h hotFiles
+	for _, key := range []string{"a", "b", "c", "b", "a"} {
+		h.hit(key, 1)
+	}
+	var got []string
+	for _, f := range h.top(3) {
+		got = append(got, f.Key)
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("top = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package cachefs
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IDMap maps the owner ids (uids or gids) of files on NFS to the ids they're shown with on the
+// mount, eg. for a service account that doesn't exist on the client. Ids without a mapping are
+// shown as they are.
+type IDMap map[uint32]uint32
+
+// Set adds an "old:new" mapping, so a flag can be given once per mapping (see flag.Value).
+func (m IDMap) Set(s string) error {
+	from, to, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("invalid id mapping %q, must be old:new", s)
+	}
+	old, err := strconv.ParseUint(strings.TrimSpace(from), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid id mapping %q: %w", s, err)
+	}
+	mapped, err := strconv.ParseUint(strings.TrimSpace(to), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid id mapping %q: %w", s, err)
+	}
+	if prev, ok := m[uint32(old)]; ok && prev != uint32(mapped) {
+		return fmt.Errorf("id %d is already mapped to %d", old, prev)
+	}
+	m[uint32(old)] = uint32(mapped)
+	return nil
+}
+
+func (m IDMap) String() string {
+	var mappings []string
+	for _, old := range slices.Sorted(maps.Keys(m)) {
+		mappings = append(mappings, fmt.Sprintf("%d:%d", old, m[old]))
+	}
+	return strings.Join(mappings, ",")
+}
+
+// mapID returns the id to show for the NFS id.
+func (m IDMap) mapID(id uint32) uint32 {
+	if mapped, ok := m[id]; ok {
+		return mapped
+	}
+	return id
+}
@@ -0,0 +1,61 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestIDMapSet(t *testing.T) {
+	m := IDMap{}
+	for _, s := range []string{"5001:1000", " 5002 : 1001 ", "5001:1000"} {
+		if err := m.Set(s); err != nil {
+			t.Errorf("Set(%q) = %v", s, err)
+		}
+	}
+	if got, want := m.String(), "5001:1000,5002:1001"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	for _, s := range []string{"5001", "5001:", "a:1000", "5001:-1", "5001:1002"} {
+		if err := m.Set(s); err == nil {
+			t.Errorf("Set(%q) succeeded", s)
+		}
+	}
+}
+
+func TestOwnersAreMapped(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "mapped.txt", []byte("a"))
+	writeTestFile(t, nfsDir, "unmapped.txt", []byte("a"))
+	for name, id := range map[string]int{"mapped.txt": 5001, "unmapped.txt": 5002} {
+		if err := os.Chown(filepath.Join(nfsDir, name), id, id); err != nil {
+			t.Skipf("can't give files another owner: %v", err)
+		}
+	}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true, UIDMap: IDMap{5001: 1000}, GIDMap: IDMap{5001: 100}})
+
+	for _, tc := range []struct {
+		relPath  string
+		uid, gid uint32
+	}{
+		{"mapped.txt", 1000, 100},
+		{"unmapped.txt", 5002, 5002},
+	} {
+		var attr fuse.Attr
+		if err := lookup(t, rfs, tc.relPath).Attr(context.Background(), &attr); err != nil {
+			t.Fatal(err)
+		}
+		if attr.Uid != tc.uid || attr.Gid != tc.gid {
+			t.Errorf("%s: Attr has owner %d:%d, want %d:%d", tc.relPath, attr.Uid, attr.Gid, tc.uid, tc.gid)
+		}
+	}
+
+	// Access is checked against the owner shown.
+	req := &fuse.AccessRequest{Header: fuse.Header{Uid: 1000, Gid: 100}, Mask: accessWrite}
+	if err := lookup(t, rfs, "mapped.txt").Access(context.Background(), req); err != nil {
+		t.Errorf("Access by the mapped owner = %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package cachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Inspector is implemented by caches that can report what they hold, so tools don't need to reach
+// into their internals. Keys are the paths the files were put under, in eviction order (the next
+// to go first) for caches that have one, sorted otherwise. Each call takes its own snapshot under
+// the cache's locks, so it is consistent with itself but not necessarily with the other calls.
+//
+// Caches that wrap another (eg. to add checksums) don't implement it themselves, the cache they wrap
+// is found with findCache instead. The encrypted cache is the exception, as the entries are stored
+// under names that can't be turned back into paths: it lists the paths it has seen put or read, and
+// leaves out the rest (eg. cached before a restart, and not read since).
+type Inspector interface {
+	Len() int
+	Bytes() int64
+	Keys() []string
+}
+
+var errNotInspectable = errors.New("cache can't list its contents")
+
+// ListCache writes the number of cached files, the bytes they take up, and their paths to w.
+func (rfs *FS) ListCache(w io.Writer) error {
+	inspector, ok := findCache[Inspector](rfs.ssdCache)
+	if !ok {
+		return errNotInspectable
+	}
+
+	keys := inspector.Keys()
+	entries := len(keys)
+	if _, ok := inspector.(*encryptedCache); ok {
+		entries = max(entries, inspector.Len()) // Including those it can't list
+	}
+	fmt.Fprintf(w, "entries: %d bytes: %d\n", entries, inspector.Bytes())
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\n", key)
+	}
+	if unknown := entries - len(keys); unknown > 0 {
+		fmt.Fprintf(w, "  (%d more, whose paths aren't known until they're read)\n", unknown)
+	}
+	return nil
+}
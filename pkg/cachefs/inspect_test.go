@@ -0,0 +1,82 @@
+package cachefs
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectorKeysInEvictionOrder(t *testing.T) {
+	cache := must(NewLRUCache(t.TempDir(), 10, false))
+	for _, path := range []string{"a", "dir/b", "dir/sub/c", "d$e"} {
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	cache.Has("dir/b") // Doesn't count as a use
+
+	inspector := cache.(Inspector)
+	if got, want := inspector.Keys(), []string{"dir/b", "dir/sub/c", "d$e", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Keys = %q, want %q", got, want)
+	}
+	if inspector.Len() != 4 || inspector.Bytes() != int64(len("a"+"dir/b"+"dir/sub/c"+"d$e")) {
+		t.Errorf("Len, Bytes = %d, %d", inspector.Len(), inspector.Bytes())
+	}
+}
+
+func TestBundledCachesAreInspectors(t *testing.T) {
+	caches := map[string]func(dir string) Cache{
+		"arc":   func(dir string) Cache { return must(NewARCCache(dir, 10)) },
+		"clock": func(dir string) Cache { return must(NewClockCache(dir, 10, 0)) },
+		"lfu":   func(dir string) Cache { return must(NewLFUCache(dir, 10)) },
+		"slru":  func(dir string) Cache { return must(NewSLRUCache(dir, 10, 0, 0.5)) },
+		"ttl":   func(dir string) Cache { return NewTTLCache(dir, time.Hour) },
+		"dedup": NewDedupCache,
+		"mem":   func(string) Cache { return NewMemCache(1 << 20) },
+	}
+	for name, newCache := range diskCaches {
+		caches[name] = newCache
+	}
+
+	for name, newCache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+			for _, path := range []string{"a", "dir/b"} {
+				if err := cache.Put(path, []byte(path), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			inspector, ok := findCache[Inspector](cache)
+			if !ok {
+				t.Fatal("not an Inspector")
+			}
+			keys := inspector.Keys()
+			slices.Sort(keys)
+			if !slices.Equal(keys, []string{"a", "dir/b"}) || inspector.Len() != 2 || inspector.Bytes() < 6 {
+				t.Errorf("Keys, Len, Bytes = %q, %d, %d", keys, inspector.Len(), inspector.Bytes())
+			}
+		})
+	}
+}
+
+func TestListCache(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a.txt", []byte("aaa"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: NewMemCache(1 << 20)})
+	if _, err := lookup(t, rfs, "dir/a.txt").data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := rfs.ListCache(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "entries: 1 bytes: 3\n  dir/a.txt\n"; b.String() != want {
+		t.Errorf("ListCache =\n%s\nwant\n%s", b.String(), want)
+	}
+}
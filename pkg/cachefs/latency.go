@@ -0,0 +1,86 @@
+package cachefs
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of buckets in a latencyHistogram. Bucket i counts durations of
+// [2^i, 2^(i+1)) nanoseconds, and the last also counts anything longer (~9 minutes and up).
+const latencyBuckets = 40
+
+// latencyHistogram counts durations in power of two buckets. Recording one is a couple of atomic
+// operations, cheap enough to leave on for every read. Quantiles are estimated by interpolating
+// within a bucket, so they're accurate to within a factor of two.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := bits.Len64(uint64(max(d, 1))) - 1
+	h.counts[min(i, latencyBuckets-1)].Add(1)
+}
+
+// since records the time elapsed since start.
+func (h *latencyHistogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+// quantiles estimates the durations below which the given fractions (0-1) of the recorded
+// durations fall, and returns them along with the number recorded.
+func (h *latencyHistogram) quantiles(qs ...float64) ([]time.Duration, int64) {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+
+	durations := make([]time.Duration, len(qs))
+	if total == 0 {
+		return durations, 0
+	}
+	for j, q := range qs {
+		rank := q * float64(total)
+		var seen int64
+		for i, count := range counts {
+			if count == 0 || float64(seen+count) < rank {
+				seen += count
+				continue
+			}
+			lower := float64(int64(1) << i)
+			fraction := (rank - float64(seen)) / float64(count)
+			durations[j] = time.Duration(lower + lower*fraction) // The bucket spans [lower, 2*lower)
+			break
+		}
+	}
+	return durations, total
+}
+
+// addStats adds the count and p50/p95/p99 (in microseconds) of the histogram to stats, named with
+// the given prefix.
+func (h *latencyHistogram) addStats(stats Stats, prefix string) {
+	ds, count := h.quantiles(0.5, 0.95, 0.99)
+	stats[prefix+"_count"] = count
+	stats[prefix+"_p50_us"] = ds[0].Microseconds()
+	stats[prefix+"_p95_us"] = ds[1].Microseconds()
+	stats[prefix+"_p99_us"] = ds[2].Microseconds()
+}
+
+// fsLatencies are the latency histograms kept by the file system.
+type fsLatencies struct {
+	readHit  latencyHistogram // Whole file reads served from the cache
+	readMiss latencyHistogram // Whole file reads that went to NFS
+	cacheGet latencyHistogram
+	cachePut latencyHistogram
+	nfsFetch latencyHistogram // Reading a file from NFS and writing it to the cache
+}
+
+func (l *fsLatencies) addStats(stats Stats) {
+	l.readHit.addStats(stats, "latency_read_hit")
+	l.readMiss.addStats(stats, "latency_read_miss")
+	l.cacheGet.addStats(stats, "latency_cache_get")
+	l.cachePut.addStats(stats, "latency_cache_put")
+	l.nfsFetch.addStats(stats, "latency_nfs_fetch")
+}
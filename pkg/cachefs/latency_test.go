@@ -0,0 +1,64 @@
+package cachefs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	var h latencyHistogram
+	for range 90 {
+		h.observe(100 * time.Microsecond)
+	}
+	for range 10 {
+		h.observe(50 * time.Millisecond)
+	}
+
+	ds, count := h.quantiles(0.5, 0.99)
+	if count != 100 {
+		t.Errorf("count = %d, want 100", count)
+	}
+	// Buckets are powers of two, so estimates are within a factor of two.
+	for i, want := range []time.Duration{100 * time.Microsecond, 50 * time.Millisecond} {
+		if ds[i] < want/2 || ds[i] > want*2 {
+			t.Errorf("quantile %d = %v, want about %v", i, ds[i], want)
+		}
+	}
+
+	h.observe(0)
+	h.observe(time.Duration(1 << 62))
+	if _, count := h.quantiles(0.5); count != 102 {
+		t.Errorf("out of range durations weren't counted, count = %d", count)
+	}
+}
+
+func TestReadLatenciesSplitHitsAndMisses(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	for range 3 {
+		if _, err := lookup(t, rfs, "a.txt").data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := rfs.Stats()
+	if stats["latency_read_miss_count"] != 1 || stats["latency_read_hit_count"] != 2 {
+		t.Errorf("%d misses and %d hits recorded, want 1 and 2", stats["latency_read_miss_count"], stats["latency_read_hit_count"])
+	}
+	if stats["latency_nfs_fetch_count"] != 1 {
+		t.Errorf("%d NFS fetches recorded, want 1", stats["latency_nfs_fetch_count"])
+	}
+}
+
+// BenchmarkLatencyHistogram measures the overhead of timing an operation, which should stay well
+// under a microsecond.
+func BenchmarkLatencyHistogram(b *testing.B) {
+	var h latencyHistogram
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.since(time.Now())
+		}
+	})
+}
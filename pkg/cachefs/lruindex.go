@@ -0,0 +1,120 @@
+package cachefs
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// lruIndexName is the file the LRU cache saves its order to on Close, under its directory, so it
+// starts warm (and still evicts the files already there) after a restart.
+const lruIndexName = metaPrefix + "lru-index"
+
+// load indexes the files already in the cache directory, in the order saved by the last Close.
+// Entries in the saved order whose file has gone are dropped, and files missing from it (eg. cached
+// after the last save, before a crash) are added as least recently used, oldest first. If that's
+// more than the cache's limits allow, the next Put evicts down to them.
+func (lru *lruCache) load() error {
+	onDisk := make(map[string]os.FileInfo)
+	if err := walkCacheFiles(lru.ssdBasePath, func(path string, fi os.FileInfo) {
+		onDisk[flattenDirPath(path)] = fi
+	}); err != nil {
+		return err
+	}
+
+	saved, err := readLRUIndex(filepath.Join(lru.ssdBasePath, lruIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: Failed to read the saved LRU order, files already cached are ordered by age: %v", err)
+	}
+
+	var ordered, dropped []string
+	seen := make(map[string]bool)
+	for _, key := range saved {
+		if _, ok := onDisk[key]; !ok {
+			dropped = append(dropped, key)
+		} else if !seen[key] {
+			ordered = append(ordered, key)
+			seen[key] = true
+		}
+	}
+	var unordered []string
+	for key := range onDisk {
+		if !seen[key] {
+			unordered = append(unordered, key)
+		}
+	}
+	slices.SortFunc(unordered, func(a, b string) int {
+		return cmp.Or(onDisk[a].ModTime().Compare(onDisk[b].ModTime()), cmp.Compare(a, b))
+	})
+
+	for _, key := range append(unordered, ordered...) {
+		size := onDisk[key].Size()
+		project := projectOf(unflattenDirPath(key))
+		lru.entries[key] = lru.queue.PushBack(&lruEntry{key: key, size: size, project: project})
+		lru.byteCount += size
+		lru.usage.add(project, size)
+	}
+
+	if len(onDisk) > 0 || len(dropped) > 0 {
+		log.Printf("CACHE_LOADED: Indexed %d files (%d bytes) already in %s, %d in their saved order. %d files in the saved order were gone",
+			len(onDisk), lru.byteCount, lru.ssdBasePath, len(ordered), len(dropped))
+	}
+	if lru.debug {
+		log.Printf("LRU_DEBUG: LRU cache loaded, members: %v", lru.members())
+	}
+	return nil
+}
+
+// readLRUIndex reads the keys saved by saveLRUIndex, least recently used first.
+func readLRUIndex(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		key, err := strconv.Unquote(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// Close saves the order of the cached files, so the next cache in the same directory picks up
+// where this one left off.
+func (lru *lruCache) Close() error {
+	lru.cacheMu.Lock()
+	keys := lru.members()
+	lru.cacheMu.Unlock()
+
+	// One quoted key per line, least recently used first. Quoting keeps any newlines in file names
+	// from splitting a key across lines.
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(strconv.Quote(key))
+		buf.WriteByte('\n')
+	}
+	if err := writeFile(filepath.Join(lru.ssdBasePath, lruIndexName), buf.Bytes(), 0o644, lru.syncWrites); err != nil {
+		return fmt.Errorf("failed to save the LRU order: %w", err)
+	}
+	return nil
+}
+
+// markPinned updates which entries are pinned, eg. after loading them before the pins were set.
+// Must be called with cacheMu held.
+func (lru *lruCache) markPinned() {
+	for el := lru.queue.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*lruEntry)
+		entry.pinned = lru.pins.match(unflattenDirPath(entry.key))
+	}
+}
@@ -0,0 +1,49 @@
+package cachefs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLRUOrderSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cache := must(NewLRUCache(dir, 4, false))
+	for _, path := range []string{"a", "dir/b", "c"} {
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.(*lruCache).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// c went away, and two files were cached after the save, eg. before a crash.
+	if err := os.Remove(filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "new", []byte("new"))
+	writeTestFile(t, dir, "old", []byte("old"))
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = must(NewLRUCache(dir, 4, false))
+	if got, want := cache.(Inspector).Keys(), []string{"old", "new", "dir/b", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Keys after a restart = %q, want %q", got, want)
+	}
+
+	// The next Put evicts the least recently used, the oldest of the files that weren't saved.
+	if err := cache.Put("d", []byte("d"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("old is still on disk: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package cachefs
+
+import (
+	"container/list"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// evictionPolicy decides the order an lruCache keeps its queue in, and which end of it files are
+// evicted from. The cache holds its lock while calling it.
+type evictionPolicy interface {
+	// PromoteOnGet moves a file within the queue when it is read, or put again.
+	PromoteOnGet(queue *list.List, el *list.Element)
+
+	// InsertOrder adds a newly cached file to the queue.
+	InsertOrder(queue *list.List, entry *lruEntry) *list.Element
+
+	// Victim returns the files in the order they should be evicted. Files may be removed from the
+	// queue while ranging over it.
+	Victim(queue *list.List) iter.Seq[*list.Element]
+
+	// order describes the order Victim returns files in, eg. for Dump.
+	order() string
+}
+
+var evictionPolicies = map[string]evictionPolicy{
+	"lru":  lruPolicy{},
+	"fifo": fifoPolicy{},
+	"mru":  mruPolicy{},
+}
+
+// EvictionPolicies returns the names of the eviction policies the lru and hybrid caches support,
+// sorted.
+func EvictionPolicies() []string {
+	return slices.Sorted(maps.Keys(evictionPolicies))
+}
+
+// evictionPolicyNamed returns the named policy, or lru for "".
+func evictionPolicyNamed(name string) (evictionPolicy, error) {
+	if name == "" {
+		return lruPolicy{}, nil
+	}
+	policy, ok := evictionPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown eviction policy %q, must be one of: %s", name, strings.Join(EvictionPolicies(), ", "))
+	}
+	return policy, nil
+}
+
+// lruPolicy evicts the least recently used file first.
+type lruPolicy struct{}
+
+func (lruPolicy) PromoteOnGet(queue *list.List, el *list.Element) {
+	queue.MoveToBack(el)
+}
+
+func (lruPolicy) InsertOrder(queue *list.List, entry *lruEntry) *list.Element {
+	return queue.PushBack(entry)
+}
+
+func (lruPolicy) Victim(queue *list.List) iter.Seq[*list.Element] {
+	return frontToBack(queue)
+}
+
+func (lruPolicy) order() string { return "least recently used first" }
+
+// fifoPolicy evicts the file cached longest ago first, however often it's read.
+type fifoPolicy struct{}
+
+func (fifoPolicy) PromoteOnGet(*list.List, *list.Element) {}
+
+func (fifoPolicy) InsertOrder(queue *list.List, entry *lruEntry) *list.Element {
+	return queue.PushBack(entry)
+}
+
+func (fifoPolicy) Victim(queue *list.List) iter.Seq[*list.Element] {
+	return frontToBack(queue)
+}
+
+func (fifoPolicy) order() string { return "oldest first" }
+
+// mruPolicy evicts the most recently used file first (other than the one being put). That keeps the
+// start of a scan that is bigger than the cache cached, where LRU would evict each file just before
+// the next pass reads it.
+type mruPolicy struct{}
+
+func (mruPolicy) PromoteOnGet(queue *list.List, el *list.Element) {
+	queue.MoveToBack(el)
+}
+
+func (mruPolicy) InsertOrder(queue *list.List, entry *lruEntry) *list.Element {
+	return queue.PushBack(entry)
+}
+
+func (mruPolicy) Victim(queue *list.List) iter.Seq[*list.Element] {
+	return func(yield func(*list.Element) bool) {
+		for el := queue.Back(); el != nil; {
+			prev := el.Prev()
+			if !yield(el) {
+				return
+			}
+			el = prev
+		}
+	}
+}
+
+func (mruPolicy) order() string { return "most recently used first" }
+
+// frontToBack ranges over the queue from the front, allowing the current element to be removed.
+func frontToBack(queue *list.List) iter.Seq[*list.Element] {
+	return func(yield func(*list.Element) bool) {
+		for el := queue.Front(); el != nil; {
+			next := el.Next()
+			if !yield(el) {
+				return
+			}
+			el = next
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package cachefs
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	// Caching three files, reading the first, then caching two more.
+	for _, tc := range []struct {
+		evict   string
+		victims []string
+	}{
+		{evict: "", victims: []string{"b", "c"}},
+		{evict: "lru", victims: []string{"b", "c"}},
+		{evict: "fifo", victims: []string{"a", "b"}},
+		{evict: "mru", victims: []string{"a", "d"}},
+	} {
+		t.Run(cmp.Or(tc.evict, "default"), func(t *testing.T) {
+			cache, err := NewCache("lru", CacheOpts{SSDDir: t.TempDir(), Capacity: 3, Evict: tc.evict})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var victims []string
+			cache.(EvictNotifier).OnEvict(func(path string, size int64) {
+				victims = append(victims, path)
+			})
+
+			for _, op := range []string{"put a", "put b", "put c", "get a", "put d", "put e"} {
+				verb, path, _ := strings.Cut(op, " ")
+				if verb == "get" {
+					_, err = cache.Get(path)
+				} else {
+					err = cache.Put(path, []byte(path), 0o644)
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", op, err)
+				}
+			}
+			if !slices.Equal(victims, tc.victims) {
+				t.Errorf("evicted %q, want %q", victims, tc.victims)
+			}
+		})
+	}
+}
+
+func TestUnknownEvictionPolicy(t *testing.T) {
+	if _, err := NewCache("lru", CacheOpts{SSDDir: t.TempDir(), Capacity: 3, Evict: "random"}); err == nil {
+		t.Error("NewCache with an unknown eviction policy succeeded")
+	}
+}
@@ -0,0 +1,153 @@
+package cachefs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsName is the file cumulative cache counters are checkpointed to, under the SSD directory,
+// so lifetime counts survive a restart.
+const metricsName = metaPrefix + "metrics"
+
+// cacheCounters count the file system's reads served from the cache and from NFS, and the files
+// the cache evicted, since the process started.
+type cacheCounters struct {
+	hits, misses        atomic.Int64 // Reads served from the cache, and from NFS
+	hitBytes, missBytes atomic.Int64
+	evictions           atomic.Int64 // Files the cache evicted by itself
+}
+
+func (c *cacheCounters) hit(bytes int64) {
+	c.hits.Add(1)
+	c.hitBytes.Add(bytes)
+}
+
+func (c *cacheCounters) miss(bytes int64) {
+	c.misses.Add(1)
+	c.missBytes.Add(bytes)
+}
+
+// snapshot returns the counters, named as they're reported.
+func (c *cacheCounters) snapshot() Stats {
+	return Stats{
+		"cache_hits":       c.hits.Load(),
+		"cache_misses":     c.misses.Load(),
+		"cache_hit_bytes":  c.hitBytes.Load(),
+		"cache_miss_bytes": c.missBytes.Load(),
+		"evictions":        c.evictions.Load(),
+	}
+}
+
+// metricsCheckpoint saves the counters, added to those saved by earlier processes, to a file every
+// interval and on close. The file is loaded when it's created, and ignored if it's corrupt.
+type metricsCheckpoint struct {
+	name     string
+	counters *cacheCounters
+	previous Stats // Lifetime counters before this process started
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newMetricsCheckpoint(ssdDir string, counters *cacheCounters, interval time.Duration) *metricsCheckpoint {
+	m := &metricsCheckpoint{
+		name:     filepath.Join(ssdDir, metricsName),
+		counters: counters,
+		previous: Stats{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if previous, err := readMetrics(m.name); err == nil {
+		m.previous = previous
+		log.Printf("METRICS: Loaded lifetime counters from %s: %v", m.name, previous)
+	} else if !os.IsNotExist(err) {
+		log.Printf("WARNING: Ignoring the saved cache counters, lifetime counters start from zero: %v", err)
+	}
+	go m.loop(interval)
+	return m
+}
+
+func (m *metricsCheckpoint) loop(interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.save(); err != nil {
+				log.Printf("WARNING: Failed to save the cache counters: %v", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// lifetime returns the counters added to those of earlier processes.
+func (m *metricsCheckpoint) lifetime() Stats {
+	stats := m.counters.snapshot()
+	for name, value := range m.previous {
+		stats[name] += value
+	}
+	return stats
+}
+
+func (m *metricsCheckpoint) addStats(stats Stats) {
+	for name, value := range m.lifetime() {
+		stats["lifetime_"+name] = value
+	}
+}
+
+// save writes the lifetime counters, one name=value per line. The file is replaced atomically, so a
+// crash leaves the last checkpoint.
+func (m *metricsCheckpoint) save() error {
+	stats := m.lifetime()
+	var buf bytes.Buffer
+	for _, name := range slices.Sorted(maps.Keys(stats)) {
+		fmt.Fprintf(&buf, "%s=%d\n", name, stats[name])
+	}
+	return writeFile(m.name, buf.Bytes(), 0o644, true)
+}
+
+// close stops checkpointing, and saves the counters one last time.
+func (m *metricsCheckpoint) close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+	if err := m.save(); err != nil {
+		return fmt.Errorf("failed to save the cache counters: %w", err)
+	}
+	return nil
+}
+
+// readMetrics reads the counters saved by metricsCheckpoint.save. Any line that isn't a counter
+// fails the whole file, rather than loading some counters and not others.
+func readMetrics(name string) (Stats, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := Stats{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || key == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid counter %q", name, line, scanner.Text())
+		}
+		stats[key] = n
+	}
+	return stats, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLifetimeCountersSurviveRestart(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "train.py", []byte("print()"))
+	cfg := Config{NFSDir: nfsDir, SSDDir: ssdDir, MetricsCheckpoint: time.Hour}
+	read := func(rfs *FS) {
+		t.Helper()
+		if _, err := lookup(t, rfs, "train.py").data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rfs := newTestFS(t, cfg)
+	read(rfs)
+	read(rfs)
+	if err := rfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rfs = newTestFS(t, cfg)
+	read(rfs)
+	stats := rfs.Stats()
+	for key, want := range map[string]int64{
+		"cache_hits":               1,
+		"cache_misses":             0,
+		"lifetime_cache_hits":      2,
+		"lifetime_cache_misses":    1,
+		"lifetime_cache_hit_bytes": 14,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %d, want %d", key, stats[key], want)
+		}
+	}
+}
+
+func TestCorruptMetricsCheckpointIsIgnored(t *testing.T) {
+	for name, checkpoint := range map[string]string{
+		"partly written": "cache_hits=5\ncache_mis",
+		"no value":       "cache_hits=5\ncache_misses=\n",
+		"negative":       "cache_hits=-5\n",
+		"not a number":   "cache_hits=lots\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			ssdDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(ssdDir, metricsName), []byte(checkpoint), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rfs := newTestFS(t, Config{SSDDir: ssdDir, MetricsCheckpoint: time.Hour})
+			if got := rfs.Stats()["lifetime_cache_hits"]; got != 0 {
+				t.Errorf("lifetime_cache_hits = %d, want 0", got)
+			}
+
+			// The next checkpoint replaces the corrupt one.
+			if err := rfs.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readMetrics(filepath.Join(ssdDir, metricsName)); err != nil {
+				t.Errorf("checkpoint still corrupt: %v", err)
+			}
+		})
+	}
+}
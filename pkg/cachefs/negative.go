@@ -0,0 +1,86 @@
+package cachefs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// negativeCache remembers paths that were found not to exist on NFS for a short while, so repeated
+// probes for them (build tools love looking for files that aren't there) don't go out to NFS.
+// A ttl of 0 disables it.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	missing map[string]time.Time // path -> when the entry expires
+
+	hits atomic.Int64
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		missing: make(map[string]time.Time),
+	}
+}
+
+// isMissing reports whether the path is known not to exist.
+func (nc *negativeCache) isMissing(path string) bool {
+	if nc.ttl <= 0 {
+		return false
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	expiry, ok := nc.missing[path]
+	if !ok {
+		return false
+	} else if time.Now().After(expiry) {
+		delete(nc.missing, path)
+		return false
+	}
+
+	nc.hits.Add(1)
+	return true
+}
+
+// markMissing records that the path does not exist.
+func (nc *negativeCache) markMissing(path string) {
+	if nc.ttl <= 0 {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if len(nc.missing) >= 1024 {
+		// Don't let expired entries pile up.
+		for p, expiry := range nc.missing {
+			if now.After(expiry) {
+				delete(nc.missing, p)
+			}
+		}
+	}
+	nc.missing[path] = now.Add(nc.ttl)
+}
+
+// reset forgets every path, eg. once the tree has been reloaded from NFS.
+func (nc *negativeCache) reset() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	clear(nc.missing)
+}
+
+// forget drops the entry for a path that now exists.
+func (nc *negativeCache) forget(path string) {
+	if nc.ttl <= 0 {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.missing, path)
+}
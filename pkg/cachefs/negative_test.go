@@ -0,0 +1,71 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func lookupErr(rfs *FS, name string) error {
+	_, err := rfs.rootNode.Lookup(context.Background(), name)
+	return err
+}
+
+func TestNegativeCacheHidesFileCreatedOnNFSUntilExpiry(t *testing.T) {
+	nfsDir := t.TempDir()
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NegativeTTL: 100 * time.Millisecond})
+
+	for range 3 {
+		if err := lookupErr(rfs, "setup.cfg"); !errors.Is(err, syscall.ENOENT) {
+			t.Fatalf("lookup of a missing file = %v, want ENOENT", err)
+		}
+	}
+	if got := rfs.Stats()["negative_hits"]; got != 2 {
+		t.Errorf("negative_hits = %d, want 2", got)
+	}
+
+	// Created behind our back while the entry is live, it stays missing until the entry expires.
+	writeTestFile(t, nfsDir, "setup.cfg", []byte("[metadata]"))
+	if err := lookupErr(rfs, "setup.cfg"); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("lookup with a live negative entry = %v, want ENOENT", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := lookupErr(rfs, "setup.cfg"); err != nil {
+		t.Fatalf("lookup after the entry expired = %v", err)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	nfsDir := t.TempDir()
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	if err := lookupErr(rfs, "setup.cfg"); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("lookup of a missing file = %v, want ENOENT", err)
+	}
+	writeTestFile(t, nfsDir, "setup.cfg", nil)
+	if err := lookupErr(rfs, "setup.cfg"); err != nil {
+		t.Errorf("lookup without a negative cache = %v", err)
+	}
+	if got := rfs.Stats()["negative_hits"]; got != 0 {
+		t.Errorf("negative_hits = %d, want 0", got)
+	}
+}
+
+func TestNegativeCacheResetByRefresh(t *testing.T) {
+	nfsDir := t.TempDir()
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NegativeTTL: time.Hour})
+
+	if err := lookupErr(rfs, "setup.cfg"); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("lookup of a missing file = %v, want ENOENT", err)
+	}
+	writeTestFile(t, nfsDir, "setup.cfg", []byte("[metadata]"))
+	if err := rfs.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lookup(t, rfs, "setup.cfg").data(context.Background()); err != nil || string(got) != "[metadata]" {
+		t.Errorf("after Refresh = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,64 @@
+package cachefs
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+)
+
+// nfsLimiter bounds the number of file reads hitting NFS at once, so a burst of cold reads queues
+// rather than overwhelming the server.
+type nfsLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64 // Reads queued for a slot
+}
+
+func newNFSLimiter(concurrency int) *nfsLimiter {
+	return &nfsLimiter{slots: make(chan struct{}, concurrency)}
+}
+
+// acquire waits for a slot, returning syscall.EINTR if ctx is cancelled first. Every successful
+// acquire must be followed by a release.
+func (l *nfsLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+func (l *nfsLimiter) release() {
+	<-l.slots
+}
+
+func (l *nfsLimiter) addStats(stats Stats) {
+	stats["nfs_reads_active"] = int64(len(l.slots))
+	stats["nfs_reads_queued"] = l.waiting.Load()
+}
+
+// startNFSRead waits for a turn to read from NFS (if reads are limited), then sleeps for the
+// simulated NFS latency. The returned func must be called once the read is done, unless there's an
+// error.
+func (rfs *FS) startNFSRead(ctx context.Context) (done func(), err error) {
+	done = func() {}
+	if rfs.nfsLimit != nil {
+		if err := rfs.nfsLimit.acquire(ctx); err != nil {
+			return nil, err
+		}
+		done = rfs.nfsLimit.release
+	}
+	if err := rfs.simulateNFSLatency(ctx); err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
@@ -0,0 +1,90 @@
+package cachefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNFSReadsAreLimited(t *testing.T) {
+	nfsDir := t.TempDir()
+	for i := range 10 {
+		writeTestFile(t, nfsDir, fmt.Sprintf("f%d", i), []byte(fmt.Sprint(i)))
+	}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSConcurrency: 2})
+
+	// Reads hold their turn until released.
+	opened, release := make(chan struct{}), make(chan struct{})
+	rfs.openNFS = func(name string) (*os.File, error) {
+		opened <- struct{}{}
+		<-release
+		return os.Open(name)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		n := lookup(t, rfs, fmt.Sprintf("f%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			want := fmt.Sprint(i)
+			if got, err := n.data(context.Background()); err != nil || string(got) != want {
+				t.Errorf("f%d: data = %q, %v, want %q", i, got, err, want)
+			}
+		}()
+	}
+
+	<-opened
+	<-opened
+	for deadline := time.Now().Add(5 * time.Second); rfs.Stats()["nfs_reads_queued"] != 8; {
+		if time.Now().After(deadline) {
+			t.Fatalf("nfs_reads_queued = %d, want 8", rfs.Stats()["nfs_reads_queued"])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if active := rfs.Stats()["nfs_reads_active"]; active != 2 {
+		t.Errorf("nfs_reads_active = %d, want 2", active)
+	}
+	select {
+	case <-opened:
+		t.Error("a third read reached NFS")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	go func() {
+		for range opened {
+		}
+	}()
+	wg.Wait()
+	close(opened)
+	if stats := rfs.Stats(); stats["nfs_reads_active"] != 0 || stats["nfs_reads_queued"] != 0 {
+		t.Errorf("after the reads, %d are active and %d queued, want none", stats["nfs_reads_active"], stats["nfs_reads_queued"])
+	}
+}
+
+func TestNFSReadTurnsAreGivenBackWhenCancelled(t *testing.T) {
+	rfs := newTestFS(t, Config{NFSConcurrency: 1, NFSReadDelay: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The turn is free, so it's taken, then given back when the latency sleep is cancelled.
+	if _, err := rfs.startNFSRead(ctx); err != syscall.EINTR {
+		t.Errorf("startNFSRead = %v, want EINTR", err)
+	}
+	if active := rfs.Stats()["nfs_reads_active"]; active != 0 {
+		t.Errorf("nfs_reads_active = %d after a cancelled read, want 0", active)
+	}
+
+	// With the only turn taken, a cancelled wait gives up.
+	if err := rfs.nfsLimit.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rfs.nfsLimit.acquire(ctx); err != syscall.EINTR {
+		t.Errorf("acquire = %v while waiting, want EINTR", err)
+	}
+}
@@ -0,0 +1,83 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errnoNames are the errnos that can be named in Errnos: those NFS reads commonly fail with and
+// then succeed on retry.
+var errnoNames = map[string]syscall.Errno{
+	"EAGAIN":       syscall.EAGAIN,
+	"EBUSY":        syscall.EBUSY,
+	"ECONNREFUSED": syscall.ECONNREFUSED,
+	"ECONNRESET":   syscall.ECONNRESET,
+	"EHOSTUNREACH": syscall.EHOSTUNREACH,
+	"EINTR":        syscall.EINTR,
+	"EIO":          syscall.EIO,
+	"ENETUNREACH":  syscall.ENETUNREACH,
+	"ESTALE":       syscall.ESTALE,
+	"ETIMEDOUT":    syscall.ETIMEDOUT,
+}
+
+// Errnos is a set of errnos.
+type Errnos []syscall.Errno
+
+// ParseErrnos parses comma separated errno names (eg. ESTALE,ETIMEDOUT), case-insensitively.
+func ParseErrnos(s string) (Errnos, error) {
+	var errnos Errnos
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		errno, ok := errnoNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown errno %q, must be one of %s", name, strings.Join(slices.Sorted(maps.Keys(errnoNames)), ", "))
+		}
+		errnos = append(errnos, errno)
+	}
+	return errnos, nil
+}
+
+// match reports whether err is (or wraps) one of the errnos.
+func (e Errnos) match(err error) bool {
+	for _, errno := range e {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryNFS calls read, retrying it while it fails with one of the retriable errnos, up to the
+// configured number of retries. The delay between attempts starts at the configured delay and
+// doubles after each. It gives up with syscall.EINTR if ctx is cancelled, and otherwise returns the
+// last error, which callers report as syscall.EIO.
+func (rfs *FS) retryNFS(ctx context.Context, relPath string, read func() error) error {
+	delay := rfs.nfsRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := read()
+		if err == nil || ctx.Err() != nil || attempt > rfs.nfsRetries || !rfs.nfsRetryErrnos.match(err) {
+			return err
+		}
+		rfs.nfsRetried.Add(1)
+		log.Printf("NFS_RETRY: Reading '%s' failed (attempt %d/%d), retrying in %v: %v", relPath, attempt, rfs.nfsRetries+1, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return syscall.EINTR
+		}
+		delay *= 2
+	}
+}
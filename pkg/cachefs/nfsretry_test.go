@@ -0,0 +1,82 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryNFS(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		errs      []error // Returned by each call in turn, nil after they run out
+		wantCalls int
+		wantErr   error
+	}{
+		{"transient, then success", []error{syscall.ESTALE, syscall.ESTALE}, 3, nil},
+		{"transient every time", slices.Repeat([]error{fmt.Errorf("read: %w", syscall.ETIMEDOUT)}, 10), 4, syscall.ETIMEDOUT},
+		{"not retriable", []error{syscall.ENOENT}, 1, syscall.ENOENT},
+	} {
+		rfs := newTestFS(t, Config{NFSRetries: 3, NFSRetryDelay: time.Millisecond, NFSRetryErrnos: Errnos{syscall.ESTALE, syscall.ETIMEDOUT}})
+		calls := 0
+		err := rfs.retryNFS(context.Background(), "a.txt", func() error {
+			calls++
+			if calls > len(tc.errs) {
+				return nil
+			}
+			return tc.errs[calls-1]
+		})
+		if calls != tc.wantCalls || !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: %d calls returning %v, want %d returning %v", tc.name, calls, err, tc.wantCalls, tc.wantErr)
+		}
+		if want := int64(tc.wantCalls - 1); rfs.Stats()["nfs_retries"] != want {
+			t.Errorf("%s: nfs_retries = %d, want %d", tc.name, rfs.Stats()["nfs_retries"], want)
+		}
+	}
+}
+
+func TestRetryNFSStopsWhenCancelled(t *testing.T) {
+	rfs := newTestFS(t, Config{NFSRetries: 3, NFSRetryDelay: time.Hour, NFSRetryErrnos: Errnos{syscall.ESTALE}})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if err := rfs.retryNFS(ctx, "a.txt", func() error { return syscall.ESTALE }); err != syscall.EINTR {
+		t.Errorf("retryNFS = %v while waiting to retry, want EINTR", err)
+	}
+}
+
+func TestReadsRetryTransientNFSErrors(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSRetries: 3, NFSRetryDelay: time.Millisecond, NFSRetryErrnos: Errnos{syscall.ESTALE}})
+	failures := 2
+	rfs.openNFS = func(name string) (*os.File, error) {
+		if failures > 0 {
+			failures--
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ESTALE}
+		}
+		return os.Open(name)
+	}
+
+	if got, err := lookup(t, rfs, "a.txt").data(context.Background()); err != nil || string(got) != "a" {
+		t.Errorf("data = %q, %v, want %q", got, err, "a")
+	}
+	if got := rfs.Stats()["nfs_retries"]; got != 2 {
+		t.Errorf("nfs_retries = %d, want 2", got)
+	}
+}
+
+func TestParseErrnos(t *testing.T) {
+	got, err := ParseErrnos("estale, ETIMEDOUT,")
+	if err != nil || !slices.Equal(got, Errnos{syscall.ESTALE, syscall.ETIMEDOUT}) {
+		t.Errorf("ParseErrnos = %v, %v", got, err)
+	}
+	if _, err := ParseErrnos("ESTALE,ENOPE"); err == nil {
+		t.Error("ParseErrnos accepted an unknown errno")
+	}
+}
@@ -0,0 +1,109 @@
+package cachefs
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NFSSources are several NFS directories served as one tree, by name: each is a directory in the
+// root named after it. The root itself isn't on NFS, so nothing can be created or renamed in it.
+type NFSSources map[string]string
+
+// Set adds a "name=dir" source, so a flag can be given once per source (see flag.Value).
+func (s NFSSources) Set(v string) error {
+	name, dir, ok := strings.Cut(v, "=")
+	name, dir = strings.TrimSpace(name), strings.TrimSpace(dir)
+	if !ok || dir == "" {
+		return fmt.Errorf("invalid NFS source %q, must be name=dir", v)
+	} else if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid NFS source name %q", name)
+	} else if _, dup := s[name]; dup {
+		return fmt.Errorf("NFS source %q is given twice", name)
+	}
+	s[name] = dir
+	return nil
+}
+
+func (s NFSSources) String() string {
+	var sources []string
+	for _, name := range slices.Sorted(maps.Keys(s)) {
+		sources = append(sources, name+"="+s[name])
+	}
+	return strings.Join(sources, ",")
+}
+
+// merged reports whether the tree is merged from several sources, so its root isn't on NFS.
+func (rfs *FS) merged() bool {
+	return rfs.nfsSources != nil
+}
+
+// nfsRoots returns the NFS directories the tree is loaded from.
+func (rfs *FS) nfsRoots() []string {
+	if !rfs.merged() {
+		return []string{rfs.nfsBaseAbs}
+	}
+	roots := make([]string, 0, len(rfs.nfsSources))
+	for _, name := range slices.Sorted(maps.Keys(rfs.nfsSources)) {
+		roots = append(roots, rfs.nfsSources[name])
+	}
+	return roots
+}
+
+// nfsPath returns the absolute NFS path of the relative path, or "" if it isn't on NFS: the root of
+// a merged tree, or a name in it that isn't a source. Nodes know their own (see nfsPathAbs), this is
+// for paths that may not have one, eg. files waiting to be written back.
+func (rfs *FS) nfsPath(relPath string) string {
+	if !rfs.merged() {
+		return filepath.Join(rfs.nfsBaseAbs, relPath)
+	}
+	name, rest, _ := strings.Cut(filepath.ToSlash(relPath), "/")
+	dir, ok := rfs.nfsSources[name]
+	if !ok {
+		return ""
+	}
+	return filepath.Join(dir, rest)
+}
+
+// nfsRelPath returns the relative path of an absolute NFS path, or false if it isn't under any of
+// the tree's NFS directories.
+func (rfs *FS) nfsRelPath(absPath string) (string, bool) {
+	if !rfs.merged() {
+		return relPathUnder(rfs.nfsBaseAbs, absPath)
+	}
+	for name, dir := range rfs.nfsSources {
+		if relPath, ok := relPathUnder(dir, absPath); ok {
+			return filepath.Join(name, relPath), true
+		}
+	}
+	return "", false
+}
+
+// relPathUnder returns the path of absPath relative to dir, "" for dir itself, or false if it isn't
+// under dir.
+func relPathUnder(dir, absPath string) (string, bool) {
+	relPath, err := filepath.Rel(dir, absPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", false
+	}
+	if relPath == "." {
+		return "", true
+	}
+	return relPath, true
+}
+
+// syntheticDirInfo describes the root of a merged tree, which isn't on NFS.
+type syntheticDirInfo struct {
+	modTime time.Time
+}
+
+func (fi syntheticDirInfo) Name() string       { return "" }
+func (fi syntheticDirInfo) Size() int64        { return 0 }
+func (fi syntheticDirInfo) Mode() os.FileMode  { return os.ModeDir | perm_READ }
+func (fi syntheticDirInfo) ModTime() time.Time { return fi.modTime }
+func (fi syntheticDirInfo) IsDir() bool        { return true }
+func (fi syntheticDirInfo) Sys() any           { return nil }
@@ -0,0 +1,886 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	native_fs "io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+type FuseFSNode interface {
+	fs.Node
+	fs.HandleReadDirAller
+	fs.NodeStringLookuper
+	fs.NodeReadlinker
+	fs.NodeSymlinker
+	fs.NodeRenamer
+	fs.NodeOpener
+	fs.HandleWriter
+	fs.NodeSetattrer
+	fs.NodeFsyncer
+	fs.HandleFlusher
+	fs.NodeGetxattrer
+	fs.NodeListxattrer
+	fs.NodeSetxattrer
+	fs.NodeRemovexattrer
+	fs.NodeAccesser
+
+	// TODO(wes): Add some more interfaces?
+	// fs.NodeRemover // Allows rm and rmdir
+	// fs.MakeDirer
+}
+
+func NewFuseFSNode(fs *FS, name, parentPathRel, nfsPath string, inode uint64, mode os.FileMode, isDir bool) *fuseFSNode {
+	return &fuseFSNode{
+		FS:            fs,
+		Name:          name,
+		parentPathRel: parentPathRel,
+		nfsPath:       nfsPath,
+		Inode:         inode,
+		Mode:          mode,
+		isDir:         isDir,
+	}
+}
+
+type fuseFSNode struct {
+	FS            *FS
+	Name          string
+	parentPathRel string // Relative to NFS/SSD base
+	nfsPath       string // Absolute path of what backs the node on NFS, "" for the root of a merged tree
+	Inode         uint64
+	Mode          os.FileMode
+	isDir         bool
+
+	pathMu sync.RWMutex // Guards Name, parentPathRel and nfsPath, which change when the node is renamed
+
+	childrenMu    sync.RWMutex
+	Children      []*fuseFSNode // nil for files
+	cachedListing *dirListing   // Guarded by childrenMu, nil when not listed since the children changed
+	loadedModTime time.Time     // Guarded by childrenMu, the directory's NFS mtime when the children were loaded
+
+	unsynced atomic.Bool // Changed through the mount since it was last fsynced, see Fsync
+}
+
+func (n *fuseFSNode) name() string {
+	n.pathMu.RLock()
+	defer n.pathMu.RUnlock()
+	return n.Name
+}
+
+func (n *fuseFSNode) parentPath() string {
+	n.pathMu.RLock()
+	defer n.pathMu.RUnlock()
+	return n.parentPathRel
+}
+
+func (n *fuseFSNode) relPath() string {
+	n.pathMu.RLock()
+	defer n.pathMu.RUnlock()
+	return filepath.Join(n.parentPathRel, n.Name)
+}
+
+// nfsPathAbs returns the node's absolute NFS path, or "" for the root of a merged tree, which isn't
+// on NFS.
+func (n *fuseFSNode) nfsPathAbs() string {
+	n.pathMu.RLock()
+	defer n.pathMu.RUnlock()
+	return n.nfsPath
+}
+
+// childNFSPath returns the absolute NFS path of the named child of the directory, whether or not
+// it exists.
+func (n *fuseFSNode) childNFSPath(name string) string {
+	if n.synthetic() {
+		return n.FS.nfsPath(name) // The children of a merged root are its sources
+	}
+	return filepath.Join(n.nfsPathAbs(), name)
+}
+
+// synthetic reports whether the node isn't on NFS, ie. it's the root of a merged tree.
+func (n *fuseFSNode) synthetic() bool {
+	return n.nfsPathAbs() == ""
+}
+
+// move gives the node a new name and parent, and updates the paths of everything below it.
+func (n *fuseFSNode) move(parent *fuseFSNode, name string) {
+	parentPathRel, nfsPath := parent.relPath(), parent.childNFSPath(name)
+	n.pathMu.Lock()
+	n.parentPathRel = parentPathRel
+	n.nfsPath = nfsPath
+	n.Name = name
+	n.pathMu.Unlock()
+
+	for _, child := range n.children() {
+		child.move(n, child.name())
+	}
+}
+
+func (n *fuseFSNode) isSymlink() bool {
+	return n.Mode&os.ModeSymlink != 0
+}
+
+// fileMode returns the mode the node is served with. Files have their permissions on NFS, so a
+// chmod there shows through. Directories and symlinks keep the fixed mode they were created with.
+func (n *fuseFSNode) fileMode(fi native_fs.FileInfo) os.FileMode {
+	if n.isDir || n.isSymlink() {
+		return n.Mode
+	}
+	return n.Mode.Type() | fi.Mode().Perm()
+}
+
+// syncMode brings the permissions of the cached copy in line with NFS, if the file has been
+// chmod'ed there since it was cached. Caches that can't change a file's mode have it evicted
+// instead, so it's cached again with the new mode.
+func (n *fuseFSNode) syncMode(fi native_fs.FileInfo) {
+	relPath := n.relPath()
+	cached, ok := n.FS.versions.get(relPath)
+	mode := n.fileMode(fi)
+	if !ok || cached.mode == mode {
+		return
+	}
+
+	if setter, ok := findCache[ModeSetter](n.FS.ssdCache); ok {
+		err := setter.SetMode(cached.key, mode)
+		if err == nil {
+			n.FS.versions.setMode(relPath, mode)
+			log.Printf("CACHE_MODE: '%s' changed from %s to %s on NFS, updated the cached copy", relPath, cached.mode, mode)
+			return
+		}
+		log.Printf("WARNING: Failed to change the mode of cached '%s', evicting it: %v", relPath, err)
+	}
+	n.FS.evict(relPath)
+}
+
+// cacheKey returns the key the whole file is cached under: its path, or with versioned keys, its
+// path and the NFS version in fi.
+func (n *fuseFSNode) cacheKey(fi native_fs.FileInfo) string {
+	if !n.FS.versionedKeys {
+		return n.relPath()
+	}
+	return versionedKey(n.relPath(), fi.ModTime(), fi.Size())
+}
+
+func (n *fuseFSNode) stat() (native_fs.FileInfo, error) {
+	if n.FS.negCache.isMissing(n.relPath()) {
+		return nil, syscall.ENOENT
+	}
+
+	if fi, ok := n.FS.attrCache.get(n.relPath()); ok {
+		return fi, nil
+	}
+	if n.synthetic() {
+		return syntheticDirInfo{modTime: n.FS.mergedAt}, nil
+	}
+
+	fi, err := os.Lstat(n.nfsPathAbs()) // NFS is source of truth. Don't follow symlinks, they are nodes themselves
+	if os.IsNotExist(err) {
+		n.FS.negCache.markMissing(n.relPath())
+		return nil, syscall.ENOENT
+	} else if err != nil {
+		if cached, ok := n.cachedStat(); ok {
+			log.Printf("WARNING: Failed to stat NFS path %s, serving what the cache has: %v", n.nfsPathAbs(), err)
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	n.FS.attrCache.put(n.relPath(), fi)
+	return fi, nil
+}
+
+// cachedStat stands in for NFS when it can't be reached, describing the file by its cached copy, so
+// files that are cached can still be served. Its modification time is when it was cached. Files
+// cached under versioned keys can't be found without knowing their version on NFS.
+func (n *fuseFSNode) cachedStat() (native_fs.FileInfo, bool) {
+	if n.isDir || n.isSymlink() || n.FS.versionedKeys || n.FS.chunkSize > 0 {
+		return nil, false
+	}
+	entry, err := statEntry(n.FS.ssdCache, n.relPath())
+	if err != nil {
+		return nil, false
+	}
+	return cachedFileInfo{name: n.name(), entry: entry}, true
+}
+
+// cachedFileInfo is a file's cached copy, passed off as the file on NFS.
+type cachedFileInfo struct {
+	name  string
+	entry Entry
+}
+
+func (fi cachedFileInfo) Name() string       { return fi.name }
+func (fi cachedFileInfo) Size() int64        { return fi.entry.Size }
+func (fi cachedFileInfo) Mode() os.FileMode  { return fi.entry.Mode.Perm() }
+func (fi cachedFileInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi cachedFileInfo) IsDir() bool        { return false }
+func (fi cachedFileInfo) Sys() any           { return nil }
+
+func (n *fuseFSNode) addChild(child *fuseFSNode) {
+	n.childrenMu.Lock()
+	defer n.childrenMu.Unlock()
+	n.Children = append(n.Children, child)
+	n.cachedListing = nil
+}
+
+// removeChild removes and returns the named child, or nil if there is no such child.
+func (n *fuseFSNode) removeChild(name string) *fuseFSNode {
+	n.childrenMu.Lock()
+	defer n.childrenMu.Unlock()
+
+	for i, child := range n.Children {
+		if child.name() == name {
+			n.Children = slices.Delete(n.Children, i, i+1)
+			n.cachedListing = nil
+			return child
+		}
+	}
+	return nil
+}
+
+// children returns a snapshot of the node's children, safe to iterate while the tree changes.
+func (n *fuseFSNode) children() []*fuseFSNode {
+	n.childrenMu.RLock()
+	defer n.childrenMu.RUnlock()
+	return slices.Clone(n.Children)
+}
+
+// child returns the named child, or nil if there is no such child.
+func (n *fuseFSNode) child(name string) *fuseFSNode {
+	n.childrenMu.RLock()
+	defer n.childrenMu.RUnlock()
+
+	for _, child := range n.Children {
+		if child.name() == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// data returns the whole file, from the cache if possible. If ctx is cancelled while it is being
+// read from NFS, it gives up with syscall.EINTR.
+func (n *fuseFSNode) data(ctx context.Context) ([]byte, error) {
+	if f, ok := n.dirtyData(); ok {
+		return f.data, nil
+	}
+
+	fi, err := n.stat()
+	if err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, syscall.EISDIR
+	}
+
+	start := time.Now()
+	n.syncMode(fi)
+
+	// 1. Try reading from SSD cache
+	key := n.cacheKey(fi)
+	entry, err := getEntry(n.FS.ssdCache, key)
+	n.FS.latency.cacheGet.since(start)
+	if err == nil && entry.Size != fi.Size() {
+		// The file has changed on NFS since it was cached (a versioned key would have missed).
+		log.Printf("CACHE_STALE: Cached '%s' is %d bytes, but %d on NFS, reading it again", n.relPath(), entry.Size, fi.Size())
+		n.FS.evict(n.relPath())
+		err = ErrNotFoundCache
+	}
+	if err == nil {
+		n.FS.latency.readHit.since(start)
+		n.FS.counters.hit(int64(len(entry.Data)))
+		n.FS.hot.hit(key, int64(len(entry.Data)))
+		log.Printf("CACHE_HIT: Read %d bytes from SSD for '%s'", len(entry.Data), n.relPath())
+		if n.FS.prefetch != nil {
+			n.FS.prefetch.hit(n.relPath())
+		}
+		return entry.Data, nil
+	}
+	if err != ErrNotFoundCache {
+		// An error other than the file not being present in the cache - could be bad but we should continue
+		log.Printf("WARNING: Error reading from SSD cache for %s (will try NFS): %v", n.relPath(), err)
+	}
+
+	// The rest of the directory is likely to be read soon too
+	if n.FS.prefetch != nil {
+		n.FS.prefetch.siblings(n)
+	}
+
+	// 2. Try reading from NFS file system
+	defer n.FS.latency.readMiss.since(start)
+	res, err := n.fetch(ctx)
+	if err != nil {
+		return nil, err
+	} else if res.data != nil {
+		n.FS.counters.miss(int64(len(res.data)))
+		return res.data, nil
+	}
+
+	// The file was streamed straight into the cache, read it back.
+	if res.cached {
+		if cachedData, err := n.FS.ssdCache.Get(res.key); err == nil {
+			n.FS.counters.miss(int64(len(cachedData)))
+			return cachedData, nil
+		}
+	}
+	done, err := n.FS.startNFSRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nfsData, err := n.readNFS(ctx)
+	done()
+	if err == syscall.EINTR {
+		return nil, err
+	} else if err != nil {
+		log.Printf("ERROR: Failed to read from NFS path %s: %v", n.nfsPathAbs(), err)
+		return nil, syscall.EIO
+	}
+	n.FS.counters.miss(int64(len(nfsData)))
+	return nfsData, nil
+}
+
+// open returns a reader of the file's contents, from the cache if possible. Otherwise the file is
+// fetched from NFS into the cache first, or read from NFS directly if the cache won't take it.
+func (n *fuseFSNode) open(ctx context.Context) (io.ReadSeekCloser, error) {
+	fi, err := n.stat()
+	if err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, syscall.EISDIR
+	}
+
+	n.syncMode(fi)
+
+	// 1. Try reading from SSD cache
+	key := n.cacheKey(fi)
+	r, err := getReader(n.FS.ssdCache, key)
+	if err == nil {
+		n.FS.counters.hit(fi.Size())
+		n.FS.hot.hit(key, fi.Size())
+		log.Printf("CACHE_HIT: Opened '%s' from SSD", n.relPath())
+		if n.FS.prefetch != nil {
+			n.FS.prefetch.hit(n.relPath())
+		}
+		return r, nil
+	}
+	if err != ErrNotFoundCache {
+		log.Printf("WARNING: Error reading from SSD cache for %s (will try NFS): %v", n.relPath(), err)
+	}
+
+	if n.FS.prefetch != nil {
+		n.FS.prefetch.siblings(n)
+	}
+
+	// 2. Fetch the file from NFS into the cache, and read it from there
+	res, err := n.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.FS.counters.miss(fi.Size())
+	if res.cached {
+		if r, err := getReader(n.FS.ssdCache, res.key); err == nil {
+			return r, nil
+		}
+	}
+
+	// 3. Not cached, read NFS directly
+	var f *os.File
+	err = n.FS.retryNFS(ctx, n.relPath(), func() (err error) {
+		f, err = n.FS.openNFS(n.nfsPathAbs())
+		return err
+	})
+	if err == syscall.EINTR {
+		return nil, err
+	} else if err != nil {
+		log.Printf("ERROR: Failed to open NFS path %s: %v", n.nfsPathAbs(), err)
+		return nil, syscall.EIO
+	}
+	return f, nil
+}
+
+// readNFS reads the whole file from NFS, retrying transient errors (see retryNFS).
+func (n *fuseFSNode) readNFS(ctx context.Context) ([]byte, error) {
+	var data []byte
+	err := n.FS.retryNFS(ctx, n.relPath(), func() (err error) {
+		f, err := n.FS.openNFS(n.nfsPathAbs())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		data, err = readAllContext(ctx, f)
+		return err
+	})
+	return data, err
+}
+
+// fetchResult is the outcome of fetching a file from NFS.
+type fetchResult struct {
+	key     string // What the file is cached under, see cacheKey
+	data    []byte // nil if the file was streamed into the cache, rather than read into memory
+	size    int64
+	cached  bool
+	refused bool // The cache returned ErrWontCache, eg. because it is full
+}
+
+// fetch reads the file from NFS and writes it to the cache, streaming it if the cache supports
+// that. Failing to cache the file is not an error, the result reports whether it was cached.
+// Concurrent fetches of the same file share a single NFS read, which is only abandoned once all of
+// their contexts are cancelled. A fetch whose ctx is cancelled returns syscall.EINTR.
+func (n *fuseFSNode) fetch(ctx context.Context) (fetchResult, error) {
+	// Taken before the read, so a change during it is caught by the scrubber (or with versioned
+	// keys, by the next read missing).
+	fi, err := n.stat()
+	if err != nil {
+		return fetchResult{}, err
+	}
+	key := n.cacheKey(fi)
+
+	res, err := n.FS.fetches.do(ctx, key, func(ctx context.Context) (fetchResult, error) {
+		// A flight for the file may have finished between our cache miss and starting this one, in
+		// which case it mustn't be read from NFS and put again. Has doesn't read the file, so the
+		// size is NFS's, which is what was cached unless the file has changed since.
+		if n.FS.ssdCache.Has(key) {
+			return fetchResult{key: key, size: fi.Size(), cached: true}, nil
+		}
+
+		defer n.FS.latency.nfsFetch.since(time.Now())
+
+		mode := n.fileMode(fi)
+		var res fetchResult
+		var err error
+		if _, ok := n.FS.ssdCache.(StreamingCache); ok {
+			res, err = n.streamNFS(ctx, key, mode)
+		} else {
+			res, err = n.fetchNFS(ctx, key, mode)
+		}
+		if err == nil && res.cached {
+			n.FS.recordVersion(n.relPath(), key, fi, mode)
+		}
+		return res, err
+	})
+	if err != nil && ctx.Err() != nil {
+		return fetchResult{}, syscall.EINTR
+	}
+	return res, err
+}
+
+func (n *fuseFSNode) fetchNFS(ctx context.Context, key string, mode os.FileMode) (fetchResult, error) {
+	done, err := n.FS.startNFSRead(ctx)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	nfsData, err := n.readNFS(ctx)
+	done()
+	if err == syscall.EINTR {
+		return fetchResult{}, err
+	} else if err != nil {
+		log.Printf("ERROR: Failed to read from NFS path %s: %v", n.nfsPathAbs(), err)
+		return fetchResult{}, syscall.EIO // Return an appropriate FUSE error (I/O error)
+	}
+	log.Printf("NFS_READ: Read %d bytes for '%s'", len(nfsData), n.relPath())
+	res := fetchResult{key: key, data: nfsData, size: int64(len(nfsData))}
+
+	// Write the file to the cache with the same permissions it has in FUSE/NFS.
+	start := time.Now()
+	err = n.FS.ssdCache.Put(key, nfsData, mode)
+	n.FS.latency.cachePut.since(start)
+	if err == ErrWontCache {
+		log.Printf("WARNING: Cache refuse to write file: '%v'", err)
+		res.refused = true
+		return res, nil
+	} else if err != nil {
+		log.Printf("ERROR: Failed to write to cache %s: %v. Proceeding without caching.", n.relPath(), err)
+		return res, nil
+	}
+
+	n.FS.negCache.forget(n.relPath())
+	log.Printf("CACHE_LOADED: Copied '%s' from NFS to cache", n.relPath())
+	res.cached = true
+	return res, nil
+}
+
+// streamNFS copies the file from NFS into the cache without holding it in memory.
+func (n *fuseFSNode) streamNFS(ctx context.Context, key string, mode os.FileMode) (fetchResult, error) {
+	// The file is read as it's written to the cache, so the turn is held until it has been.
+	done, err := n.FS.startNFSRead(ctx)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer done()
+
+	// A failed attempt leaves nothing in the cache, so the whole copy is retried.
+	var written int64
+	var openErr error
+	err = n.FS.retryNFS(ctx, n.relPath(), func() error {
+		f, err := n.FS.openNFS(n.nfsPathAbs())
+		if openErr = err; err != nil {
+			return err
+		}
+		defer f.Close()
+
+		start := time.Now()
+		written, err = putReader(n.FS.ssdCache, key, contextReader{ctx: ctx, r: f}, mode)
+		n.FS.latency.cachePut.since(start)
+		return err
+	})
+	if openErr != nil && err != syscall.EINTR {
+		log.Printf("ERROR: Failed to open NFS path %s: %v", n.nfsPathAbs(), err)
+		return fetchResult{}, syscall.EIO
+	} else if err == ErrWontCache {
+		log.Printf("WARNING: Cache refuse to write file: '%v'", err)
+		return fetchResult{size: written, refused: true}, nil
+	} else if errors.Is(err, syscall.EINTR) {
+		return fetchResult{}, syscall.EINTR
+	} else if err != nil {
+		log.Printf("ERROR: Failed to stream %s from NFS to cache: %v. Proceeding without caching.", n.relPath(), err)
+		return fetchResult{}, nil
+	}
+
+	n.FS.negCache.forget(n.relPath())
+	log.Printf("CACHE_LOADED: Streamed %d bytes of '%s' from NFS to cache", written, n.relPath())
+	return fetchResult{key: key, size: written, cached: true}, nil
+}
+
+func (n *fuseFSNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Inode = n.Inode
+	attr.Valid = n.FS.attrTTL
+
+	fi, err := n.stat()
+	if err != nil {
+		return err
+	}
+	attr.Mode = n.fileMode(fi)
+	// A directory's size is its size on NFS, ie. that of its own entries rather than of the files in
+	// it, as for any other file system. du goes by blocks, which are NFS's too.
+	attr.Size = uint64(fi.Size())
+	attr.Blocks = uint64(blocksOf(diskUsage(fi)))
+	attr.Mtime = fi.ModTime()
+	attr.Atime, attr.Ctime = nfsTimes(fi)
+	if f, ok := n.dirtyData(); ok {
+		attr.Size = uint64(len(f.data))
+		attr.Blocks = uint64(blocksOf(roundToBlock(int64(len(f.data)))))
+		attr.Mtime, attr.Ctime = f.mtime, f.mtime
+	}
+	if uid, gid, ok := n.FS.owner(fi); ok {
+		attr.Uid, attr.Gid = uid, gid
+	}
+
+	return nil
+}
+
+// ReadDirAll lists the directory's children. With listings cached, a listing is reused until it
+// expires or the directory is modified on NFS, in which case its entries are reloaded from NFS first.
+func (n *fuseFSNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	// TODO(wes): Lazy load?
+	ttl := n.FS.dirListingTTL
+	if ttl <= 0 {
+		return n.list(time.Time{}, 0), nil
+	}
+
+	fi, err := n.stat()
+	if err != nil {
+		return n.list(time.Time{}, 0), nil // As it was, without knowing whether it has changed
+	}
+	ents, changed := n.listing(fi.ModTime())
+	if ents != nil {
+		n.FS.dirListingHits.Add(1)
+		return ents, nil
+	}
+	if changed {
+		if err := n.FS.reloadDir(n); err != nil {
+			log.Printf("ERROR: Failed to reload '%s' from NFS, listing it as it was: %v", n.relPath(), err)
+		}
+	}
+	return n.list(fi.ModTime(), ttl), nil
+}
+
+// Lookup finds an immediate child of the directory by name. Names that aren't in the tree are
+// looked for on NFS, in case they were created after the tree was loaded.
+func (n *fuseFSNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if child := n.child(name); child != nil {
+		return child, nil
+	}
+
+	relPath := filepath.Join(n.relPath(), name)
+	if n.FS.negCache.isMissing(relPath) {
+		return nil, syscall.ENOENT
+	}
+
+	fi, err := os.Lstat(n.childNFSPath(name))
+	if os.IsNotExist(err) {
+		n.FS.negCache.markMissing(relPath)
+		return nil, syscall.ENOENT
+	} else if err != nil {
+		log.Printf("ERROR: Failed to look up %s on NFS: %v", relPath, err)
+		return nil, syscall.EIO
+	}
+
+	n.FS.treeMu.Lock()
+	defer n.FS.treeMu.Unlock()
+	if child := n.child(name); child != nil {
+		return child, nil // Added while we were looking
+	}
+
+	child := newNodeFromEntry(n.FS, n, native_fs.FileInfoToDirEntry(fi))
+	if child.isDir {
+		if err := loadSubtree(n.FS, child); err != nil {
+			log.Printf("WARNING: Failed to load new directory '%s': %v", relPath, err)
+		}
+	}
+	n.addChild(child)
+	log.Printf("LOOKUP: Found '%s' on NFS", relPath)
+
+	return child, nil
+}
+
+func (n *fuseFSNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	relPath := n.relPath()
+	n.FS.requests.begin(relPath)
+	defer n.FS.requests.end(relPath)
+
+	data, err := n.readAt(ctx, req.Offset, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// readAt reads up to size bytes from offset, however the file is cached.
+func (n *fuseFSNode) readAt(ctx context.Context, offset int64, size int) ([]byte, error) {
+	if n.FS.chunkSize > 0 {
+		return n.readChunked(ctx, offset, size)
+	}
+
+	_, streaming := n.FS.ssdCache.(StreamingCache)
+	if _, dirty := n.dirtyData(); streaming && !dirty {
+		return n.readStream(ctx, offset, size)
+	}
+
+	data, err := n.data(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset >= int64(len(data)) {
+		return nil, nil // At or past EOF
+	}
+	return data[offset:min(offset+int64(size), int64(len(data)))], nil
+}
+
+// Open gives small files a handle that reads them whole, once per open, rather than going to the
+// cache for every Read, and other files a read-ahead handle when that is enabled. Anything else is
+// read through the node itself.
+func (n *fuseFSNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if n.FS.requests.isDraining() {
+		return nil, syscall.ESHUTDOWN
+	}
+	if n.isDir || !req.Flags.IsReadOnly() {
+		return n, nil // Writes go to the node itself
+	}
+
+	if n.FS.readAllThreshold > 0 && n.FS.chunkSize == 0 {
+		fi, err := n.stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().IsRegular() && fi.Size() <= n.FS.readAllThreshold {
+			return &readAllHandle{node: n}, nil
+		}
+	}
+
+	if n.FS.readAhead != nil {
+		return newReadAheadHandle(n), nil
+	}
+	return n, nil
+}
+
+// readAllHandle is an open small file. The FUSE server reads it whole on the first Read, and serves
+// the rest of the reads on the handle from that.
+type readAllHandle struct {
+	node *fuseFSNode
+}
+
+func (h *readAllHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	relPath := h.node.relPath()
+	h.node.FS.requests.begin(relPath)
+	defer h.node.FS.requests.end(relPath)
+
+	return h.node.data(ctx)
+}
+
+// readStream serves a read by seeking in the file, rather than loading all of it.
+func (n *fuseFSNode) readStream(ctx context.Context, offset int64, size int) ([]byte, error) {
+	r, err := n.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("ERROR: Failed to seek in %s: %v", n.relPath(), err)
+		return nil, syscall.EIO
+	}
+
+	buf := make([]byte, size)
+	read, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("ERROR: Failed to read %s: %v", n.relPath(), err)
+		return nil, syscall.EIO
+	}
+
+	return buf[:read], nil
+}
+
+func (n *fuseFSNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if !n.isSymlink() {
+		return "", syscall.EINVAL
+	}
+
+	target, err := os.Readlink(n.nfsPathAbs())
+	if err != nil {
+		log.Printf("ERROR: Failed to read link %s: %v", n.nfsPathAbs(), err)
+		return "", syscall.EIO
+	}
+	return target, nil
+}
+
+// Symlink creates a new symlink in this directory, on NFS. Only possible when the FS is writable.
+func (n *fuseFSNode) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if !n.FS.writable {
+		return nil, syscall.EROFS
+	} else if !n.isDir {
+		return nil, syscall.ENOTDIR
+	} else if n.synthetic() {
+		return nil, syscall.EPERM
+	}
+
+	linkPath := n.childNFSPath(req.NewName)
+	if err := os.Symlink(req.Target, linkPath); os.IsExist(err) {
+		return nil, syscall.EEXIST
+	} else if err != nil {
+		log.Printf("ERROR: Failed to create symlink %s in %s: %v", req.NewName, n.nfsPathAbs(), err)
+		return nil, syscall.EIO
+	}
+
+	linkNode := NewFuseFSNode(
+		n.FS,
+		req.NewName,
+		n.relPath(),
+		linkPath,
+		n.FS.inodeFor(linkPath, n.Inode, req.NewName),
+		os.ModeSymlink|os.ModePerm,
+		false,
+	)
+	n.addChild(linkNode)
+	n.unsynced.Store(true)
+	n.FS.negCache.forget(linkNode.relPath())
+
+	return linkNode, nil
+}
+
+// Rename moves the named child to newDir as req.NewName, on NFS and in the tree. Anything already
+// at the new name is replaced, as rename(2) does. Whatever was cached under the old path is dropped,
+// and is cached again under the new one when it is next read.
+func (n *fuseFSNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if !n.FS.writable {
+		return syscall.EROFS
+	}
+	newParent, ok := newDir.(*fuseFSNode)
+	if !ok || !newParent.isDir {
+		return syscall.ENOTDIR
+	}
+	if n == newParent && req.OldName == req.NewName {
+		return nil
+	} else if n.synthetic() || newParent.synthetic() {
+		// The sources of a merged tree can't be renamed, and nothing else can be in its root.
+		return syscall.EPERM
+	}
+
+	n.FS.treeMu.Lock()
+	defer n.FS.treeMu.Unlock()
+
+	node := n.child(req.OldName)
+	if node == nil {
+		return syscall.ENOENT
+	}
+
+	oldPath := node.relPath()
+	newPath := filepath.Join(newParent.relPath(), req.NewName)
+	if wb := n.FS.writeBack; wb != nil {
+		// Writes not yet written back would otherwise go to the old path, or over what's moved to
+		// the new one.
+		if err := wb.flush(oldPath); err != nil {
+			return syscall.EIO
+		}
+		wb.discard(newPath)
+	}
+	if err := os.Rename(node.nfsPathAbs(), newParent.childNFSPath(req.NewName)); err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return errno // eg. ENOTEMPTY, EISDIR
+		}
+		log.Printf("ERROR: Failed to rename %s to %s: %v", oldPath, newPath, err)
+		return syscall.EIO
+	}
+
+	// The kernel updates its own entries for a rename, so these are only forgotten here.
+	if replaced := newParent.removeChild(req.NewName); replaced != nil {
+		n.FS.forgetNode(replaced)
+	}
+	n.removeChild(req.OldName)
+	n.FS.forgetNode(node)
+
+	node.move(newParent, req.NewName)
+	newParent.addChild(node)
+	n.unsynced.Store(true)
+	newParent.unsynced.Store(true)
+
+	n.FS.negCache.forget(newPath)
+	n.FS.attrCache.forget(n.relPath()) // Both directories' mtimes changed
+	n.FS.attrCache.forget(newParent.relPath())
+	log.Printf("RENAME: Moved '%s' to '%s'", oldPath, newPath)
+
+	return nil
+}
+
+// Helper function to print the tree (for verification)
+func printTree(w io.Writer, n *fuseFSNode, indent string) {
+	children := n.children()
+
+	var contentInfo, nodeType string
+	if n.isDir {
+		nodeType = "Dir"
+		contentInfo = fmt.Sprintf("%d children", len(children))
+	} else if n.isSymlink() {
+		nodeType = "Link"
+		if target, err := os.Readlink(n.nfsPathAbs()); err != nil {
+			contentInfo = fmt.Sprintf("'%v'", err)
+		} else {
+			contentInfo = target
+		}
+	} else {
+		nodeType = "File"
+		if fi, err := n.stat(); err != nil {
+			contentInfo = fmt.Sprintf("'%v'", err)
+		} else {
+			contentInfo = fmt.Sprintf("%d bytes", fi.Size())
+		}
+	}
+	fmt.Fprintf(w, "%s%s[%d] (%s: %s) -> %s\n", indent, n.name(), n.Inode, nodeType, contentInfo, n.relPath())
+
+	for _, child := range children {
+		printTree(w, child, indent+"  ")
+	}
+}
@@ -0,0 +1,217 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestLookupOnlyMatchesDirectChildren(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "project-1/common-lib.py", []byte("one"))
+	writeTestFile(t, nfsDir, "project-2/common-lib.py", []byte("two"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	for _, tc := range []struct{ path, want string }{
+		{"project-1/common-lib.py", "one"},
+		{"project-2/common-lib.py", "two"},
+	} {
+		got, err := lookup(t, rfs, tc.path).data(context.Background())
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s = %q, %v, want %q", tc.path, got, err, tc.want)
+		}
+	}
+
+	if _, err := rfs.rootNode.Lookup(context.Background(), "common-lib.py"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("root lookup of a file in a subdirectory = %v, want ENOENT", err)
+	}
+}
+
+func TestLookupFindsFileAddedOnNFS(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "project-1/a.py", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	writeTestFile(t, nfsDir, "project-1/b.py", []byte("b"))
+	if got, err := lookup(t, rfs, "project-1/b.py").data(context.Background()); err != nil || string(got) != "b" {
+		t.Errorf("new file = %q, %v", got, err)
+	}
+}
+
+func TestOpenReadsSmallFilesWhole(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "small.txt", []byte("small"))
+	writeTestFile(t, nfsDir, "big.txt", []byte("bigger than the threshold"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, ReadAllThreshold: 10})
+
+	open := func(relPath string) any {
+		t.Helper()
+		h, err := lookup(t, rfs, relPath).Open(context.Background(), &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("Open %s: %v", relPath, err)
+		}
+		return h
+	}
+
+	h, ok := open("small.txt").(*readAllHandle)
+	if !ok {
+		t.Fatalf("small file opened as %T, want a *readAllHandle", h)
+	}
+	if got, err := h.ReadAll(context.Background()); err != nil || string(got) != "small" {
+		t.Errorf("ReadAll = %q, %v, want %q", got, err, "small")
+	}
+	if h, ok := open("big.txt").(*fuseFSNode); !ok {
+		t.Errorf("big file opened as %T, want the node", h)
+	}
+}
+
+func TestRenameMovesFileAndDropsCachedCopy(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	writeTestFile(t, nfsDir, "dir/b.txt", []byte("old b"))
+	cache := NewDefaultCache(ssdDir)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache, Writable: true})
+	ctx := context.Background()
+
+	for _, relPath := range []string{"a.txt", "dir/b.txt"} {
+		if _, err := lookup(t, rfs, relPath).data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := lookup(t, rfs, "dir")
+	if err := rfs.rootNode.Rename(ctx, &fuse.RenameRequest{OldName: "a.txt", NewName: "b.txt"}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Has("a.txt") {
+		t.Error("a.txt is still cached under its old path")
+	}
+	if _, err := rfs.rootNode.Lookup(ctx, "a.txt"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Lookup of the old name = %v, want ENOENT", err)
+	}
+	// The file that was at the new name has been replaced.
+	if got, err := lookup(t, rfs, "dir/b.txt").data(context.Background()); err != nil || string(got) != "a" {
+		t.Errorf("data at the new path = %q, %v, want %q", got, err, "a")
+	}
+	if got, err := os.ReadFile(filepath.Join(nfsDir, "dir/b.txt")); err != nil || string(got) != "a" {
+		t.Errorf("NFS file at the new path = %q, %v, want %q", got, err, "a")
+	}
+
+	// Read-only mounts refuse.
+	ro := newTestFS(t, Config{NFSDir: nfsDir})
+	if err := ro.rootNode.Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "dir2"}, ro.rootNode); err != syscall.EROFS {
+		t.Errorf("Rename on a read-only mount = %v, want %v", err, syscall.EROFS)
+	}
+}
+
+func TestNFSModeChangeReachesCachedCopy(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "run.sh", []byte("#!/bin/sh"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir})
+	n := lookup(t, rfs, "run.sh")
+
+	for _, mode := range []os.FileMode{0o644, 0o755, 0o644} {
+		if err := os.Chmod(filepath.Join(nfsDir, "run.sh"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var attr fuse.Attr
+		if err := n.Attr(context.Background(), &attr); err != nil {
+			t.Fatal(err)
+		}
+		if attr.Mode.Perm() != mode {
+			t.Errorf("Attr mode = %v, want %v", attr.Mode.Perm(), mode)
+		}
+		fi, err := os.Stat(filepath.Join(ssdDir, "run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("SSD file mode = %v, want %v", fi.Mode().Perm(), mode)
+		}
+	}
+	// The cached copy was updated in place, rather than fetched again.
+	if got := rfs.Stats()["cache_hits"]; got != 2 {
+		t.Errorf("cache_hits = %d, want 2", got)
+	}
+}
+
+func TestVersionedKeysServeChangedFiles(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "model.bin", []byte("v1"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, VersionedKeys: true})
+	n := lookup(t, rfs, "model.bin")
+	cachedAs := func() string {
+		fi, err := os.Stat(filepath.Join(nfsDir, "model.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cacheFileName(ssdDir, flattenDirPath(versionedKey("model.bin", fi.ModTime(), fi.Size())))
+	}
+
+	if got, err := n.data(context.Background()); err != nil || string(got) != "v1" {
+		t.Fatalf("data = %q, %v", got, err)
+	}
+	old := cachedAs()
+	if _, err := os.Stat(old); err != nil {
+		t.Fatalf("first version not cached: %v", err)
+	}
+
+	writeTestFile(t, nfsDir, "model.bin", []byte("v2, longer"))
+	if got, err := n.data(context.Background()); err != nil || string(got) != "v2, longer" {
+		t.Errorf("data after the NFS file changed = %q, %v", got, err)
+	}
+	if _, err := os.Stat(cachedAs()); err != nil {
+		t.Errorf("second version not cached: %v", err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("stale version still on SSD: %v", err)
+	}
+}
+
+func TestCachedCopyOfWrongSizeIsReadAgain(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("old"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+	n := lookup(t, rfs, "a.txt")
+	if _, err := n.data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed on NFS behind the mount's back, so only the size gives it away.
+	writeTestFile(t, nfsDir, "a.txt", []byte("newer"))
+	if got, err := n.data(context.Background()); err != nil || string(got) != "newer" {
+		t.Errorf("data after NFS changed = %q, %v, want %q", got, err, "newer")
+	}
+	if got, err := rfs.ssdCache.Get("a.txt"); err != nil || string(got) != "newer" {
+		t.Errorf("cached copy = %q, %v, want %q", got, err, "newer")
+	}
+}
+
+func TestRenameAcrossMergedSources(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeTestFile(t, a, "dir/f.txt", []byte("from a"))
+	writeTestFile(t, b, "other.txt", []byte("b"))
+	rfs := newTestFS(t, Config{NFSSources: NFSSources{"a": a, "b": b}, Writable: true})
+
+	if err := lookup(t, rfs, "a").Rename(context.Background(), &fuse.RenameRequest{OldName: "dir", NewName: "moved"}, lookup(t, rfs, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory and everything under it are now backed by the other source.
+	n := lookup(t, rfs, "b/moved/f.txt")
+	if want := filepath.Join(b, "moved/f.txt"); n.nfsPathAbs() != want {
+		t.Errorf("NFS path = %q, want %q", n.nfsPathAbs(), want)
+	}
+	if got, err := n.data(context.Background()); err != nil || string(got) != "from a" {
+		t.Errorf("data = %q, %v, want %q", got, err, "from a")
+	}
+}
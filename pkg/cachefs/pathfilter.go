@@ -0,0 +1,134 @@
+package cachefs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// regexpPrefix marks a path pattern as an RE2 regular expression, rather than a glob.
+const regexpPrefix = "re:"
+
+// PathPatterns are patterns of relative paths, each a glob (as for path.Match, so * doesn't match
+// /) or, prefixed with "re:", an RE2 regular expression. A glob matches a path if it matches the
+// path or any directory above it, so "*/checkpoints/*" matches everything in a project's
+// checkpoints directory, however deep. A regular expression matches anywhere in the path unless
+// it's anchored, so "re:(^|/)checkpoints/" matches checkpoints directories at any depth.
+type PathPatterns []pathPattern
+
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp // Set instead of glob, for regular expressions
+}
+
+// Set compiles and adds a pattern, so a flag can be given once per pattern (see flag.Value).
+func (p *PathPatterns) Set(s string) error {
+	if expr, ok := strings.CutPrefix(s, regexpPrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s, err)
+		}
+		*p = append(*p, pathPattern{re: re})
+		return nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", s, err)
+	}
+	*p = append(*p, pathPattern{glob: s})
+	return nil
+}
+
+func (p *PathPatterns) String() string {
+	var patterns []string
+	for _, pattern := range *p {
+		if pattern.re != nil {
+			patterns = append(patterns, regexpPrefix+pattern.re.String())
+		} else {
+			patterns = append(patterns, pattern.glob)
+		}
+	}
+	return strings.Join(patterns, ",")
+}
+
+// match reports whether the (relative, unflattened) path matches any of the patterns.
+func (p PathPatterns) match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range p {
+		if pattern.re != nil {
+			if pattern.re.MatchString(relPath) {
+				return true
+			}
+			continue
+		}
+		for dir := relPath; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern.glob, dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewPathFilterCache never caches files whose paths match the excluded patterns: Put returns
+// ErrWontCache for them, and prefetching and warming skip them. Everything else (eg. Get of a file
+// cached before the filter) goes to the wrapped cache as usual.
+func NewPathFilterCache(inner Cache, exclude PathPatterns) Cache {
+	return &pathFilterCache{
+		Cache:   inner,
+		exclude: exclude,
+	}
+}
+
+type pathFilterCache struct {
+	Cache
+	exclude PathPatterns
+
+	filtered atomic.Int64
+}
+
+func (f *pathFilterCache) Unwrap() Cache {
+	return f.Cache
+}
+
+func (f *pathFilterCache) Put(path string, data []byte, mode os.FileMode) error {
+	if !f.allowed(path) {
+		f.filtered.Add(1)
+		return ErrWontCache
+	}
+	return f.Cache.Put(path, data, mode)
+}
+
+func (f *pathFilterCache) allowed(key string) bool {
+	return !f.exclude.match(keyPath(key))
+}
+
+func (f *pathFilterCache) Stats() Stats {
+	stats := statsOf(f.Cache)
+	stats["path_filtered"] = f.filtered.Load()
+	return stats
+}
+
+// cacheFilter is implemented by caches that never cache some files, so callers can skip reading
+// them for the cache (eg. prefetching).
+type cacheFilter interface {
+	allowed(key string) bool
+}
+
+// cacheable reports whether every filter c has would let the file at key be cached.
+func cacheable(c Cache, key string) bool {
+	for c != nil {
+		if f, ok := c.(cacheFilter); ok && !f.allowed(key) {
+			return false
+		}
+		u, ok := c.(unwrapper)
+		if !ok {
+			break
+		}
+		c = u.Unwrap()
+	}
+	return true
+}
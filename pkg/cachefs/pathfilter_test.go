@@ -0,0 +1,70 @@
+package cachefs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathPatternsRejectInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"[", "proj-a/[a-", "re:(", "re:a**"} {
+		var patterns PathPatterns
+		if err := patterns.Set(pattern); err == nil {
+			t.Errorf("Set(%q) succeeded", pattern)
+		}
+		if len(patterns) != 0 {
+			t.Errorf("Set(%q) added the pattern", pattern)
+		}
+	}
+}
+
+func TestPathFilterCache(t *testing.T) {
+	var exclude PathPatterns
+	for _, pattern := range []string{
+		"*/checkpoints/*",      // A checkpoints directory at the top of any project
+		"proj-a/*.log",         // Logs at the top of one project
+		`re:\.tmp$`,            // Anywhere
+		"re:(^|/)__pycache__/", // A directory at any depth
+	} {
+		if err := exclude.Set(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := exclude.String(), `*/checkpoints/*,proj-a/*.log,re:\.tmp$,re:(^|/)__pycache__/`; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	inner := NewMemCache(1 << 20)
+	cache := NewDoorkeeperCache(NewPathFilterCache(inner, exclude), time.Minute)
+
+	for relPath, want := range map[string]bool{
+		"proj-a/checkpoints/step-1.ckpt":     false,
+		"proj-b/checkpoints/run-1/step.ckpt": false,
+		"proj-a/sub/checkpoints/step.ckpt":   true, // Only anchored at the project
+		"checkpoints/step.ckpt":              true, // Not in a project
+		"proj-a/train.log":                   false,
+		"proj-a/logs/train.log":              true,
+		"proj-b/train.log":                   true,
+		"out.tmp":                            false,
+		"proj-a/deep/dir/out.tmp":            false,
+		"proj-a/tmp.py":                      true,
+		"proj-a/__pycache__/x.pyc":           false,
+		"proj-a/lib/__pycache__/x.pyc":       false,
+		"proj-a/my__pycache__/x.pyc":         true,
+	} {
+		if got := cacheable(cache, relPath); got != want {
+			t.Errorf("cacheable(%s) = %v, want %v", relPath, got, want)
+		}
+		expectPut(cache, relPath)
+		err := cache.Put(relPath, []byte("x"), 0o644)
+		if want && err != nil {
+			t.Errorf("Put %s = %v", relPath, err)
+		} else if !want && err != ErrWontCache {
+			t.Errorf("Put %s = %v, want %v", relPath, err, ErrWontCache)
+		}
+		if inner.Has(relPath) != want {
+			t.Errorf("%s cached = %v, want %v", relPath, inner.Has(relPath), want)
+		}
+	}
+	if got := statsOf(cache)["path_filtered"]; got != 7 {
+		t.Errorf("path_filtered = %d, want 7", got)
+	}
+}
@@ -0,0 +1,45 @@
+package cachefs
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Pins are glob patterns (as for path.Match, so * doesn't match /) of paths a cache must never
+// evict, eg. "*/common-lib.py". Pinned files still count towards the cache's limits.
+type Pins []string
+
+// Pinner is implemented by caches that can keep pinned files from being evicted. SetPins must be
+// called before the cache is used.
+type Pinner interface {
+	SetPins(pins Pins)
+}
+
+// ParsePins parses comma separated glob patterns.
+func ParsePins(s string) (Pins, error) {
+	var pins Pins
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pin %q: %w", pattern, err)
+		}
+		pins = append(pins, pattern)
+	}
+	return pins, nil
+}
+
+// match reports whether the (relative, unflattened) path is pinned.
+func (p Pins) match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package cachefs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPinnedFileSurvivesEviction(t *testing.T) {
+	cache := must(NewHybridCache(t.TempDir(), 3, 0, false))
+	cache.(Pinner).SetPins(Pins{"*/common-lib.py"})
+
+	if err := cache.Put("project-1/common-lib.py", []byte("lib"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Enough to evict everything else several times over.
+	for i := range 10 {
+		if err := cache.Put(fmt.Sprintf("project-1/data-%d", i), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !cache.Has("project-1/common-lib.py") {
+		t.Error("pinned file was evicted")
+	}
+	for i := range 10 {
+		path := fmt.Sprintf("project-1/data-%d", i)
+		if want := i >= 8; cache.Has(path) != want {
+			t.Errorf("%s cached = %v, want %v", path, !want, want)
+		}
+	}
+	if stats := statsOf(cache); stats["lru_pinned_entries"] != 1 || stats["lru_pinned_bytes"] != 3 {
+		t.Errorf("%d pinned entries of %d bytes, want 1 of 3", stats["lru_pinned_entries"], stats["lru_pinned_bytes"])
+	}
+}
+
+func TestPinnedFileOverBudgetFails(t *testing.T) {
+	cache := must(NewByteLRUCache(t.TempDir(), 10, false))
+	cache.(Pinner).SetPins(Pins{"*/common-lib.py"})
+
+	if err := cache.Put("project-1/common-lib.py", make([]byte, 11), 0o644); err != ErrWontCache {
+		t.Errorf("Put of a pinned file bigger than the cache = %v, want %v", err, ErrWontCache)
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	pins, err := ParsePins("*/common-lib.py, project-1/*.so,")
+	if err != nil || len(pins) != 2 {
+		t.Fatalf("ParsePins = %q, %v", pins, err)
+	}
+	for path, want := range map[string]bool{
+		"project-2/common-lib.py":     true,
+		"project-2/sub/common-lib.py": false, // * doesn't match /
+		"project-1/libfoo.so":         true,
+		"project-2/libfoo.so":         false,
+	} {
+		if got := pins.match(path); got != want {
+			t.Errorf("match(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	if _, err := ParsePins("[a-"); err == nil {
+		t.Error("ParsePins accepted an invalid pattern")
+	}
+}
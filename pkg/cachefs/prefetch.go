@@ -0,0 +1,138 @@
+package cachefs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// prefetcher loads the rest of a directory into the cache in the background when one of its files
+// misses, since the siblings are usually read soon after.
+type prefetcher struct {
+	sem    chan struct{} // Bounds the number of concurrent fetches
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	inflight   map[string]bool // Being fetched right now
+	prefetched map[string]bool // Cached by the prefetcher and not read since
+
+	issued, hits atomic.Int64
+}
+
+func newPrefetcher(concurrency int) *prefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &prefetcher{
+		sem:        make(chan struct{}, concurrency),
+		ctx:        ctx,
+		cancel:     cancel,
+		inflight:   make(map[string]bool),
+		prefetched: make(map[string]bool),
+	}
+}
+
+// siblings starts fetching the other files in n's directory. It doesn't wait for them.
+func (p *prefetcher) siblings(n *fuseFSNode) {
+	parent := n.FS.nodeAt(n.parentPath())
+	if parent == nil {
+		return
+	}
+
+	var files []*fuseFSNode
+	for _, sibling := range parent.children() {
+		if sibling == n || sibling.isDir || sibling.isSymlink() {
+			continue
+		}
+		files = append(files, sibling)
+	}
+
+	go func() {
+		// Once the cache refuses a file (eg. it's full) the rest most likely won't fit either, so
+		// stop reading them from NFS.
+		var refused atomic.Bool
+		for _, f := range files {
+			select {
+			case p.sem <- struct{}{}:
+			case <-p.ctx.Done():
+				return
+			}
+			if refused.Load() {
+				<-p.sem
+				return
+			}
+			go func() {
+				defer func() { <-p.sem }()
+				if p.fetch(f) {
+					refused.Store(true)
+				}
+			}()
+		}
+	}()
+}
+
+// fetch loads the file into the cache, unless it's there already. It reports whether the cache
+// refused the file.
+func (p *prefetcher) fetch(n *fuseFSNode) bool {
+	relPath := n.relPath()
+
+	p.mu.Lock()
+	if p.inflight[relPath] || p.prefetched[relPath] {
+		p.mu.Unlock()
+		return false
+	}
+	p.inflight[relPath] = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, relPath)
+		p.mu.Unlock()
+	}()
+
+	if p.ctx.Err() != nil || !cacheable(n.FS.ssdCache, relPath) {
+		return false
+	}
+	fi, err := n.stat()
+	if err != nil {
+		return false
+	}
+	if n.FS.ssdCache.Has(n.cacheKey(fi)) {
+		return false // Already cached
+	}
+
+	p.issued.Add(1)
+	res, err := n.fetch(p.ctx)
+	if err != nil {
+		return false
+	}
+	if res.cached {
+		p.mu.Lock()
+		p.prefetched[relPath] = true
+		p.mu.Unlock()
+	}
+	return res.refused
+}
+
+// hit records a cache hit, counting it if the file was put there by the prefetcher.
+func (p *prefetcher) hit(relPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.prefetched[relPath] {
+		delete(p.prefetched, relPath)
+		p.hits.Add(1)
+	}
+}
+
+// forget drops the file from the prefetched set, eg. because the cache evicted it before it was
+// read.
+func (p *prefetcher) forget(relPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.prefetched, relPath)
+}
+
+// stop abandons any prefetching that hasn't started yet.
+func (p *prefetcher) stop() {
+	p.cancel()
+}
@@ -0,0 +1,45 @@
+package cachefs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPrefetchStopsOnceCacheRefuses(t *testing.T) {
+	nfsDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		writeTestFile(t, nfsDir, "dir/"+name, []byte("0123456789"))
+	}
+	// Room for the file read and one sibling, each taking a whole block.
+	cache := NewSizeLimitedCache(t.TempDir(), 2*diskBlockSize+diskBlockSize/2)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache, PrefetchConcurrency: 1})
+	opens := countNFSOpens(rfs)
+
+	if _, err := lookup(t, rfs, "dir/a").data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a, the sibling that fits, and the one that's refused.
+	deadline := time.Now().Add(10 * time.Second)
+	for opens.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		rfs.prefetch.mu.Lock()
+		inflight := len(rfs.prefetch.inflight)
+		rfs.prefetch.mu.Unlock()
+		if inflight == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got := opens.Load(); got != 3 {
+		t.Errorf("%d files read from NFS, want 3", got)
+	}
+	if got := rfs.Stats()["prefetch_issued"]; got != 2 {
+		t.Errorf("prefetch_issued = %d, want 2", got)
+	}
+}
@@ -0,0 +1,110 @@
+package cachefs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultQuota is the Quotas entry for projects without one of their own.
+const defaultQuota = "default"
+
+// Quotas limits the bytes each project may take up in a cache. A project is the top-level directory
+// of a path. Projects without an entry fall under the "default" entry, or are only limited by the
+// cache itself if there is none.
+type Quotas map[string]int64
+
+// QuotaEnforcer is implemented by caches that can enforce per-project quotas. SetQuotas must be
+// called before the cache is used.
+type QuotaEnforcer interface {
+	SetQuotas(quotas Quotas)
+}
+
+// ParseQuotas parses comma separated project=size pairs, eg. "project-2=10GB,default=50GB".
+func ParseQuotas(s string) (Quotas, error) {
+	quotas := make(Quotas)
+	for _, pair := range strings.Split(s, ",") {
+		project, size, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || project == "" {
+			return nil, fmt.Errorf("invalid quota %q, must be project=size", pair)
+		}
+		if _, dup := quotas[project]; dup {
+			return nil, fmt.Errorf("quota for %q given twice", project)
+		}
+
+		var limit ByteSize
+		if err := limit.Set(size); err != nil {
+			return nil, fmt.Errorf("quota for %q: %w", project, err)
+		} else if limit <= 0 {
+			return nil, fmt.Errorf("quota for %q must be more than 0", project)
+		}
+		quotas[project] = int64(limit)
+	}
+	return quotas, nil
+}
+
+// limitFor returns the project's quota, and whether it has one.
+func (q Quotas) limitFor(project string) (int64, bool) {
+	if limit, ok := q[project]; ok {
+		return limit, true
+	}
+	limit, ok := q[defaultQuota]
+	return limit, ok
+}
+
+// projectOf returns the project a (relative, unflattened) path belongs to: its top-level directory.
+func projectOf(path string) string {
+	project, _, _ := strings.Cut(filepath.ToSlash(path), "/")
+	return project
+}
+
+// projectUsage counts the bytes each project takes up against its quota. It isn't safe for
+// concurrent use, the cache using it guards it with its own lock.
+type projectUsage struct {
+	quotas Quotas // nil when there are none
+	used   map[string]int64
+}
+
+func newProjectUsage() projectUsage {
+	return projectUsage{used: make(map[string]int64)}
+}
+
+func (u *projectUsage) add(project string, delta int64) {
+	u.used[project] += delta
+	if u.used[project] == 0 {
+		delete(u.used, project)
+	}
+}
+
+// remaining returns how many more bytes the project may take up, and whether it has a quota at all.
+func (u *projectUsage) remaining(project string) (int64, bool) {
+	limit, ok := u.quotas.limitFor(project)
+	if !ok {
+		return 0, false
+	}
+	return limit - u.used[project], true
+}
+
+// fits reports whether the project's usage can grow by delta bytes and stay within its quota.
+func (u *projectUsage) fits(project string, delta int64) bool {
+	remaining, ok := u.remaining(project)
+	return !ok || delta <= remaining
+}
+
+func (u *projectUsage) reset() {
+	clear(u.used)
+}
+
+// addStats adds the usage of every project, and the quotas, to stats. Nothing is added when there
+// are no quotas.
+func (u *projectUsage) addStats(stats Stats) {
+	if len(u.quotas) == 0 {
+		return
+	}
+	for project, used := range u.used {
+		stats["quota_used_"+project] = used
+	}
+	for project, limit := range u.quotas {
+		stats["quota_limit_"+project] = limit
+	}
+}
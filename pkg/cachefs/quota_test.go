@@ -0,0 +1,64 @@
+package cachefs
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+)
+
+func TestParseQuotas(t *testing.T) {
+	got, err := ParseQuotas("project-2=10KB, default=1MB")
+	if want := (Quotas{"project-2": 10_000, "default": 1_000_000}); err != nil || !maps.Equal(got, want) {
+		t.Errorf("ParseQuotas = %v, %v, want %v", got, err, want)
+	}
+	for _, s := range []string{"project-2", "=10KB", "a=1KB,a=2KB", "a=0", "a=lots"} {
+		if _, err := ParseQuotas(s); err == nil {
+			t.Errorf("ParseQuotas(%q) succeeded", s)
+		}
+	}
+}
+
+func TestQuotaChurnStaysInProject(t *testing.T) {
+	cache := must(NewByteLRUCache(t.TempDir(), 1000, false))
+	cache.(QuotaEnforcer).SetQuotas(Quotas{"project-2": 300})
+
+	for i := range 3 {
+		if err := cache.Put(fmt.Sprintf("project-1/lib-%d.py", i), make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// project-2 goes through many times its quota, evicting its own files.
+	for i := range 20 {
+		if err := cache.Put(fmt.Sprintf("project-2/shard-%d", i), make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 3 {
+		if path := fmt.Sprintf("project-1/lib-%d.py", i); !cache.Has(path) {
+			t.Errorf("%s was evicted", path)
+		}
+	}
+	if stats := statsOf(cache); stats["quota_used_project-1"] != 300 || stats["quota_used_project-2"] != 300 || stats["quota_limit_project-2"] != 300 {
+		t.Errorf("project-1 uses %d, project-2 uses %d of %d, want 300, 300 of 300",
+			stats["quota_used_project-1"], stats["quota_used_project-2"], stats["quota_limit_project-2"])
+	}
+}
+
+func TestSizeLimitedCacheRefusesOverQuota(t *testing.T) {
+	cache := NewSizeLimitedCache(t.TempDir(), 1<<20)
+	cache.(QuotaEnforcer).SetQuotas(Quotas{"project-2": 150})
+
+	if err := cache.Put("project-2/a", make([]byte, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("project-2/b", make([]byte, 100), 0o644); err != ErrWontCache {
+		t.Errorf("Put over the quota = %v, want %v", err, ErrWontCache)
+	}
+	if err := cache.Put("project-1/b", make([]byte, 100), 0o644); err != nil {
+		t.Errorf("Put to another project: %v", err)
+	}
+	if !cache.Has("project-2/a") {
+		t.Error("project-2/a was removed")
+	}
+}
@@ -0,0 +1,176 @@
+package cachefs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+)
+
+// readAhead holds the settings and memory budget shared by every read-ahead handle.
+type readAhead struct {
+	size int64 // Bytes read ahead of a sequential read
+
+	mu       sync.Mutex
+	limit    int64 // Most bytes read ahead across all handles at once
+	reserved int64
+
+	hits   atomic.Int64 // Reads served from a read-ahead buffer
+	denied atomic.Int64 // Read-aheads skipped because the budget was used up
+}
+
+func newReadAhead(size, limit int64) *readAhead {
+	return &readAhead{size: size, limit: limit}
+}
+
+// reserve takes size bytes of the budget, if they're available.
+func (ra *readAhead) reserve(size int64) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.reserved+size > ra.limit {
+		ra.denied.Add(1)
+		return false
+	}
+	ra.reserved += size
+	return true
+}
+
+func (ra *readAhead) release(size int64) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.reserved -= size
+}
+
+func (ra *readAhead) inUse() int64 {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.reserved
+}
+
+// readAheadBuf is a block of a file read in the background, ahead of where it is being read.
+type readAheadBuf struct {
+	offset int64
+	size   int64 // Bytes asked for. Fewer are read at EOF
+
+	done chan struct{} // Closed once data and err are set
+	data []byte
+	err  error
+}
+
+// covers reports whether the (finished) buffer can serve a read of size bytes from offset. Reads
+// past the end of the buffer are only covered if the buffer ends at EOF.
+func (b *readAheadBuf) covers(offset int64, size int) bool {
+	if b.err != nil || offset < b.offset {
+		return false
+	}
+	end := b.offset + int64(len(b.data))
+	return offset+int64(size) <= end || (int64(len(b.data)) < b.size && offset <= end)
+}
+
+// readAheadHandle is an open file that, while it is read sequentially, reads the next block in the
+// background so the following Read is served from memory. A read anywhere other than where the last
+// one ended is taken as random access, and drops the block.
+type readAheadHandle struct {
+	node *fuseFSNode
+
+	mu         sync.Mutex
+	nextOffset int64         // Where the next read starts, if it is sequential
+	ahead      *readAheadBuf // nil when nothing has been read ahead
+}
+
+func newReadAheadHandle(n *fuseFSNode) *readAheadHandle {
+	return &readAheadHandle{node: n}
+}
+
+func (h *readAheadHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	relPath := h.node.relPath()
+	h.node.FS.requests.begin(relPath)
+	defer h.node.FS.requests.end(relPath)
+
+	h.mu.Lock()
+	sequential := req.Offset == h.nextOffset
+	if !sequential {
+		h.dropLocked()
+	}
+	ahead := h.ahead
+	h.mu.Unlock()
+
+	data, err := h.readBuffered(ctx, ahead, req.Offset, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+
+	end := req.Offset + int64(len(data))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextOffset = end
+	if sequential && len(data) == req.Size {
+		h.startLocked(end)
+	}
+	return nil
+}
+
+// readBuffered serves the read from the read-ahead buffer if it covers it, otherwise from the node.
+func (h *readAheadHandle) readBuffered(ctx context.Context, ahead *readAheadBuf, offset int64, size int) ([]byte, error) {
+	if ahead != nil && offset >= ahead.offset && offset < ahead.offset+ahead.size {
+		select {
+		case <-ahead.done:
+		case <-ctx.Done():
+			return nil, fuse.EINTR
+		}
+		if ahead.covers(offset, size) {
+			h.node.FS.readAhead.hits.Add(1)
+			from := min(offset-ahead.offset, int64(len(ahead.data)))
+			to := min(from+int64(size), int64(len(ahead.data)))
+			return ahead.data[from:to], nil
+		}
+	}
+	return h.node.readAt(ctx, offset, size)
+}
+
+// startLocked reads ahead from offset, unless the current buffer still has data past it, or the
+// budget is used up.
+func (h *readAheadHandle) startLocked(offset int64) {
+	if h.ahead != nil && offset < h.ahead.offset+h.ahead.size {
+		return
+	}
+	h.dropLocked()
+
+	ra := h.node.FS.readAhead
+	if !ra.reserve(ra.size) {
+		return
+	}
+
+	b := &readAheadBuf{offset: offset, size: ra.size, done: make(chan struct{})}
+	h.ahead = b
+	// Nobody is waiting for it yet, so it isn't tied to any request's context.
+	go func() {
+		defer close(b.done)
+		b.data, b.err = h.node.readAt(context.Background(), b.offset, int(b.size))
+	}()
+}
+
+// dropLocked forgets the read-ahead buffer. Its memory is returned to the budget once any read
+// still filling it has finished.
+func (h *readAheadHandle) dropLocked() {
+	b := h.ahead
+	if b == nil {
+		return
+	}
+	h.ahead = nil
+
+	ra := h.node.FS.readAhead
+	go func() {
+		<-b.done
+		ra.release(b.size)
+	}()
+}
+
+func (h *readAheadHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropLocked()
+	return nil
+}
@@ -0,0 +1,71 @@
+package cachefs
+
+import (
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// readHandle reads size bytes from offset through the handle.
+func readHandle(t *testing.T, h *readAheadHandle, offset int64, size int) string {
+	t.Helper()
+	var resp fuse.ReadResponse
+	if err := h.Read(context.Background(), &fuse.ReadRequest{Offset: offset, Size: size}, &resp); err != nil {
+		t.Fatalf("Read at %d: %v", offset, err)
+	}
+	return string(resp.Data)
+}
+
+func TestReadAheadServesSequentialReads(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789abcdef"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, ReadAheadBytes: 8, ReadAheadLimit: 1 << 20})
+	h := newReadAheadHandle(lookup(t, rfs, "data.bin"))
+
+	// The first read starts a read-ahead of 4-12, which serves the next two.
+	for _, read := range []struct {
+		offset int64
+		want   string
+	}{{0, "0123"}, {4, "4567"}, {8, "89ab"}} {
+		if got := readHandle(t, h, read.offset, 4); got != read.want {
+			t.Errorf("Read at %d = %q, want %q", read.offset, got, read.want)
+		}
+	}
+	if got := rfs.Stats()["readahead_hits"]; got != 2 {
+		t.Errorf("readahead_hits = %d, want 2", got)
+	}
+
+	// A random read drops the buffer, and doesn't start another.
+	if got := readHandle(t, h, 1, 4); got != "1234" {
+		t.Errorf("random Read = %q, want %q", got, "1234")
+	}
+	h.mu.Lock()
+	ahead := h.ahead
+	h.mu.Unlock()
+	if ahead != nil {
+		t.Errorf("random read left a read-ahead buffer at %d", ahead.offset)
+	}
+
+	if err := h.Release(context.Background(), &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAheadBudget(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "data.bin", []byte("0123456789abcdef"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, ReadAheadBytes: 8, ReadAheadLimit: 8})
+	n := lookup(t, rfs, "data.bin")
+
+	// The first handle takes the whole budget, so the second can't read ahead.
+	first, second := newReadAheadHandle(n), newReadAheadHandle(n)
+	readHandle(t, first, 0, 4)
+	readHandle(t, second, 0, 4)
+	if got := rfs.Stats()["readahead_denied"]; got != 1 {
+		t.Errorf("readahead_denied = %d, want 1", got)
+	}
+	if got := readHandle(t, second, 4, 4); got != "4567" {
+		t.Errorf("Read without read-ahead = %q, want %q", got, "4567")
+	}
+}
@@ -0,0 +1,200 @@
+package cachefs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisConfig is where a cache keeps an index shared with other processes (see NewRedisCache).
+type RedisConfig struct {
+	Addr     string // host:port
+	Password string // Empty for none
+	DB       int
+	Prefix   string        // Of every key, so several indexes can share a server
+	Timeout  time.Duration // For connecting and each command, 0 for a second
+}
+
+// redisClient is a minimal Redis client: one connection, one command at a time, which is all the
+// index needs. The connection is made on first use, and again after any error reading or writing
+// it.
+type redisClient struct {
+	cfg RedisConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// redisError is an error reply from the server (eg. a bad command), as opposed to not being able to
+// talk to it.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// errRedisArgument is returned for a command with an argument of a type the client can't send. It's
+// a bug in the caller, not the server being unreachable.
+var errRedisArgument = errors.New("redis: unsupported argument type")
+
+// isRedisUnreachable reports whether err means the server couldn't be reached, rather than it
+// refusing the command.
+func isRedisUnreachable(err error) bool {
+	var replyErr redisError
+	return err != nil && !errors.As(err, &replyErr) && !errors.Is(err, errRedisArgument)
+}
+
+func newRedisClient(cfg RedisConfig) *redisClient {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	return &redisClient{cfg: cfg}
+}
+
+// key returns the name of one of the index's keys, under the configured prefix.
+func (c *redisClient) key(name string) string {
+	return c.cfg.Prefix + ":" + name
+}
+
+// do sends a command and returns its reply: a string, int64, []any or nil. Error replies are
+// returned as a redisError.
+func (c *redisClient) do(args ...any) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if isRedisUnreachable(err) {
+		// The connection is in an unknown state, start again next time.
+		c.conn.Close()
+		c.conn, c.rw = nil, nil
+	}
+	return reply, err
+}
+
+// connect dials the server, and authenticates and selects the database if configured.
+// Must be called with mu held.
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.cfg.Addr, c.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	var setup [][]any
+	if c.cfg.Password != "" {
+		setup = append(setup, []any{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []any{"SELECT", c.cfg.DB})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn, c.rw = nil, nil
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command and reads its reply. An argument of a type it can't send fails the
+// command before anything is written, leaving the connection usable.
+// Must be called with mu held, and a connection.
+func (c *redisClient) roundTrip(args []any) (any, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			strs[i] = arg
+		case int:
+			strs[i] = strconv.Itoa(arg)
+		case int64:
+			strs[i] = strconv.FormatInt(arg, 10)
+		default:
+			return nil, fmt.Errorf("%w %T", errRedisArgument, arg)
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+
+	fmt.Fprintf(c.rw, "*%d\r\n", len(strs))
+	for _, s := range strs {
+		fmt.Fprintf(c.rw, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if err := c.rw.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rw.Reader)
+}
+
+// readRedisReply reads one reply in the Redis protocol (RESP2).
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err // nil for a null bulk string
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err // nil for a null array
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// redisInt converts an integer reply, returning 0 for anything else (eg. nil).
+func redisInt(reply any) int64 {
+	switch v := reply.(type) {
+	case int64:
+		return v
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+package cachefs
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOpts are the settings a cache is built from. Each cache uses the ones that apply to it.
+type CacheOpts struct {
+	SSDDir    string
+	Capacity  int           // Maximum number of files, for caches that count them (eg. lru)
+	ByteLimit int64         // Maximum total size of files, for caches that limit it (eg. size)
+	TTL       time.Duration // How long files stay cached, for caches that expire them (eg. ttl)
+	Quotas    Quotas        // Bytes per project, for caches that enforce them (see QuotaEnforcer)
+	Pins      Pins          // Files never to evict, for caches that evict (see Pinner)
+	Evict     string        // Which file to evict first, for caches that can choose (see EvictionPolicies). Defaults to lru
+	Protected float64       // Share of the limits for files read more than once, for caches with segments (eg. slru)
+	Sync      bool          // fsync every file written, for caches on disk (see SyncWriter)
+	Redis     RedisConfig   // Where to keep a shared index, for caches that use one (eg. redis)
+	Debug     bool
+}
+
+// CacheFactory builds a cache from its options, returning an error if they aren't valid for it.
+type CacheFactory func(opts CacheOpts) (Cache, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]CacheFactory)
+)
+
+// Register makes a cache available by name (eg. for --cache). Registering the same name twice
+// panics, as it's a programming error. Call it from an init function.
+func Register(name string, factory CacheFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("cache: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("cache: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// RegisteredCaches returns the names of the registered caches, sorted.
+func RegisteredCaches() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return slices.Sorted(maps.Keys(registry))
+}
+
+// NewCache builds the cache registered under name.
+func NewCache(name string, opts CacheOpts) (Cache, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown cache %q, must be one of: %s", name, strings.Join(RegisteredCaches(), ", "))
+	}
+
+	c, err := factory(opts)
+	if err != nil {
+		return nil, fmt.Errorf("cache %q: %w", name, err)
+	}
+
+	if len(opts.Quotas) > 0 {
+		enforcer, ok := c.(QuotaEnforcer)
+		if !ok {
+			return nil, fmt.Errorf("cache %q doesn't support quotas", name)
+		}
+		enforcer.SetQuotas(opts.Quotas)
+	}
+	if len(opts.Pins) > 0 {
+		pinner, ok := c.(Pinner)
+		if !ok {
+			return nil, fmt.Errorf("cache %q doesn't support pins", name)
+		}
+		pinner.SetPins(opts.Pins)
+	}
+	if opts.Sync {
+		writer, ok := c.(SyncWriter)
+		if !ok {
+			return nil, fmt.Errorf("cache %q doesn't write to disk, so can't sync", name)
+		}
+		writer.SetSyncWrites(true)
+	}
+	return c, nil
+}
+
+var (
+	errNoCapacity  = errors.New("capacity must be more than 0")
+	errNoByteLimit = errors.New("byte limit must be more than 0")
+	errNoTTL       = errors.New("ttl must be more than 0")
+	errNoRedis     = errors.New("redis address must be set")
+)
+
+func init() {
+	Register("default", func(opts CacheOpts) (Cache, error) {
+		return NewDefaultCache(opts.SSDDir), nil
+	})
+	Register("size", func(opts CacheOpts) (Cache, error) {
+		if opts.ByteLimit <= 0 {
+			return nil, errNoByteLimit
+		}
+		return NewSizeLimitedCache(opts.SSDDir, opts.ByteLimit), nil
+	})
+	// Limited by the number of files, their total size, or both if both are given.
+	Register("lru", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 && opts.ByteLimit <= 0 {
+			return nil, errNoCapacity
+		}
+		policy, err := evictionPolicyNamed(opts.Evict)
+		if err != nil {
+			return nil, err
+		}
+		return newLRUCache(opts.SSDDir, max(opts.Capacity, 0), max(opts.ByteLimit, 0), opts.Debug, policy)
+	})
+	Register("lfu", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 {
+			return nil, errNoCapacity
+		}
+		return NewLFUCache(opts.SSDDir, opts.Capacity)
+	})
+	Register("arc", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 {
+			return nil, errNoCapacity
+		}
+		return NewARCCache(opts.SSDDir, opts.Capacity)
+	})
+	// Like lru, limited by the number of files, their total size, or both.
+	Register("clock", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 && opts.ByteLimit <= 0 {
+			return nil, errNoCapacity
+		}
+		return NewClockCache(opts.SSDDir, max(opts.Capacity, 0), max(opts.ByteLimit, 0))
+	})
+	// Like lru, limited by the number of files, their total size, or both.
+	Register("slru", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 && opts.ByteLimit <= 0 {
+			return nil, errNoCapacity
+		} else if opts.Protected <= 0 || opts.Protected >= 1 {
+			return nil, fmt.Errorf("protected share of the slru cache must be between 0 and 1, not %g", opts.Protected)
+		}
+		return NewSLRUCache(opts.SSDDir, max(opts.Capacity, 0), max(opts.ByteLimit, 0), opts.Protected)
+	})
+	// Like lru, with its index shared with other processes through Redis.
+	Register("redis", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 && opts.ByteLimit <= 0 {
+			return nil, errNoCapacity
+		} else if opts.Redis.Addr == "" {
+			return nil, errNoRedis
+		}
+		return NewRedisCache(opts.SSDDir, max(opts.Capacity, 0), max(opts.ByteLimit, 0), opts.Redis)
+	})
+	Register("hybrid", func(opts CacheOpts) (Cache, error) {
+		if opts.Capacity <= 0 {
+			return nil, errNoCapacity
+		} else if opts.ByteLimit <= 0 {
+			return nil, errNoByteLimit
+		}
+		policy, err := evictionPolicyNamed(opts.Evict)
+		if err != nil {
+			return nil, err
+		}
+		return newLRUCache(opts.SSDDir, opts.Capacity, opts.ByteLimit, opts.Debug, policy)
+	})
+	Register("dedup", func(opts CacheOpts) (Cache, error) {
+		return NewDedupCache(opts.SSDDir), nil
+	})
+	Register("mem", func(opts CacheOpts) (Cache, error) {
+		if opts.ByteLimit <= 0 {
+			return nil, errNoByteLimit
+		}
+		return NewMemCache(opts.ByteLimit), nil
+	})
+	Register("ttl", func(opts CacheOpts) (Cache, error) {
+		if opts.TTL <= 0 {
+			return nil, errNoTTL
+		}
+		return NewTTLCache(opts.SSDDir, opts.TTL), nil
+	})
+}
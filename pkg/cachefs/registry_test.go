@@ -0,0 +1,100 @@
+package cachefs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerForTest registers a cache for the rest of the test.
+func registerForTest(t *testing.T, name string, factory CacheFactory) {
+	t.Helper()
+	Register(name, factory)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(registry, name)
+	})
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	factory := func(opts CacheOpts) (Cache, error) { return NewMemCache(1), nil }
+	registerForTest(t, "test-dup", factory)
+
+	for _, tc := range []struct {
+		name    string
+		factory CacheFactory
+	}{
+		{"test-dup", factory},
+		{"default", factory},
+		{"test-nil", nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) didn't panic", tc.name)
+				}
+			}()
+			Register(tc.name, tc.factory)
+		}()
+	}
+}
+
+func TestRegisteredCacheIsBuilt(t *testing.T) {
+	var got CacheOpts
+	registerForTest(t, "test-custom", func(opts CacheOpts) (Cache, error) {
+		got = opts
+		return NewMemCache(opts.ByteLimit), nil
+	})
+
+	if _, err := NewCache("test-custom", CacheOpts{SSDDir: "/ssd", ByteLimit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if got.SSDDir != "/ssd" || got.ByteLimit != 10 {
+		t.Errorf("factory got %+v", got)
+	}
+}
+
+func TestNewCacheUnknownListsRegistered(t *testing.T) {
+	_, err := NewCache("nope", CacheOpts{})
+	if err == nil {
+		t.Fatal("no error for an unknown cache")
+	}
+	for _, name := range RegisteredCaches() {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't list %s", err, name)
+		}
+	}
+}
+
+func TestNewCacheValidatesOptions(t *testing.T) {
+	for _, tc := range []struct {
+		cache   string
+		opts    CacheOpts
+		wantErr error // nil to only check there is one
+	}{
+		{"size", CacheOpts{}, errNoByteLimit},
+		{"lru", CacheOpts{}, errNoCapacity},
+		{"lfu", CacheOpts{ByteLimit: 10}, errNoCapacity},
+		{"hybrid", CacheOpts{Capacity: 10}, errNoByteLimit},
+		{"mem", CacheOpts{Capacity: 10}, errNoByteLimit},
+		{"ttl", CacheOpts{}, errNoTTL},
+		{"redis", CacheOpts{Capacity: 10}, errNoRedis},
+		{"slru", CacheOpts{Capacity: 10, Protected: 1}, nil},
+		{"lru", CacheOpts{Capacity: 10, Evict: "random"}, nil},
+		{"default", CacheOpts{Quotas: Quotas{"project-1": 10}}, nil},
+		{"mem", CacheOpts{ByteLimit: 10, Sync: true}, nil},
+		{"arc", CacheOpts{Capacity: 10, Pins: Pins{"a.txt"}}, nil},
+	} {
+		tc.opts.SSDDir = t.TempDir()
+		_, err := NewCache(tc.cache, tc.opts)
+		if err == nil || (tc.wantErr != nil && !errors.Is(err, tc.wantErr)) {
+			t.Errorf("NewCache(%q, %+v) = %v, want %v", tc.cache, tc.opts, err, tc.wantErr)
+		}
+	}
+
+	if _, err := NewCache("ttl", CacheOpts{SSDDir: t.TempDir(), TTL: time.Minute}); err != nil {
+		t.Errorf("valid options: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package cachefs
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// fileVersion is the size and modification time a file had on NFS when it was cached, and the key
+// and mode it was cached with.
+type fileVersion struct {
+	key     string
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// cachedVersions remembers the NFS version of every whole file this process has cached, so the
+// scrubber can tell when the cached copy is out of date, and the key it's cached under (see
+// versionedKey). Files cached before a restart aren't known, and aren't scrubbed.
+type cachedVersions struct {
+	mu       sync.Mutex
+	versions map[string]fileVersion
+}
+
+// record remembers the version of the file just cached under key, returning the one it replaces.
+func (cv *cachedVersions) record(relPath, key string, size int64, modTime time.Time, mode os.FileMode) (fileVersion, bool) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if cv.versions == nil {
+		cv.versions = make(map[string]fileVersion)
+	}
+	prev, ok := cv.versions[relPath]
+	cv.versions[relPath] = fileVersion{key: key, size: size, modTime: modTime, mode: mode}
+	return prev, ok
+}
+
+// setMode updates the mode of a file that is still cached, once its cached copy has been chmod'ed.
+func (cv *cachedVersions) setMode(relPath string, mode os.FileMode) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if v, ok := cv.versions[relPath]; ok {
+		v.mode = mode
+		cv.versions[relPath] = v
+	}
+}
+
+func (cv *cachedVersions) get(relPath string) (fileVersion, bool) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	v, ok := cv.versions[relPath]
+	return v, ok
+}
+
+func (cv *cachedVersions) forget(relPath string) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	delete(cv.versions, relPath)
+}
+
+// forgetKey forgets the file if it's cached under key, but not if it has been cached again under
+// another key since (eg. a newer version).
+func (cv *cachedVersions) forgetKey(relPath, key string) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if v, ok := cv.versions[relPath]; ok && v.key == key {
+		delete(cv.versions, relPath)
+	}
+}
+
+func (cv *cachedVersions) reset() {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	clear(cv.versions)
+}
+
+// paths returns the known paths, sorted.
+func (cv *cachedVersions) paths() []string {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	paths := make([]string, 0, len(cv.versions))
+	for relPath := range cv.versions {
+		paths = append(paths, relPath)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// scrubResult is the summary of a scrub pass.
+type scrubResult struct {
+	checked, invalidated, skipped, errors int
+}
+
+// Scrub reconciles the cache with NFS every interval until ctx is done. Each pass stats the NFS
+// file of everything cached, at most rate a second so NFS isn't hammered, and invalidates files
+// that have changed (size or modification time) or gone. Files being read are skipped, and checked
+// again on the next pass.
+func (rfs *FS) Scrub(ctx context.Context, interval time.Duration, rate int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		res := rfs.scrubPass(ctx, rate)
+		if ctx.Err() != nil {
+			return nil // Stopped part way through the pass
+		}
+		log.Printf("SCRUB: Checked %d cached files, %d invalidated, %d skipped (being read), %d errors", res.checked, res.invalidated, res.skipped, res.errors)
+	}
+}
+
+// scrubPass checks every cached file once, stopping early if ctx is done.
+func (rfs *FS) scrubPass(ctx context.Context, rate int) scrubResult {
+	limit := time.NewTicker(time.Second / time.Duration(max(rate, 1)))
+	defer limit.Stop()
+
+	var res scrubResult
+	for _, relPath := range rfs.versions.paths() {
+		select {
+		case <-ctx.Done():
+			return res
+		case <-limit.C:
+		}
+
+		if rfs.requests.isActive(relPath) {
+			res.skipped++
+			continue
+		}
+		cached, ok := rfs.versions.get(relPath)
+		if !ok {
+			continue // Evicted or invalidated since the pass started
+		}
+
+		res.checked++
+		fi, err := os.Lstat(rfs.nfsPath(relPath))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("WARNING: Failed to stat NFS path for '%s' while scrubbing: %v", relPath, err)
+			res.errors++
+			continue
+		}
+		if err == nil && fi.Size() == cached.size && fi.ModTime().Equal(cached.modTime) {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("SCRUB: '%s' is gone from NFS, invalidating", relPath)
+		} else {
+			log.Printf("SCRUB: '%s' changed on NFS, invalidating", relPath)
+		}
+		rfs.scrubInvalidate(relPath)
+		res.invalidated++
+	}
+	return res
+}
+
+// scrubInvalidate drops the cached copy of the file at relPath, and tells the kernel to forget its
+// data.
+func (rfs *FS) scrubInvalidate(relPath string) {
+	rfs.evict(relPath)
+
+	rfs.treeMu.Lock()
+	node := rfs.nodeAt(relPath)
+	rfs.treeMu.Unlock()
+	if node != nil && rfs.server != nil {
+		if err := rfs.server.InvalidateNodeData(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("WARNING: Failed to invalidate kernel data for '%s': %v", relPath, err)
+		}
+	}
+}
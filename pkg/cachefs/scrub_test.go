@@ -0,0 +1,77 @@
+package cachefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScrubInvalidatesChangedAndDeletedFiles(t *testing.T) {
+	nfsDir := t.TempDir()
+	for _, name := range []string{"same.txt", "changed.txt", "deleted.txt", "busy.txt"} {
+		writeTestFile(t, nfsDir, name, []byte("v1"))
+	}
+	cache := NewMemCache(1 << 20)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache})
+	for _, name := range []string{"same.txt", "changed.txt", "deleted.txt", "busy.txt"} {
+		if _, err := lookup(t, rfs, name).data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestFile(t, nfsDir, "changed.txt", []byte("version 2"))
+	if err := os.Remove(filepath.Join(nfsDir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, nfsDir, "busy.txt", []byte("version 2"))
+	rfs.requests.begin("busy.txt")
+
+	res := rfs.scrubPass(context.Background(), 1000)
+	if want := (scrubResult{checked: 3, invalidated: 2, skipped: 1}); res != want {
+		t.Errorf("scrub pass = %+v, want %+v", res, want)
+	}
+	for name, want := range map[string]bool{"same.txt": true, "changed.txt": false, "deleted.txt": false, "busy.txt": true} {
+		if got := cache.Has(name); got != want {
+			t.Errorf("%s cached = %v, want %v", name, got, want)
+		}
+	}
+
+	// Once it's no longer being read, the next pass catches it.
+	rfs.requests.end("busy.txt")
+	if res := rfs.scrubPass(context.Background(), 1000); res.invalidated != 1 || cache.Has("busy.txt") {
+		t.Errorf("second pass = %+v, busy.txt cached = %v", res, cache.Has("busy.txt"))
+	}
+}
+
+func TestScrubStops(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("v1"))
+	cache := NewMemCache(1 << 20)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Cache: cache})
+	if _, err := lookup(t, rfs, "a.txt").data(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- rfs.Scrub(ctx, 10*time.Millisecond, 1000) }()
+
+	writeTestFile(t, nfsDir, "a.txt", []byte("version 2"))
+	for deadline := time.Now().Add(5 * time.Second); cache.Has("a.txt"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("background scrub didn't invalidate the changed file")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Scrub = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scrub didn't stop")
+	}
+}
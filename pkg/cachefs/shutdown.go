@@ -0,0 +1,90 @@
+package cachefs
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// requestTracker counts the FUSE requests being handled, so shutdown can wait for them to finish
+// before unmounting. Reads on files that are already open keep arriving while draining, so this is
+// a counter rather than a sync.WaitGroup, which can't be added to from zero while being waited on.
+// The paths being read are counted too, so the scrubber can leave them alone.
+type requestTracker struct {
+	mu       sync.Mutex
+	active   int
+	paths    map[string]int
+	draining bool
+	idle     chan struct{} // Closed once nothing is active while draining
+}
+
+func (t *requestTracker) begin(relPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active++
+	if t.paths == nil {
+		t.paths = make(map[string]int)
+	}
+	t.paths[relPath]++
+}
+
+func (t *requestTracker) end(relPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	if t.paths[relPath]--; t.paths[relPath] == 0 {
+		delete(t.paths, relPath)
+	}
+	if t.draining && t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// isActive reports whether the file at relPath is being read.
+func (t *requestTracker) isActive(relPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paths[relPath] > 0
+}
+
+// isDraining reports whether shutdown has started, and new files shouldn't be opened.
+func (t *requestTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops new files being opened, and waits up to timeout for the active requests to finish.
+// It returns how many were still active when it gave up.
+func (t *requestTracker) drain(timeout time.Duration) int {
+	t.mu.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.mu.Unlock()
+		return 0
+	}
+	idle := make(chan struct{})
+	t.idle = idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Shutdown stops new files being opened, waits up to timeout for the requests being handled to
+// finish, and then unmounts. Requests still going after the timeout are abandoned.
+func (rfs *FS) Shutdown(timeout time.Duration) error {
+	log.Printf("Draining requests before unmounting (up to %s)", timeout)
+	if abandoned := rfs.requests.drain(timeout); abandoned > 0 {
+		log.Printf("WARNING: Shutdown timed out, abandoning %d requests", abandoned)
+	}
+	return rfs.Unmount()
+}
@@ -0,0 +1,25 @@
+package cachefs
+
+import (
+	native_fs "io/fs"
+	"syscall"
+	"time"
+)
+
+// nfsTimes returns the access and change times from NFS file info.
+func nfsTimes(fi native_fs.FileInfo) (atime, ctime time.Time) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime(), fi.ModTime()
+	}
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Ctim.Unix())
+}
+
+// diskUsage returns how much space the file takes up on disk, in whole blocks.
+func diskUsage(fi native_fs.FileInfo) int64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size()
+	}
+	return st.Blocks * 512
+}
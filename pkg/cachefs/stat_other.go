@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package cachefs
+
+import (
+	native_fs "io/fs"
+	"time"
+)
+
+// nfsTimes returns the access and change times from NFS file info. This platform doesn't expose
+// them, so the modification time is used for both.
+func nfsTimes(fi native_fs.FileInfo) (atime, ctime time.Time) {
+	return fi.ModTime(), fi.ModTime()
+}
+
+// diskUsage returns how much space the file takes up on disk. This platform doesn't expose it, so
+// the size is rounded up to whole blocks.
+func diskUsage(fi native_fs.FileInfo) int64 {
+	return roundToBlock(fi.Size())
+}
@@ -0,0 +1,36 @@
+package cachefs
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Stats is a snapshot of named counters.
+type Stats map[string]int64
+
+// StatsReporter is implemented by anything (eg. a cache) that keeps counters worth reporting.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// statsOf returns the stats of v if it reports any, or empty stats otherwise.
+func statsOf(v any) Stats {
+	if r, ok := v.(StatsReporter); ok {
+		return r.Stats()
+	}
+	return Stats{}
+}
+
+// String formats the stats as space separated key=value pairs, sorted by key.
+func (s Stats) String() string {
+	var b strings.Builder
+	for i, k := range slices.Sorted(maps.Keys(s)) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%d", k, s[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,21 @@
+package cachefs
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lazyUnmount detaches the mount even though it is busy, like fusermount -uz. It is cleaned up
+// once nothing is using it any more.
+func lazyUnmount(mountpoint string) error {
+	var errs []string
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		out, err := exec.Command(bin, "-u", "-z", mountpoint).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v: %s", bin, err, strings.TrimSpace(string(out))))
+	}
+	return fmt.Errorf("lazy unmount failed: %s", strings.Join(errs, "; "))
+}
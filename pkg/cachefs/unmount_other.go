@@ -0,0 +1,10 @@
+//go:build !linux
+
+package cachefs
+
+import "errors"
+
+// lazyUnmount isn't available here, a busy mount has to be unmounted by hand.
+func lazyUnmount(mountpoint string) error {
+	return errors.New("lazy unmount is only supported on Linux")
+}
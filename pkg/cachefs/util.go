@@ -0,0 +1,427 @@
+package cachefs
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// flatPathEscaper flattens a path so it can be stored as a single file in the cache directory.
+// `%` and `$` are escaped first, so `/` can become `$` without two paths ever mapping to the same
+// name (eg. `a$b` and `a/b`).
+var (
+	flatPathEscaper   = strings.NewReplacer("%", "%25", "$", "%24", "/", "$")
+	flatPathUnescaper = strings.NewReplacer("%25", "%", "%24", "$", "$", "/")
+)
+
+// flattenDirPath accepts a file directory and flattens it, replacing `/` with `$`. The result can be
+// turned back into the path with unflattenDirPath.
+func flattenDirPath(path string) string {
+	return flatPathEscaper.Replace(path)
+}
+
+// unflattenDirPath reverses flattenDirPath.
+func unflattenDirPath(flatPath string) string {
+	return flatPathUnescaper.Replace(flatPath)
+}
+
+// sortedPaths returns the paths a map of flattened paths is keyed by, sorted.
+func sortedPaths[V any](m map[string]V) []string {
+	paths := make([]string, 0, len(m))
+	for flatPath := range m {
+		paths = append(paths, unflattenDirPath(flatPath))
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// cacheFileName returns where the file with the given flattened path is stored under base. Files
+// are laid out in the same directory structure as on NFS, so the cache directory can be browsed
+// and large directories don't end up with every cached file in a single directory.
+func cacheFileName(base, flatPath string) string {
+	return filepath.Join(base, unflattenDirPath(flatPath))
+}
+
+// chmodCacheFile changes the mode of the cached file with the given flattened path under base.
+func chmodCacheFile(base, flatPath string, mode os.FileMode) error {
+	err := os.Chmod(cacheFileName(base, flatPath), mode.Perm())
+	if os.IsNotExist(err) {
+		return ErrNotFoundCache
+	}
+	return err
+}
+
+// readEntry reads a cached file and its metadata, or only the metadata if withData isn't set. The
+// file on SSD has the mode it was put with, and was last modified when it was put.
+func readEntry(name string, withData bool) (Entry, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFoundCache
+	} else if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{Mode: fi.Mode(), ModTime: fi.ModTime(), Size: fi.Size()}
+	if withData {
+		if entry.Data, err = io.ReadAll(f); err != nil {
+			return Entry{}, err
+		}
+		entry.Size = int64(len(entry.Data))
+	}
+	return entry, nil
+}
+
+// removeCacheFile removes the named cache file, and then any parent directories left empty by its
+// removal, up to (but not including) base. A file that doesn't exist isn't an error.
+func removeCacheFile(base, name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyDirs(base, filepath.Dir(name))
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to base, stopping at the first that isn't empty.
+// Failures are ignored: a directory that isn't empty, or has already gone, is simply left alone.
+func removeEmptyDirs(base, dir string) {
+	base = filepath.Clean(base)
+	for dir = filepath.Clean(dir); dir != base && strings.HasPrefix(dir, base+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// keyLocks is a fixed set of locks that keys are hashed onto. Operations on the same key are
+// serialised, while operations on different keys (mostly) aren't.
+type keyLocks [64]sync.RWMutex
+
+func (kl *keyLocks) forKey(key string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &kl[h.Sum32()%uint32(len(kl))]
+}
+
+// lockAll takes every lock for writing, waiting for all operations on all keys to finish.
+func (kl *keyLocks) lockAll() {
+	for i := range kl {
+		kl[i].Lock()
+	}
+}
+
+func (kl *keyLocks) unlockAll() {
+	for i := range kl {
+		kl[i].Unlock()
+	}
+}
+
+// clearDir removes everything in dir, leaving dir itself in place, along with the caches' own
+// metadata at its top (see metaPrefix).
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if isMetaFile(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirUsage counts the files in dir (recursively), and the bytes they take up.
+func dirUsage(dir string) (files int, bytes int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		bytes += fi.Size()
+		return nil
+	})
+	return files, bytes, err
+}
+
+// walkCacheFiles calls fn with the relative path and info of every cached file under dir, skipping
+// temporary files and the caches' own metadata.
+func walkCacheFiles(dir string, fn func(path string, fi os.FileInfo)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isMetaFile(d.Name()) && filepath.Dir(path) == filepath.Clean(dir) {
+			if d.IsDir() {
+				return filepath.SkipDir // Eg. a faster tier's directory, see TierDir
+			}
+			return nil
+		}
+		if d.IsDir() || isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fn(filepath.ToSlash(rel), fi)
+		return nil
+	})
+}
+
+// diskBlockSize is the usual filesystem block size. Files take up whole blocks, so it's used to
+// estimate how much space a file will take up before it's written.
+const diskBlockSize = 4096
+
+// roundToBlock rounds size up to a whole number of blocks.
+func roundToBlock(size int64) int64 {
+	return (size + diskBlockSize - 1) / diskBlockSize * diskBlockSize
+}
+
+// blocksOf returns how many 512 byte blocks (the unit st_blocks is in) it takes to hold size bytes.
+func blocksOf(size int64) int64 {
+	return (size + 511) / 512
+}
+
+// fileDiskUsage returns how much space the named file takes up on disk, or fallback if it can't be
+// stat'd.
+func fileDiskUsage(name string, fallback int64) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fallback
+	}
+	return diskUsage(fi)
+}
+
+// contextReadSize is the most contextReader reads at once, so cancellation is noticed promptly
+// even when reading into a big buffer.
+const contextReadSize = 1 << 20
+
+// contextReader reads from r until ctx is cancelled, after which it fails with syscall.EINTR.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, syscall.EINTR
+	}
+	if len(p) > contextReadSize {
+		p = p[:contextReadSize]
+	}
+	return c.r.Read(p)
+}
+
+// readAllContext reads the rest of f like os.ReadFile, except it gives up with syscall.EINTR if ctx
+// is cancelled part way through.
+func readAllContext(ctx context.Context, f *os.File) ([]byte, error) {
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	if _, err := buf.ReadFrom(contextReader{ctx: ctx, r: f}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tempSuffix is the suffix of files being written to the cache. They're only renamed to their
+// final name once complete, so a crash mid-write never leaves a truncated file behind.
+const tempSuffix = ".tmp"
+
+// writeFile writes data to the named file, see writeFileFrom.
+func writeFile(name string, data []byte, mode os.FileMode, durable bool) error {
+	_, err := writeFileFrom(name, bytes.NewReader(data), mode, durable)
+	return err
+}
+
+// writeFileFrom writes everything from r to the named file, replacing it if it exists. The data is
+// written to a temporary file in the same directory and renamed into place, so the file is either
+// absent or complete, even if the write fails or the process dies part way through.
+//
+// If durable is set, the file is fsynced before it is renamed, and its directory after, so the file
+// is still there and complete after a power loss. That costs a couple of disk flushes per file.
+func writeFileFrom(name string, r io.Reader, mode os.FileMode, durable bool) (int64, error) {
+	f, err := createTemp(name)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return written, err
+	}
+
+	if durable {
+		return written, syncDir(filepath.Dir(name))
+	}
+	return written, nil
+}
+
+// syncDir fsyncs the directory, so entries just created or renamed in it survive a power loss.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// createTempAttempts is how many times createTemp tries to create the parent directory and the
+// temporary file in it, each time another goroutine removes the directory in between.
+const createTempAttempts = 5
+
+// createTemp creates a temporary file next to name, creating the parent directories if needed.
+// Removing a cache file removes any directories it leaves empty, so a concurrent removal can
+// delete a directory between it being created and the next one (or the temporary file) being
+// created in it; that is retried.
+func createTemp(name string) (*os.File, error) {
+	dir := filepath.Dir(name)
+	for attempt := 1; ; attempt++ {
+		err := os.MkdirAll(dir, 0o755)
+		if os.IsNotExist(err) && attempt < createTempAttempts {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".*"+tempSuffix)
+		if os.IsNotExist(err) && attempt < createTempAttempts {
+			continue
+		}
+		return f, err
+	}
+}
+
+// PrepareCacheDir tidies up a cache directory before a cache is built on it: files left half written
+// by a process that died are removed, and files stored by older versions in a single flat
+// directory are moved to where they're stored now. Failures are logged, as the cache still works.
+func PrepareCacheDir(dir string) {
+	if err := removeTempFiles(dir); err != nil {
+		log.Printf("WARNING: Failed to clean up incomplete cache files in %s: %v", dir, err)
+	}
+	if moved, err := migrateFlatCache(dir); err != nil {
+		log.Printf("WARNING: Failed to migrate cache files in %s to the directory layout: %v", dir, err)
+	} else if moved > 0 {
+		log.Printf("CACHE_LOADED: Moved %d cache files in %s to the directory layout", moved, dir)
+	}
+}
+
+// migrateFlatCache moves files stored in dir by older versions, with the whole path flattened into
+// a single file name, to where they're stored now, in the same directory structure as on NFS. It
+// returns the number of files moved.
+func migrateFlatCache(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isTempFile(entry.Name()) || isMetaFile(entry.Name()) {
+			continue
+		}
+		name := cacheFileName(dir, entry.Name())
+		if name == filepath.Join(dir, entry.Name()) {
+			continue // Not in a subdirectory, so already where it belongs
+		}
+		err := os.MkdirAll(filepath.Dir(name), 0o755)
+		if err == nil {
+			err = os.Rename(filepath.Join(dir, entry.Name()), name)
+		}
+		if err != nil {
+			// Eg. a cached file has the name of a directory needed here. It's only a cached copy,
+			// so drop it and let it be fetched again.
+			log.Printf("WARNING: Dropping cache file %s that can't be moved: %v", entry.Name(), err)
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// isTempFile reports whether name is that of a file still being written, see createTemp: a dot,
+// the name of the file being written, a dot and os.CreateTemp's random digits, then tempSuffix.
+// Cached files with names merely like it (eg. ".build.tmp") don't match.
+func isTempFile(name string) bool {
+	rest, ok := strings.CutPrefix(name, ".")
+	if !ok {
+		return false
+	}
+	if rest, ok = strings.CutSuffix(rest, tempSuffix); !ok {
+		return false
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i <= 0 {
+		return false // No name before the random part
+	}
+	random := rest[i+1:]
+	return random != "" && strings.Trim(random, "0123456789") == ""
+}
+
+// metaPrefix starts the names of files a cache keeps about itself at the top of its directory (eg.
+// the saved LRU order, or a faster tier's directory), as opposed to cached files.
+const metaPrefix = ".fuse-test-"
+
+// isMetaFile reports whether name is that of a cache's own metadata file, see metaPrefix.
+func isMetaFile(name string) bool {
+	return strings.HasPrefix(name, metaPrefix)
+}
+
+// removeTempFiles removes temporary files left in dir by writes that never completed, eg. because
+// the process was killed.
+func removeTempFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isTempFile(d.Name()) {
+			log.Printf("WARNING: Removing incomplete cache file %s", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,237 @@
+package cachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIsTempFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		".a.txt.123.tmp":     true,
+		".build.tmp.42.tmp":  true,
+		".build.tmp":         false, // A dotfile that happens to end in .tmp
+		"a.txt.123.tmp":      false,
+		"..123.tmp":          false,
+		".a.txt..tmp":        false,
+		".a.txt.12x.tmp":     false,
+		".a.txt.123.tmp.bak": false,
+	} {
+		if got := isTempFile(name); got != want {
+			t.Errorf("isTempFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	// Whatever createTemp makes is one.
+	f, err := createTemp(filepath.Join(t.TempDir(), ".build.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if name := filepath.Base(f.Name()); !isTempFile(name) {
+		t.Errorf("isTempFile(%q) = false for a file createTemp made", name)
+	}
+}
+
+func TestRemoveTempFilesKeepsCachedDotfiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "dir/.build.tmp", []byte("cached"))
+	writeTestFile(t, dir, "dir/.a.txt.123.tmp", []byte("half written"))
+
+	if err := removeTempFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir/.build.tmp")); err != nil {
+		t.Errorf("cached dotfile was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir/.a.txt.123.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temp file is still there: %v", err)
+	}
+
+	var indexed []string
+	if err := walkCacheFiles(dir, func(path string, fi os.FileInfo) { indexed = append(indexed, path) }); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir/.build.tmp"}; !slices.Equal(indexed, want) {
+		t.Errorf("indexed %v, want %v", indexed, want)
+	}
+}
+
+// failingReader returns its data, and then err rather than io.EOF.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFailedPutLeavesNoPartialFile(t *testing.T) {
+	errDisk := errors.New("disk full")
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache := newCache(dir)
+			if err := cache.Put("a.txt", []byte("old"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := putReader(cache, "a.txt", &failingReader{data: []byte("half of the new"), err: errDisk}, 0o644)
+			if !errors.Is(err, errDisk) {
+				t.Fatalf("Put = %v, want %v", err, errDisk)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(got) != "old" {
+				t.Errorf("file after a failed Put = %q, %v, want the old one", got, err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if isTempFile(e.Name()) {
+					t.Errorf("temp file %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFailedWriteIsNeverVisible(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.txt")
+	if _, err := writeFileFrom(name, &failingReader{data: []byte("half"), err: io.ErrUnexpectedEOF}, 0o644, false); err == nil {
+		t.Fatal("write succeeded")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("file is visible after a failed write: %v", err)
+	}
+}
+
+func TestFlattenDirPathIsReversible(t *testing.T) {
+	seen := make(map[string]string)
+	for _, path := range []string{"a/b", "a$b", "a%24b", "a%b", "a$/b", "$", "%", "a/b/c"} {
+		flat := flattenDirPath(path)
+		if other, ok := seen[flat]; ok {
+			t.Errorf("%q and %q both flatten to %q", path, other, flat)
+		}
+		seen[flat] = path
+		if got := unflattenDirPath(flat); got != path {
+			t.Errorf("unflattenDirPath(flattenDirPath(%q)) = %q", path, got)
+		}
+	}
+}
+
+func TestCachesKeepDollarAndNestedPathsApart(t *testing.T) {
+	deep := strings.Repeat("nested/", 40) + "file.py"
+	paths := []string{"a$b", "a/b", "a%24b", deep}
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+			for _, path := range paths {
+				if err := cache.Put(path, []byte(path), 0o644); err != nil {
+					t.Fatalf("Put %s: %v", path, err)
+				}
+			}
+			for _, path := range paths {
+				if got, err := cache.Get(path); err != nil || string(got) != path {
+					t.Errorf("Get %s = %q, %v", path, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentPutsShareParentDir(t *testing.T) {
+	for name, newCache := range diskCaches {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache(t.TempDir())
+
+			// Half the goroutines put files into the same new directories, the other half delete
+			// theirs, which removes the directories again whenever they're left empty.
+			var wg sync.WaitGroup
+			for g := range 16 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range 20 {
+						path := fmt.Sprintf("project/dir-%d/deeper/file-%d", i, g)
+						if err := cache.Put(path, []byte(path), 0o644); err != nil {
+							t.Errorf("Put %s: %v", path, err)
+							return
+						}
+						if g%2 == 1 {
+							if err := cache.Delete(path); err != nil {
+								t.Errorf("Delete %s: %v", path, err)
+								return
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			for g := 0; g < 16; g += 2 {
+				for i := range 20 {
+					path := fmt.Sprintf("project/dir-%d/deeper/file-%d", i, g)
+					if got, err := cache.Get(path); err != nil || string(got) != path {
+						t.Errorf("Get %s = %q, %v", path, got, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEvictionRemovesEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	cache := must(NewLRUCache(dir, 2, false))
+	for _, path := range []string{"project-1/a/b/c.py", "project-1/keep.py", "project-2/d.py"} {
+		if err := cache.Put(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "project-1/a")); !os.IsNotExist(err) {
+		t.Errorf("directory of the evicted file is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "project-1/keep.py")); err != nil {
+		t.Errorf("parent directory with another file was removed: %v", err)
+	}
+}
+
+func TestPrepareCacheDirMigratesFlatFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "project-1$lib$a.py", []byte("a"))
+	writeTestFile(t, dir, "top.py", []byte("top"))
+	writeTestFile(t, dir, ".project-1$b.py.123.tmp", []byte("half written"))
+
+	PrepareCacheDir(dir)
+
+	for name, want := range map[string]string{"project-1/lib/a.py": "a", "top.py": "top"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"project-1", "top.py"}; !slices.Equal(names, want) {
+		t.Errorf("cache directory holds %v, want %v", names, want)
+	}
+}
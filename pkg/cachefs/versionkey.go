@@ -0,0 +1,30 @@
+package cachefs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// versionSep separates a file's path from its NFS version in a versioned cache key.
+const versionSep = "#v"
+
+// versionedKey returns the key a whole file is cached under with versioned keys: its path, plus the
+// modification time and size it has on NFS. A file changed on NFS then has a new key, and misses,
+// rather than being served from a stale copy.
+func versionedKey(relPath string, modTime time.Time, size int64) string {
+	return fmt.Sprintf("%s%s%x-%x", relPath, versionSep, modTime.UnixNano(), size)
+}
+
+// splitVersionedKey returns the path a versioned key is for, or false if key isn't one.
+func splitVersionedKey(key string) (string, bool) {
+	i := strings.LastIndex(key, versionSep)
+	if i < 0 {
+		return "", false
+	}
+	var modTime, size int64
+	if _, err := fmt.Sscanf(key[i+len(versionSep):], "%x-%x", &modTime, &size); err != nil || versionedKey(key[:i], time.Unix(0, modTime), size) != key {
+		return "", false
+	}
+	return key[:i], true
+}
@@ -0,0 +1,151 @@
+package cachefs
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ReadManifest reads a newline separated list of NFS relative paths. Blank lines and lines
+// starting with '#' are ignored.
+func ReadManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var relPaths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		relPaths = append(relPaths, line)
+	}
+	return relPaths, scanner.Err()
+}
+
+// WarmProgress counts what Warm has done so far.
+type WarmProgress struct {
+	Total   int   // Files to warm, once the paths given have been expanded
+	Done    int   // Files looked at so far
+	Cached  int   // Files read into the cache
+	Bytes   int64 // Bytes read into the cache
+	Skipped int   // Files already cached, refused by the cache, or that failed to read
+}
+
+// Warm reads the given files (relative to NFS), and every file under the given directories, into
+// the cache ahead of time, using up to jobs concurrent NFS reads. Files are put through the cache
+// as a read would, so its admission policies (eg. size limits, tinylfu, second-access) apply. Files already cached
+// are skipped, so running it again after an interruption picks up where it left off. Files the
+// cache refuses are skipped too, as are paths that don't exist. Stops early if ctx is cancelled.
+//
+// progress, if not nil, is called after every file, one call at a time. The final counts are
+// returned.
+func (rfs *FS) Warm(ctx context.Context, relPaths []string, jobs int, progress func(WarmProgress)) (WarmProgress, error) {
+	var nodes []*fuseFSNode
+	for _, relPath := range relPaths {
+		relPath = filepath.Clean(strings.TrimPrefix(relPath, "/"))
+		node := rfs.nodeAt(relPath)
+		if node == nil {
+			log.Printf("WARNING: Not warming '%s', it does not exist", relPath)
+			continue
+		} else if node.isSymlink() {
+			log.Printf("WARNING: Not warming '%s', it is not a regular file", relPath)
+			continue
+		}
+		nodes = appendFiles(nodes, node)
+	}
+
+	var mu sync.Mutex
+	p := WarmProgress{Total: len(nodes)}
+	sem := make(chan struct{}, max(jobs, 1))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			size, cached := rfs.warmFile(ctx, node)
+
+			mu.Lock()
+			defer mu.Unlock()
+			p.Done++
+			if cached {
+				p.Cached++
+				p.Bytes += size
+			} else {
+				p.Skipped++
+			}
+			if progress != nil {
+				progress(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return p, ctx.Err()
+}
+
+// appendFiles appends the node if it's a file, or every file below it if it's a directory.
+func appendFiles(nodes []*fuseFSNode, node *fuseFSNode) []*fuseFSNode {
+	if node.isSymlink() {
+		return nodes
+	} else if !node.isDir {
+		return append(nodes, node)
+	}
+	for _, child := range node.children() {
+		nodes = appendFiles(nodes, child)
+	}
+	return nodes
+}
+
+// warmFile reads one file into the cache, unless it's there already. It returns the file's size,
+// and whether it was read into the cache.
+func (rfs *FS) warmFile(ctx context.Context, node *fuseFSNode) (int64, bool) {
+	relPath := node.relPath()
+	if !cacheable(rfs.ssdCache, relPath) {
+		return 0, false // Filtered out, so it would only be read from NFS for nothing
+	}
+	fi, err := node.stat()
+	if err != nil {
+		log.Printf("WARNING: Failed to warm '%s': %v", relPath, err)
+		return 0, false
+	}
+
+	if rfs.chunkSize > 0 {
+		// Reading the whole file loads every block that isn't already cached.
+		data, err := node.readChunked(ctx, 0, int(fi.Size()))
+		if err != nil {
+			log.Printf("WARNING: Failed to warm '%s': %v", relPath, err)
+			return 0, false
+		}
+		return int64(len(data)), true
+	}
+
+	if rfs.ssdCache.Has(node.cacheKey(fi)) {
+		return 0, false // Already warm
+	}
+
+	res, err := node.fetch(ctx)
+	if err != nil {
+		log.Printf("WARNING: Failed to warm '%s': %v", relPath, err)
+		return 0, false
+	}
+	return res.size, res.cached
+}
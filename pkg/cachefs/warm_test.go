@@ -0,0 +1,116 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	if err := os.WriteFile(manifest, []byte("a.txt\n\n# comment\n  dir/b.txt  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(manifest)
+	if want := []string{"a.txt", "dir/b.txt"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadManifest = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestWarmedFilesAreHits(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("aaaa"))
+	writeTestFile(t, nfsDir, "dir/b.txt", []byte("bb"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, NFSReadDelay: delay})
+
+	p, err := rfs.Warm(context.Background(), []string{"a.txt", "dir/b.txt", "missing.txt"}, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (WarmProgress{Total: 2, Done: 2, Cached: 2, Bytes: 6}); p != want {
+		t.Errorf("Warm = %+v, want %+v", p, want)
+	}
+
+	for _, relPath := range []string{"a.txt", "dir/b.txt"} {
+		start := time.Now()
+		if _, err := lookup(t, rfs, relPath).data(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); took >= delay {
+			t.Errorf("first read of %s took %v, as long as reading NFS", relPath, took)
+		}
+	}
+	if got := rfs.Stats()["cache_hits"]; got != 2 {
+		t.Errorf("cache_hits = %d, want 2", got)
+	}
+}
+
+func TestWarmStopsWhenCancelled(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, err := rfs.Warm(ctx, []string{"a.txt"}, 1, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Warm after cancelling = %v, want %v", err, context.Canceled)
+	}
+	if p.Cached != 0 {
+		t.Errorf("warmed %d files after cancelling", p.Cached)
+	}
+}
+
+func TestWarmExpandsDirectoriesAndResumes(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "dir/a.txt", []byte("aaaa"))
+	writeTestFile(t, nfsDir, "dir/sub/b.txt", []byte("bb"))
+	rfs := newTestFS(t, Config{NFSDir: nfsDir})
+	if _, err := rfs.Warm(context.Background(), []string{"dir/a.txt"}, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.txt is already cached, so only b.txt is read.
+	var calls int
+	p, err := rfs.Warm(context.Background(), []string{"dir"}, 2, func(WarmProgress) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (WarmProgress{Total: 2, Done: 2, Cached: 1, Bytes: 2, Skipped: 1}); p != want {
+		t.Errorf("Warm = %+v, want %+v", p, want)
+	}
+	if calls != 2 {
+		t.Errorf("progress called %d times, want 2", calls)
+	}
+}
+
+func TestWarmRespectsAdmission(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("aaaa"))
+	cache := NewDoorkeeperCache(NewDefaultCache(ssdDir), time.Minute)
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, Cache: cache})
+
+	// Warming is the first read, so the doorkeeper turns the file away.
+	p, err := rfs.Warm(context.Background(), []string{"a.txt"}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Cached != 0 || cache.Has("a.txt") {
+		t.Errorf("first warm cached %d files", p.Cached)
+	}
+	if got := statsOf(cache)["doorkeeper_rejected"]; got != 1 {
+		t.Errorf("doorkeeper_rejected = %d, want 1", got)
+	}
+
+	if p, err = rfs.Warm(context.Background(), []string{"a.txt"}, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p.Cached != 1 || !cache.Has("a.txt") {
+		t.Errorf("second warm cached %d files", p.Cached)
+	}
+}
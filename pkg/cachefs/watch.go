@@ -0,0 +1,175 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	native_fs "io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/fsnotify/fsnotify"
+)
+
+var errNFSRootRemoved = errors.New("NFS root was removed")
+
+// Watch keeps the node tree in sync with NFS using inotify, until ctx is cancelled. Created paths
+// are added to the tree (recursively for directories), removed paths are dropped and modified
+// files have their cached data invalidated.
+func (rfs *FS) Watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating watcher: %w", err)
+	}
+	defer w.Close()
+
+	roots := rfs.nfsRoots()
+	for _, root := range roots {
+		if err := watchDirs(w, root); err != nil {
+			return err
+		}
+	}
+	log.Printf("WATCH: Watching '%s' for changes", strings.Join(roots, "', '"))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if err := rfs.handleWatchEvent(w, event); err != nil {
+				return err
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("WARNING: NFS watcher error: %v", err)
+		}
+	}
+}
+
+// watchDirs adds a watch for the directory at absPath, and every directory below it.
+func watchDirs(w *fsnotify.Watcher, absPath string) error {
+	return filepath.WalkDir(absPath, func(path string, d native_fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("WARNING: Not watching %q: %v", path, err)
+			if d != nil && d.IsDir() {
+				return native_fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := w.Add(path); err != nil {
+			return fmt.Errorf("watching %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func (rfs *FS) handleWatchEvent(w *fsnotify.Watcher, event fsnotify.Event) error {
+	rfs.treeMu.Lock()
+	defer rfs.treeMu.Unlock()
+
+	relPath, ok := rfs.nfsRelPath(event.Name)
+	if !ok {
+		return nil // Not ours
+	}
+
+	if slices.Contains(rfs.nfsRoots(), event.Name) {
+		if !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+			return nil
+		} else if rfs.merged() {
+			// The other sources are still there.
+			log.Printf("ERROR: NFS source '%s' was removed, dropping it from the tree", event.Name)
+			rfs.removeNode(relPath)
+			return nil
+		}
+		log.Printf("ERROR: NFS root '%s' was removed, emptying the tree and no longer watching", event.Name)
+		for _, child := range rfs.rootNode.children() {
+			rfs.removeNode(child.relPath())
+		}
+		return errNFSRootRemoved
+	}
+
+	switch {
+	case event.Has(fsnotify.Create):
+		rfs.addNode(w, relPath)
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		// Renames are seen as a remove of the old name, followed by a create of the new one.
+		rfs.removeNode(relPath)
+	case event.Has(fsnotify.Write), event.Has(fsnotify.Chmod):
+		rfs.invalidateNode(relPath)
+	}
+
+	return nil
+}
+
+// addNode adds a node for the NFS path to the tree, along with everything below it for directories.
+// Must be called with treeMu held.
+func (rfs *FS) addNode(w *fsnotify.Watcher, relPath string) {
+	parent := rfs.nodeAt(filepath.Dir(relPath))
+	if parent == nil || parent.child(filepath.Base(relPath)) != nil {
+		return // Either already known, or the parent's own create event will pick it up
+	}
+
+	fi, err := os.Lstat(rfs.nfsPath(relPath))
+	if err != nil {
+		return // Already gone again
+	}
+
+	node := newNodeFromEntry(rfs, parent, native_fs.FileInfoToDirEntry(fi))
+	if node.isDir {
+		// Watch first, so anything created while we walk is still seen.
+		if err := watchDirs(w, node.nfsPathAbs()); err != nil {
+			log.Printf("WARNING: Failed to watch new directory '%s': %v", relPath, err)
+		}
+		if err := loadSubtree(rfs, node); err != nil {
+			log.Printf("WARNING: Failed to load new directory '%s': %v", relPath, err)
+		}
+	}
+	parent.addChild(node)
+	rfs.negCache.forget(relPath)
+	log.Printf("WATCH: Added '%s'", relPath)
+}
+
+// removeNode removes the node at the NFS path from the tree, dropping anything cached for it.
+// Must be called with treeMu held.
+func (rfs *FS) removeNode(relPath string) {
+	parent := rfs.nodeAt(filepath.Dir(relPath))
+	if parent == nil {
+		return
+	}
+
+	if node := parent.removeChild(filepath.Base(relPath)); node != nil {
+		rfs.dropNode(parent, node)
+		log.Printf("WATCH: Removed '%s'", relPath)
+	}
+}
+
+// invalidateNode drops cached data for a file that has changed on NFS.
+func (rfs *FS) invalidateNode(relPath string) {
+	node := rfs.nodeAt(relPath)
+	if node == nil || node.isDir {
+		return
+	}
+
+	rfs.evict(relPath)
+	if rfs.server != nil {
+		if err := rfs.server.InvalidateNodeAttr(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("WARNING: Failed to invalidate kernel attributes for '%s': %v", relPath, err)
+		}
+		if err := rfs.server.InvalidateNodeData(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("WARNING: Failed to invalidate kernel data for '%s': %v", relPath, err)
+		}
+	}
+	log.Printf("WATCH: Invalidated '%s'", relPath)
+}
@@ -0,0 +1,148 @@
+package cachefs
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Writes to existing files, on a writable mount. Without write-back they go straight through to
+// NFS, and whatever was cached for the file is dropped. With it, the file's new contents replace
+// the cached copy straight away, and are written to NFS in the background (see writeBack).
+
+// Write changes part of the file, extending it if the write goes past the end.
+func (n *fuseFSNode) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if !n.FS.writable {
+		return syscall.EROFS
+	} else if n.isDir {
+		return syscall.EISDIR
+	}
+
+	relPath := n.relPath()
+	n.FS.requests.begin(relPath)
+	defer n.FS.requests.end(relPath)
+	n.unsynced.Store(true)
+
+	if n.FS.writeBack != nil {
+		err := n.rewrite(ctx, func(data []byte) []byte {
+			if end := req.Offset + int64(len(req.Data)); end > int64(len(data)) {
+				data = append(data, make([]byte, end-int64(len(data)))...)
+			}
+			copy(data[req.Offset:], req.Data)
+			return data
+		})
+		if err != nil {
+			return err
+		}
+		resp.Size = len(req.Data)
+		return nil
+	}
+
+	f, err := os.OpenFile(n.nfsPathAbs(), os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return syscall.ENOENT
+	} else if err != nil {
+		log.Printf("ERROR: Failed to open NFS path %s for writing: %v", n.nfsPathAbs(), err)
+		return syscall.EIO
+	}
+	written, err := f.WriteAt(req.Data, req.Offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	n.FS.evict(relPath)
+	if err != nil {
+		log.Printf("ERROR: Failed to write to NFS path %s: %v", n.nfsPathAbs(), err)
+		return syscall.EIO
+	}
+	resp.Size = written
+	return nil
+}
+
+// Setattr truncates (or extends) the file when its size is set, eg. by open(2) with O_TRUNC. Other
+// attributes can't be changed through the mount, and are left as they are.
+func (n *fuseFSNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if !n.FS.writable {
+			return syscall.EROFS
+		} else if n.isDir {
+			return syscall.EISDIR
+		}
+
+		n.unsynced.Store(true)
+		if n.FS.writeBack != nil {
+			err := n.rewrite(ctx, func(data []byte) []byte {
+				if size := int64(req.Size); size <= int64(len(data)) {
+					return data[:size]
+				}
+				return append(data, make([]byte, int64(req.Size)-int64(len(data)))...)
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			err := os.Truncate(n.nfsPathAbs(), int64(req.Size))
+			n.FS.evict(n.relPath())
+			if os.IsNotExist(err) {
+				return syscall.ENOENT
+			} else if err != nil {
+				log.Printf("ERROR: Failed to truncate NFS path %s: %v", n.nfsPathAbs(), err)
+				return syscall.EIO
+			}
+		}
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+// rewrite changes the file's contents with change, which is given its current contents (its own
+// copy, to change in place) and returns the new ones. These are cached, unless files are cached
+// under versioned keys (whose version isn't known until it's written), and written back to NFS
+// later.
+func (n *fuseFSNode) rewrite(ctx context.Context, change func(data []byte) []byte) error {
+	wb := n.FS.writeBack
+	relPath := n.relPath()
+
+	lock := wb.locks.forKey(relPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var data []byte
+	var mode os.FileMode
+	if f, ok := wb.get(relPath); ok {
+		data, mode = f.data, f.mode
+	} else {
+		fi, err := n.stat()
+		if err != nil {
+			return err
+		}
+		mode = n.fileMode(fi)
+		if data, err = n.data(ctx); err != nil {
+			return err
+		}
+	}
+	data = change(bytes.Clone(data))
+
+	// Whatever was cached is out of date, so it's replaced.
+	n.FS.evict(relPath)
+	// With versioned keys, they're served from memory until written back, then fetched again
+	// under the new version's key.
+	if !n.FS.versionedKeys {
+		if err := n.FS.ssdCache.Put(relPath, data, mode); err != nil && err != ErrWontCache {
+			log.Printf("WARNING: Failed to cache the new contents of '%s', serving them from memory until written back: %v", relPath, err)
+		}
+	}
+	wb.put(ctx, relPath, data, mode)
+	return nil
+}
+
+// dirtyData returns the file's contents if they've been written through the mount but not yet
+// written back to NFS.
+func (n *fuseFSNode) dirtyData() (dirtyFile, bool) {
+	if n.FS.writeBack == nil {
+		return dirtyFile{}, false
+	}
+	return n.FS.writeBack.get(n.relPath())
+}
@@ -0,0 +1,239 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeBack holds files written through the mount that haven't been written to NFS yet. They're
+// written in the background every interval, or straight away once they add up to more than limit
+// bytes, in which case writers wait for them. The whole file is kept in memory until then, as the
+// cache may evict or refuse its copy: losing a dirty file would lose the write.
+type writeBack struct {
+	nfsPath   func(relPath string) string // The absolute NFS path of a file
+	limit     int64
+	interval  time.Duration
+	onFlushed func(relPath string) // Called once a file has been written to NFS
+
+	mu         sync.Mutex
+	dirty      map[string]*dirtyFile // By relative path
+	dirtyBytes int64
+	flushed    *sync.Cond // Broadcast after every flush pass, for writers waiting on the limit
+	failing    bool       // The last pass failed to write something, so writers stop waiting on it
+
+	locks keyLocks // Serialises writes to each file, which replace its whole contents
+
+	kick    chan struct{} // Starts a flush pass before the interval is up
+	stop    chan struct{}
+	stopped chan struct{}
+
+	flushMu sync.Mutex // Held while writing to NFS, or discarding, so only one pass (or Rename's flush) runs at once
+
+	flushes, flushErrors atomic.Int64
+}
+
+type dirtyFile struct {
+	data  []byte
+	mode  os.FileMode
+	since time.Time // When it was first written after its last flush
+	mtime time.Time // When it was last written
+	gen   uint64    // Bumped on every write, so a flush can tell if the file changed under it
+}
+
+func newWriteBack(nfsPath func(relPath string) string, limit int64, interval time.Duration, onFlushed func(relPath string)) *writeBack {
+	wb := &writeBack{
+		nfsPath:   nfsPath,
+		limit:     limit,
+		interval:  interval,
+		onFlushed: onFlushed,
+		dirty:     make(map[string]*dirtyFile),
+		kick:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	wb.flushed = sync.NewCond(&wb.mu)
+	go wb.run()
+	return wb
+}
+
+func (wb *writeBack) run() {
+	defer close(wb.stopped)
+
+	ticker := time.NewTicker(wb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wb.kick:
+		case <-wb.stop:
+			return
+		}
+		wb.flush("")
+	}
+}
+
+// get returns the unflushed contents of the file, if it has any.
+func (wb *writeBack) get(relPath string) (dirtyFile, bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	f, ok := wb.dirty[relPath]
+	if !ok {
+		return dirtyFile{}, false
+	}
+	return *f, true
+}
+
+// put replaces the file's unflushed contents. If that takes the dirty files over the limit, it
+// starts a flush and waits for them to be back under it, or for ctx to be cancelled. If NFS can't
+// be written to, it doesn't wait, and the dirty files go over the limit until it can.
+func (wb *writeBack) put(ctx context.Context, relPath string, data []byte, mode os.FileMode) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	now := time.Now()
+	f, ok := wb.dirty[relPath]
+	if !ok {
+		f = &dirtyFile{since: now}
+		wb.dirty[relPath] = f
+	}
+	wb.dirtyBytes += int64(len(data)) - int64(len(f.data))
+	f.data, f.mode, f.mtime = data, mode, now
+	f.gen++
+
+	if wb.dirtyBytes <= wb.limit {
+		return
+	}
+	// Cond can't wait on a context, so a cancelled writer is woken by the flush after next at the
+	// latest.
+	stop := context.AfterFunc(ctx, func() {
+		wb.mu.Lock()
+		defer wb.mu.Unlock()
+		wb.flushed.Broadcast()
+	})
+	defer stop()
+	for wb.dirtyBytes > wb.limit && ctx.Err() == nil {
+		select {
+		case wb.kick <- struct{}{}:
+		default:
+		}
+		wb.flushed.Wait()
+		if wb.failing {
+			return
+		}
+	}
+}
+
+// flush writes the dirty files at or under prefix (or all of them, for "") to NFS. Files that fail
+// to write stay dirty, to be tried again by the next pass. It returns the errors.
+func (wb *writeBack) flush(prefix string) error {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	var paths []string
+	for relPath := range wb.dirty {
+		if prefix == "" || relPath == prefix || strings.HasPrefix(relPath, prefix+"/") {
+			paths = append(paths, relPath)
+		}
+	}
+	wb.mu.Unlock()
+	slices.Sort(paths)
+
+	var errs []error
+	for _, relPath := range paths {
+		if err := wb.flushFile(relPath); err != nil {
+			wb.flushErrors.Add(1)
+			log.Printf("ERROR: Failed to write '%s' back to NFS, will try again: %v", relPath, err)
+			errs = append(errs, err)
+		}
+	}
+
+	wb.mu.Lock()
+	wb.failing = len(errs) > 0
+	wb.flushed.Broadcast()
+	wb.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// flushFile writes one dirty file to NFS. Must be called with flushMu held.
+func (wb *writeBack) flushFile(relPath string) error {
+	wb.mu.Lock()
+	f, ok := wb.dirty[relPath]
+	if !ok {
+		wb.mu.Unlock()
+		return nil
+	}
+	snapshot := *f
+	wb.mu.Unlock()
+
+	// Written in place, rather than replaced, so the file keeps its NFS inode and anything else
+	// holding it open sees the change.
+	name := wb.nfsPath(relPath)
+	if err := os.WriteFile(name, snapshot.data, snapshot.mode.Perm()); err != nil {
+		return err
+	}
+	wb.flushes.Add(1)
+	log.Printf("WRITE_BACK: Wrote %d bytes of '%s' to NFS, %s after it was first written", len(snapshot.data), relPath, time.Since(snapshot.since).Round(time.Millisecond))
+
+	wb.mu.Lock()
+	// Unless it was written again, or discarded (and maybe written again) since the snapshot.
+	if wb.dirty[relPath] == f && f.gen == snapshot.gen {
+		delete(wb.dirty, relPath)
+		wb.dirtyBytes -= int64(len(f.data))
+	}
+	wb.mu.Unlock()
+
+	wb.onFlushed(relPath)
+	return nil
+}
+
+// discard forgets the dirty files at or under prefix without writing them, eg. because what they
+// were written to has been replaced. It waits for a flush pass in progress, which may be writing
+// them, so nothing it discards is written to NFS after it returns.
+func (wb *writeBack) discard(prefix string) {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for relPath, f := range wb.dirty {
+		if relPath == prefix || strings.HasPrefix(relPath, prefix+"/") {
+			log.Printf("WARNING: Discarding %d bytes written to '%s' that weren't written back, it has been replaced", len(f.data), relPath)
+			wb.dirtyBytes -= int64(len(f.data))
+			delete(wb.dirty, relPath)
+		}
+	}
+	wb.flushed.Broadcast()
+}
+
+// close stops flushing in the background, and flushes everything that's left.
+func (wb *writeBack) close() error {
+	close(wb.stop)
+	<-wb.stopped
+	return wb.flush("")
+}
+
+func (wb *writeBack) addStats(stats Stats) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// How far behind NFS is: the age of the oldest write not written back yet.
+	var lag time.Duration
+	for _, f := range wb.dirty {
+		lag = max(lag, time.Since(f.since))
+	}
+	stats["writeback_dirty_files"] = int64(len(wb.dirty))
+	stats["writeback_dirty_bytes"] = wb.dirtyBytes
+	stats["writeback_flush_lag_ms"] = lag.Milliseconds()
+	stats["writeback_flushes"] = wb.flushes.Load()
+	stats["writeback_flush_errors"] = wb.flushErrors.Load()
+}
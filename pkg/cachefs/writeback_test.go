@@ -0,0 +1,170 @@
+package cachefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// newWriteBackFS builds a writable file system that only writes back when asked to.
+func newWriteBackFS(t *testing.T, cfg Config) *FS {
+	t.Helper()
+	cfg.Writable, cfg.WriteBack = true, true
+	cfg.WriteBackLimit, cfg.WriteBackInterval = 1<<20, time.Hour
+	return newTestFS(t, cfg)
+}
+
+func write(t *testing.T, n *fuseFSNode, data string) {
+	t.Helper()
+	if err := n.Setattr(context.Background(), &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Write(context.Background(), &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBackWithVersionedKeys(t *testing.T) {
+	nfsDir, ssdDir := t.TempDir(), t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("old"))
+	rfs := newWriteBackFS(t, Config{NFSDir: nfsDir, SSDDir: ssdDir, VersionedKeys: true})
+	ctx := context.Background()
+	n := lookup(t, rfs, "a.txt")
+	if _, err := n.data(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, n, "newer")
+	if got, err := n.data(ctx); err != nil || string(got) != "newer" {
+		t.Fatalf("data before writing back = %q, %v", got, err)
+	}
+	if err := rfs.writeBack.flush(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read from NFS once, then from the cache under the new version's key.
+	hits := rfs.Stats()["cache_hits"]
+	for range 2 {
+		if got, err := n.data(ctx); err != nil || string(got) != "newer" {
+			t.Errorf("data after writing back = %q, %v", got, err)
+		}
+	}
+	if got := rfs.Stats()["cache_hits"] - hits; got != 1 {
+		t.Errorf("%d cache hits, want 1", got)
+	}
+	// Only the new version is left on SSD, and nothing under the plain path.
+	entries, err := os.ReadDir(ssdDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, e.Name())
+		}
+	}
+	fi, err := os.Stat(filepath.Join(nfsDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Base(cacheFileName(ssdDir, flattenDirPath(versionedKey("a.txt", fi.ModTime(), fi.Size()))))
+	if len(files) != 1 || files[0] != want {
+		t.Errorf("SSD has %q, want only %q", files, want)
+	}
+}
+
+func TestDiscardWaitsForFlush(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("old"))
+	rfs := newWriteBackFS(t, Config{NFSDir: nfsDir})
+	wb := rfs.writeBack
+	write(t, lookup(t, rfs, "a.txt"), "stale")
+
+	writing, gate := make(chan struct{}), make(chan struct{})
+	nfsPath := wb.nfsPath
+	wb.nfsPath = func(relPath string) string {
+		close(writing)
+		<-gate
+		return nfsPath(relPath)
+	}
+	flushed := make(chan error)
+	go func() { flushed <- wb.flush("") }()
+	<-writing
+
+	discarded := make(chan struct{})
+	go func() {
+		wb.discard("a.txt")
+		close(discarded)
+	}()
+	select {
+	case <-discarded:
+		t.Error("discard didn't wait for the flush writing the file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gate)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	<-discarded
+
+	if stats := rfs.Stats(); stats["writeback_dirty_bytes"] != 0 || stats["writeback_dirty_files"] != 0 {
+		t.Errorf("%d dirty files of %d bytes, want none", stats["writeback_dirty_files"], stats["writeback_dirty_bytes"])
+	}
+}
+
+// TestRenameOverDirtyFileWhileFlushing renames files over ones with writes not written back, while
+// flushes run all the time. What was renamed must be left on NFS, not the writes it replaced.
+func TestRenameOverDirtyFileWhileFlushing(t *testing.T) {
+	const rounds = 50
+	nfsDir := t.TempDir()
+	for i := range rounds {
+		writeTestFile(t, nfsDir, fmt.Sprintf("src-%d", i), []byte(fmt.Sprintf("renamed %d", i)))
+		writeTestFile(t, nfsDir, fmt.Sprintf("dst-%d", i), []byte("old"))
+	}
+	rfs := newWriteBackFS(t, Config{NFSDir: nfsDir})
+	ctx := context.Background()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				rfs.writeBack.flush("")
+			}
+		}
+	}()
+
+	for i := range rounds {
+		src, dst := fmt.Sprintf("src-%d", i), fmt.Sprintf("dst-%d", i)
+		write(t, lookup(t, rfs, dst), "stale")
+		if err := rfs.rootNode.Rename(ctx, &fuse.RenameRequest{OldName: src, NewName: dst}, rfs.rootNode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err := rfs.writeBack.flush(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range rounds {
+		want := fmt.Sprintf("renamed %d", i)
+		if got, err := os.ReadFile(filepath.Join(nfsDir, fmt.Sprintf("dst-%d", i))); err != nil || string(got) != want {
+			t.Errorf("dst-%d on NFS = %q, %v, want %q", i, got, err, want)
+		}
+	}
+	if stats := rfs.Stats(); stats["writeback_dirty_bytes"] != 0 || stats["writeback_dirty_files"] != 0 {
+		t.Errorf("%d dirty files of %d bytes, want none", stats["writeback_dirty_files"], stats["writeback_dirty_bytes"])
+	}
+}
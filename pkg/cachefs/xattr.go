@@ -0,0 +1,80 @@
+package cachefs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Extended attributes are passed straight through to NFS. Symlinks have none of their own here,
+// since the xattr syscalls would follow them to their target, and nor does the root of a merged
+// tree, which isn't on NFS.
+
+func (n *fuseFSNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if n.isSymlink() || n.synthetic() {
+		return fuse.ErrNoXattr
+	}
+
+	value, err := getxattr(n.nfsPathAbs(), req.Name)
+	if err != nil {
+		return xattrError(err)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func (n *fuseFSNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if n.isSymlink() || n.synthetic() {
+		return nil
+	}
+
+	names, err := listxattr(n.nfsPathAbs())
+	if err != nil {
+		return xattrError(err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+func (n *fuseFSNode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !n.FS.writable {
+		return syscall.EROFS
+	} else if n.isSymlink() || n.synthetic() {
+		return syscall.ENOTSUP
+	}
+
+	if err := setxattr(n.nfsPathAbs(), req.Name, req.Xattr, int(req.Flags)); err != nil {
+		return xattrError(err)
+	}
+	n.unsynced.Store(true)
+	n.FS.attrCache.forget(n.relPath()) // ctime changed
+	return nil
+}
+
+func (n *fuseFSNode) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if !n.FS.writable {
+		return syscall.EROFS
+	} else if n.isSymlink() || n.synthetic() {
+		return fuse.ErrNoXattr
+	}
+
+	if err := removexattr(n.nfsPathAbs(), req.Name); err != nil {
+		return xattrError(err)
+	}
+	n.unsynced.Store(true)
+	n.FS.attrCache.forget(n.relPath()) // ctime changed
+	return nil
+}
+
+// xattrError maps an error from the xattr syscalls to one for FUSE.
+func xattrError(err error) error {
+	var errno syscall.Errno
+	if isNoXattr(err) {
+		return fuse.ErrNoXattr
+	} else if errors.As(err, &errno) {
+		return errno
+	}
+	return syscall.EIO
+}
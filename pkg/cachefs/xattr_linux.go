@@ -0,0 +1,57 @@
+package cachefs
+
+import (
+	"strings"
+	"syscall"
+)
+
+// getxattr reads the named extended attribute of the file at path.
+func getxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, value)
+		if err == syscall.ERANGE {
+			continue // It grew in between, try again
+		} else if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
+
+// listxattr lists the names of the extended attributes of the file at path.
+func listxattr(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue // It grew in between, try again
+		} else if err != nil {
+			return nil, err
+		}
+		return strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00"), nil
+	}
+}
+
+func setxattr(path, name string, value []byte, flags int) error {
+	return syscall.Setxattr(path, name, value, flags)
+}
+
+func removexattr(path, name string) error {
+	return syscall.Removexattr(path, name)
+}
+
+// isNoXattr reports whether the error means the attribute doesn't exist.
+func isNoXattr(err error) bool {
+	return err == syscall.ENODATA
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package cachefs
+
+import "syscall"
+
+// Extended attributes are only passed through on Linux.
+
+func getxattr(path, name string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func listxattr(path string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func setxattr(path, name string, value []byte, flags int) error {
+	return syscall.ENOTSUP
+}
+
+func removexattr(path, name string) error {
+	return syscall.ENOTSUP
+}
+
+func isNoXattr(err error) bool {
+	return false
+}
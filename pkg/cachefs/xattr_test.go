@@ -0,0 +1,51 @@
+package cachefs
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestXattrsPassThroughToNFS(t *testing.T) {
+	nfsDir := t.TempDir()
+	writeTestFile(t, nfsDir, "a.txt", []byte("a"))
+	if err := setxattr(filepath.Join(nfsDir, "a.txt"), "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("no xattr support here: %v", err)
+	}
+	rfs := newTestFS(t, Config{NFSDir: nfsDir, Writable: true})
+	n := lookup(t, rfs, "a.txt")
+	ctx := context.Background()
+
+	if err := n.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.test", Xattr: []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+	var get fuse.GetxattrResponse
+	if err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.test"}, &get); err != nil || string(get.Xattr) != "value" {
+		t.Errorf("Getxattr = %q, %v, want %q", get.Xattr, err, "value")
+	}
+	var list fuse.ListxattrResponse
+	if err := n.Listxattr(ctx, &fuse.ListxattrRequest{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Split(string(list.Xattr), "\x00"); !slices.Contains(names, "user.test") {
+		t.Errorf("Listxattr = %q, want user.test in it", names)
+	}
+
+	if err := n.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.test"}, &get); err != fuse.ErrNoXattr {
+		t.Errorf("Getxattr after Removexattr = %v, want %v", err, fuse.ErrNoXattr)
+	}
+
+	// Read-only mounts can read them, but not change them.
+	n = lookup(t, newTestFS(t, Config{NFSDir: nfsDir}), "a.txt")
+	if err := n.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.test", Xattr: []byte("value")}); err != syscall.EROFS {
+		t.Errorf("Setxattr on a read-only mount = %v, want %v", err, syscall.EROFS)
+	}
+}
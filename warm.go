@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wesrobin/cerebrium-test/pkg/cachefs"
+)
+
+// warmProgressEvery is how often warming reports its progress.
+const warmProgressEvery = time.Second
+
+// runWarm is the warm subcommand, which reads everything under the given NFS relative paths into the
+// cache. With --admin-socket it asks the mount listening there to do it, so the files go through
+// that mount's cache. Otherwise it builds the cache from the same flags as a mount would, and reads
+// NFS into the SSD directory itself, which is only safe while nothing is mounted on them.
+func runWarm(args []string) error {
+	var paths []string
+	flag.Func("path", "NFS relative path (file or directory) to load into the cache. May be given more than once.\n EXAMPLE: --path=project-1", func(s string) error {
+		paths = append(paths, s)
+		return nil
+	})
+	jobs := flag.Int("jobs", 4, "Maximum number of files read from NFS at once.")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	paths = append(paths, flag.Args()...)
+	if len(paths) == 0 {
+		return errors.New("usage: fuse-test warm --path=<path> [--jobs=N] [--admin-socket=<socket>]")
+	} else if *jobs < 1 {
+		return errors.New("--jobs must be at least 1")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *adminSocket != "" {
+		return warmThroughSocket(ctx, *adminSocket, paths, *jobs)
+	}
+
+	absSSDDir, err := filepath.Abs(ssdDir)
+	if err != nil {
+		return fmt.Errorf("invalid SSD relative path '%s': %w", ssdDir, err)
+	}
+	c, err := initCache(absSSDDir)
+	if err != nil {
+		return err
+	}
+	fuseFS, err := cachefs.New(cachefs.Config{
+		Mountpoint:    mountPoint,
+		NFSDir:        nfsDir,
+		NFSSources:    nfsSources,
+		SSDDir:        ssdDir,
+		Cache:         c,
+		ChunkSize:     *chunkSize,
+		NFSReadDelay:  *nfsReadDelay,
+		VersionedKeys: *versionKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	p, warmErr := warmWithProgress(ctx, os.Stdout, fuseFS, paths, *jobs)
+	fmt.Println(warmSummary(p))
+	// Saves what the cache needs to pick the files up when it's next started (eg. the LRU order).
+	if err := fuseFS.Close(); err != nil {
+		return err
+	}
+	if warmErr != nil {
+		return fmt.Errorf("stopped early, run again to carry on: %w", warmErr)
+	}
+	return nil
+}
+
+// warmWithProgress warms the paths, writing a line of progress to w at most every
+// warmProgressEvery.
+func warmWithProgress(ctx context.Context, w io.Writer, fuseFS cachefs.FuseFS, paths []string, jobs int) (cachefs.WarmProgress, error) {
+	var mu sync.Mutex
+	last := time.Now()
+	return fuseFS.Warm(ctx, paths, jobs, func(p cachefs.WarmProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(last) < warmProgressEvery && p.Done < p.Total {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(w, "WARM: %d/%d files, %d cached (%d bytes), %d skipped\n", p.Done, p.Total, p.Cached, p.Bytes, p.Skipped)
+	})
+}
+
+// warmSummary is the last line of output of a warm.
+func warmSummary(p cachefs.WarmProgress) string {
+	return fmt.Sprintf("WARM: Done, cached %d files (%d bytes) of %d, %d skipped (already cached, refused or failed)", p.Cached, p.Bytes, p.Total, p.Skipped)
+}
+
+// warmThroughSocket asks the mount listening on the admin socket to warm each path, copying its
+// output to stdout.
+func warmThroughSocket(ctx context.Context, socketPath string, paths []string, jobs int) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("could not connect to the mount's admin socket: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for _, path := range paths {
+		if strings.ContainsAny(path, " \n") {
+			return fmt.Errorf("can't warm '%s' through the admin socket, it has a space or newline", path)
+		}
+		fmt.Fprintf(conn, "warm %s %s\n", path, strconv.Itoa(jobs))
+	}
+	// Closing our side ends the session once the commands are done, which closes the connection.
+	if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+		return err
+	}
+
+	out := io.TeeReader(conn, os.Stdout)
+	data, err := io.ReadAll(out)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+	if strings.Contains(string(data), "\nerror: ") || strings.HasPrefix(string(data), "error: ") {
+		return errors.New("the mount reported an error")
+	}
+	log.Printf("WARM: Finished warming %d paths through %s", len(paths), socketPath)
+	return nil
+}